@@ -0,0 +1,167 @@
+package iavl
+
+import (
+	"sync"
+)
+
+// defaultAuditBufferSize is the default number of access records buffered before a flush.
+const defaultAuditBufferSize = 1024
+
+// AccessKind is the kind of a key access recorded by an AuditLog.
+type AccessKind uint8
+
+const (
+	AccessRead AccessKind = iota
+	AccessWrite
+	AccessDelete
+)
+
+// String implements fmt.Stringer.
+func (k AccessKind) String() string {
+	switch k {
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	case AccessDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// AccessRecord is a single key access recorded by an AuditLog.
+type AccessRecord struct {
+	Kind AccessKind
+	Key  []byte
+	// Version is the version read by GetVersioned, or the working version, i.e. the version
+	// which will be saved next, for accesses to the working tree.
+	Version int64
+	// Labels are the labels set with AuditLog.SetLabels at the time of the access, e.g. the hash
+	// of the transaction being executed. They must not be modified.
+	Labels []string
+}
+
+// AuditSink receives flushed access records. It is called from a single background goroutine,
+// in the order the records were made, and may retain the records.
+type AuditSink func(records []AccessRecord)
+
+// AuditLog records the keys read and written through the MutableTree it is attached to with
+// SetAuditLog, e.g. to profile state access or to build access lists for parallel execution.
+// SetAuditLog lists the accesses covered. Records are buffered and handed to the sink
+// asynchronously. If the sink falls behind, recording blocks once a further full buffer is pending.
+//
+// AuditLog is safe for concurrent use. Users must call Close() when done.
+type AuditLog struct {
+	mtx        sync.Mutex
+	sink       AuditSink
+	bufferSize int
+	buffer     []AccessRecord
+	labels     []string
+	ch         chan []AccessRecord
+	done       chan struct{}
+	closed     bool
+}
+
+// NewAuditLog creates an AuditLog flushing to sink every bufferSize records, or every
+// defaultAuditBufferSize records if bufferSize is not positive.
+func NewAuditLog(sink AuditSink, bufferSize int) *AuditLog {
+	if bufferSize <= 0 {
+		bufferSize = defaultAuditBufferSize
+	}
+	l := &AuditLog{
+		sink:       sink,
+		bufferSize: bufferSize,
+		buffer:     make([]AccessRecord, 0, bufferSize),
+		ch:         make(chan []AccessRecord, 1),
+		done:       make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// run hands flushed buffers to the sink until the log is closed.
+func (l *AuditLog) run() {
+	for records := range l.ch {
+		l.sink(records)
+	}
+	close(l.done)
+}
+
+// SetLabels sets the labels attached to subsequent records, replacing any previous labels.
+func (l *AuditLog) SetLabels(labels ...string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.labels = append([]string(nil), labels...)
+}
+
+// Flush hands all buffered records to the sink, without waiting for the sink to process them.
+func (l *AuditLog) Flush() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.flush()
+}
+
+// Close flushes all buffered records and waits for the sink to process them. Accesses after
+// Close are not recorded. It is safe to call multiple times.
+func (l *AuditLog) Close() {
+	l.mtx.Lock()
+	if l.closed {
+		l.mtx.Unlock()
+		return
+	}
+	l.flush()
+	l.closed = true
+	close(l.ch)
+	l.mtx.Unlock()
+	<-l.done
+}
+
+// record records a key access. It is a no-op on a nil log.
+func (l *AuditLog) record(kind AccessKind, key []byte, version int64) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return
+	}
+	l.buffer = append(l.buffer, AccessRecord{
+		Kind:    kind,
+		Key:     append([]byte(nil), key...),
+		Version: version,
+		Labels:  l.labels,
+	})
+	if len(l.buffer) >= l.bufferSize {
+		l.flush()
+	}
+}
+
+// flush sends the buffer to the background goroutine. It must be called with mtx held.
+func (l *AuditLog) flush() {
+	if len(l.buffer) == 0 {
+		return
+	}
+	l.ch <- l.buffer
+	l.buffer = make([]AccessRecord, 0, l.bufferSize)
+}
+
+// SetAuditLog attaches an audit log recording the keys accessed through the MutableTree, or
+// detaches it if nil. It is safe to call concurrently with other tree operations.
+//
+// Only the key accesses of Get, Has, GetVersioned, BatchGetVersioned, Set, SetIfAbsent,
+// CompareAndSet and Remove are recorded. Reads are recorded whether or not the key exists,
+// including reads of an empty tree or of a missing version, since they still depend on the key's
+// absence. Reads through ImmutableTree methods, including those promoted to the MutableTree such
+// as GetWithIndex, GetByIndex and the proof getters, reads through trees returned by
+// GetImmutable, and keys visited by iterators are not recorded.
+func (tree *MutableTree) SetAuditLog(log *AuditLog) {
+	tree.auditLog.Store(log)
+}
+
+// getAuditLog returns the attached audit log, or nil if none. It is safe for concurrent use.
+func (tree *MutableTree) getAuditLog() *AuditLog {
+	log, _ := tree.auditLog.Load().(*AuditLog)
+	return log
+}
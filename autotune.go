@@ -0,0 +1,204 @@
+package iavl
+
+import (
+	"runtime/metrics"
+
+	"github.com/cosmos/iavl/cache"
+)
+
+const (
+	// defaultAutoTuneTargetHitRate is the default AutoTuneOptions.TargetHitRate.
+	defaultAutoTuneTargetHitRate = 0.9
+	// autoTuneMinAccesses is the number of node cache accesses needed to estimate the hit rate.
+	// The cache budget is left unchanged until that many accesses have been observed.
+	autoTuneMinAccesses = 100
+	// autoTuneFlushesPerCommit is the number of partial flushes the sub-batch size aims for in a
+	// commit of typical size.
+	autoTuneFlushesPerCommit = 4
+	// defaultAutoTuneMinSubBatchSize is the default AutoTuneOptions.MinSubBatchSize.
+	defaultAutoTuneMinSubBatchSize = 1 << 20
+	// heapObjectsMetric is the runtime metric used to observe memory pressure.
+	heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+)
+
+// Reasons of an AutoTuneDecision.
+const (
+	AutoTuneReasonNone           = ""
+	AutoTuneReasonMemoryPressure = "memory pressure"
+	AutoTuneReasonLowHitRate     = "low hit rate"
+	AutoTuneReasonCommitSize     = "commit size"
+)
+
+// AutoTuneOptions configures the adaptive controller enabled by Options.AutoTune. After every
+// commit, it observes the node cache hit rate, the size of the commit and the heap size, and:
+//
+//   - shrinks the cache byte budget by a quarter, and the sub-batch size to its minimum, while the
+//     heap exceeds MemoryLimit;
+//   - otherwise grows the cache byte budget by a quarter while the hit rate is below
+//     TargetHitRate;
+//   - moves the sub-batch size halfway towards a quarter of the encoded size of the commit.
+//
+// The cache byte budget is converted to a node cache size using the average encoded size of the
+// nodes written so far. Only the small tier of a tiered node cache is resized.
+//
+// Setting MaxSubBatchSize enables sub-batches, so commits are no longer written atomically, see
+// Options.CommitSubBatchSize.
+type AutoTuneOptions struct {
+	// MinCacheBytes and MaxCacheBytes bound the node cache byte budget. The budget starts at the
+	// configured cache size, clamped to these bounds. A zero MaxCacheBytes leaves it unbounded.
+	MinCacheBytes int64
+	MaxCacheBytes int64
+	// MinSubBatchSize and MaxSubBatchSize bound Options.CommitSubBatchSize, in bytes. A zero
+	// MaxSubBatchSize leaves the sub-batch size unchanged. MinSubBatchSize defaults to 1 MiB, or
+	// MaxSubBatchSize if smaller, so that the controller never disables sub-batches.
+	MinSubBatchSize int
+	MaxSubBatchSize int
+	// TargetHitRate is the node cache hit rate the budget is grown towards. It defaults to 0.9.
+	TargetHitRate float64
+	// MemoryLimit is the heap size in bytes considered memory pressure, or 0 to ignore memory.
+	MemoryLimit uint64
+}
+
+// AutoTuneDecision is a decision of the adaptive controller, made after a commit.
+type AutoTuneDecision struct {
+	Reason       string  // Why the budget or sub-batch size changed, or AutoTuneReasonNone.
+	HitRate      float64 // The node cache hit rate since the previous decision, or -1 if unknown.
+	HeapBytes    uint64  // The observed heap size, or 0 if MemoryLimit is not set.
+	CacheBytes   int64   // The node cache byte budget.
+	CacheSize    int     // The node cache size the budget was converted to.
+	SubBatchSize int     // The sub-batch size for the next commit.
+}
+
+// autoTuner is the state of the adaptive controller. It is only used with the tree commit lock
+// held.
+type autoTuner struct {
+	opts      AutoTuneOptions
+	heapBytes func() uint64 // Reads the heap size, replaceable for tests.
+
+	cacheBytes int64  // The current byte budget, or 0 until the first decision.
+	cacheSize  int    // The configured node cache size, converted to the initial budget.
+	nodes      int64  // The number of nodes written, for the average node size.
+	nodeBytes  int64  // The encoded size of the nodes written.
+	hits       uint64 // The cache hits at the previous decision.
+	misses     uint64 // The cache misses at the previous decision.
+}
+
+func newAutoTuner(opts AutoTuneOptions, cacheSize int) *autoTuner {
+	if opts.TargetHitRate <= 0 {
+		opts.TargetHitRate = defaultAutoTuneTargetHitRate
+	}
+	if opts.MaxSubBatchSize > 0 && opts.MinSubBatchSize <= 0 {
+		opts.MinSubBatchSize = defaultAutoTuneMinSubBatchSize
+		if opts.MinSubBatchSize > opts.MaxSubBatchSize {
+			opts.MinSubBatchSize = opts.MaxSubBatchSize
+		}
+	}
+	return &autoTuner{opts: opts, heapBytes: readHeapBytes, cacheSize: cacheSize}
+}
+
+// tune makes a decision after a commit with the given timings, and applies it to the node cache
+// and sub-batch size. It is a no-op on a nil tuner.
+func (t *autoTuner) tune(ndb *nodeDB, timings *CommitTimings) *AutoTuneDecision {
+	if t == nil {
+		return nil
+	}
+	t.nodes += int64(timings.NewNodes)
+	t.nodeBytes += int64(timings.NewNodeBytes)
+	if t.nodes == 0 {
+		return nil
+	}
+	avgNodeSize := t.nodeBytes / t.nodes
+	if avgNodeSize == 0 {
+		avgNodeSize = 1
+	}
+	if t.cacheBytes == 0 {
+		t.cacheBytes = t.clampCacheBytes(int64(t.cacheSize) * avgNodeSize)
+	}
+
+	decision := &AutoTuneDecision{HitRate: -1, SubBatchSize: ndb.opts.CommitSubBatchSize}
+	hits, misses := ndb.opts.Stat.GetCacheHitCnt(), ndb.opts.Stat.GetCacheMissCnt()
+	if hits < t.hits || misses < t.misses { // the statistics were reset
+		t.hits, t.misses = 0, 0
+	}
+	if accesses := (hits - t.hits) + (misses - t.misses); accesses >= autoTuneMinAccesses {
+		decision.HitRate = float64(hits-t.hits) / float64(accesses)
+		t.hits, t.misses = hits, misses
+	}
+
+	pressure := false
+	if t.opts.MemoryLimit > 0 {
+		decision.HeapBytes = t.heapBytes()
+		pressure = decision.HeapBytes > t.opts.MemoryLimit
+	}
+
+	switch {
+	case pressure:
+		decision.Reason = AutoTuneReasonMemoryPressure
+		t.cacheBytes = t.clampCacheBytes(t.cacheBytes - t.cacheBytes/4)
+		if t.opts.MaxSubBatchSize > 0 {
+			decision.SubBatchSize = t.opts.MinSubBatchSize
+		}
+	case decision.HitRate >= 0 && decision.HitRate < t.opts.TargetHitRate &&
+		(t.opts.MaxCacheBytes == 0 || t.cacheBytes < t.opts.MaxCacheBytes):
+		decision.Reason = AutoTuneReasonLowHitRate
+		t.cacheBytes = t.clampCacheBytes(t.cacheBytes + t.cacheBytes/4 + 1)
+	}
+	if !pressure && t.opts.MaxSubBatchSize > 0 {
+		target := timings.NewNodeBytes / autoTuneFlushesPerCommit
+		size := t.clampSubBatchSize((decision.SubBatchSize + target) / 2)
+		if size != decision.SubBatchSize && decision.Reason == AutoTuneReasonNone {
+			decision.Reason = AutoTuneReasonCommitSize
+		}
+		decision.SubBatchSize = size
+	}
+
+	decision.CacheBytes = t.cacheBytes
+	decision.CacheSize = int(t.cacheBytes / avgNodeSize)
+	if decision.CacheSize < 1 {
+		decision.CacheSize = 1
+	}
+	ndb.opts.CommitSubBatchSize = decision.SubBatchSize
+	ndb.cacheMtx.Lock()
+	if resizer, ok := ndb.nodeCache.(cache.Resizer); ok {
+		resizer.Resize(decision.CacheSize)
+		ndb.prefixes.reconcile(ndb.nodeCache)
+	}
+	ndb.cacheMtx.Unlock()
+	return decision
+}
+
+func (t *autoTuner) clampCacheBytes(n int64) int64 {
+	if n < t.opts.MinCacheBytes {
+		n = t.opts.MinCacheBytes
+	}
+	if t.opts.MaxCacheBytes > 0 && n > t.opts.MaxCacheBytes {
+		n = t.opts.MaxCacheBytes
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (t *autoTuner) clampSubBatchSize(n int) int {
+	if t.opts.MaxSubBatchSize <= 0 {
+		return n
+	}
+	if n < t.opts.MinSubBatchSize {
+		n = t.opts.MinSubBatchSize
+	}
+	if n > t.opts.MaxSubBatchSize {
+		n = t.opts.MaxSubBatchSize
+	}
+	return n
+}
+
+// readHeapBytes returns the size of the live and not yet swept heap objects.
+func readHeapBytes() uint64 {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
@@ -0,0 +1,114 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutableTree_CommitSubBatchSize(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{CommitSubBatchSize: 1024}, false)
+	require.NoError(t, err)
+
+	for v := 0; v < 2; v++ {
+		for i := 0; i < 200; i++ {
+			_, err = tree.Set([]byte(fmt.Sprintf("key-%d-%d", v, i)), []byte{byte(i)})
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// version 1 is flushed node by node anyway.
+	timings, ok := tree.LastCommitTimings()
+	require.True(t, ok)
+	require.Greater(t, timings.PartialFlushes, 0)
+	require.Less(t, timings.PartialFlushes, timings.NewNodes)
+	require.Greater(t, timings.NewNodeBytes, 1024)
+	require.Nil(t, timings.AutoTune)
+
+	reloaded, err := NewMutableTree(tree.ndb.db, 0, false)
+	require.NoError(t, err)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	hash, err := tree.Hash()
+	require.NoError(t, err)
+	reloadedHash, err := reloaded.Hash()
+	require.NoError(t, err)
+	require.Equal(t, hash, reloadedHash)
+}
+
+func TestMutableTree_AutoTune(t *testing.T) {
+	opts := &Options{AutoTune: &AutoTuneOptions{
+		MinCacheBytes:   1024,
+		MaxCacheBytes:   64 * 1024,
+		MinSubBatchSize: 512,
+		MaxSubBatchSize: 4096,
+	}}
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 10, opts, false)
+	require.NoError(t, err)
+
+	commit := func() *AutoTuneDecision {
+		for i := 0; i < 100; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d-%d", tree.Version(), i)), []byte{byte(i)})
+			require.NoError(t, err)
+			// reads of earlier keys traverse the saved nodes through the cache.
+			_, _, err = tree.GetWithIndex([]byte(fmt.Sprintf("key-%d-%d", int64(i)%(tree.Version()+1), i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		timings, ok := tree.LastCommitTimings()
+		require.True(t, ok)
+		require.NotNil(t, timings.AutoTune)
+		return timings.AutoTune
+	}
+
+	// a small cache misses a lot when reading all over the tree, so the budget grows up to its
+	// bound.
+	var decision *AutoTuneDecision
+	for i := 0; i < 40; i++ {
+		decision = commit()
+		require.GreaterOrEqual(t, decision.CacheBytes, opts.AutoTune.MinCacheBytes)
+		require.LessOrEqual(t, decision.CacheBytes, opts.AutoTune.MaxCacheBytes)
+		require.GreaterOrEqual(t, decision.SubBatchSize, opts.AutoTune.MinSubBatchSize)
+		require.LessOrEqual(t, decision.SubBatchSize, opts.AutoTune.MaxSubBatchSize)
+		require.Equal(t, decision.SubBatchSize, tree.ndb.opts.CommitSubBatchSize)
+	}
+	require.Equal(t, opts.AutoTune.MaxCacheBytes, decision.CacheBytes)
+	require.Greater(t, decision.CacheSize, 10)
+
+	// memory pressure shrinks the budget and the sub-batch size.
+	tree.ndb.tuner.opts.MemoryLimit = 1
+	tree.ndb.tuner.heapBytes = func() uint64 { return 2 }
+	decision = commit()
+	require.Equal(t, AutoTuneReasonMemoryPressure, decision.Reason)
+	require.EqualValues(t, 2, decision.HeapBytes)
+	require.Equal(t, opts.AutoTune.MaxCacheBytes*3/4, decision.CacheBytes)
+	require.Equal(t, opts.AutoTune.MinSubBatchSize, decision.SubBatchSize)
+	tree.ndb.cacheMtx.Lock()
+	require.LessOrEqual(t, tree.ndb.nodeCache.Len(), decision.CacheSize)
+	tree.ndb.cacheMtx.Unlock()
+}
+
+func TestMutableTree_AutoTune_DefaultMinSubBatchSize(t *testing.T) {
+	opts := &Options{AutoTune: &AutoTuneOptions{MaxSubBatchSize: 4096, MemoryLimit: 1}}
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 10, opts, false)
+	require.NoError(t, err)
+	require.Equal(t, 4096, tree.ndb.tuner.opts.MinSubBatchSize)
+
+	// neither memory pressure nor small commits disable the sub-batches.
+	for _, heapBytes := range []uint64{2, 0} {
+		tree.ndb.tuner.heapBytes = func() uint64 { return heapBytes }
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", tree.Version())), []byte{1})
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			timings, ok := tree.LastCommitTimings()
+			require.True(t, ok)
+			require.Equal(t, 4096, timings.AutoTune.SubBatchSize)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package iavl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+const (
+	// defaultBackupPartSize is the default size of the snapshot parts uploaded to object storage.
+	defaultBackupPartSize = 64 * 1024 * 1024
+	// defaultBackupConcurrency is the default number of parts uploaded or downloaded in parallel.
+	defaultBackupConcurrency = 4
+	// defaultBackupRetries is the default number of retries of a failed part upload or download.
+	defaultBackupRetries = 3
+	// defaultBackupRetryBackoff is the default delay before the first retry, doubled on each retry.
+	defaultBackupRetryBackoff = 100 * time.Millisecond
+	// backupManifestName is the name of the manifest object of a backup, relative to its version.
+	backupManifestName = "manifest.json"
+)
+
+var (
+	// ErrObjectNotFound is returned by ObjectStore.Get for missing objects.
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrBackupChecksum is returned when a downloaded backup part or the restored tree does not
+	// match the backup manifest.
+	ErrBackupChecksum = errors.New("backup checksum mismatch")
+
+	objectStoresMtx sync.RWMutex
+	objectStores    = map[string]ObjectStoreOpener{
+		"file": openFileObjectStore,
+		"s3":   openS3ObjectStore,
+		"gs":   openGCSObjectStore,
+	}
+)
+
+// ObjectStore is a minimal interface to object storage. This package implements it for local
+// directories with the "file" scheme, for S3 and S3 compatible services with the "s3" scheme, see
+// openS3ObjectStore, and for Google Cloud Storage with the "gs" scheme, see openGCSObjectStore.
+// Other stores can be registered with RegisterObjectStore. It must be safe for concurrent use.
+type ObjectStore interface {
+	// Put stores an object, replacing any existing object with the same name.
+	Put(ctx context.Context, name string, data []byte) error
+	// Get returns the contents of an object, or ErrObjectNotFound.
+	Get(ctx context.Context, name string) ([]byte, error)
+	// Delete removes an object. Removing a missing object is not an error.
+	Delete(ctx context.Context, name string) error
+}
+
+// ObjectStoreOpener opens the object store for a bucket URL.
+type ObjectStoreOpener func(ctx context.Context, bucketURL *url.URL) (ObjectStore, error)
+
+// RegisterObjectStore registers an opener for bucket URLs with the given scheme, replacing any
+// opener registered before, including the default ones for the "file", "s3" and "gs" schemes.
+func RegisterObjectStore(scheme string, opener ObjectStoreOpener) {
+	objectStoresMtx.Lock()
+	defer objectStoresMtx.Unlock()
+	objectStores[scheme] = opener
+}
+
+// OpenObjectStore opens the object store for a bucket URL with a registered scheme.
+func OpenObjectStore(ctx context.Context, bucketURL string) (ObjectStore, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	objectStoresMtx.RLock()
+	opener, ok := objectStores[u.Scheme]
+	objectStoresMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no object store registered for scheme %q", u.Scheme)
+	}
+	return opener(ctx, u)
+}
+
+// BackupOptions configures backups to and restores from object storage.
+type BackupOptions struct {
+	// PartSize is the size of the snapshot parts, each stored as a separate object.
+	PartSize int
+	// Concurrency is the number of parts uploaded or downloaded in parallel.
+	Concurrency int
+	// Retries is the number of times a failed part upload or download is retried.
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubled on each further retry.
+	RetryBackoff time.Duration
+	// Stream configures the export stream the snapshot is encoded as.
+	Stream ExportStreamOptions
+}
+
+// DefaultBackupOptions returns the default backup options, with zstd compressed snapshots.
+func DefaultBackupOptions() BackupOptions {
+	return BackupOptions{
+		PartSize:     defaultBackupPartSize,
+		Concurrency:  defaultBackupConcurrency,
+		Retries:      defaultBackupRetries,
+		RetryBackoff: defaultBackupRetryBackoff,
+		Stream:       DefaultExportStreamOptions(),
+	}
+}
+
+// BackupManifest describes a backup of a tree version. It is stored as the last object of a
+// backup, so a backup without a manifest is incomplete.
+type BackupManifest struct {
+	Version int64        `json:"version"`
+	Hash    []byte       `json:"hash"`
+	Size    int64        `json:"size"`
+	Parts   []BackupPart `json:"parts"`
+}
+
+// BackupPart describes a single part of a backup.
+type BackupPart struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 []byte `json:"sha256"`
+}
+
+// BackupToObjectStore backs up the given version to the object store at bucketURL with the
+// default options, see BackupToObjectStoreWithOpts.
+func (tree *MutableTree) BackupToObjectStore(ctx context.Context, bucketURL string, version int64) error {
+	return tree.BackupToObjectStoreWithOpts(ctx, bucketURL, version, DefaultBackupOptions())
+}
+
+// BackupToObjectStoreWithOpts backs up the given version to the object store at bucketURL. The
+// version is exported as an export stream, which is split into checksummed parts uploaded in
+// parallel as objects named "<version>/part-<n>", followed by a "<version>/manifest.json" object
+// listing the parts.
+func (tree *MutableTree) BackupToObjectStoreWithOpts(ctx context.Context, bucketURL string, version int64, opts BackupOptions) error {
+	opts = opts.withDefaults()
+	store, err := OpenObjectStore(ctx, bucketURL)
+	if err != nil {
+		return err
+	}
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return err
+	}
+	hash, err := itree.Hash()
+	if err != nil {
+		return err
+	}
+	exporter, err := itree.Export()
+	if err != nil {
+		return err
+	}
+	defer exporter.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(WriteExportStream(exporter, pw, opts.Stream))
+	}()
+	defer pr.Close()
+
+	manifest := &BackupManifest{Version: version, Hash: hash, Size: itree.Size()}
+	var (
+		wg       sync.WaitGroup
+		errMtx   sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, opts.Concurrency)
+	)
+	setErr := func(err error) {
+		errMtx.Lock()
+		defer errMtx.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	for i := 0; ; i++ {
+		data := make([]byte, opts.PartSize)
+		n, err := io.ReadFull(pr, data)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			setErr(err)
+			break
+		}
+		data = data[:n]
+		checksum := sha256.Sum256(data)
+		part := BackupPart{Name: backupPartName(version, i), Size: n, SHA256: checksum[:]}
+		manifest.Parts = append(manifest.Parts, part)
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := opts.retry(ctx, func() error {
+				return store.Put(ctx, part.Name, data)
+			})
+			if err != nil {
+				setErr(fmt.Errorf("failed to upload %s: %w", part.Name, err))
+			}
+		}()
+		if n < opts.PartSize {
+			break
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bz, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return opts.retry(ctx, func() error {
+		return store.Put(ctx, backupManifestPath(version), bz)
+	})
+}
+
+// RestoreFromObjectStore restores the given version from a backup in the object store at
+// bucketURL into the empty tree with the default options, see RestoreFromObjectStoreWithOpts.
+func (tree *MutableTree) RestoreFromObjectStore(ctx context.Context, bucketURL string, version int64) error {
+	return tree.RestoreFromObjectStoreWithOpts(ctx, bucketURL, version, DefaultBackupOptions())
+}
+
+// RestoreFromObjectStoreWithOpts restores the given version from a backup in the object store at
+// bucketURL into the empty tree. Parts are downloaded in parallel ahead of the import and verified
+// against their checksums, and a failed part download is retried up to opts.Retries times.
+// Finally, the hash of the restored tree is checked against the manifest.
+//
+// The restore is resumable. Verified parts are kept in the database until the restore finishes,
+// and the number of imported nodes is recorded with every batch of nodes written. If the restore
+// fails, e.g. due to a crash or a part that could not be downloaded, calling it again on a tree
+// opened over the same database, without loading it, resumes it: only the missing parts are
+// downloaded, and the nodes imported before are decoded again from the kept parts, but not
+// written again. See InterruptedRestoreVersion.
+func (tree *MutableTree) RestoreFromObjectStoreWithOpts(ctx context.Context, bucketURL string, version int64, opts BackupOptions) error {
+	opts = opts.withDefaults()
+	store, err := OpenObjectStore(ctx, bucketURL)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := readBackupManifest(ctx, store, version, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read backup manifest of version %d: %w", version, err)
+	}
+	if manifest.Version != version {
+		return fmt.Errorf("backup manifest is for version %d, expected %d", manifest.Version, version)
+	}
+	bz, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(bz)
+
+	importer, err := tree.Import(version)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+
+	progressKey := metadataKeyFormat.Key([]byte(restoreProgressKey))
+	value, err := tree.ndb.dbGet(progressKey)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		progressVersion, progressDigest, added, err := decodeRestoreProgress(value)
+		if err != nil {
+			return err
+		}
+		if progressVersion != version || !bytes.Equal(progressDigest, digest[:]) {
+			return fmt.Errorf("database contains an interrupted restore of version %d from a different backup", progressVersion)
+		}
+		importer.resume(added)
+	} else if err := tree.ndb.db.SetSync(progressKey, encodeRestoreProgress(version, digest[:], 0)); err != nil {
+		return err
+	}
+	importer.progress = func(batch dbm.Batch, added int64, committed bool) error {
+		if !committed {
+			return batch.Set(progressKey, encodeRestoreProgress(version, digest[:], added))
+		}
+		for i := range manifest.Parts {
+			if err := batch.Delete(restorePartKey(i)); err != nil {
+				return err
+			}
+		}
+		return batch.Delete(progressKey)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	reader := newBackupPartReader(ctx, store, tree.ndb, manifest.Parts, opts)
+	defer func() {
+		cancel()
+		reader.wait()
+	}()
+	if err := ReadExportStream(reader, importer); err != nil {
+		// the stream decoder may mask download errors, so prefer those.
+		if reader.err != nil {
+			return reader.err
+		}
+		return err
+	}
+	if err := importer.Commit(); err != nil {
+		return err
+	}
+
+	hash, err := tree.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, manifest.Hash) {
+		return fmt.Errorf("%w: restored hash %X, expected %X", ErrBackupChecksum, hash, manifest.Hash)
+	}
+	return nil
+}
+
+// InterruptedRestoreVersion returns the version of a restore from object storage which did not
+// finish, or 0 if there is none. The restore is resumed by restoring the version again, see
+// RestoreFromObjectStoreWithOpts.
+func (tree *MutableTree) InterruptedRestoreVersion() (int64, error) {
+	value, err := tree.ndb.dbGet(metadataKeyFormat.Key([]byte(restoreProgressKey)))
+	if err != nil || value == nil {
+		return 0, err
+	}
+	version, _, _, err := decodeRestoreProgress(value)
+	return version, err
+}
+
+// encodeRestoreProgress encodes the restored version, the SHA-256 digest of its backup manifest
+// and the number of nodes imported so far.
+func encodeRestoreProgress(version int64, digest []byte, added int64) []byte {
+	value := make([]byte, 2*int64Size+sha256.Size)
+	binary.BigEndian.PutUint64(value, uint64(version))
+	copy(value[int64Size:], digest)
+	binary.BigEndian.PutUint64(value[int64Size+sha256.Size:], uint64(added))
+	return value
+}
+
+func decodeRestoreProgress(value []byte) (int64, []byte, int64, error) {
+	if len(value) != 2*int64Size+sha256.Size {
+		return 0, nil, 0, fmt.Errorf("invalid restore progress %X", value)
+	}
+	return int64(binary.BigEndian.Uint64(value)), value[int64Size : int64Size+sha256.Size],
+		int64(binary.BigEndian.Uint64(value[int64Size+sha256.Size:])), nil
+}
+
+func restorePartKey(part int) []byte {
+	return metadataKeyFormat.Key([]byte(fmt.Sprintf("%s%06d", restorePartKeyPrefix, part)))
+}
+
+// withDefaults replaces unset options with their defaults.
+func (opts BackupOptions) withDefaults() BackupOptions {
+	defaults := DefaultBackupOptions()
+	if opts.PartSize <= 0 {
+		opts.PartSize = defaults.PartSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaults.Concurrency
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	return opts
+}
+
+// retry calls fn until it succeeds, it has been retried opts.Retries times, or ctx is done.
+// Missing objects are not retried.
+func (opts BackupOptions) retry(ctx context.Context, fn func() error) error {
+	backoff := opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= opts.Retries || errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// backupPartReader reads the concatenated contents of backup parts, downloading up to
+// opts.Concurrency parts ahead. Downloaded parts are kept in the database for a resumed restore,
+// see RestoreFromObjectStoreWithOpts.
+type backupPartReader struct {
+	results []chan backupPartResult
+	sem     chan struct{} // Download slots, released as parts are consumed.
+	wg      sync.WaitGroup
+	next    int
+	current []byte
+	err     error // The download error, if any, which is also returned by Read.
+}
+
+type backupPartResult struct {
+	data []byte
+	err  error
+}
+
+func newBackupPartReader(ctx context.Context, store ObjectStore, ndb *nodeDB, parts []BackupPart, opts BackupOptions) *backupPartReader {
+	r := &backupPartReader{
+		results: make([]chan backupPartResult, len(parts)),
+		sem:     make(chan struct{}, opts.Concurrency),
+	}
+	for i := range r.results {
+		r.results[i] = make(chan backupPartResult, 1)
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for i, part := range parts {
+			select {
+			case r.sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			r.wg.Add(1)
+			go func(i int, part BackupPart) {
+				defer r.wg.Done()
+				data, err := fetchBackupPart(ctx, store, ndb, i, part, opts)
+				r.results[i] <- backupPartResult{data: data, err: err}
+			}(i, part)
+		}
+	}()
+	return r
+}
+
+// fetchBackupPart returns a part kept in the database by an interrupted restore, or downloads it
+// and keeps it once it matches its checksum.
+func fetchBackupPart(ctx context.Context, store ObjectStore, ndb *nodeDB, index int, part BackupPart, opts BackupOptions) ([]byte, error) {
+	verify := func(data []byte) error {
+		if checksum := sha256.Sum256(data); len(data) != part.Size || !bytes.Equal(checksum[:], part.SHA256) {
+			return fmt.Errorf("%w: part %s", ErrBackupChecksum, part.Name)
+		}
+		return nil
+	}
+
+	key := restorePartKey(index)
+	data, err := ndb.dbGet(key)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		return data, verify(data)
+	}
+	err = opts.retry(ctx, func() error {
+		var err error
+		data, err = store.Get(ctx, part.Name)
+		if err != nil {
+			return err
+		}
+		return verify(data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, ndb.db.Set(key, data)
+}
+
+// wait waits for the downloads in progress, which must have been canceled first.
+func (r *backupPartReader) wait() {
+	r.wg.Wait()
+}
+
+// Read implements io.Reader.
+func (r *backupPartReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.next >= len(r.results) {
+			return 0, io.EOF
+		}
+		result := <-r.results[r.next]
+		<-r.sem
+		if result.err != nil {
+			r.err = fmt.Errorf("failed to download backup part %d: %w", r.next, result.err)
+			return 0, r.err
+		}
+		r.current = result.data
+		r.next++
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// readBackupManifest reads the manifest of the backup of a version.
+func readBackupManifest(ctx context.Context, store ObjectStore, version int64, opts BackupOptions) (*BackupManifest, error) {
+	manifest := &BackupManifest{}
+	err := opts.retry(ctx, func() error {
+		bz, err := store.Get(ctx, backupManifestPath(version))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(bz, manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// deleteBackup deletes the backup of a version from the object store. The manifest is deleted
+// first, so that a partially deleted backup is incomplete rather than corrupt.
+func deleteBackup(ctx context.Context, store ObjectStore, version int64, opts BackupOptions) error {
+	manifest, err := readBackupManifest(ctx, store, version, opts)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	names := []string{backupManifestPath(version)}
+	for _, part := range manifest.Parts {
+		names = append(names, part.Name)
+	}
+	for _, name := range names {
+		if err := opts.retry(ctx, func() error { return store.Delete(ctx, name) }); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func backupPartName(version int64, part int) string {
+	return fmt.Sprintf("%d/part-%06d", version, part)
+}
+
+func backupManifestPath(version int64) string {
+	return fmt.Sprintf("%d/%s", version, backupManifestName)
+}
+
+// fileObjectStore stores objects as files below a root directory.
+type fileObjectStore struct {
+	root string
+}
+
+func openFileObjectStore(_ context.Context, bucketURL *url.URL) (ObjectStore, error) {
+	if bucketURL.Path == "" {
+		return nil, fmt.Errorf("file object store URL %q has no path", bucketURL)
+	}
+	return &fileObjectStore{root: filepath.FromSlash(bucketURL.Path)}, nil
+}
+
+func (s *fileObjectStore) Put(_ context.Context, name string, data []byte) error {
+	path := filepath.Join(s.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// write to a temporary file first, so that readers never see partial objects.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileObjectStore) Get(_ context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.root, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	return data, err
+}
+
+func (s *fileObjectStore) Delete(_ context.Context, name string) error {
+	err := os.Remove(filepath.Join(s.root, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
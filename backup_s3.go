@@ -0,0 +1,258 @@
+package iavl
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// gcsEndpoint is the endpoint of the S3 compatible XML API of Google Cloud Storage.
+	gcsEndpoint = "https://storage.googleapis.com"
+	// s3DefaultRegion is the region of S3 buckets if none is configured.
+	s3DefaultRegion = "us-east-1"
+	// s3TimeFormat is the format of the request time in AWS Signature Version 4.
+	s3TimeFormat = "20060102T150405Z"
+)
+
+// s3Credentials are the access keys requests to an S3 compatible API are signed with.
+type s3Credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// s3ObjectStore stores objects in a bucket of an S3 compatible API, authenticated with AWS
+// Signature Version 4.
+type s3ObjectStore struct {
+	client      *http.Client
+	base        *url.URL // URL of the bucket, which object names are appended to.
+	prefix      string   // Prefix of the object names, from the bucket URL path.
+	region      string
+	credentials s3Credentials
+}
+
+// openS3ObjectStore opens an S3 bucket for URLs of the form
+// "s3://<bucket>/<prefix>?region=<region>&endpoint=<endpoint>". Without an endpoint, the bucket
+// is addressed on AWS, otherwise it is addressed by path below the endpoint, as required by most
+// S3 compatible services. The region defaults to the AWS_REGION or AWS_DEFAULT_REGION
+// environment variables, or us-east-1.
+//
+// Requests are signed with the access keys from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// optional AWS_SESSION_TOKEN environment variables.
+func openS3ObjectStore(_ context.Context, bucketURL *url.URL) (ObjectStore, error) {
+	query := bucketURL.Query()
+	region := query.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucketURL.Host, region)
+	} else {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/" + bucketURL.Host
+	}
+	return newS3ObjectStore(bucketURL, endpoint, region)
+}
+
+// openGCSObjectStore opens a Google Cloud Storage bucket for URLs of the form
+// "gs://<bucket>/<prefix>", through the S3 compatible XML API of Cloud Storage. Requests are
+// signed with the HMAC key of a service account, given by the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables.
+func openGCSObjectStore(_ context.Context, bucketURL *url.URL) (ObjectStore, error) {
+	return newS3ObjectStore(bucketURL, gcsEndpoint+"/"+bucketURL.Host, "auto")
+}
+
+func newS3ObjectStore(bucketURL *url.URL, endpoint, region string) (ObjectStore, error) {
+	if bucketURL.Host == "" {
+		return nil, fmt.Errorf("object store URL %q has no bucket", bucketURL.Redacted())
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	credentials := s3Credentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.accessKeyID == "" || credentials.secretAccessKey == "" {
+		return nil, fmt.Errorf("no credentials for object store URL %q, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set",
+			bucketURL.Redacted())
+	}
+	prefix := strings.Trim(bucketURL.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3ObjectStore{
+		client:      http.DefaultClient,
+		base:        base,
+		prefix:      prefix,
+		region:      region,
+		credentials: credentials,
+	}, nil
+}
+
+func (s *s3ObjectStore) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.do(ctx, http.MethodPut, name, data)
+	return err
+}
+
+func (s *s3ObjectStore) Get(ctx context.Context, name string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, name, nil)
+}
+
+func (s *s3ObjectStore) Delete(ctx context.Context, name string) error {
+	_, err := s.do(ctx, http.MethodDelete, name, nil)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+// do sends a signed request for an object and returns the response body.
+func (s *s3ObjectStore) do(ctx context.Context, method, name string, body []byte) ([]byte, error) {
+	u := *s.base
+	u.Path = strings.TrimSuffix(s.base.Path, "/") + "/" + s.prefix + name
+	u.RawPath = strings.TrimSuffix(s.base.EscapedPath(), "/") + "/" + s3Escape(s.prefix+name, false)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.credentials.sign(req, body, s.region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		if len(data) > 1024 {
+			data = data[:1024]
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, name, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// sign signs the request with AWS Signature Version 4. All headers set on the request are
+// signed, in addition to the host and the x-amz headers set by sign.
+func (c s3Credentials) sign(req *http.Request, body []byte, region string, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := []byte("AWS4" + c.secretAccessKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		c.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes all but the unreserved characters, as required by AWS Signature
+// Version 4. Slashes are only encoded if encodeSlash is set, i.e. outside of paths.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
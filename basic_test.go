@@ -177,9 +177,9 @@ func TestUnit(t *testing.T) {
 		// ensure node was added & structure is as expected.
 		if updated || P(tree.root, tree.ImmutableTree) != repr {
 			t.Fatalf("Adding %v to %v:\nExpected         %v\nUnexpectedly got %v updated:%v",
-				i, P(tree.lastSaved.root, tree.lastSaved), repr, P(tree.root, tree.ImmutableTree), updated)
+				i, P(tree.getLastSaved().root, tree.getLastSaved()), repr, P(tree.root, tree.ImmutableTree), updated)
 		}
-		tree.ImmutableTree = tree.lastSaved.clone()
+		tree.ImmutableTree = tree.getLastSaved().clone()
 	}
 
 	expectRemove := func(tree *MutableTree, i int, repr string) {
@@ -189,9 +189,9 @@ func TestUnit(t *testing.T) {
 		// ensure node was added & structure is as expected.
 		if len(value) != 0 || !removed || P(tree.root, tree.ImmutableTree) != repr {
 			t.Fatalf("Removing %v from %v:\nExpected         %v\nUnexpectedly got %v value:%v removed:%v",
-				i, P(tree.lastSaved.root, tree.lastSaved), repr, P(tree.root, tree.ImmutableTree), value, removed)
+				i, P(tree.getLastSaved().root, tree.getLastSaved()), repr, P(tree.root, tree.ImmutableTree), value, removed)
 		}
-		tree.ImmutableTree = tree.lastSaved.clone()
+		tree.ImmutableTree = tree.getLastSaved().clone()
 	}
 
 	// Test Set cases:
@@ -0,0 +1,244 @@
+package benchmarks
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	db "github.com/cosmos/cosmos-db"
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+)
+
+// proofBaselineFile records the proof sizes and generation latencies of the proof suite, which
+// TestProofSizeRegression compares against. Regenerate it with -update-proof-baseline after an
+// intended change of the proof format.
+const proofBaselineFile = "testdata/proof_baseline.json"
+
+var (
+	updateProofBaseline = flag.Bool("update-proof-baseline", false, "rewrite "+proofBaselineFile)
+	checkProofLatency   = flag.Bool("check-proof-latency", false,
+		"also fail on proof generation latency regressions, which depend on the machine")
+	proofSizeThreshold    = flag.Float64("proof-size-threshold", 0.02, "allowed relative growth of proof sizes")
+	proofLatencyThreshold = flag.Float64("proof-latency-threshold", 0.5, "allowed relative growth of proof latencies")
+)
+
+const (
+	// proofSuiteSamples is the number of keys proven per case and kind of proof.
+	proofSuiteSamples = 64
+	// proofLatencyRounds is the number of times the samples are proven, keeping the fastest
+	// round as the latency to reduce noise.
+	proofLatencyRounds = 5
+)
+
+// proofCase is a tree shape of the proof suite.
+type proofCase struct {
+	size int
+	dist string
+}
+
+func (c proofCase) name() string {
+	return fmt.Sprintf("%s-%d", c.dist, c.size)
+}
+
+var proofCases = func() (cases []proofCase) {
+	for _, dist := range []string{"random", "sequential", "prefixed"} {
+		for _, size := range []int{100, 1000, 10000} {
+			cases = append(cases, proofCase{size: size, dist: dist})
+		}
+	}
+	return cases
+}()
+
+// proofKey returns the i'th key of a key distribution:
+//   - random: uniformly random 32 byte keys, e.g. hashes.
+//   - sequential: big-endian counters, e.g. sequence numbers.
+//   - prefixed: 16 store prefixes with a 20 byte address each, followed by a counter, like the
+//     keys of Cosmos SDK modules.
+func proofKey(r *rand.Rand, dist string, i int) []byte {
+	switch dist {
+	case "random":
+		key := make([]byte, 32)
+		r.Read(key)
+		return key
+	case "sequential":
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		return key
+	case "prefixed":
+		key := make([]byte, 29)
+		for j := 0; j < 21; j++ {
+			key[j] = byte(i%16) * 17
+		}
+		binary.BigEndian.PutUint64(key[21:], uint64(i/16))
+		return key
+	default:
+		panic("unknown key distribution " + dist)
+	}
+}
+
+// buildProofTree deterministically builds and saves the tree of a case, returning its sorted keys.
+func buildProofTree(tb testing.TB, c proofCase) (*iavl.MutableTree, [][]byte) {
+	tree, err := iavl.NewMutableTreeWithOpts(db.NewMemDB(), 0, nil, true)
+	require.NoError(tb, err)
+	r := rand.New(rand.NewSource(int64(c.size)))
+	keys := make([][]byte, c.size)
+	for i := range keys {
+		keys[i] = proofKey(r, c.dist, i)
+		value := make([]byte, 32)
+		r.Read(value)
+		_, err = tree.Set(keys[i], value)
+		require.NoError(tb, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(tb, err)
+	sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+	return tree, keys
+}
+
+// proofSamples returns the keys to prove for a case, spread evenly over the key space, and keys
+// absent from the tree right after each of them.
+func proofSamples(keys [][]byte) (present, absent [][]byte) {
+	for i := 0; i < proofSuiteSamples; i++ {
+		key := keys[i*(len(keys)-1)/(proofSuiteSamples-1)]
+		present = append(present, key)
+		absent = append(absent, append(append([]byte{}, key...), 0))
+	}
+	return present, absent
+}
+
+// proofStats are the sizes and generation latency of a kind of proof.
+type proofStats struct {
+	AvgBytes   int   `json:"avg_bytes"`
+	MaxBytes   int   `json:"max_bytes"`
+	AvgLatency int64 `json:"avg_latency_ns"`
+}
+
+// proofCaseStats are the proof statistics of a case.
+type proofCaseStats struct {
+	Membership    proofStats `json:"membership"`
+	NonMembership proofStats `json:"non_membership"`
+}
+
+func measureProofs(tb testing.TB, keys [][]byte, prove func([]byte) (*ics23.CommitmentProof, error)) proofStats {
+	var stats proofStats
+	for round := 0; round < proofLatencyRounds; round++ {
+		total := 0
+		start := time.Now()
+		for _, key := range keys {
+			proof, err := prove(key)
+			require.NoError(tb, err)
+			size := proof.Size()
+			total += size
+			if size > stats.MaxBytes {
+				stats.MaxBytes = size
+			}
+		}
+		latency := time.Since(start).Nanoseconds() / int64(len(keys))
+		if round == 0 || latency < stats.AvgLatency {
+			stats.AvgLatency = latency
+		}
+		stats.AvgBytes = total / len(keys)
+	}
+	return stats
+}
+
+// TestProofSizeRegression generates proofs across tree sizes and key distributions, and fails if
+// their sizes grew beyond -proof-size-threshold of the baseline, so that changes of the proof
+// format can not silently increase the bandwidth of relayers. Since latencies depend on the
+// machine, they are only checked with -check-proof-latency, against a baseline recorded on the
+// same machine.
+func TestProofSizeRegression(t *testing.T) {
+	results := map[string]proofCaseStats{}
+	for _, c := range proofCases {
+		tree, keys := buildProofTree(t, c)
+		present, absent := proofSamples(keys)
+		results[c.name()] = proofCaseStats{
+			Membership:    measureProofs(t, present, tree.GetMembershipProof),
+			NonMembership: measureProofs(t, absent, tree.GetNonMembershipProof),
+		}
+	}
+
+	if *updateProofBaseline {
+		bz, err := json.MarshalIndent(results, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(filepath.Dir(proofBaselineFile), 0o755))
+		require.NoError(t, os.WriteFile(proofBaselineFile, append(bz, '\n'), 0o644))
+		return
+	}
+
+	bz, err := os.ReadFile(proofBaselineFile)
+	require.NoError(t, err, "run with -update-proof-baseline to create the baseline")
+	baseline := map[string]proofCaseStats{}
+	require.NoError(t, json.Unmarshal(bz, &baseline))
+
+	check := func(name, metric string, got, base int64, threshold float64) {
+		if float64(got) > float64(base)*(1+threshold) {
+			t.Errorf("%s: %s regressed from %d to %d (more than %.0f%%)", name, metric, base, got, threshold*100)
+		} else {
+			t.Logf("%s: %s %d (baseline %d)", name, metric, got, base)
+		}
+	}
+	for _, c := range proofCases {
+		name := c.name()
+		base, ok := baseline[name]
+		if !ok {
+			t.Errorf("%s: missing from %s", name, proofBaselineFile)
+			continue
+		}
+		got := results[name]
+		for _, kind := range []struct {
+			name      string
+			got, base proofStats
+		}{
+			{"membership", got.Membership, base.Membership},
+			{"non-membership", got.NonMembership, base.NonMembership},
+		} {
+			check(name, kind.name+" avg bytes", int64(kind.got.AvgBytes), int64(kind.base.AvgBytes), *proofSizeThreshold)
+			check(name, kind.name+" max bytes", int64(kind.got.MaxBytes), int64(kind.base.MaxBytes), *proofSizeThreshold)
+			if *checkProofLatency {
+				check(name, kind.name+" latency ns", kind.got.AvgLatency, kind.base.AvgLatency, *proofLatencyThreshold)
+			}
+		}
+	}
+}
+
+// BenchmarkProofs measures proof generation latency across tree sizes and key distributions,
+// reporting the average proof size as the "proof-bytes" metric.
+func BenchmarkProofs(b *testing.B) {
+	for _, c := range proofCases {
+		tree, keys := buildProofTree(b, c)
+		present, absent := proofSamples(keys)
+		for _, kind := range []struct {
+			name  string
+			keys  [][]byte
+			prove func([]byte) (*ics23.CommitmentProof, error)
+		}{
+			{"membership", present, tree.GetMembershipProof},
+			{"non-membership", absent, tree.GetNonMembershipProof},
+		} {
+			kind := kind
+			b.Run(c.name()+"/"+kind.name, func(b *testing.B) {
+				b.ReportAllocs()
+				total := 0
+				for i := 0; i < b.N; i++ {
+					proof, err := kind.prove(kind.keys[i%len(kind.keys)])
+					if err != nil {
+						b.Fatal(err)
+					}
+					total += proof.Size()
+				}
+				b.ReportMetric(float64(total)/float64(b.N), "proof-bytes")
+			})
+		}
+	}
+}
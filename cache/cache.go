@@ -108,3 +108,19 @@ func (c *lruCache) remove(e *list.Element) Node {
 	delete(c.dict, ibytes.UnsafeBytesToStr(removed.GetKey()))
 	return removed
 }
+
+// Resizer is implemented by caches whose maximum element count can be changed at runtime.
+type Resizer interface {
+	// Resize sets the maximum number of nodes in the cache, evicting the least recently used
+	// nodes if there are more.
+	Resize(maxElementCount int)
+}
+
+var _ Resizer = (*lruCache)(nil)
+
+func (c *lruCache) Resize(maxElementCount int) {
+	c.maxElementCount = maxElementCount
+	for c.ll.Len() > c.maxElementCount {
+		c.remove(c.ll.Back())
+	}
+}
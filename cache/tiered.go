@@ -0,0 +1,105 @@
+package cache
+
+// TierStats contains the metrics of a single tier of a TieredCache.
+type TierStats struct {
+	Len       int    // The number of nodes in the tier.
+	Hits      uint64 // The number of Get calls served by the tier.
+	Evictions uint64 // The number of nodes evicted from the tier to make room for others.
+}
+
+// TieredStats contains the metrics of a TieredCache.
+type TieredStats struct {
+	Small  TierStats
+	Large  TierStats
+	Misses uint64 // The number of Get calls served by neither tier.
+}
+
+// TieredCache is a cache segmented into a tier of small nodes and a tier of large nodes, each an
+// LRU cache with its own maximum element count. Nodes are assigned to a tier by their size, so a
+// scan over many large nodes, e.g. leaves with giant values, only evicts other large nodes and
+// leaves the working set of small nodes intact.
+//
+// Like the other cache implementations, TieredCache is not safe for concurrent use.
+type TieredCache struct {
+	small     *lruCache
+	large     *lruCache
+	threshold int
+	sizeOf    func(Node) int
+	stats     TieredStats
+}
+
+var (
+	_ Cache   = (*TieredCache)(nil)
+	_ Resizer = (*TieredCache)(nil)
+)
+
+// NewTiered creates a TieredCache holding up to smallCount nodes smaller than threshold bytes,
+// and up to largeCount nodes of at least threshold bytes, as measured by sizeOf.
+func NewTiered(smallCount, largeCount, threshold int, sizeOf func(Node) int) *TieredCache {
+	return &TieredCache{
+		small:     New(smallCount).(*lruCache),
+		large:     New(largeCount).(*lruCache),
+		threshold: threshold,
+		sizeOf:    sizeOf,
+	}
+}
+
+func (c *TieredCache) Add(node Node) Node {
+	tier, other := c.small, c.large
+	evictions := &c.stats.Small.Evictions
+	if c.sizeOf(node) >= c.threshold {
+		tier, other = c.large, c.small
+		evictions = &c.stats.Large.Evictions
+	}
+
+	// the node may have changed size, so drop any copy in the other tier.
+	other.Remove(node.GetKey())
+	exists := tier.Has(node.GetKey())
+	removed := tier.Add(node)
+	if removed != nil && !exists {
+		*evictions++
+	}
+	return removed
+}
+
+func (c *TieredCache) Get(key []byte) Node {
+	if node := c.small.Get(key); node != nil {
+		c.stats.Small.Hits++
+		return node
+	}
+	if node := c.large.Get(key); node != nil {
+		c.stats.Large.Hits++
+		return node
+	}
+	c.stats.Misses++
+	return nil
+}
+
+func (c *TieredCache) Has(key []byte) bool {
+	return c.small.Has(key) || c.large.Has(key)
+}
+
+func (c *TieredCache) Remove(key []byte) Node {
+	if node := c.small.Remove(key); node != nil {
+		return node
+	}
+	return c.large.Remove(key)
+}
+
+func (c *TieredCache) Len() int {
+	return c.small.Len() + c.large.Len()
+}
+
+// Resize sets the maximum number of small nodes, which make up the working set. The size of the
+// large tier is unchanged.
+func (c *TieredCache) Resize(maxElementCount int) {
+	c.small.Resize(maxElementCount)
+}
+
+// Stats returns the metrics of the cache.
+func (c *TieredCache) Stats() TieredStats {
+	stats := c.stats
+	stats.Small.Len = c.small.Len()
+	stats.Large.Len = c.large.Len()
+	return stats
+}
@@ -0,0 +1,88 @@
+package cache_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/stretchr/testify/require"
+)
+
+// sizedNode is a test node with an explicit size.
+type sizedNode struct {
+	key  []byte
+	size int
+}
+
+func (n *sizedNode) GetKey() []byte {
+	return n.key
+}
+
+func sizeOfSizedNode(node cache.Node) int {
+	return node.(*sizedNode).size
+}
+
+func Test_TieredCache_LargeNodesDoNotEvictSmall(t *testing.T) {
+	c := cache.NewTiered(10, 2, 100, sizeOfSizedNode)
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.Add(&sizedNode{key: []byte(fmt.Sprintf("small%d", i)), size: 10}))
+	}
+	// a scan over large nodes only evicts large nodes.
+	for i := 0; i < 100; i++ {
+		c.Add(&sizedNode{key: []byte(fmt.Sprintf("large%d", i)), size: 1000})
+	}
+	require.Equal(t, 12, c.Len())
+	for i := 0; i < 10; i++ {
+		require.NotNil(t, c.Get([]byte(fmt.Sprintf("small%d", i))))
+	}
+	require.NotNil(t, c.Get([]byte("large99")))
+	require.Nil(t, c.Get([]byte("large0")))
+
+	require.Equal(t, cache.TieredStats{
+		Small:  cache.TierStats{Len: 10, Hits: 10},
+		Large:  cache.TierStats{Len: 2, Hits: 1, Evictions: 98},
+		Misses: 1,
+	}, c.Stats())
+}
+
+func Test_TieredCache_Resize(t *testing.T) {
+	c := cache.NewTiered(2, 2, 100, sizeOfSizedNode)
+
+	key := []byte("key")
+	require.Nil(t, c.Add(&sizedNode{key: key, size: 10}))
+	// re-adding the node with a larger size moves it to the large tier.
+	c.Add(&sizedNode{key: key, size: 1000})
+	require.Equal(t, 1, c.Len())
+	require.True(t, c.Has(key))
+	require.Equal(t, 1000, c.Get(key).(*sizedNode).size)
+
+	stats := c.Stats()
+	require.Equal(t, 0, stats.Small.Len)
+	require.Equal(t, 1, stats.Large.Len)
+	require.Equal(t, uint64(1), stats.Large.Hits)
+
+	require.NotNil(t, c.Remove(key))
+	require.False(t, c.Has(key))
+	require.Nil(t, c.Remove(key))
+	require.Equal(t, 0, c.Len())
+}
+
+func Test_TieredCache_ResizeSmallTier(t *testing.T) {
+	c := cache.NewTiered(4, 2, 100, sizeOfSizedNode)
+	for i := 0; i < 4; i++ {
+		c.Add(&sizedNode{key: []byte(fmt.Sprintf("small%d", i)), size: 10})
+	}
+	c.Add(&sizedNode{key: []byte("large"), size: 1000})
+
+	// shrinking evicts the least recently used small nodes only.
+	c.Resize(2)
+	require.Equal(t, 3, c.Len())
+	require.Nil(t, c.Get([]byte("small1")))
+	require.NotNil(t, c.Get([]byte("small3")))
+	require.NotNil(t, c.Get([]byte("large")))
+
+	c.Resize(3)
+	require.Nil(t, c.Add(&sizedNode{key: []byte("small4"), size: 10}))
+	require.Equal(t, 3, c.Stats().Small.Len)
+}
@@ -0,0 +1,185 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// The changeset stream format is a framed binary encoding of the state changes of consecutive
+// versions, for ingestion by external stores such as versiondb or analytics pipelines:
+//
+//	stream    := magic format changeset*
+//	magic     := "IAVLCS"
+//	format    := uint8, currently 1
+//	changeset := version length pair*
+//	version   := uint64, big endian
+//	length    := uint64, big endian, the byte length of the pairs which follow
+//	pair      := flags key [value]
+//	flags     := uint8, 1 for a deletion (tombstone), 0 for a set
+//	key       := uvarint length prefixed bytes
+//	value     := uvarint length prefixed bytes, omitted for deletions
+//
+// Every version in the written range has a changeset, which is empty if the version did not
+// change any keys. The length prefix allows readers to skip versions without decoding them.
+var changesetStreamMagic = []byte("IAVLCS")
+
+const (
+	// changesetStreamFormat is the current changeset stream format version.
+	changesetStreamFormat = 1
+	// changesetHeaderSize is the size of the version and length of a changeset.
+	changesetHeaderSize = 16
+	// maxChangesetSize is the maximum length of a changeset read from a stream.
+	maxChangesetSize = 1 << 30
+
+	changesetFlagDelete = 1
+)
+
+// ErrInvalidChangesetStream is returned when a changeset stream is malformed or truncated.
+var ErrInvalidChangesetStream = errors.New("invalid changeset stream")
+
+// WriteChangesets writes the state changes of the versions from through to, inclusive, to w in
+// the changeset stream format. The range is clamped to the available versions, like
+// TraverseStateChanges. Keys are written as stored in the tree, i.e. hashed if Options.HashKeys
+// is set.
+func (t *ImmutableTree) WriteChangesets(w io.Writer, from, to int64) error {
+	cw, err := NewChangesetWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := t.TraverseStateChanges(from, to, cw.Write); err != nil {
+		return err
+	}
+	return cw.Flush()
+}
+
+// ChangesetWriter writes changesets to a stream in the changeset stream format. Users must call
+// Flush() when done.
+type ChangesetWriter struct {
+	w   *bufio.Writer
+	buf bytes.Buffer
+}
+
+// NewChangesetWriter writes the stream header to w and returns a writer for the changesets.
+func NewChangesetWriter(w io.Writer) (*ChangesetWriter, error) {
+	cw := &ChangesetWriter{w: bufio.NewWriter(w)}
+	if _, err := cw.w.Write(changesetStreamMagic); err != nil {
+		return nil, err
+	}
+	if err := cw.w.WriteByte(changesetStreamFormat); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Write writes the changeset of a version. Versions should be written in ascending order.
+func (cw *ChangesetWriter) Write(version int64, changeSet *ChangeSet) error {
+	if version < 0 {
+		return fmt.Errorf("invalid version %d", version)
+	}
+	cw.buf.Reset()
+	for _, pair := range changeSet.Pairs {
+		if pair.Delete {
+			cw.buf.WriteByte(changesetFlagDelete)
+		} else {
+			cw.buf.WriteByte(0)
+		}
+		if err := encoding.EncodeBytes(&cw.buf, pair.Key); err != nil {
+			return err
+		}
+		if !pair.Delete {
+			if err := encoding.EncodeBytes(&cw.buf, pair.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	var header [changesetHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(version))
+	binary.BigEndian.PutUint64(header[8:], uint64(cw.buf.Len()))
+	if _, err := cw.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(cw.buf.Bytes())
+	return err
+}
+
+// Flush flushes buffered changesets to the underlying writer.
+func (cw *ChangesetWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+// ChangesetReader reads changesets from a stream written by ChangesetWriter.
+type ChangesetReader struct {
+	r *bufio.Reader
+}
+
+// NewChangesetReader reads and checks the stream header from r.
+func NewChangesetReader(r io.Reader) (*ChangesetReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(changesetStreamMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: failed to read header: %v", ErrInvalidChangesetStream, err)
+	}
+	if !bytes.Equal(header[:len(changesetStreamMagic)], changesetStreamMagic) {
+		return nil, fmt.Errorf("%w: bad magic %X", ErrInvalidChangesetStream, header[:len(changesetStreamMagic)])
+	}
+	if format := header[len(changesetStreamMagic)]; format != changesetStreamFormat {
+		return nil, fmt.Errorf("%w: unknown format version %d", ErrInvalidChangesetStream, format)
+	}
+	return &ChangesetReader{r: br}, nil
+}
+
+// Next reads the next changeset and its version, or returns io.EOF at the end of the stream.
+func (cr *ChangesetReader) Next() (int64, *ChangeSet, error) {
+	var header [changesetHeaderSize]byte
+	if _, err := io.ReadFull(cr.r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, fmt.Errorf("%w: failed to read changeset header: %v", ErrInvalidChangesetStream, err)
+	}
+	version := int64(binary.BigEndian.Uint64(header[:8]))
+	size := binary.BigEndian.Uint64(header[8:])
+	if version < 0 || size > maxChangesetSize {
+		return 0, nil, fmt.Errorf("%w: invalid changeset header for version %d of length %d",
+			ErrInvalidChangesetStream, version, size)
+	}
+
+	payload, err := encoding.ReadSized(cr.r, size)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: failed to read changeset of version %d: %v", ErrInvalidChangesetStream, version, err)
+	}
+
+	changeSet := &ChangeSet{}
+	for len(payload) > 0 {
+		pair := KVPair{Delete: payload[0] == changesetFlagDelete}
+		if payload[0] > changesetFlagDelete {
+			return 0, nil, fmt.Errorf("%w: invalid flags %d in version %d", ErrInvalidChangesetStream, payload[0], version)
+		}
+		payload = payload[1:]
+
+		key, n, err := encoding.DecodeBytes(payload)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: failed to decode key in version %d: %v", ErrInvalidChangesetStream, version, err)
+		}
+		pair.Key = key
+		payload = payload[n:]
+
+		if !pair.Delete {
+			value, n, err := encoding.DecodeBytes(payload)
+			if err != nil {
+				return 0, nil, fmt.Errorf("%w: failed to decode value in version %d: %v", ErrInvalidChangesetStream, version, err)
+			}
+			pair.Value = value
+			payload = payload[n:]
+		}
+		changeSet.Pairs = append(changeSet.Pairs, pair)
+	}
+	return version, changeSet, nil
+}
@@ -0,0 +1,111 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangesetStreamRoundTrip(t *testing.T) {
+	changeSets := genChangeSets(rand.New(rand.NewSource(0)), 50)
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	for i := range changeSets {
+		_, err := tree.SaveChangeSet(&changeSets[i])
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.WriteChangesets(&buf, 0, math.MaxInt64))
+
+	// replaying the stream into a new tree yields the same tree.
+	reader, err := NewChangesetReader(&buf)
+	require.NoError(t, err)
+	newTree, err := NewMutableTree(db.NewMemDB(), 0, true)
+	require.NoError(t, err)
+	for i := range changeSets {
+		version, changeSet, err := reader.Next()
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), version)
+		require.Equal(t, changeSets[i], *changeSet)
+		_, err = newTree.SaveChangeSet(changeSet)
+		require.NoError(t, err)
+	}
+	_, _, err = reader.Next()
+	require.Equal(t, io.EOF, err)
+
+	hash, err := tree.Hash()
+	require.NoError(t, err)
+	newHash, err := newTree.Hash()
+	require.NoError(t, err)
+	require.Equal(t, hash, newHash)
+}
+
+func TestChangesetStream_Range(t *testing.T) {
+	changeSets := genChangeSets(rand.New(rand.NewSource(1)), 10)
+	tree, err := NewMutableTree(db.NewMemDB(), 0, true)
+	require.NoError(t, err)
+	for i := range changeSets {
+		_, err := tree.SaveChangeSet(&changeSets[i])
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.WriteChangesets(&buf, 4, 6))
+	reader, err := NewChangesetReader(&buf)
+	require.NoError(t, err)
+	for version := int64(4); version <= 6; version++ {
+		v, changeSet, err := reader.Next()
+		require.NoError(t, err)
+		require.Equal(t, version, v)
+		require.Equal(t, changeSets[version-1], *changeSet)
+	}
+	_, _, err = reader.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestChangesetStream_Invalid(t *testing.T) {
+	_, err := NewChangesetReader(bytes.NewReader([]byte("IAVLXX\x01")))
+	require.ErrorIs(t, err, ErrInvalidChangesetStream)
+
+	var buf bytes.Buffer
+	writer, err := NewChangesetWriter(&buf)
+	require.NoError(t, err)
+	require.NoError(t, writer.Write(1, &ChangeSet{Pairs: []KVPair{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Delete: true},
+	}}))
+	require.NoError(t, writer.Flush())
+
+	// truncated streams fail instead of ending cleanly.
+	reader, err := NewChangesetReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	require.NoError(t, err)
+	_, _, err = reader.Next()
+	require.ErrorIs(t, err, ErrInvalidChangesetStream)
+
+	// a forged length is not allocated before the bytes arrive.
+	var header [changesetHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:8], 1)
+	binary.BigEndian.PutUint64(header[8:], maxChangesetSize)
+	forged := append([]byte{}, changesetStreamMagic...)
+	forged = append(forged, changesetStreamFormat)
+	forged = append(forged, header[:]...)
+	forged = append(forged, "short"...)
+	reader, err = NewChangesetReader(bytes.NewReader(forged))
+	require.NoError(t, err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err = reader.Next()
+	runtime.ReadMemStats(&after)
+	require.ErrorIs(t, err, ErrInvalidChangesetStream)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl"
+)
+
+const (
+	// doctorSampleVersions is the number of versions sampled for hash verification.
+	doctorSampleVersions = 10
+	// doctorSampleKeys is the number of keys sampled per version for hash verification.
+	doctorSampleKeys = 20
+	// retainedVersionsWarnThreshold is the number of retained versions above which pruning is suggested.
+	retainedVersionsWarnThreshold = 10000
+	// cacheRatioWarnThreshold is the minimum ratio of cache size to tree nodes before a larger cache is suggested.
+	cacheRatioWarnThreshold = 0.001
+)
+
+// CheckStatus is the outcome of a single doctor check.
+type CheckStatus string
+
+const (
+	StatusOK   CheckStatus = "OK"
+	StatusWarn CheckStatus = "WARN"
+	StatusFail CheckStatus = "FAIL"
+)
+
+// CheckResult is the result of a single doctor check, with a suggested remediation for any
+// non-OK status.
+type CheckResult struct {
+	Name        string
+	Status      CheckStatus
+	Detail      string
+	Remediation string
+}
+
+// HealthReport is the result of running all doctor checks against a tree.
+type HealthReport struct {
+	Checks []CheckResult
+}
+
+// Healthy returns true if no check failed.
+func (r *HealthReport) Healthy() bool {
+	for _, check := range r.Checks {
+		if check.Status == StatusFail {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *HealthReport) add(name string, status CheckStatus, detail, remediation string) {
+	r.Checks = append(r.Checks, CheckResult{
+		Name:        name,
+		Status:      status,
+		Detail:      detail,
+		Remediation: remediation,
+	})
+}
+
+// String renders the report for printing.
+func (r *HealthReport) String() string {
+	var sb strings.Builder
+	for _, check := range r.Checks {
+		fmt.Fprintf(&sb, "[%-4s] %s: %s\n", check.Status, check.Name, check.Detail)
+		if check.Status != StatusOK && check.Remediation != "" {
+			fmt.Fprintf(&sb, "       suggestion: %s\n", check.Remediation)
+		}
+	}
+	if r.Healthy() {
+		sb.WriteString("Tree is healthy\n")
+	} else {
+		sb.WriteString("Tree is NOT healthy\n")
+	}
+	return sb.String()
+}
+
+// RunDoctor runs a battery of health checks against the tree stored in db, which is opened with
+// the given cache size, i.e. the node cache size the store is used with. Checks which depend on a
+// loadable tree are skipped if loading fails. Like on the startup of a node, loading the tree
+// resumes an interrupted pruning and rolls back a partially written commit.
+func RunDoctor(db dbm.DB, cacheSize int, rnd *rand.Rand) *HealthReport {
+	report := &HealthReport{}
+
+	tree, hashKeys, err := openDoctorTree(db, cacheSize, true)
+	if err != nil {
+		report.add("load latest version", StatusFail, err.Error(), "check that the database path and prefix are correct")
+		return report
+	}
+	// loading the tree resumes an interrupted pruning, so look for it first.
+	interrupted, err := tree.InterruptedPruneVersion()
+	if err != nil {
+		report.add("load latest version", StatusFail, err.Error(), "check that the database path and prefix are correct")
+		return report
+	}
+	latest, err := tree.Load()
+	if err != nil {
+		report.add("load latest version", StatusFail, err.Error(),
+			"the latest version is unreadable, roll back to an earlier version with LoadVersionForOverwriting or restore from a snapshot")
+		return report
+	}
+	if latest == 0 {
+		report.add("load latest version", StatusWarn, "no versions found", "check that the prefix matches the store to inspect")
+		return report
+	}
+	report.add("load latest version", StatusOK, fmt.Sprintf("loaded version %d", latest), "")
+
+	versions := tree.AvailableVersions()
+	checkLatestVersion(report, tree, versions)
+	retained := checkRoots(report, tree, versions)
+	checkSampledHashes(report, tree, retained, hashKeys, rnd)
+	checkFastStorage(report, db, cacheSize)
+	checkCacheSize(report, tree, cacheSize)
+	checkPruning(report, tree, versions, interrupted)
+
+	return report
+}
+
+// openDoctorTree opens the tree stored in db with Options.HashKeys matching the key mode recorded
+// in the store, and returns whether the keys are hashed.
+func openDoctorTree(db dbm.DB, cacheSize int, skipFastStorageUpgrade bool) (*iavl.MutableTree, bool, error) {
+	tree, err := iavl.NewMutableTreeWithOpts(db, cacheSize, &iavl.Options{}, skipFastStorageUpgrade)
+	if !errors.Is(err, iavl.ErrHashKeysMismatch) {
+		return tree, false, err
+	}
+	tree, err = iavl.NewMutableTreeWithOpts(db, cacheSize, &iavl.Options{HashKeys: true}, skipFastStorageUpgrade)
+	return tree, true, err
+}
+
+// checkLatestVersion checks that the loaded version is the latest claimed version, and that its
+// root hash can be computed.
+func checkLatestVersion(report *HealthReport, tree *iavl.MutableTree, versions []int) {
+	const name = "latest version consistency"
+	if len(versions) == 0 || int64(versions[len(versions)-1]) != tree.Version() {
+		report.add(name, StatusFail, fmt.Sprintf("loaded version %d does not match the available versions", tree.Version()),
+			"the version metadata is inconsistent, roll back to the last good version with LoadVersionForOverwriting")
+		return
+	}
+	hash, err := tree.Hash()
+	if err != nil {
+		report.add(name, StatusFail, fmt.Sprintf("failed to compute root hash: %v", err),
+			"the latest root is corrupted, roll back to the last good version with LoadVersionForOverwriting")
+		return
+	}
+	report.add(name, StatusOK, fmt.Sprintf("version %d has hash %X", tree.Version(), hash), "")
+}
+
+// checkRoots checks that all claimed versions have a readable root, and returns the versions
+// which do.
+func checkRoots(report *HealthReport, tree *iavl.MutableTree, versions []int) []int64 {
+	const name = "root presence"
+	var (
+		retained []int64
+		missing  []string
+	)
+	for _, version := range versions {
+		if _, err := tree.GetImmutable(int64(version)); err != nil {
+			missing = append(missing, fmt.Sprintf("%d (%v)", version, err))
+			continue
+		}
+		retained = append(retained, int64(version))
+	}
+	if len(missing) > 0 {
+		if len(missing) > 10 {
+			missing = append(missing[:10], fmt.Sprintf("and %d more", len(missing)-10))
+		}
+		report.add(name, StatusFail, fmt.Sprintf("%d of %d versions have no readable root: %s",
+			len(versions)-len(retained), len(versions), strings.Join(missing, ", ")),
+			"prune the broken versions with DeleteVersionsTo if they are old, or restore from a snapshot")
+		return retained
+	}
+	report.add(name, StatusOK, fmt.Sprintf("all %d versions have a root", len(versions)), "")
+	return retained
+}
+
+// checkSampledHashes verifies membership proofs of random keys in random versions against the
+// root hash, which recomputes the hashes along each sampled path. The original keys of a store
+// with hashed keys are unknown, so non-membership proofs of random probe keys are verified
+// instead, which recompute the hashes along the paths of their neighbouring leaves.
+func checkSampledHashes(report *HealthReport, tree *iavl.MutableTree, versions []int64, hashKeys bool, rnd *rand.Rand) {
+	const name = "sampled hash verification"
+	if len(versions) == 0 {
+		report.add(name, StatusWarn, "no versions to sample", "")
+		return
+	}
+
+	sampled := make([]int64, 0, doctorSampleVersions)
+	// always include the latest version, and sample distinct earlier versions
+	sampled = append(sampled, versions[len(versions)-1])
+	for _, i := range rnd.Perm(len(versions) - 1) {
+		if len(sampled) == doctorSampleVersions {
+			break
+		}
+		sampled = append(sampled, versions[i])
+	}
+
+	var failures []string
+	checked := 0
+	for _, version := range sampled {
+		itree, err := tree.GetImmutable(version)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("version %d: %v", version, err))
+			continue
+		}
+		if itree.Size() == 0 {
+			continue
+		}
+		for i := 0; i < doctorSampleKeys; i++ {
+			checked++
+			if hashKeys {
+				if err := verifyProbeKey(itree, rnd); err != nil {
+					failures = append(failures, fmt.Sprintf("version %d: %v", version, err))
+					break
+				}
+				continue
+			}
+			key, _, err := itree.GetByIndex(rnd.Int63n(itree.Size()))
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("version %d: %v", version, err))
+				break
+			}
+			proof, err := itree.GetMembershipProof(key)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("version %d key %X: %v", version, key, err))
+				break
+			}
+			ok, err := itree.VerifyMembership(proof, key)
+			if err != nil || !ok {
+				failures = append(failures, fmt.Sprintf("version %d key %X: hash mismatch", version, key))
+				break
+			}
+		}
+	}
+	if len(failures) > 0 {
+		report.add(name, StatusFail, strings.Join(failures, "; "),
+			"stored node hashes are inconsistent, restore the store from a snapshot or state sync")
+		return
+	}
+	report.add(name, StatusOK, fmt.Sprintf("verified %d paths across %d versions", checked, len(sampled)), "")
+}
+
+// verifyProbeKey verifies a non-membership proof of a random key against the root hash of a tree
+// with hashed keys.
+func verifyProbeKey(itree *iavl.ImmutableTree, rnd *rand.Rand) error {
+	key := make([]byte, 32)
+	rnd.Read(key)
+	proof, err := itree.GetNonMembershipProof(key)
+	if err != nil {
+		return fmt.Errorf("probe key %X: %w", key, err)
+	}
+	ok, err := itree.VerifyNonMembership(proof, key)
+	if err != nil || !ok {
+		return fmt.Errorf("probe key %X: hash mismatch", key)
+	}
+	return nil
+}
+
+// checkFastStorage checks whether the fast storage index is up to date. It uses a separate tree
+// instance, since the fast index is only consulted for trees not skipping the upgrade.
+func checkFastStorage(report *HealthReport, db dbm.DB, cacheSize int) {
+	const name = "fast storage"
+	tree, _, err := openDoctorTree(db, cacheSize, false)
+	if err != nil {
+		report.add(name, StatusFail, err.Error(), "")
+		return
+	}
+	upgradeable, err := tree.IsUpgradeable()
+	if err != nil {
+		report.add(name, StatusFail, err.Error(), "")
+		return
+	}
+	if upgradeable {
+		report.add(name, StatusWarn, "the fast storage index is missing or out of date",
+			"the index is rebuilt on the next LoadVersion by a node not skipping the fast storage upgrade, expect a slow startup")
+		return
+	}
+	report.add(name, StatusOK, "the fast storage index is up to date", "")
+}
+
+// checkCacheSize checks that the node cache is large enough for the latest version of the tree.
+func checkCacheSize(report *HealthReport, tree *iavl.MutableTree, cacheSize int) {
+	const name = "cache size"
+	nodes := 2*tree.Size() - 1
+	switch {
+	case cacheSize <= 0:
+		report.add(name, StatusWarn, "the node cache is disabled", "set a node cache size to avoid reading every node from disk")
+	case nodes > 0 && float64(cacheSize)/float64(nodes) < cacheRatioWarnThreshold:
+		report.add(name, StatusWarn, fmt.Sprintf("cache of %d nodes for a tree of %d nodes", cacheSize, nodes),
+			"increase the node cache size to hold at least the upper levels of the tree")
+	default:
+		report.add(name, StatusOK, fmt.Sprintf("cache of %d nodes for a tree of %d nodes", cacheSize, nodes), "")
+	}
+}
+
+// checkPruning reports a pruning interrupted up to the given version, which is looked up before
+// loading the tree resumes it, and checks that the number of retained versions looks sane,
+// reporting the disk space which pruning all but the latest version reclaims at most.
+func checkPruning(report *HealthReport, tree *iavl.MutableTree, versions []int, interrupted int64) {
+	const name = "pruning"
+	if interrupted > 0 {
+		report.add(name, StatusWarn, fmt.Sprintf("the pruning of the versions up to %d was interrupted and resumed when loading the tree", interrupted),
+			"check why the process pruning the versions stopped, e.g. a crash or an out of memory kill")
+		return
+	}
+	if len(versions) < 2 {
+		report.add(name, StatusOK, fmt.Sprintf("%d versions are retained", len(versions)), "")
+		return
+	}
+
+	first, latest := int64(versions[0]), int64(versions[len(versions)-1])
+	usage, err := tree.DiskUsage(first, latest-1)
+	if err != nil {
+		report.add(name, StatusFail, err.Error(), "")
+		return
+	}
+	detail := fmt.Sprintf("%d versions from %d to %d are retained, pruning up to version %d reclaims at most %d bytes",
+		len(versions), first, latest, latest-1, usage.TotalBytes())
+	if len(versions) > retainedVersionsWarnThreshold {
+		report.add(name, StatusWarn, detail, "enable pruning or call DeleteVersionsTo to reduce disk usage")
+		return
+	}
+	report.add(name, StatusOK, detail, "")
+}
+
+// newDoctorRand returns the random source for sampling.
+func newDoctorRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano())) //nolint:gosec
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	dbm "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+)
+
+// setupDoctorDB saves versions 1 to 20 of a tree, each setting a batch of keys.
+func setupDoctorDB(t *testing.T) dbm.DB {
+	db := dbm.NewMemDB()
+	tree, err := iavl.NewMutableTree(db, 0, false)
+	require.NoError(t, err)
+	for version := 1; version <= 20; version++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d-%d", version, i)), []byte{byte(version)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	return db
+}
+
+// rootKey returns the database key of the root node of a version.
+func rootKey(version int64) []byte {
+	key := make([]byte, 13)
+	key[0] = 'n'
+	binary.BigEndian.PutUint64(key[1:], uint64(version))
+	binary.BigEndian.PutUint32(key[9:], 1)
+	return key
+}
+
+func dbContents(t *testing.T, db dbm.DB) map[string]string {
+	contents := map[string]string{}
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		contents[string(itr.Key())] = string(itr.Value())
+	}
+	return contents
+}
+
+func TestRunDoctor_Healthy(t *testing.T) {
+	db := setupDoctorDB(t)
+	before := dbContents(t, db)
+
+	report := RunDoctor(db, 1000, rand.New(rand.NewSource(0)))
+	require.True(t, report.Healthy(), report.String())
+	for _, check := range report.Checks {
+		require.Equal(t, StatusOK, check.Status, "%s: %s", check.Name, check.Detail)
+	}
+	require.Contains(t, report.String(), "verified 200 paths across 10 versions")
+	require.Contains(t, report.String(), "20 versions from 1 to 20 are retained")
+
+	// the doctor does not write to the store
+	require.Equal(t, before, dbContents(t, db))
+}
+
+func TestRunDoctor_Corrupted(t *testing.T) {
+	testCases := []struct {
+		name    string
+		version int64
+		check   string
+	}{
+		{"old root", 5, "root presence"},
+		{"latest root", 20, "load latest version"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := setupDoctorDB(t)
+			require.NoError(t, db.Set(rootKey(tc.version), []byte("corrupted")))
+
+			report := RunDoctor(db, 1000, rand.New(rand.NewSource(0)))
+			require.False(t, report.Healthy(), report.String())
+			failed := false
+			for _, check := range report.Checks {
+				if check.Name == tc.check {
+					require.Equal(t, StatusFail, check.Status, check.Detail)
+					require.NotEmpty(t, check.Remediation)
+					failed = true
+				}
+			}
+			require.True(t, failed, report.String())
+		})
+	}
+}
+
+func TestRunDoctor_HashKeys(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree, err := iavl.NewMutableTreeWithOpts(db, 0, &iavl.Options{HashKeys: true}, false)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	report := RunDoctor(db, 1000, rand.New(rand.NewSource(0)))
+	require.True(t, report.Healthy(), report.String())
+	for _, check := range report.Checks {
+		require.Equal(t, StatusOK, check.Status, "%s: %s", check.Name, check.Detail)
+	}
+}
+
+func TestRunDoctor_CacheSize(t *testing.T) {
+	db := setupDoctorDB(t)
+	for cacheSize, status := range map[int]CheckStatus{0: StatusWarn, 1000: StatusOK} {
+		report := RunDoctor(db, cacheSize, rand.New(rand.NewSource(0)))
+		require.True(t, report.Healthy(), report.String())
+		found := false
+		for _, check := range report.Checks {
+			if check.Name == "cache size" {
+				require.Equal(t, status, check.Status, check.Detail)
+				found = true
+			}
+		}
+		require.True(t, found, report.String())
+	}
+}
@@ -23,13 +23,36 @@ const (
 
 func main() {
 	args := os.Args[1:]
-	if len(args) < 3 || (args[0] != "data" && args[0] != "shape" && args[0] != "versions") {
-		fmt.Fprintln(os.Stderr, "Usage: iaviewer <data|shape|versions> <leveldb dir> <prefix> [version number]")
+	if len(args) < 3 || (args[0] != "data" && args[0] != "shape" && args[0] != "versions" && args[0] != "doctor") {
+		fmt.Fprintln(os.Stderr, "Usage: iaviewer <data|shape|versions|doctor> <leveldb dir> <prefix> [version number]")
+		fmt.Fprintln(os.Stderr, "       iaviewer doctor <leveldb dir> <prefix> [cache size]")
 		fmt.Fprintln(os.Stderr, "<prefix> is the prefix of db, and the iavl tree of different modules in cosmos-sdk uses ")
 		fmt.Fprintln(os.Stderr, "different <prefix> to identify, just like \"s/k:gov/\" represents the prefix of gov module")
 		os.Exit(1)
 	}
 
+	if args[0] == "doctor" {
+		db, err := OpenPrefixDB(args[1], []byte(args[2]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening database: %s\n", err)
+			os.Exit(1)
+		}
+		cacheSize := DefaultCacheSize
+		if len(args) == 4 {
+			cacheSize, err = strconv.Atoi(args[3])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid cache size: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		report := RunDoctor(db, cacheSize, newDoctorRand())
+		fmt.Print(report.String())
+		if !report.Healthy() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	version := 0
 	if len(args) == 4 {
 		var err error
@@ -91,6 +114,18 @@ func OpenDB(dir string) (dbm.DB, error) {
 	return db, nil
 }
 
+// OpenPrefixDB opens the database in the directory, restricted to the given prefix if any.
+func OpenPrefixDB(dir string, prefix []byte) (dbm.DB, error) {
+	db, err := OpenDB(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefix) != 0 {
+		db = dbm.NewPrefixDB(db, prefix)
+	}
+	return db, nil
+}
+
 func PrintDBStats(db dbm.DB) {
 	count := 0
 	prefix := map[string]int{}
@@ -118,13 +153,10 @@ func PrintDBStats(db dbm.DB) {
 // If version is 0, load latest, otherwise, load named version
 // The prefix represents which iavl tree you want to read. The iaviwer will always set a prefix.
 func ReadTree(dir string, version int, prefix []byte) (*iavl.MutableTree, error) {
-	db, err := OpenDB(dir)
+	db, err := OpenPrefixDB(dir, prefix)
 	if err != nil {
 		return nil, err
 	}
-	if len(prefix) != 0 {
-		db = dbm.NewPrefixDB(db, prefix)
-	}
 
 	tree, err := iavl.NewMutableTree(db, DefaultCacheSize, false)
 	if err != nil {
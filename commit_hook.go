@@ -0,0 +1,78 @@
+package iavl
+
+import (
+	"fmt"
+)
+
+// CommitSummary describes a version which is about to be committed by SaveVersion.
+type CommitSummary struct {
+	Version       int64  // The version being saved.
+	Hash          []byte // The root hash of the new version.
+	PrevHash      []byte // The root hash of the previously saved version.
+	Size          int64  // The number of leaves in the new version.
+	NewLeaves     int    // The number of leaf nodes written by the new version.
+	NewInnerNodes int    // The number of inner nodes written by the new version.
+}
+
+// PreCommitHook is called by SaveVersion after the new version has been hashed but before it is
+// persisted. Returning an error vetoes the commit: nothing is written, and SaveVersion returns the
+// error wrapped. The working tree is left as it was, so the caller may modify it further, retry,
+// or discard the changes with Rollback.
+//
+// Hooks must not modify the tree.
+type PreCommitHook func(summary *CommitSummary) error
+
+// AddPreCommitHook registers a hook to be run by SaveVersion, e.g. to check invariants or to
+// cross-validate the app hash with an external source. Hooks are run in registration order, and
+// are not run when saving a version which already exists with the same hash.
+func (tree *MutableTree) AddPreCommitHook(hook PreCommitHook) {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	tree.preCommitHooks = append(tree.preCommitHooks, hook)
+}
+
+// runPreCommitHooks hashes the working tree at the given version and runs the registered hooks.
+// It must be called with the commit lock held.
+func (tree *MutableTree) runPreCommitHooks(version int64) error {
+	if len(tree.preCommitHooks) == 0 {
+		return nil
+	}
+
+	summary := &CommitSummary{
+		Version: version,
+		Size:    tree.Size(),
+	}
+	var err error
+	if summary.Hash, err = tree.root.hashWithCount(version); err != nil {
+		return err
+	}
+	if summary.PrevHash, err = tree.getLastSaved().Hash(); err != nil {
+		return err
+	}
+	if tree.root != nil && tree.root.nodeKey == nil {
+		tree.root.countNewNodes(summary)
+	}
+
+	for _, hook := range tree.preCommitHooks {
+		if err := hook(summary); err != nil {
+			return fmt.Errorf("pre-commit hook vetoed version %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// countNewNodes counts the nodes of the subtree which have not been persisted yet. Persisted nodes
+// only have persisted children, so their subtrees are skipped.
+func (node *Node) countNewNodes(summary *CommitSummary) {
+	if node.isLeaf() {
+		summary.NewLeaves++
+		return
+	}
+	summary.NewInnerNodes++
+	if node.leftNode != nil && node.leftNode.nodeKey == nil {
+		node.leftNode.countNewNodes(summary)
+	}
+	if node.rightNode != nil && node.rightNode.nodeKey == nil {
+		node.rightNode.countNewNodes(summary)
+	}
+}
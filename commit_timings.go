@@ -0,0 +1,59 @@
+package iavl
+
+import (
+	"time"
+
+	"github.com/cosmos/iavl/internal/logger"
+)
+
+// CommitTimings is the time spent in each phase of a SaveVersion call, to attribute slow commits.
+type CommitTimings struct {
+	Version int64
+
+	Hooks          time.Duration // Running pre-commit hooks, see AddPreCommitHook.
+	Hashing        time.Duration // Assigning node keys to new nodes and hashing them.
+	Encoding       time.Duration // Serializing new nodes.
+	BatchBuild     time.Duration // Adding new nodes to the write batch.
+	MetadataUpdate time.Duration // Writing the root, fast node index and version metadata.
+	BackendWrite   time.Duration // Writing batches to the database, including partial flushes.
+	Total          time.Duration // The whole SaveVersion call.
+
+	NewNodes       int // The number of nodes written.
+	NewNodeBytes   int // The encoded size of the nodes written.
+	PartialFlushes int // The number of times the batch was flushed before the final write.
+
+	// AutoTune is the decision of the controller enabled by Options.AutoTune, if any.
+	AutoTune *AutoTuneDecision
+
+	// DeadlineExceeded is set when Total exceeded Options.CommitDeadline.
+	DeadlineExceeded bool
+}
+
+// LastCommitTimings returns the timings of the most recent successful SaveVersion call, or false
+// if there is none. It is safe to call concurrently with SaveVersion.
+func (tree *MutableTree) LastCommitTimings() (CommitTimings, bool) {
+	timings, ok := tree.lastCommitTimings.Load().(CommitTimings)
+	return timings, ok
+}
+
+// finishCommitTimings completes the timings of a successful commit, flags it if it exceeded the
+// deadline, and publishes it.
+func (tree *MutableTree) finishCommitTimings(timings *CommitTimings, start time.Time) {
+	timings.Total = time.Since(start)
+	if deadline := tree.ndb.opts.CommitDeadline; deadline > 0 && timings.Total > deadline {
+		timings.DeadlineExceeded = true
+		logger.Debug("SaveVersion %d took %v, exceeding the deadline of %v: %+v\n",
+			timings.Version, timings.Total, deadline, *timings)
+	}
+	tree.lastCommitTimings.Store(*timings)
+	if tree.ndb.opts.OnCommitTimings != nil {
+		tree.ndb.opts.OnCommitTimings(*timings)
+	}
+}
+
+// since adds the time elapsed since start to d, and returns the current time.
+func since(d *time.Duration, start time.Time) time.Time {
+	now := time.Now()
+	*d += now.Sub(start)
+	return now
+}
@@ -0,0 +1,177 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// Revisions of the on-disk format. A database records the oldest revision able to read it, which
+// is raised when data that older readers would misinterpret is written.
+const (
+	// formatRevisionBase is the node key format, readable by all releases using it.
+	formatRevisionBase = 1
+	// formatRevisionGaps adds the version gaps left by SaveVersionAt. Older readers would treat
+	// skipped versions as existing, and fail to load or prune them.
+	formatRevisionGaps = 2
+	// formatRevisionHashKeys adds databases with hashed keys, see Options.HashKeys. Older readers
+	// would look up the keys unhashed, and silently miss all of them.
+	formatRevisionHashKeys = 3
+
+	// formatRevision is the newest revision this library can read.
+	formatRevision = formatRevisionHashKeys
+
+	// minReaderVersionKey is the metadata key of the oldest revision able to read the database,
+	// stored as a decimal number. Databases without it have formatRevisionBase.
+	minReaderVersionKey = "min_reader_version"
+	// minReaderReleaseKey is the metadata key of the first library release able to read the
+	// database, see formatRevisionReleases, so that older releases can name it.
+	minReaderReleaseKey = "min_reader_release"
+	// hashKeysKey is the metadata key recording that the database was written with
+	// Options.HashKeys. Databases without it have unhashed keys.
+	hashKeysKey = "hash_keys"
+)
+
+// formatRevisionReleases maps each format revision to the first library release able to read it.
+// The revisions up to formatRevisionHashKeys ship with v1.0.0, which introduced the node key
+// format. A revision added after a release must map to the release it ships with.
+var formatRevisionReleases = map[int]string{
+	formatRevisionBase:     "v1.0.0",
+	formatRevisionGaps:     "v1.0.0",
+	formatRevisionHashKeys: "v1.0.0",
+}
+
+// ErrIncompatibleFormat is matched by IncompatibleFormatError with errors.Is.
+var ErrIncompatibleFormat = errors.New("database format is newer than supported")
+
+// ErrHashKeysMismatch is returned when opening a database with a different Options.HashKeys
+// setting than it was written with, which would make every lookup miss.
+var ErrHashKeysMismatch = errors.New("Options.HashKeys does not match the database")
+
+// IncompatibleFormatError is returned when opening a database written in a format newer than this
+// library can read, e.g. after downgrading the library.
+type IncompatibleFormatError struct {
+	// MinReaderRevision is the oldest format revision able to read the database.
+	MinReaderRevision int
+	// SupportedRevision is the newest format revision this library can read.
+	SupportedRevision int
+	// RequiredRelease is the first library release able to read the database, as recorded by the
+	// release which wrote it, or empty if it was not recorded.
+	RequiredRelease string
+}
+
+func (e *IncompatibleFormatError) Error() string {
+	required := "a newer iavl release"
+	if e.RequiredRelease != "" {
+		required = "iavl >= " + e.RequiredRelease
+	}
+	return fmt.Sprintf("database format revision %d is newer than this library supports, which reads up to revision %d: requires %s",
+		e.MinReaderRevision, e.SupportedRevision, required)
+}
+
+// Is makes IncompatibleFormatError match ErrIncompatibleFormat.
+func (e *IncompatibleFormatError) Is(target error) bool {
+	return target == ErrIncompatibleFormat
+}
+
+// CheckCompatibility checks that this library can read the database, without modifying it. It
+// returns an *IncompatibleFormatError if the database was written in a newer format. Opening a
+// tree with NewMutableTree performs the same check, so tools can call this before touching a
+// database in any other way.
+func CheckCompatibility(db dbm.DB) error {
+	revision, err := getMinReaderVersion(db)
+	if err != nil {
+		return err
+	}
+	if revision > formatRevision {
+		release, err := db.Get(metadataKeyFormat.Key(ibytes.UnsafeStrToBytes(minReaderReleaseKey)))
+		if err != nil {
+			return err
+		}
+		return &IncompatibleFormatError{
+			MinReaderRevision: revision,
+			SupportedRevision: formatRevision,
+			RequiredRelease:   string(release),
+		}
+	}
+	return nil
+}
+
+// getMinReaderVersion returns the oldest format revision able to read the database.
+func getMinReaderVersion(db dbm.DB) (int, error) {
+	value, err := db.Get(metadataKeyFormat.Key(ibytes.UnsafeStrToBytes(minReaderVersionKey)))
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return formatRevisionBase, nil
+	}
+	revision, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid minimum reader version %q", value)
+	}
+	return revision, nil
+}
+
+// raiseMinReaderVersionToBatch records that the database can only be read by libraries
+// supporting the given format revision, and the first release doing so, unless it already
+// requires a newer one.
+func (ndb *nodeDB) raiseMinReaderVersionToBatch(batch dbm.Batch, revision int) error {
+	current, err := getMinReaderVersion(ndb.db)
+	if err != nil {
+		return err
+	}
+	if current >= revision {
+		return nil
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(minReaderVersionKey)), []byte(strconv.Itoa(revision))); err != nil {
+		return err
+	}
+	return batch.Set(metadataKeyFormat.Key([]byte(minReaderReleaseKey)), []byte(formatRevisionReleases[revision]))
+}
+
+// checkHashKeys returns an error wrapping ErrHashKeysMismatch if the database was written with a
+// different Options.HashKeys setting, and whether the database records that its keys are hashed.
+// An empty database matches either setting.
+func checkHashKeys(db dbm.DB, hashKeys bool) (bool, error) {
+	value, err := db.Get(metadataKeyFormat.Key(ibytes.UnsafeStrToBytes(hashKeysKey)))
+	if err != nil {
+		return false, err
+	}
+	recorded := value != nil
+	switch {
+	case recorded && !hashKeys:
+		return recorded, fmt.Errorf("%w: the database has hashed keys", ErrHashKeysMismatch)
+	case !recorded && hashKeys:
+		itr, err := dbm.IteratePrefix(db, nodeKeyFormat.Key())
+		if err != nil {
+			return recorded, err
+		}
+		defer itr.Close()
+		if itr.Valid() {
+			return recorded, fmt.Errorf("%w: the database has unhashed keys", ErrHashKeysMismatch)
+		}
+		return recorded, itr.Error()
+	}
+	return recorded, nil
+}
+
+// setHashKeysToBatch records that the database has hashed keys the first time a version is
+// written with Options.HashKeys, see checkHashKeys.
+func (ndb *nodeDB) setHashKeysToBatch(batch dbm.Batch) error {
+	if !ndb.opts.HashKeys || ndb.hashKeysRecorded {
+		return nil
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(hashKeysKey)), []byte{1}); err != nil {
+		return err
+	}
+	if err := ndb.raiseMinReaderVersionToBatch(batch, formatRevisionHashKeys); err != nil {
+		return err
+	}
+	ndb.hashKeysRecorded = true
+	return nil
+}
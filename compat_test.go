@@ -0,0 +1,120 @@
+package iavl
+
+import (
+	"errors"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCompatibility(t *testing.T) {
+	memDB := db.NewMemDB()
+	require.NoError(t, CheckCompatibility(memDB))
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	revision, err := getMinReaderVersion(memDB)
+	require.NoError(t, err)
+	require.Equal(t, formatRevisionBase, revision)
+
+	// version gaps require a newer reader.
+	_, _, err = tree.SaveVersionAt(5)
+	require.NoError(t, err)
+	revision, err = getMinReaderVersion(memDB)
+	require.NoError(t, err)
+	require.Equal(t, formatRevisionGaps, revision)
+	release, err := memDB.Get(metadataKeyFormat.Key([]byte(minReaderReleaseKey)))
+	require.NoError(t, err)
+	require.Equal(t, formatRevisionReleases[formatRevisionGaps], string(release))
+	require.NoError(t, CheckCompatibility(memDB))
+	_, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+
+	// a database written by a future release can't be opened, and the error names that release.
+	key := metadataKeyFormat.Key([]byte(minReaderVersionKey))
+	require.NoError(t, memDB.Set(key, []byte("99")))
+	require.NoError(t, memDB.Set(metadataKeyFormat.Key([]byte(minReaderReleaseKey)), []byte("v1.9.0")))
+	err = CheckCompatibility(memDB)
+	require.ErrorIs(t, err, ErrIncompatibleFormat)
+	var formatErr *IncompatibleFormatError
+	require.True(t, errors.As(err, &formatErr))
+	require.Equal(t, IncompatibleFormatError{
+		MinReaderRevision: 99,
+		SupportedRevision: formatRevision,
+		RequiredRelease:   "v1.9.0",
+	}, *formatErr)
+	require.EqualError(t, err, "database format revision 99 is newer than this library supports, which reads up to revision 3: requires iavl >= v1.9.0")
+	_, err = NewMutableTree(memDB, 0, false)
+	require.ErrorIs(t, err, ErrIncompatibleFormat)
+
+	// without a recorded release, the error still says that a newer release is needed.
+	require.NoError(t, memDB.Delete(metadataKeyFormat.Key([]byte(minReaderReleaseKey))))
+	require.EqualError(t, CheckCompatibility(memDB), "database format revision 99 is newer than this library supports, which reads up to revision 3: requires a newer iavl release")
+
+	require.NoError(t, memDB.Set(key, []byte("garbage")))
+	require.Error(t, CheckCompatibility(memDB))
+}
+
+func TestCheckHashKeys(t *testing.T) {
+	// an empty database can be opened with either setting.
+	memDB := db.NewMemDB()
+	_, err := NewMutableTreeWithOpts(memDB, 0, &Options{HashKeys: true}, false)
+	require.NoError(t, err)
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = NewMutableTreeWithOpts(memDB, 0, &Options{HashKeys: true}, false)
+	require.ErrorIs(t, err, ErrHashKeysMismatch)
+
+	memDB = db.NewMemDB()
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{HashKeys: true}, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	revision, err := getMinReaderVersion(memDB)
+	require.NoError(t, err)
+	require.Equal(t, formatRevisionHashKeys, revision)
+	_, err = NewMutableTree(memDB, 0, false)
+	require.ErrorIs(t, err, ErrHashKeysMismatch)
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{HashKeys: true}, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	value, err := tree.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// imported trees record the setting as well.
+	exported, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	exporter, err := exported.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	importDB := db.NewMemDB()
+	imported, err := NewMutableTreeWithOpts(importDB, 0, &Options{HashKeys: true}, false)
+	require.NoError(t, err)
+	importer, err := imported.Import(1)
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	_, err = NewMutableTree(importDB, 0, false)
+	require.ErrorIs(t, err, ErrHashKeysMismatch)
+}
@@ -0,0 +1,98 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/cosmos/iavl/keyformat"
+)
+
+// DiskUsage is an estimate of the disk space used by a range of versions, see
+// MutableTree.DiskUsage. Sizes are the raw sizes of the keys and values of the records, before
+// any compression and overhead of the database backend.
+type DiskUsage struct {
+	From  int64
+	To    int64
+	Nodes int64 // The number of node records written by the versions, including root references.
+	// NodeBytes is the size of the node records.
+	NodeBytes int64
+	// MetadataBytes is the size of the per-version records, e.g. commit timestamps and statistics.
+	MetadataBytes int64
+	// Versions is the breakdown by version, in ascending order, of the versions with records.
+	Versions []VersionDiskUsage
+}
+
+// VersionDiskUsage is the disk usage of a single version.
+type VersionDiskUsage struct {
+	Version       int64
+	Nodes         int64
+	NodeBytes     int64
+	MetadataBytes int64
+}
+
+// TotalBytes returns the size of all records of the versions.
+func (u DiskUsage) TotalBytes() int64 {
+	return u.NodeBytes + u.MetadataBytes
+}
+
+// DiskUsage estimates the disk space used by the records written by the versions from from to to,
+// inclusive, by scanning their key ranges. Nodes written by a version may still be part of later
+// versions, so the usage of the versions up to a version is an upper bound of the space that
+// DeleteVersionsTo reclaims. It is safe to call concurrently with SaveVersion.
+func (tree *MutableTree) DiskUsage(from, to int64) (DiskUsage, error) {
+	if from <= 0 || from > to {
+		return DiskUsage{}, fmt.Errorf("invalid version range %d to %d", from, to)
+	}
+	usage := DiskUsage{From: from, To: to}
+	byVersion := make(map[int64]*VersionDiskUsage)
+	versionUsage := func(key []byte) *VersionDiskUsage {
+		version := int64(binary.BigEndian.Uint64(key[1 : 1+int64Size]))
+		u, ok := byVersion[version]
+		if !ok {
+			u = &VersionDiskUsage{Version: version}
+			byVersion[version] = u
+		}
+		return u
+	}
+
+	// the end key is exclusive, up to the end of the prefix if to is the maximum version.
+	endKey := func(format *keyformat.KeyFormat) []byte {
+		if to == math.MaxInt64 {
+			return []byte{format.Prefix()[0] + 1}
+		}
+		return format.Key(to + 1)
+	}
+
+	err := tree.ndb.traverseRange(nodeKeyFormat.Key(from), endKey(nodeKeyFormat), func(k, v []byte) error {
+		size := int64(len(k) + len(v))
+		u := versionUsage(k)
+		u.Nodes++
+		u.NodeBytes += size
+		usage.Nodes++
+		usage.NodeBytes += size
+		return nil
+	})
+	if err != nil {
+		return DiskUsage{}, err
+	}
+	for _, format := range []*keyformat.KeyFormat{timestampKeyFormat, gapKeyFormat, statsKeyFormat} {
+		err := tree.ndb.traverseRange(format.Key(from), endKey(format), func(k, v []byte) error {
+			size := int64(len(k) + len(v))
+			versionUsage(k).MetadataBytes += size
+			usage.MetadataBytes += size
+			return nil
+		})
+		if err != nil {
+			return DiskUsage{}, err
+		}
+	}
+
+	usage.Versions = make([]VersionDiskUsage, 0, len(byVersion))
+	for version := range byVersion {
+		usage.Versions = append(usage.Versions, *byVersion[version])
+	}
+	sort.Slice(usage.Versions, func(i, j int) bool { return usage.Versions[i].Version < usage.Versions[j].Version })
+	return usage, nil
+}
@@ -0,0 +1,74 @@
+package iavl
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/cosmos/cosmos-db"
+)
+
+// nodeRecordBytes returns the number and size of all node records in the database.
+func nodeRecordBytes(t *testing.T, memDB db.DB) (int64, int64) {
+	var nodes, size int64
+	iter, err := memDB.Iterator(nodeKeyFormat.Key(), []byte{nodeKeyFormat.Prefix()[0] + 1})
+	require.NoError(t, err)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		nodes++
+		size += int64(len(iter.Key()) + len(iter.Value()))
+	}
+	return nodes, size
+}
+
+func TestMutableTree_DiskUsage(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{RecordVersionStats: true, RecordVersionTimestamps: true}, false)
+	require.NoError(t, err)
+	for version := 1; version <= 10; version++ {
+		for i := 0; i < 10*version; i++ {
+			_, err = tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", version)))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	nodes, size := nodeRecordBytes(t, memDB)
+	usage, err := tree.DiskUsage(1, math.MaxInt64)
+	require.NoError(t, err)
+	require.Equal(t, nodes, usage.Nodes)
+	require.Equal(t, size, usage.NodeBytes)
+	require.Positive(t, usage.MetadataBytes)
+	require.Equal(t, usage.NodeBytes+usage.MetadataBytes, usage.TotalBytes())
+	require.Len(t, usage.Versions, 10)
+
+	// the breakdown adds up to the totals.
+	var sum VersionDiskUsage
+	for i, v := range usage.Versions {
+		require.EqualValues(t, i+1, v.Version)
+		sum.Nodes += v.Nodes
+		sum.NodeBytes += v.NodeBytes
+		sum.MetadataBytes += v.MetadataBytes
+	}
+	require.Equal(t, usage.Nodes, sum.Nodes)
+	require.Equal(t, usage.NodeBytes, sum.NodeBytes)
+	require.Equal(t, usage.MetadataBytes, sum.MetadataBytes)
+
+	partial, err := tree.DiskUsage(3, 5)
+	require.NoError(t, err)
+	require.Equal(t, usage.Versions[2:5], partial.Versions)
+
+	// the usage of the pruned versions bounds the reclaimed space.
+	pruned, err := tree.DiskUsage(1, 6)
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsTo(6))
+	_, after := nodeRecordBytes(t, memDB)
+	require.Positive(t, size-after)
+	require.LessOrEqual(t, size-after, pruned.NodeBytes)
+
+	_, err = tree.DiskUsage(5, 4)
+	require.Error(t, err)
+}
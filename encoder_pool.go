@@ -0,0 +1,77 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity above which buffers are not returned to an EncoderPool, so
+// that a few large values do not keep memory alive in the pool.
+const maxPooledBufferSize = 64 * 1024
+
+// EncoderPool pools the buffers and SHA256 hashers used to encode and hash nodes. It is used for
+// all node hashing in the package, see DefaultEncoderPool, and can be shared by integrations
+// producing many hashes, e.g. of snapshots or proofs, to reuse buffers instead of allocating them
+// per node. It is safe for concurrent use.
+type EncoderPool struct {
+	buffers sync.Pool
+	hashers sync.Pool
+}
+
+// DefaultEncoderPool is the EncoderPool used by the package.
+var DefaultEncoderPool = NewEncoderPool()
+
+// NewEncoderPool creates a new, empty EncoderPool.
+func NewEncoderPool() *EncoderPool {
+	return &EncoderPool{
+		buffers: sync.Pool{New: func() interface{} { return new(bytes.Buffer) }},
+		hashers: sync.Pool{New: func() interface{} { return sha256.New() }},
+	}
+}
+
+// GetBuffer returns an empty buffer from the pool. It must be returned with PutBuffer once its
+// contents are no longer referenced.
+func (p *EncoderPool) GetBuffer() *bytes.Buffer {
+	buf := p.buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// PutBuffer returns a buffer to the pool. Large buffers are dropped.
+func (p *EncoderPool) PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	p.buffers.Put(buf)
+}
+
+// GetHasher returns a reset SHA256 hasher from the pool. It must be returned with PutHasher.
+func (p *EncoderPool) GetHasher() hash.Hash {
+	h := p.hashers.Get().(hash.Hash)
+	h.Reset()
+	return h
+}
+
+// PutHasher returns a hasher obtained from GetHasher to the pool.
+func (p *EncoderPool) PutHasher(h hash.Hash) {
+	p.hashers.Put(h)
+}
+
+// Sum256 returns the SHA256 hash of the bytes written by encode, using a pooled buffer and hasher.
+// The bytes are buffered, so that the hasher receives them in a single write.
+func (p *EncoderPool) Sum256(encode func(w io.Writer) error) ([]byte, error) {
+	buf := p.GetBuffer()
+	defer p.PutBuffer(buf)
+	if err := encode(buf); err != nil {
+		return nil, err
+	}
+	h := p.GetHasher()
+	defer p.PutHasher(h)
+	if _, err := h.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return h.Sum(make([]byte, 0, sha256.Size)), nil
+}
@@ -0,0 +1,52 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoderPool(t *testing.T) {
+	pool := NewEncoderPool()
+
+	hash, err := pool.Sum256(func(w io.Writer) error {
+		_, err := w.Write([]byte("hello"))
+		return err
+	})
+	require.NoError(t, err)
+	expected := sha256.Sum256([]byte("hello"))
+	require.Equal(t, expected[:], hash)
+
+	// pooled buffers and hashers are returned reset.
+	buf := pool.GetBuffer()
+	buf.WriteString("dirty")
+	pool.PutBuffer(buf)
+	require.Zero(t, pool.GetBuffer().Len())
+	h := pool.GetHasher()
+	h.Write([]byte("dirty"))
+	pool.PutHasher(h)
+	require.Equal(t, sha256.New().Sum(nil), pool.GetHasher().Sum(nil))
+
+	// large buffers are not retained.
+	large := bytes.NewBuffer(make([]byte, 0, 2*maxPooledBufferSize))
+	pool.PutBuffer(large)
+	require.NotSame(t, large, pool.GetBuffer())
+
+	_, err = pool.Sum256(func(w io.Writer) error { return io.ErrShortWrite })
+	require.ErrorIs(t, err, io.ErrShortWrite)
+}
+
+func TestEncoderPool_NodeHash(t *testing.T) {
+	node := NewNode([]byte("key"), []byte("value"))
+	node.nodeKey = &NodeKey{version: 1, nonce: 1}
+	hash, err := node._hash(1)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, node.writeHashBytes(&buf, 1))
+	expected := sha256.Sum256(buf.Bytes())
+	require.Equal(t, expected[:], hash)
+}
@@ -34,6 +34,7 @@ type Exporter struct {
 	tree   *ImmutableTree
 	ch     chan *ExportNode
 	cancel context.CancelFunc
+	err    error // The traversal error, if any, set before ch is closed.
 }
 
 // NewExporter creates a new Exporter. Callers must call Close() when done.
@@ -61,7 +62,7 @@ func newExporter(tree *ImmutableTree) (*Exporter, error) {
 
 // export exports nodes
 func (e *Exporter) export(ctx context.Context) {
-	e.tree.root.traversePost(e.tree, true, func(node *Node) bool {
+	_, e.err = e.tree.root.traversePost(e.tree, true, func(node *Node) bool {
 		exportNode := &ExportNode{
 			Key:     node.key,
 			Value:   node.value,
@@ -84,6 +85,9 @@ func (e *Exporter) Next() (*ExportNode, error) {
 	if exportNode, ok := <-e.ch; ok {
 		return exportNode, nil
 	}
+	if e.err != nil {
+		return nil, e.err
+	}
 	return nil, ErrorExportDone
 }
 
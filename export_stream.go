@@ -0,0 +1,640 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// ExportCodec identifies the compression codec of an export stream.
+type ExportCodec byte
+
+const (
+	// ExportCodecNone writes the node encodings uncompressed.
+	ExportCodecNone ExportCodec = 0
+	// ExportCodecZstd compresses the node encodings with zstd, optionally with a dictionary
+	// trained over the first nodes of the export.
+	ExportCodecZstd ExportCodec = 1
+)
+
+// exportStreamMagic prefixes every export stream from ExportFormatV2 on, followed by the stream
+// format version. A headerless ExportFormatV1 stream never starts with it, since its first byte
+// would decode to a negative node height.
+var exportStreamMagic = []byte("IAVLEXP")
+
+const (
+	// ExportFormatV1 is a headerless format: the plain Exporter node stream, i.e. the encodings
+	// of the exported nodes in order, ending at EOF. It was added along with ExportFormatV2, for
+	// peers which exchange the node stream without framing. It has no header, so it is never
+	// compressed and does not record the tree version, and it has no end marker, so a stream
+	// truncated between two nodes is not detected.
+	ExportFormatV1 uint8 = 1
+	// ExportFormatV2 starts with a header recording the format version, the codec, any zstd
+	// dictionary and the version of the exported tree, and ends with an end marker followed by
+	// the number of nodes, which readers verify.
+	ExportFormatV2 uint8 = 2
+
+	// exportStreamFormat is the export stream format version written by default.
+	exportStreamFormat = ExportFormatV2
+)
+
+const (
+	// exportStreamDictID is the zstd dictionary ID of the trained dictionary. The dictionary itself
+	// is stored in the stream header, so the ID only has to be non-zero.
+	exportStreamDictID = 1
+	// exportStreamEnd is written in place of a node height to mark the end of the stream, so that
+	// truncated streams are detected.
+	exportStreamEnd = -1
+	// maxExportDictSize is the maximum size of a dictionary read from a stream header.
+	maxExportDictSize = 1 << 24
+	// maxExportNodeSize is the maximum total size of the key and value of a node read from a
+	// stream.
+	maxExportNodeSize = 1 << 26
+	// defaultExportDictSamples is the default number of nodes sampled for dictionary training.
+	defaultExportDictSamples = 1000
+	// defaultExportDictSize is the default maximum size of a trained dictionary.
+	defaultExportDictSize = 32 * 1024
+	// maxExportDictSampleBytes is the maximum total size of the nodes sampled for dictionary
+	// training, which bounds the memory used by training regardless of value sizes.
+	maxExportDictSampleBytes = 256 * 1024
+	// exportDictSegmentSize is the size of the segments a dictionary is assembled from.
+	exportDictSegmentSize = 16
+)
+
+var (
+	// ErrUnsupportedExportCodec is returned when an export stream uses a codec the reader does
+	// not accept, or when no common codec can be negotiated.
+	ErrUnsupportedExportCodec = errors.New("unsupported export codec")
+
+	// ErrInvalidExportStream is returned when an export stream is malformed or truncated.
+	ErrInvalidExportStream = errors.New("invalid export stream")
+
+	// ErrUnsupportedExportVersion is returned when an export stream uses a format version the
+	// reader does not support, or when no common format version can be negotiated.
+	ErrUnsupportedExportVersion = errors.New("unsupported export format version")
+)
+
+// SupportedExportVersions returns the export stream format versions this implementation can read
+// and write, most preferred first. ExportFormatV1 is only written uncompressed. Nodes exchanging
+// snapshots while a network is upgraded can negotiate a common version with
+// NegotiateExportVersion, and write it with ExportStreamOptions.FormatVersion.
+func SupportedExportVersions() []uint8 {
+	return []uint8{ExportFormatV2, ExportFormatV1}
+}
+
+// NegotiateExportVersion returns the first format version in preferred which is also in accepted,
+// e.g. the versions supported by the exporting and the importing side respectively.
+func NegotiateExportVersion(preferred, accepted []uint8) (uint8, error) {
+	for _, version := range preferred {
+		for _, other := range accepted {
+			if version == other {
+				return version, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: no common version in %v and %v", ErrUnsupportedExportVersion, preferred, accepted)
+}
+
+// isSupportedExportVersion returns whether the format version can be read and written.
+func isSupportedExportVersion(version uint8) bool {
+	_, err := NegotiateExportVersion([]uint8{version}, SupportedExportVersions())
+	return err == nil
+}
+
+// SupportedExportCodecs returns the codecs supported by this implementation, most preferred first.
+func SupportedExportCodecs() []ExportCodec {
+	return []ExportCodec{ExportCodecZstd, ExportCodecNone}
+}
+
+// String implements fmt.Stringer.
+func (c ExportCodec) String() string {
+	switch c {
+	case ExportCodecNone:
+		return "none"
+	case ExportCodecZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// NegotiateExportCodec returns the first codec in preferred which is also in accepted, e.g. the
+// codecs supported by the exporting and the importing side respectively.
+func NegotiateExportCodec(preferred, accepted []ExportCodec) (ExportCodec, error) {
+	for _, codec := range preferred {
+		for _, other := range accepted {
+			if codec == other {
+				return codec, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: no common codec in %v and %v", ErrUnsupportedExportCodec, preferred, accepted)
+}
+
+// ExportStreamOptions configures an ExportStreamWriter.
+type ExportStreamOptions struct {
+	// Codec is the compression codec of the stream.
+	Codec ExportCodec
+
+	// DictSamples is the number of nodes buffered to train a zstd dictionary before writing the
+	// stream header. The default is used if zero, and no dictionary is trained if negative.
+	DictSamples int
+
+	// DictSize is the maximum size of the trained zstd dictionary. The default is used if zero.
+	DictSize int
+
+	// FormatVersion is the stream format version to write, see SupportedExportVersions. The
+	// current version is used if zero. ExportFormatV1 requires ExportCodecNone.
+	FormatVersion uint8
+
+	// Version is the version of the exported tree, recorded in the header. WriteExportStream sets
+	// it from the exporter if zero.
+	Version int64
+}
+
+// DefaultExportStreamOptions returns zstd compression with dictionary training.
+func DefaultExportStreamOptions() ExportStreamOptions {
+	return ExportStreamOptions{
+		Codec:         ExportCodecZstd,
+		DictSamples:   defaultExportDictSamples,
+		DictSize:      defaultExportDictSize,
+		FormatVersion: exportStreamFormat,
+	}
+}
+
+// ExportStreamWriter serializes ExportNodes into a byte stream, e.g. for writing snapshots to
+// disk or sending them over the network. Unless it writes the headerless ExportFormatV1, the
+// stream starts with a header recording the format version, the codec and any dictionary, so
+// readers never have to be configured out of band. Users must call Close() to complete the stream.
+type ExportStreamWriter struct {
+	w           io.Writer
+	opts        ExportStreamOptions
+	samples     [][]byte
+	sampleBytes int
+	out         io.Writer
+	encoder     *zstd.Encoder
+	count       uint64
+	closed      bool
+}
+
+// NewExportStreamWriter creates a new ExportStreamWriter writing to w.
+func NewExportStreamWriter(w io.Writer, opts ExportStreamOptions) (*ExportStreamWriter, error) {
+	switch opts.Codec {
+	case ExportCodecNone, ExportCodecZstd:
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedExportCodec, opts.Codec)
+	}
+	if opts.FormatVersion == 0 {
+		opts.FormatVersion = exportStreamFormat
+	}
+	if !isSupportedExportVersion(opts.FormatVersion) {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedExportVersion, opts.FormatVersion)
+	}
+	if opts.FormatVersion == ExportFormatV1 && opts.Codec != ExportCodecNone {
+		return nil, fmt.Errorf("%w: %v in format version %d", ErrUnsupportedExportCodec, opts.Codec, opts.FormatVersion)
+	}
+	if opts.DictSamples == 0 {
+		opts.DictSamples = defaultExportDictSamples
+	}
+	if opts.DictSize <= 0 {
+		opts.DictSize = defaultExportDictSize
+	}
+	return &ExportStreamWriter{w: w, opts: opts}, nil
+}
+
+// Add writes an ExportNode to the stream. Nodes used for dictionary training are buffered until
+// enough samples have been collected, or the samples reach maxExportDictSampleBytes.
+func (sw *ExportStreamWriter) Add(node *ExportNode) error {
+	if sw.closed {
+		return errors.New("export stream is closed")
+	}
+	if node == nil {
+		return errors.New("node cannot be nil")
+	}
+	var buf bytes.Buffer
+	if err := encodeExportNode(&buf, node); err != nil {
+		return err
+	}
+	sw.count++
+
+	if sw.out == nil {
+		if sw.opts.Codec == ExportCodecZstd && len(sw.samples) < sw.opts.DictSamples &&
+			sw.sampleBytes < maxExportDictSampleBytes {
+			sw.samples = append(sw.samples, buf.Bytes())
+			sw.sampleBytes += buf.Len()
+			return nil
+		}
+		if err := sw.start(); err != nil {
+			return err
+		}
+	}
+	_, err := sw.out.Write(buf.Bytes())
+	return err
+}
+
+// Close writes the end of the stream and flushes it. It does not close the underlying writer.
+func (sw *ExportStreamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	if sw.out == nil {
+		if err := sw.start(); err != nil {
+			return err
+		}
+	}
+	sw.closed = true
+	if sw.opts.FormatVersion == ExportFormatV1 {
+		return nil
+	}
+	if err := encoding.EncodeVarint(sw.out, exportStreamEnd); err != nil {
+		return err
+	}
+	if err := encoding.EncodeUvarint(sw.out, sw.count); err != nil {
+		return err
+	}
+	if sw.encoder != nil {
+		return sw.encoder.Close()
+	}
+	return nil
+}
+
+// start trains the dictionary if enabled, writes the stream header and any buffered samples.
+func (sw *ExportStreamWriter) start() error {
+	if sw.opts.FormatVersion == ExportFormatV1 {
+		sw.out = sw.w
+		return nil
+	}
+	var dict []byte
+	if sw.opts.Codec == ExportCodecZstd && sw.opts.DictSamples > 0 {
+		dict = trainExportDict(sw.samples, sw.opts.DictSize)
+	}
+	header := exportStreamHeader{
+		format:  sw.opts.FormatVersion,
+		codec:   sw.opts.Codec,
+		version: sw.opts.Version,
+		dict:    dict,
+	}
+	if err := writeExportStreamHeader(sw.w, header); err != nil {
+		return err
+	}
+
+	switch sw.opts.Codec {
+	case ExportCodecZstd:
+		zopts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if len(dict) > 0 {
+			zopts = append(zopts, zstd.WithEncoderDictRaw(exportStreamDictID, dict))
+		}
+		encoder, err := zstd.NewWriter(sw.w, zopts...)
+		if err != nil {
+			return err
+		}
+		sw.encoder = encoder
+		sw.out = encoder
+	default:
+		sw.out = sw.w
+	}
+
+	for _, sample := range sw.samples {
+		if _, err := sw.out.Write(sample); err != nil {
+			return err
+		}
+	}
+	sw.samples = nil
+	return nil
+}
+
+// ExportStreamReader reads ExportNodes from a stream written by ExportStreamWriter, in any of the
+// SupportedExportVersions. Users must call Close() when done.
+type ExportStreamReader struct {
+	header  exportStreamHeader
+	in      *bufio.Reader
+	decoder *zstd.Decoder
+	count   uint64
+	done    bool
+}
+
+// NewExportStreamReader reads the stream header from r and sets up decompression. A stream
+// without the header is read as the headerless ExportFormatV1. The stream codec must be one of
+// accepted, or any supported codec if none are given, otherwise ErrUnsupportedExportCodec is
+// returned.
+func NewExportStreamReader(r io.Reader, accepted ...ExportCodec) (*ExportStreamReader, error) {
+	if len(accepted) == 0 {
+		accepted = SupportedExportCodecs()
+	}
+	br := bufio.NewReader(r)
+	header := exportStreamHeader{format: ExportFormatV1, codec: ExportCodecNone}
+	if prefix, _ := br.Peek(len(exportStreamMagic)); bytes.Equal(prefix, exportStreamMagic) {
+		var err error
+		if header, err = readExportStreamHeader(br); err != nil {
+			return nil, err
+		}
+	}
+	codec := header.codec
+	if _, err := NegotiateExportCodec([]ExportCodec{codec}, accepted); err != nil {
+		return nil, err
+	}
+
+	sr := &ExportStreamReader{header: header, in: br}
+	switch codec {
+	case ExportCodecNone:
+	case ExportCodecZstd:
+		zopts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if len(header.dict) > 0 {
+			zopts = append(zopts, zstd.WithDecoderDictRaw(exportStreamDictID, header.dict))
+		}
+		decoder, err := zstd.NewReader(br, zopts...)
+		if err != nil {
+			return nil, err
+		}
+		sr.decoder = decoder
+		sr.in = bufio.NewReader(decoder)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedExportCodec, codec)
+	}
+	return sr, nil
+}
+
+// Codec returns the codec of the stream.
+func (sr *ExportStreamReader) Codec() ExportCodec {
+	return sr.header.codec
+}
+
+// FormatVersion returns the format version of the stream.
+func (sr *ExportStreamReader) FormatVersion() uint8 {
+	return sr.header.format
+}
+
+// Version returns the version of the exported tree, or 0 if the stream format does not record it.
+func (sr *ExportStreamReader) Version() int64 {
+	return sr.header.version
+}
+
+// Next reads the next ExportNode, or returns ErrorExportDone at the end of the stream.
+func (sr *ExportStreamReader) Next() (*ExportNode, error) {
+	if sr.done {
+		return nil, ErrorExportDone
+	}
+	if sr.header.format == ExportFormatV1 {
+		if _, err := sr.in.Peek(1); errors.Is(err, io.EOF) {
+			sr.done = true
+			return nil, ErrorExportDone
+		}
+	}
+	node, err := decodeExportNode(sr.in)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		if sr.header.format == ExportFormatV1 {
+			return nil, fmt.Errorf("%w: end marker in format version %d", ErrInvalidExportStream, sr.header.format)
+		}
+		if err := sr.readTrailer(); err != nil {
+			return nil, err
+		}
+		sr.done = true
+		return nil, ErrorExportDone
+	}
+	sr.count++
+	return node, nil
+}
+
+// readTrailer reads and verifies the node count following the end marker.
+func (sr *ExportStreamReader) readTrailer() error {
+	count, err := binary.ReadUvarint(sr.in)
+	if err != nil {
+		return fmt.Errorf("%w: failed to read node count: %v", ErrInvalidExportStream, err)
+	}
+	if count != sr.count {
+		return fmt.Errorf("%w: read %d nodes, but the stream has %d", ErrInvalidExportStream, sr.count, count)
+	}
+	return nil
+}
+
+// Close frees the resources of the reader. It is safe to call multiple times.
+func (sr *ExportStreamReader) Close() {
+	if sr.decoder != nil {
+		sr.decoder.Close()
+		sr.decoder = nil
+	}
+}
+
+// WriteExportStream writes all nodes of the exporter to w as an export stream.
+func WriteExportStream(exporter *Exporter, w io.Writer, opts ExportStreamOptions) error {
+	if opts.Version == 0 && exporter.tree != nil {
+		opts.Version = exporter.tree.version
+	}
+	sw, err := NewExportStreamWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := sw.Add(node); err != nil {
+			return err
+		}
+	}
+	return sw.Close()
+}
+
+// ReadExportStream adds all nodes of the export stream in r to the importer. The caller must
+// still call Commit() on the importer.
+func ReadExportStream(r io.Reader, importer *Importer, accepted ...ExportCodec) error {
+	sr, err := NewExportStreamReader(r, accepted...)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	for {
+		node, err := sr.Next()
+		if errors.Is(err, ErrorExportDone) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := importer.Add(node); err != nil {
+			return err
+		}
+	}
+}
+
+// exportStreamHeader is the header of an export stream.
+type exportStreamHeader struct {
+	format  uint8
+	codec   ExportCodec
+	version int64
+	dict    []byte
+}
+
+// writeExportStreamHeader writes the magic, format version, codec, tree version and dictionary.
+func writeExportStreamHeader(w io.Writer, header exportStreamHeader) error {
+	var buf bytes.Buffer
+	buf.Write(exportStreamMagic)
+	buf.WriteByte(header.format)
+	buf.WriteByte(byte(header.codec))
+	if err := encoding.EncodeVarint(&buf, header.version); err != nil {
+		return err
+	}
+	if err := encoding.EncodeBytes(&buf, header.dict); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readExportStreamHeader reads the header written by writeExportStreamHeader.
+func readExportStreamHeader(r *bufio.Reader) (exportStreamHeader, error) {
+	var header exportStreamHeader
+	prefix := make([]byte, len(exportStreamMagic)+2)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return header, fmt.Errorf("%w: failed to read header: %v", ErrInvalidExportStream, err)
+	}
+	if !bytes.Equal(prefix[:len(exportStreamMagic)], exportStreamMagic) {
+		return header, fmt.Errorf("%w: bad magic %X", ErrInvalidExportStream, prefix[:len(exportStreamMagic)])
+	}
+	header.format = prefix[len(exportStreamMagic)]
+	if header.format < ExportFormatV2 || !isSupportedExportVersion(header.format) {
+		return header, fmt.Errorf("%w: %d", ErrUnsupportedExportVersion, header.format)
+	}
+	header.codec = ExportCodec(prefix[len(exportStreamMagic)+1])
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return header, fmt.Errorf("%w: failed to read version: %v", ErrInvalidExportStream, err)
+	}
+	header.version = version
+	dict, err := readExportStreamBytes(r, maxExportDictSize)
+	if err != nil {
+		return header, err
+	}
+	header.dict = dict
+	return header, nil
+}
+
+// encodeExportNode writes the height, version, key and, for leaf nodes, the value of the node.
+func encodeExportNode(w io.Writer, node *ExportNode) error {
+	if node.Height < 0 {
+		return fmt.Errorf("invalid node height %d", node.Height)
+	}
+	if err := encoding.EncodeVarint(w, int64(node.Height)); err != nil {
+		return err
+	}
+	if err := encoding.EncodeVarint(w, node.Version); err != nil {
+		return err
+	}
+	if err := encoding.EncodeBytes(w, node.Key); err != nil {
+		return err
+	}
+	if node.Height == 0 {
+		return encoding.EncodeBytes(w, node.Value)
+	}
+	return nil
+}
+
+// decodeExportNode reads a node written by encodeExportNode, or returns nil at the end marker.
+func decodeExportNode(r *bufio.Reader) (*ExportNode, error) {
+	height, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read node height: %v", ErrInvalidExportStream, err)
+	}
+	if height == exportStreamEnd {
+		return nil, nil
+	}
+	if height < 0 || height > 127 {
+		return nil, fmt.Errorf("%w: invalid node height %d", ErrInvalidExportStream, height)
+	}
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read node version: %v", ErrInvalidExportStream, err)
+	}
+	key, err := readExportStreamBytes(r, maxExportNodeSize)
+	if err != nil {
+		return nil, err
+	}
+	node := &ExportNode{Key: key, Version: version, Height: int8(height)}
+	if height == 0 {
+		if node.Value, err = readExportStreamBytes(r, maxExportNodeSize-uint64(len(key))); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// readExportStreamBytes reads a length-prefixed byte slice of at most maxSize bytes. The slice is
+// read with encoding.ReadSized, so memory only grows with the bytes actually present in the
+// stream. It never returns nil, since leaf values must be non-nil.
+func readExportStreamBytes(r *bufio.Reader, maxSize uint64) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read length: %v", ErrInvalidExportStream, err)
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("%w: length %d exceeds maximum %d", ErrInvalidExportStream, size, maxSize)
+	}
+	bz, err := encoding.ReadSized(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read %d bytes: %v", ErrInvalidExportStream, size, err)
+	}
+	return bz, nil
+}
+
+// trainExportDict builds a raw zstd dictionary of at most size bytes from the sampled node
+// encodings. The samples are cut into fixed-size segments, and the segments occurring in the most
+// samples are kept. At most maxExportDictSampleBytes of the samples are considered. Since zstd
+// matches recent history more cheaply, the most frequent segments are placed at the end of the
+// dictionary. Segments occurring in a single sample are useless for other nodes and are dropped,
+// so the dictionary may be empty.
+func trainExportDict(samples [][]byte, size int) []byte {
+	counts := make(map[string]int)
+	budget := maxExportDictSampleBytes
+	for _, sample := range samples {
+		if budget <= 0 {
+			break
+		}
+		if len(sample) > budget {
+			sample = sample[:budget]
+		}
+		budget -= len(sample)
+		seen := make(map[string]bool)
+		for i := 0; i+exportDictSegmentSize <= len(sample); i++ {
+			segment := string(sample[i : i+exportDictSegmentSize])
+			if !seen[segment] {
+				seen[segment] = true
+				counts[segment]++
+			}
+		}
+	}
+
+	segments := make([]string, 0, len(counts))
+	for segment, count := range counts {
+		if count > 1 {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if counts[segments[i]] != counts[segments[j]] {
+			return counts[segments[i]] > counts[segments[j]]
+		}
+		return segments[i] < segments[j]
+	})
+
+	if limit := size / exportDictSegmentSize; len(segments) > limit {
+		segments = segments[:limit]
+	}
+	dict := make([]byte, 0, len(segments)*exportDictSegmentSize)
+	for i := len(segments) - 1; i >= 0; i-- {
+		dict = append(dict, segments[i]...)
+	}
+	return dict
+}
@@ -0,0 +1,306 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+func TestExportStream_Import(t *testing.T) {
+	tree := setupExportTreeSized(t, 4096)
+	treeHash, err := tree.Hash()
+	require.NoError(t, err)
+
+	testcases := map[string]ExportStreamOptions{
+		"none":            {Codec: ExportCodecNone},
+		"zstd":            {Codec: ExportCodecZstd, DictSamples: -1},
+		"zstd with dict":  DefaultExportStreamOptions(),
+		"zstd small dict": {Codec: ExportCodecZstd, DictSamples: 10, DictSize: 64},
+	}
+	for desc, opts := range testcases {
+		opts := opts
+		t.Run(desc, func(t *testing.T) {
+			exporter, err := tree.Export()
+			require.NoError(t, err)
+			defer exporter.Close()
+
+			var buf bytes.Buffer
+			require.NoError(t, WriteExportStream(exporter, &buf, opts))
+
+			newTree, err := NewMutableTree(db.NewMemDB(), 0, false)
+			require.NoError(t, err)
+			importer, err := newTree.Import(tree.Version())
+			require.NoError(t, err)
+			defer importer.Close()
+
+			require.NoError(t, ReadExportStream(&buf, importer))
+			require.NoError(t, importer.Commit())
+
+			newTreeHash, err := newTree.Hash()
+			require.NoError(t, err)
+			require.Equal(t, treeHash, newTreeHash)
+		})
+	}
+}
+
+func TestExportStream_Compression(t *testing.T) {
+	tree := setupExportTreeSized(t, 4096)
+
+	sizes := make(map[string]int)
+	for desc, opts := range map[string]ExportStreamOptions{
+		"none":           {Codec: ExportCodecNone},
+		"zstd":           {Codec: ExportCodecZstd, DictSamples: -1},
+		"zstd with dict": DefaultExportStreamOptions(),
+	} {
+		exporter, err := tree.Export()
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, WriteExportStream(exporter, &buf, opts))
+		exporter.Close()
+		sizes[desc] = buf.Len()
+	}
+	require.Less(t, sizes["zstd"], sizes["none"])
+	require.Less(t, sizes["zstd with dict"], sizes["none"])
+}
+
+func TestExportStream_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	sw, err := NewExportStreamWriter(&buf, DefaultExportStreamOptions())
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+
+	sr, err := NewExportStreamReader(&buf)
+	require.NoError(t, err)
+	defer sr.Close()
+	require.Equal(t, ExportCodecZstd, sr.Codec())
+	_, err = sr.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+}
+
+func TestExportStream_Negotiation(t *testing.T) {
+	codec, err := NegotiateExportCodec(SupportedExportCodecs(), []ExportCodec{ExportCodecNone})
+	require.NoError(t, err)
+	require.Equal(t, ExportCodecNone, codec)
+
+	codec, err = NegotiateExportCodec(SupportedExportCodecs(), SupportedExportCodecs())
+	require.NoError(t, err)
+	require.Equal(t, ExportCodecZstd, codec)
+
+	_, err = NegotiateExportCodec([]ExportCodec{ExportCodecZstd}, []ExportCodec{ExportCodecNone})
+	require.ErrorIs(t, err, ErrUnsupportedExportCodec)
+
+	_, err = NewExportStreamWriter(&bytes.Buffer{}, ExportStreamOptions{Codec: 7})
+	require.ErrorIs(t, err, ErrUnsupportedExportCodec)
+
+	// a reader only accepting uncompressed streams rejects zstd streams from the header.
+	var buf bytes.Buffer
+	sw, err := NewExportStreamWriter(&buf, DefaultExportStreamOptions())
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+	_, err = NewExportStreamReader(&buf, ExportCodecNone)
+	require.ErrorIs(t, err, ErrUnsupportedExportCodec)
+}
+
+func TestExportStream_Invalid(t *testing.T) {
+	// a stream without the magic is read as a headerless stream, which fails on the first node.
+	sr, err := NewExportStreamReader(bytes.NewReader([]byte("not a stream")))
+	require.NoError(t, err)
+	_, err = sr.Next()
+	require.ErrorIs(t, err, ErrInvalidExportStream)
+	sr.Close()
+	_, err = NewExportStreamReader(bytes.NewReader(exportStreamMagic[:len(exportStreamMagic)-1]))
+	require.NoError(t, err)
+	_, err = NewExportStreamReader(bytes.NewReader(exportStreamMagic))
+	require.ErrorIs(t, err, ErrInvalidExportStream)
+
+	tree := setupExportTreeSized(t, 1024)
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	var buf bytes.Buffer
+	require.NoError(t, WriteExportStream(exporter, &buf, ExportStreamOptions{Codec: ExportCodecNone}))
+
+	// a truncated stream must not end cleanly.
+	sr, err = NewExportStreamReader(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	require.NoError(t, err)
+	defer sr.Close()
+	for {
+		_, err = sr.Next()
+		if err != nil {
+			break
+		}
+	}
+	require.True(t, errors.Is(err, ErrInvalidExportStream))
+
+	// a forged length is not allocated before the bytes arrive.
+	var forged bytes.Buffer
+	require.NoError(t, encoding.EncodeUvarint(&forged, maxExportNodeSize))
+	forged.WriteString("short")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = readExportStreamBytes(bufio.NewReader(&forged), maxExportNodeSize)
+	runtime.ReadMemStats(&after)
+	require.ErrorIs(t, err, ErrInvalidExportStream)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	forged.Reset()
+	require.NoError(t, encoding.EncodeUvarint(&forged, maxExportNodeSize+1))
+	_, err = readExportStreamBytes(bufio.NewReader(&forged), maxExportNodeSize)
+	require.ErrorIs(t, err, ErrInvalidExportStream)
+}
+
+func TestExportStream_LargeValues(t *testing.T) {
+	var buf bytes.Buffer
+	sw, err := NewExportStreamWriter(&buf, DefaultExportStreamOptions())
+	require.NoError(t, err)
+	values := make([][]byte, 0, 20)
+	for i := 0; i < 20; i++ {
+		value := bytes.Repeat([]byte{byte(i)}, 3*encoding.ReadChunkSize+i)
+		values = append(values, value)
+		require.NoError(t, sw.Add(&ExportNode{Key: []byte{byte(i)}, Value: value, Version: 1}))
+	}
+	require.NoError(t, sw.Close())
+	// the large values stop dictionary sampling early.
+	require.Less(t, sw.sampleBytes, maxExportDictSampleBytes+3*encoding.ReadChunkSize+20)
+
+	sr, err := NewExportStreamReader(&buf)
+	require.NoError(t, err)
+	defer sr.Close()
+	for _, value := range values {
+		node, err := sr.Next()
+		require.NoError(t, err)
+		require.Equal(t, value, node.Value)
+	}
+	_, err = sr.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+}
+
+func TestExportStream_FormatVersions(t *testing.T) {
+	tree := setupExportTreeSized(t, 1024)
+	treeHash, err := tree.Hash()
+	require.NoError(t, err)
+
+	for _, format := range SupportedExportVersions() {
+		exporter, err := tree.Export()
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, WriteExportStream(exporter, &buf, ExportStreamOptions{Codec: ExportCodecNone, FormatVersion: format}))
+		exporter.Close()
+
+		sr, err := NewExportStreamReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, format, sr.FormatVersion())
+		if format >= ExportFormatV2 {
+			require.Equal(t, tree.Version(), sr.Version())
+		} else {
+			require.Zero(t, sr.Version())
+		}
+		sr.Close()
+
+		newTree, err := NewMutableTree(db.NewMemDB(), 0, false)
+		require.NoError(t, err)
+		importer, err := newTree.Import(tree.Version())
+		require.NoError(t, err)
+		require.NoError(t, ReadExportStream(&buf, importer))
+		require.NoError(t, importer.Commit())
+		newTreeHash, err := newTree.Hash()
+		require.NoError(t, err)
+		require.Equal(t, treeHash, newTreeHash)
+	}
+
+	version, err := NegotiateExportVersion(SupportedExportVersions(), []uint8{ExportFormatV1})
+	require.NoError(t, err)
+	require.Equal(t, ExportFormatV1, version)
+	version, err = NegotiateExportVersion(SupportedExportVersions(), SupportedExportVersions())
+	require.NoError(t, err)
+	require.Equal(t, ExportFormatV2, version)
+	_, err = NegotiateExportVersion(SupportedExportVersions(), []uint8{9})
+	require.ErrorIs(t, err, ErrUnsupportedExportVersion)
+
+	_, err = NewExportStreamWriter(&bytes.Buffer{}, ExportStreamOptions{FormatVersion: 9})
+	require.ErrorIs(t, err, ErrUnsupportedExportVersion)
+	for _, format := range []uint8{ExportFormatV1, 9} {
+		stream := append(append([]byte{}, exportStreamMagic...), format, byte(ExportCodecNone), 0)
+		_, err = NewExportStreamReader(bytes.NewReader(stream))
+		require.ErrorIs(t, err, ErrUnsupportedExportVersion)
+	}
+}
+
+func TestExportStream_Headerless(t *testing.T) {
+	// the headerless format is the plain node stream, which is never compressed.
+	_, err := NewExportStreamWriter(&bytes.Buffer{}, ExportStreamOptions{Codec: ExportCodecZstd, FormatVersion: ExportFormatV1})
+	require.ErrorIs(t, err, ErrUnsupportedExportCodec)
+
+	nodes := []*ExportNode{
+		{Key: []byte("a"), Value: []byte("1"), Version: 1, Height: 0},
+		{Key: []byte("b"), Value: []byte("2"), Version: 2, Height: 0},
+		{Key: []byte("b"), Version: 2, Height: 1},
+	}
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		require.NoError(t, encodeExportNode(&buf, node))
+	}
+	sr, err := NewExportStreamReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, ExportFormatV1, sr.FormatVersion())
+	require.Equal(t, ExportCodecNone, sr.Codec())
+	for _, expect := range nodes {
+		node, err := sr.Next()
+		require.NoError(t, err)
+		require.Equal(t, expect, node)
+	}
+	_, err = sr.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+	sr.Close()
+
+	// a reader only accepting zstd streams rejects headerless streams.
+	_, err = NewExportStreamReader(bytes.NewReader(buf.Bytes()), ExportCodecZstd)
+	require.ErrorIs(t, err, ErrUnsupportedExportCodec)
+
+	// an empty tree exports an empty stream.
+	sr, err = NewExportStreamReader(bytes.NewReader(nil))
+	require.NoError(t, err)
+	_, err = sr.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+	sr.Close()
+
+	// the end marker is not part of the headerless format.
+	require.NoError(t, encoding.EncodeVarint(&buf, exportStreamEnd))
+	sr, err = NewExportStreamReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	defer sr.Close()
+	for range nodes {
+		_, err = sr.Next()
+		require.NoError(t, err)
+	}
+	_, err = sr.Next()
+	require.ErrorIs(t, err, ErrInvalidExportStream)
+}
+
+func TestExportStream_NodeCount(t *testing.T) {
+	var buf bytes.Buffer
+	sw, err := NewExportStreamWriter(&buf, ExportStreamOptions{Codec: ExportCodecNone})
+	require.NoError(t, err)
+	require.NoError(t, sw.Add(&ExportNode{Key: []byte("a"), Value: []byte("1"), Version: 1}))
+	require.NoError(t, sw.Close())
+
+	// corrupt the node count in the trailer.
+	stream := buf.Bytes()
+	require.Equal(t, byte(1), stream[len(stream)-1])
+	stream[len(stream)-1] = 2
+	sr, err := NewExportStreamReader(bytes.NewReader(stream))
+	require.NoError(t, err)
+	defer sr.Close()
+	_, err = sr.Next()
+	require.NoError(t, err)
+	_, err = sr.Next()
+	require.ErrorIs(t, err, ErrInvalidExportStream)
+}
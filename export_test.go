@@ -1,6 +1,7 @@
 package iavl
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"testing"
@@ -307,6 +308,96 @@ func TestExporter_DeleteVersionErrors(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestExporter_DeleteVersionDeferred(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{DeferPruning: true}, false)
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("a"), []byte{1})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("b"), []byte{2})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("c"), []byte{3})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	err = tree.DeleteVersionsTo(1)
+	require.NoError(t, err)
+
+	// pruning of the exported version is deferred.
+	err = tree.DeleteVersionsTo(2)
+	require.NoError(t, err)
+	require.True(t, tree.VersionExists(2))
+	require.EqualValues(t, 2, tree.DeferredPruneVersion())
+
+	exporter.Close()
+	err = tree.DeleteVersionsTo(2)
+	require.NoError(t, err)
+	require.False(t, tree.VersionExists(2))
+	require.EqualValues(t, 0, tree.DeferredPruneVersion())
+}
+
+func TestMutableTree_ExportCheckpoint(t *testing.T) {
+	tree := setupExportTreeSized(t, 4096)
+	mtree, err := NewMutableTreeWithOpts(tree.ndb.db, 0, &Options{DeferPruning: true}, false)
+	require.NoError(t, err)
+	version, err := mtree.Load()
+	require.NoError(t, err)
+	hash, err := mtree.Hash()
+	require.NoError(t, err)
+
+	exporter, err := mtree.ExportCheckpoint(version)
+	require.NoError(t, err)
+	defer exporter.Close()
+	_, err = mtree.ExportCheckpoint(version + 1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// keep committing and pruning while exporting.
+	imported, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	importer, err := imported.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	for i := 0; ; i++ {
+		node, err := exporter.Next()
+		if err == ErrorExportDone {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+		if i%100 == 0 {
+			_, err = mtree.Set([]byte(fmt.Sprintf("new%d", i)), []byte{1})
+			require.NoError(t, err)
+			_, latest, err := mtree.SaveVersion()
+			require.NoError(t, err)
+			require.NoError(t, mtree.DeleteVersionsTo(latest-1))
+		}
+	}
+	require.NoError(t, importer.Commit())
+	importedHash, err := imported.Hash()
+	require.NoError(t, err)
+	require.Equal(t, hash, importedHash)
+
+	require.True(t, mtree.VersionExists(version))
+	require.Equal(t, mtree.Version()-1, mtree.DeferredPruneVersion())
+	exporter.Close()
+	require.NoError(t, mtree.DeleteVersionsTo(mtree.Version()-1))
+	require.False(t, mtree.VersionExists(version))
+	require.Equal(t, []int{int(mtree.Version())}, mtree.AvailableVersions())
+}
+
 func BenchmarkExport(b *testing.B) {
 	b.StopTimer()
 	tree := setupExportTreeSized(b, 4096)
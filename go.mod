@@ -8,6 +8,7 @@ require (
 	github.com/emicklei/dot v1.3.1
 	github.com/golang/mock v1.6.0
 	github.com/golangci/golangci-lint v1.51.2
+	github.com/klauspost/compress v1.16.7
 	github.com/stretchr/testify v1.8.2
 	golang.org/x/crypto v0.7.0
 )
@@ -100,7 +101,6 @@ require (
 	github.com/kisielk/errcheck v1.6.3 // indirect
 	github.com/kisielk/gotool v1.0.0 // indirect
 	github.com/kkHAIKE/contextcheck v1.1.3 // indirect
-	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/kr/pretty v0.3.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/kulti/thelper v0.6.3 // indirect
@@ -0,0 +1,360 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/cosmos/cosmos-db"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden vectors in testdata/golden")
+
+const (
+	goldenNodesFile = "testdata/golden/nodes.json"
+	goldenTreesFile = "testdata/golden/trees.json"
+)
+
+// goldenNodes are the node vectors, see testdata/golden/README.md.
+type goldenNodes struct {
+	Encodings []goldenEncoding `json:"encodings"`
+	Hashes    []goldenHash     `json:"hashes"`
+}
+
+type goldenNodeKey struct {
+	Version int64 `json:"version"`
+	Nonce   int32 `json:"nonce"`
+}
+
+type goldenEncoding struct {
+	Name     string         `json:"name"`
+	Height   int8           `json:"height"`
+	Size     int64          `json:"size"`
+	Key      string         `json:"key"`
+	Value    string         `json:"value,omitempty"`
+	Hash     string         `json:"hash,omitempty"`
+	Left     *goldenNodeKey `json:"left,omitempty"`
+	Right    *goldenNodeKey `json:"right,omitempty"`
+	Encoding string         `json:"encoding"`
+}
+
+type goldenHash struct {
+	Name      string `json:"name"`
+	Height    int8   `json:"height"`
+	Size      int64  `json:"size"`
+	Version   int64  `json:"version"`
+	Key       string `json:"key,omitempty"`
+	Value     string `json:"value,omitempty"`
+	LeftHash  string `json:"left_hash,omitempty"`
+	RightHash string `json:"right_hash,omitempty"`
+	Hash      string `json:"hash"`
+}
+
+// goldenTree is a tree vector, see testdata/golden/README.md.
+type goldenTree struct {
+	Name           string          `json:"name"`
+	HashKeys       bool            `json:"hash_keys,omitempty"`
+	InitialVersion uint64          `json:"initial_version,omitempty"`
+	Versions       []goldenVersion `json:"versions"`
+}
+
+type goldenVersion struct {
+	Ops         []goldenOp `json:"ops"`
+	PruneTo     int64      `json:"prune_to,omitempty"`
+	Version     int64      `json:"version"`
+	RootHash    string     `json:"root_hash"`
+	Nodes       int64      `json:"nodes"`
+	NodesDigest string     `json:"nodes_digest"`
+}
+
+type goldenOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	bz, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return bz
+}
+
+// goldenFile compares the vectors with the file, or rewrites it with -update-golden.
+func goldenFile(t *testing.T, path string, vectors interface{}) {
+	bz, err := json.MarshalIndent(vectors, "", "  ")
+	require.NoError(t, err)
+	bz = append(bz, '\n')
+	if *updateGolden {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, bz, 0o644)) //nolint:gosec
+		return
+	}
+	expected, err := os.ReadFile(path)
+	require.NoError(t, err, "run the test with -update-golden to create it")
+	require.Equal(t, string(expected), string(bz), "the vectors changed, this breaks compatibility with other implementations")
+}
+
+func readGoldenFile(t *testing.T, path string, vectors interface{}) {
+	bz, err := os.ReadFile(path)
+	require.NoError(t, err, "run the test with -update-golden to create it")
+	require.NoError(t, json.Unmarshal(bz, vectors))
+}
+
+func TestGolden_Nodes(t *testing.T) {
+	var vectors goldenNodes
+	if *updateGolden {
+		vectors = generateGoldenNodes()
+	} else {
+		readGoldenFile(t, goldenNodesFile, &vectors)
+	}
+
+	for i, v := range vectors.Encodings {
+		node := &Node{subtreeHeight: v.Height, size: v.Size, key: mustHex(t, v.Key)}
+		if v.Height == 0 {
+			node.value = mustHex(t, v.Value)
+		} else {
+			node.hash = mustHex(t, v.Hash)
+		}
+		if v.Left != nil {
+			node.leftNodeKey = &NodeKey{version: v.Left.Version, nonce: v.Left.Nonce}
+		}
+		if v.Right != nil {
+			node.rightNodeKey = &NodeKey{version: v.Right.Version, nonce: v.Right.Nonce}
+		}
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf), v.Name)
+		vectors.Encodings[i].Encoding = hex.EncodeToString(buf.Bytes())
+
+		// the encoding decodes back to the node, and is canonical.
+		decoded, err := MakeNode(&NodeKey{version: 1, nonce: 1}, buf.Bytes())
+		require.NoError(t, err, v.Name)
+		require.NoError(t, checkCanonicalNode(decoded, buf.Bytes()), v.Name)
+	}
+
+	for i, v := range vectors.Hashes {
+		node := &Node{subtreeHeight: v.Height, size: v.Size, key: mustHex(t, v.Key), value: mustHex(t, v.Value)}
+		if v.Height > 0 {
+			node.value = nil
+			node.leftNode = &Node{hash: mustHex(t, v.LeftHash)}
+			node.rightNode = &Node{hash: mustHex(t, v.RightHash)}
+		}
+		hash, err := node._hash(v.Version)
+		require.NoError(t, err, v.Name)
+		vectors.Hashes[i].Hash = hex.EncodeToString(hash)
+	}
+
+	goldenFile(t, goldenNodesFile, vectors)
+}
+
+func TestGolden_Trees(t *testing.T) {
+	var vectors []goldenTree
+	if *updateGolden {
+		vectors = generateGoldenTrees()
+	} else {
+		readGoldenFile(t, goldenTreesFile, &vectors)
+	}
+
+	for i := range vectors {
+		replayGoldenTree(t, &vectors[i])
+	}
+
+	goldenFile(t, goldenTreesFile, vectors)
+}
+
+// replayGoldenTree applies the operations of the vector in strict determinism mode, and records the
+// resulting versions, root hashes and node records in it.
+func replayGoldenTree(t *testing.T, vector *goldenTree) {
+	memDB := db.NewMemDB()
+	opts := &Options{StrictDeterminism: true, HashKeys: vector.HashKeys, InitialVersion: vector.InitialVersion}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts, false)
+	require.NoError(t, err)
+
+	for i := range vector.Versions {
+		v := &vector.Versions[i]
+		for _, op := range v.Ops {
+			switch op.Op {
+			case "set":
+				_, err = tree.Set(mustHex(t, op.Key), mustHex(t, op.Value))
+			case "remove":
+				_, _, err = tree.Remove(mustHex(t, op.Key))
+			default:
+				err = fmt.Errorf("unknown operation %q", op.Op)
+			}
+			require.NoError(t, err, vector.Name)
+		}
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err, vector.Name)
+		if v.PruneTo > 0 {
+			require.NoError(t, tree.DeleteVersionsTo(v.PruneTo), vector.Name)
+		}
+		v.Version = version
+		v.RootHash = hex.EncodeToString(hash)
+		v.Nodes, v.NodesDigest = goldenNodesDigest(t, memDB)
+	}
+
+	// a tree reading the records back in strict mode finds them canonically encoded. It skips the
+	// fast index, so that the latest version is also read from the nodes.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts, true)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for _, version := range tree.AvailableVersions() {
+		itree, err := tree.GetImmutable(int64(version))
+		if err != nil {
+			require.ErrorIs(t, err, ErrVersionDoesNotExist) // an empty version.
+			continue
+		}
+		_, err = itree.Iterate(func(_, _ []byte) bool { return false })
+		require.NoError(t, err, vector.Name)
+	}
+}
+
+// goldenNodesDigest returns the number of node records, and the SHA256 digest of the node records
+// in key order, each written as the uvarint length of the key, the key, the uvarint length of the
+// value and the value.
+func goldenNodesDigest(t *testing.T, memDB db.DB) (int64, string) {
+	iter, err := memDB.Iterator(nodeKeyFormat.Key(), []byte{nodeKeyFormat.Prefix()[0] + 1})
+	require.NoError(t, err)
+	defer iter.Close()
+	h := sha256.New()
+	var count int64
+	length := make([]byte, binary.MaxVarintLen64)
+	for ; iter.Valid(); iter.Next() {
+		count++
+		for _, bz := range [][]byte{iter.Key(), iter.Value()} {
+			h.Write(length[:binary.PutUvarint(length, uint64(len(bz)))])
+			h.Write(bz)
+		}
+	}
+	return count, hex.EncodeToString(h.Sum(nil))
+}
+
+// generateGoldenNodes returns the node vectors, including those of TestNode_encode_decode.
+func generateGoldenNodes() goldenNodes {
+	hexs := func(s string) string { return hex.EncodeToString([]byte(s)) }
+	hash := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	return goldenNodes{
+		Encodings: []goldenEncoding{
+			{Name: "inner", Height: 3, Size: 7, Key: hexs("key"), Hash: "708090a0",
+				Left: &goldenNodeKey{Version: 1, Nonce: 1}, Right: &goldenNodeKey{Version: 1, Nonce: 1}},
+			{Name: "leaf", Height: 0, Size: 1, Key: hexs("key"), Value: hexs("value")},
+			{Name: "leaf with empty key and value", Height: 0, Size: 1},
+			{Name: "leaf with large value", Height: 0, Size: 1, Key: hexs("k"), Value: hex.EncodeToString(bytes.Repeat([]byte{0xab}, 300))},
+			{Name: "inner with large node keys", Height: 20, Size: 1 << 40, Key: hexs("split"), Hash: hash("hash"),
+				Left: &goldenNodeKey{Version: 1 << 50, Nonce: 1 << 30}, Right: &goldenNodeKey{Version: 12345, Nonce: 678}},
+		},
+		Hashes: []goldenHash{
+			{Name: "leaf", Height: 0, Size: 1, Version: 3, Key: hexs("key"), Value: hexs("value")},
+			{Name: "leaf with empty key and value", Height: 0, Size: 1, Version: 1},
+			{Name: "leaf at a large version", Height: 0, Size: 1, Version: 1 << 40, Key: hexs("key"), Value: hexs("value")},
+			{Name: "inner", Height: 1, Size: 2, Version: 2, LeftHash: hash("left"), RightHash: hash("right")},
+			{Name: "inner with large size", Height: 30, Size: 1 << 33, Version: 1000, LeftHash: hash("a"), RightHash: hash("b")},
+		},
+	}
+}
+
+// generateGoldenTrees returns the tree vectors, with the operations but without the results.
+func generateGoldenTrees() []goldenTree {
+	set := func(key, value string) goldenOp {
+		return goldenOp{Op: "set", Key: hex.EncodeToString([]byte(key)), Value: hex.EncodeToString([]byte(value))}
+	}
+	remove := func(key string) goldenOp {
+		return goldenOp{Op: "remove", Key: hex.EncodeToString([]byte(key))}
+	}
+	random := func(seed int64, versions, ops, keys int) []goldenVersion {
+		r := rand.New(rand.NewSource(seed))
+		result := make([]goldenVersion, versions)
+		for v := range result {
+			for i := 0; i < ops; i++ {
+				key := fmt.Sprintf("key%04d", r.Intn(keys))
+				if r.Intn(4) == 0 {
+					result[v].Ops = append(result[v].Ops, remove(key))
+				} else {
+					result[v].Ops = append(result[v].Ops, set(key, fmt.Sprintf("value%d", r.Int63())))
+				}
+			}
+		}
+		return result
+	}
+
+	pruned := random(3, 8, 20, 60)
+	pruned[5].PruneTo = 3
+	pruned[7].PruneTo = 7
+
+	return []goldenTree{
+		{Name: "single key", Versions: []goldenVersion{{Ops: []goldenOp{set("key", "value")}}}},
+		{Name: "basic", Versions: []goldenVersion{
+			{Ops: []goldenOp{set("x", "\xff"), set("z", "\xff"), set("a", "\x01"), set("b", "\x02"), set("c", "\x03")}},
+			{Ops: []goldenOp{remove("x"), remove("b"), set("c", "\xff"), set("d", "\x04")}},
+			{Ops: []goldenOp{set("b", "\x02"), set("c", "\x03"), set("e", "\x05"), remove("z")}},
+		}},
+		{Name: "empty and unchanged versions", Versions: []goldenVersion{
+			{Ops: []goldenOp{set("a", "1"), set("b", "2")}},
+			{},
+			{Ops: []goldenOp{remove("a"), remove("b")}},
+			{Ops: []goldenOp{set("c", "3")}},
+		}},
+		{Name: "sequential keys", Versions: func() []goldenVersion {
+			var ops []goldenOp
+			for i := 0; i < 100; i++ {
+				ops = append(ops, set(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i)))
+			}
+			return []goldenVersion{{Ops: ops}}
+		}()},
+		{Name: "initial version", InitialVersion: 1000, Versions: random(1, 3, 20, 30)},
+		{Name: "random", Versions: random(2, 8, 30, 80)},
+		{Name: "random with hashed keys", HashKeys: true, Versions: random(2, 8, 30, 80)},
+		{Name: "random with pruning", Versions: pruned},
+	}
+}
+
+func TestStrictDeterminism(t *testing.T) {
+	_, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{StrictDeterminism: true, RecordVersionTimestamps: true}, false)
+	require.ErrorIs(t, err, ErrNonDeterministicOptions)
+	_, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{StrictDeterminism: true, AutoTune: &AutoTuneOptions{}}, false)
+	require.ErrorIs(t, err, ErrNonDeterministicOptions)
+	_, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{StrictDeterminism: true, DeferPruning: true}, false)
+	require.ErrorIs(t, err, ErrNonDeterministicOptions)
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// re-encode the leaf with a non-minimal varint for its height.
+	nk := &NodeKey{version: 1, nonce: 1}
+	bz, err := memDB.Get(tree.ndb.nodeKey(nk))
+	require.NoError(t, err)
+	require.Equal(t, byte(0), bz[0])
+	require.NoError(t, memDB.Set(tree.ndb.nodeKey(nk), append([]byte{0x80, 0x00}, bz[1:]...)))
+
+	for _, strict := range []bool{false, true} {
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{StrictDeterminism: strict}, true)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		if strict {
+			require.ErrorIs(t, err, ErrNonCanonicalNode)
+			continue
+		}
+		require.NoError(t, err)
+		value, err := tree.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+	}
+}
@@ -1,6 +1,8 @@
 package iavl
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -139,14 +141,54 @@ func (t *ImmutableTree) Height() int8 {
 	return t.root.subtreeHeight
 }
 
-// Has returns whether or not a key exists.
+// Has returns whether or not a key exists. Like Get, it first checks the fast index for the key.
+// Otherwise it stops at the first node holding the key, and does not decode the value of leaves,
+// so it is cheaper than Get.
 func (t *ImmutableTree) Has(key []byte) (bool, error) {
+	return t.has(t.treeKey(key))
+}
+
+// has implements Has for a key that has already been passed through treeKey.
+func (t *ImmutableTree) has(key []byte) (bool, error) {
 	if t.root == nil {
 		return false, nil
 	}
+	if !t.skipFastStorageUpgrade && t.ndb.hasUpgradedToFastStorage() {
+		commits := t.ndb.getCommits()
+		fastNode, err := t.ndb.GetFastNode(key)
+		if err != nil {
+			return t.root.has(t, key)
+		}
+		if fastNode != nil && fastNode.GetVersionLastUpdatedAt() <= t.version {
+			return true, nil
+		}
+		// the fast index represents the live state of the latest version, as long as no commit
+		// changed it meanwhile.
+		latestVersion, err := t.ndb.getLatestVersion()
+		if err != nil {
+			return false, err
+		}
+		if fastNode == nil && t.version == latestVersion && !t.ndb.commitsSince(commits) {
+			return false, nil
+		}
+	}
 	return t.root.has(t, key)
 }
 
+// treeKey returns the key the given key is stored under in the tree, which is the SHA256 hash
+// of the key if Options.HashKeys is set, and the key itself otherwise.
+func (t *ImmutableTree) treeKey(key []byte) []byte {
+	if t.ndb == nil {
+		return key
+	}
+	return t.ndb.treeKey(key)
+}
+
+// hashKeys returns true if the tree was created with Options.HashKeys.
+func (t *ImmutableTree) hashKeys() bool {
+	return t.ndb != nil && t.ndb.opts.HashKeys
+}
+
 // Hash returns the root hash.
 func (t *ImmutableTree) Hash() ([]byte, error) {
 	return t.root.hashWithCount(t.version + 1)
@@ -165,6 +207,10 @@ func (t *ImmutableTree) Export() (*Exporter, error) {
 // The index is the index in the list of leaf nodes sorted lexicographically by key. The leftmost leaf has index 0.
 // It's neighbor has index 1 and so on.
 func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
+	return t.getWithIndex(t.treeKey(key))
+}
+
+func (t *ImmutableTree) getWithIndex(key []byte) (int64, []byte, error) {
 	if t.root == nil {
 		return 0, nil, nil
 	}
@@ -176,6 +222,11 @@ func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
 // Get potentially employs a more performant strategy than GetWithIndex for retrieving the value.
 // If tree.skipFastStorageUpgrade is true, this will work almost the same as GetWithIndex.
 func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
+	return t.get(t.treeKey(key))
+}
+
+// get implements Get for a key that has already been passed through treeKey.
+func (t *ImmutableTree) get(key []byte) ([]byte, error) {
 	if t.root == nil {
 		return nil, nil
 	}
@@ -183,6 +234,7 @@ func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
 	if !t.skipFastStorageUpgrade {
 		// attempt to get a FastNode directly from db/cache.
 		// if call fails, fall back to the original IAVL logic in place.
+		commits := t.ndb.getCommits()
 		fastNode, err := t.ndb.GetFastNode(key)
 		if err != nil {
 			_, result, err := t.root.get(t, key)
@@ -192,8 +244,12 @@ func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
 		if fastNode == nil {
 			// If the tree is of the latest version and fast node is not in the tree
 			// then the regular node is not in the tree either because fast node
-			// represents live state.
-			if t.version == t.ndb.latestVersion {
+			// represents live state, unless a commit changed it meanwhile.
+			latestVersion, err := t.ndb.getLatestVersion()
+			if err != nil {
+				return nil, err
+			}
+			if t.version == latestVersion && !t.ndb.commitsSince(commits) {
 				return nil, nil
 			}
 
@@ -213,6 +269,48 @@ func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
 	return result, err
 }
 
+// ErrLeafNotSaved is returned by GetLeafHash for a key whose leaf is not saved yet, since the
+// leaf hash commits to the version the leaf is saved at.
+var ErrLeafNotSaved = errors.New("leaf is not saved yet")
+
+// GetLeafHash returns the hash of the leaf node holding the specified key, which commits to the
+// key, the hash of the value and the version the leaf was written at. It returns nil if the key
+// does not exist, and ErrLeafNotSaved if the leaf was changed in the working tree.
+func (t *ImmutableTree) GetLeafHash(key []byte) ([]byte, error) {
+	node, err := t.getLeaf(t.treeKey(key))
+	if err != nil || node == nil {
+		return nil, err
+	}
+	if node.nodeKey == nil {
+		return nil, fmt.Errorf("%w: key %X", ErrLeafNotSaved, key)
+	}
+	return node._hash(node.nodeKey.version)
+}
+
+// getLeaf returns the leaf node holding the given tree key, or nil if the key does not exist.
+func (t *ImmutableTree) getLeaf(key []byte) (*Node, error) {
+	if t.root == nil {
+		return nil, nil
+	}
+
+	node := t.root
+	for !node.isLeaf() {
+		var err error
+		if bytes.Compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !bytes.Equal(node.key, key) {
+		return nil, nil
+	}
+	return node, nil
+}
+
 // GetByIndex gets the key and value at the specified index.
 func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte, err error) {
 	if t.root == nil {
@@ -240,7 +338,7 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, e
 			return true, nil
 		}
 	}
-	return false, nil
+	return false, itr.Error()
 }
 
 // Iterator returns an iterator over the immutable tree.
@@ -260,10 +358,19 @@ func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (dbm.Iterato
 
 // IterateRange makes a callback for all nodes with key between start and end non-inclusive.
 // If either are nil, then it is open on that side (nil, nil is the same as Iterate). The keys and
-// values must not be modified, since they may point to data stored within IAVL.
+// values must not be modified, since they may point to data stored within IAVL. The iteration
+// stops early if a node fails to load, which is indistinguishable from the end of the range, use
+// IterateRangeWithError to detect such errors.
 func (t *ImmutableTree) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool) {
+	stopped, _ = t.IterateRangeWithError(start, end, ascending, fn)
+	return stopped
+}
+
+// IterateRangeWithError is like IterateRange, but returns the error of a node which failed to
+// load, e.g. because of a backend read error, rather than stopping silently.
+func (t *ImmutableTree) IterateRangeWithError(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (bool, error) {
 	if t.root == nil {
-		return false
+		return false, nil
 	}
 	return t.root.traverseInRange(t, start, end, ascending, false, false, func(node *Node) bool {
 		if node.subtreeHeight == 0 {
@@ -275,10 +382,19 @@ func (t *ImmutableTree) IterateRange(start, end []byte, ascending bool, fn func(
 
 // IterateRangeInclusive makes a callback for all nodes with key between start and end inclusive.
 // If either are nil, then it is open on that side (nil, nil is the same as Iterate). The keys and
-// values must not be modified, since they may point to data stored within IAVL.
+// values must not be modified, since they may point to data stored within IAVL. Like IterateRange,
+// the iteration stops early if a node fails to load, use IterateRangeInclusiveWithError to detect
+// such errors.
 func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool, fn func(key, value []byte, version int64) bool) (stopped bool) {
+	stopped, _ = t.IterateRangeInclusiveWithError(start, end, ascending, fn)
+	return stopped
+}
+
+// IterateRangeInclusiveWithError is like IterateRangeInclusive, but returns the error of a node
+// which failed to load rather than stopping silently.
+func (t *ImmutableTree) IterateRangeInclusiveWithError(start, end []byte, ascending bool, fn func(key, value []byte, version int64) bool) (bool, error) {
 	if t.root == nil {
-		return false
+		return false, nil
 	}
 	return t.root.traverseInRange(t, start, end, ascending, true, false, func(node *Node) bool {
 		if node.subtreeHeight == 0 {
@@ -1,9 +1,9 @@
 package iavl
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
+	"sync/atomic"
 
 	db "github.com/cosmos/cosmos-db"
 )
@@ -28,6 +28,12 @@ type Importer struct {
 	batchSize uint32
 	stack     []*Node
 	nonces    []int32
+	added     int64 // Number of nodes added so far.
+	replay    int64 // Number of added nodes already written by an interrupted import, see resume.
+
+	// progress, if set, is called with every batch before it is written, so that the progress
+	// of the import is recorded atomically with its nodes. committed is set for the last batch.
+	progress func(batch db.Batch, added int64, committed bool) error
 }
 
 // newImporter creates a new Importer for an empty MutableTree.
@@ -38,8 +44,8 @@ func newImporter(tree *MutableTree, version int64) (*Importer, error) {
 	if version < 0 {
 		return nil, errors.New("imported version cannot be negative")
 	}
-	if tree.ndb.latestVersion > 0 {
-		return nil, fmt.Errorf("found database at version %d, must be 0", tree.ndb.latestVersion)
+	if latestVersion := atomic.LoadInt64(&tree.ndb.latestVersion); latestVersion > 0 {
+		return nil, fmt.Errorf("found database at version %d, must be 0", latestVersion)
 	}
 	if !tree.IsEmpty() {
 		return nil, errors.New("tree must be empty")
@@ -62,10 +68,12 @@ func (i *Importer) writeNode(node *Node) error {
 	if err := node.validate(); err != nil {
 		return err
 	}
+	if i.added < i.replay {
+		return nil
+	}
 
-	buf := bufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bufPool.Put(buf)
+	buf := DefaultEncoderPool.GetBuffer()
+	defer DefaultEncoderPool.PutBuffer(buf)
 
 	if err := node.writeBytes(buf); err != nil {
 		return err
@@ -79,18 +87,35 @@ func (i *Importer) writeNode(node *Node) error {
 	}
 
 	i.batchSize++
-	if i.batchSize >= maxBatchSize {
-		if err := i.batch.Write(); err != nil {
+	return nil
+}
+
+// flush writes the batch once it reaches maxBatchSize. It is only called between nodes, so that
+// the recorded progress covers all writes of the nodes added so far.
+func (i *Importer) flush() error {
+	if i.batchSize < maxBatchSize {
+		return nil
+	}
+	if i.progress != nil {
+		if err := i.progress(i.batch, i.added, false); err != nil {
 			return err
 		}
-		i.batch.Close()
-		i.batch = i.tree.ndb.db.NewBatch()
-		i.batchSize = 0
 	}
-
+	if err := i.batch.Write(); err != nil {
+		return err
+	}
+	i.batch.Close()
+	i.batch = i.tree.ndb.db.NewBatch()
+	i.batchSize = 0
 	return nil
 }
 
+// resume makes the importer rebuild the first added nodes without writing them, since an
+// interrupted import already wrote them, as recorded by progress.
+func (i *Importer) resume(added int64) {
+	i.replay = added
+}
+
 // Close frees all resources. It is safe to call multiple times. Uncommitted nodes may already have
 // been flushed to the database, but will not be visible.
 func (i *Importer) Close() {
@@ -155,8 +180,9 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	}
 
 	i.stack = append(i.stack, node)
+	i.added++
 
-	return nil
+	return i.flush()
 }
 
 // Commit finalizes the import by flushing any outstanding nodes to the database, making the
@@ -173,14 +199,34 @@ func (i *Importer) Commit() error {
 			return err
 		}
 	case 1:
-		i.stack[0].nodeKey.nonce = 1
-		if err := i.writeNode(i.stack[0]); err != nil {
+		// The root was last changed before the imported version if the version was saved without
+		// changes. It then keeps its nonce, so that its version does not appear to exist, and the
+		// imported version refers to it like SaveVersion does.
+		root := i.stack[0]
+		if root.nodeKey.version == i.version {
+			root.nodeKey.nonce = 1
+		}
+		if err := i.writeNode(root); err != nil {
 			return err
 		}
+		if root.nodeKey.version < i.version {
+			if err := i.batch.Set(i.tree.ndb.nodeKey(&NodeKey{version: i.version, nonce: 1}),
+				i.tree.ndb.nodeKey(root.nodeKey)); err != nil {
+				return err
+			}
+		}
 	default:
 		return fmt.Errorf("invalid node structure, found stack size %v when committing",
 			len(i.stack))
 	}
+	if err := i.tree.ndb.setHashKeysToBatch(i.batch); err != nil {
+		return err
+	}
+	if i.progress != nil {
+		if err := i.progress(i.batch, i.added, true); err != nil {
+			return err
+		}
+	}
 
 	err := i.batch.WriteSync()
 	if err != nil {
@@ -233,6 +233,82 @@ func TestImporter_Commit_Empty(t *testing.T) {
 	assert.EqualValues(t, 3, tree.Version())
 }
 
+func TestImporter_Commit_UnchangedRoot(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	importer, err := tree.Import(3)
+	require.NoError(t, err)
+
+	// the root was last changed at version 2, like after saving version 3 without changes.
+	err = importer.Add(&ExportNode{Key: []byte("key"), Value: []byte("value"), Version: 2, Height: 0})
+	require.NoError(t, err)
+	err = importer.Commit()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, tree.Version())
+	assert.Equal(t, []int{3}, tree.AvailableVersions())
+	assert.False(t, tree.VersionExists(2))
+	value, err := tree.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// the root is pruned once a later version changes it.
+	_, err = tree.Set([]byte("key"), []byte("new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	assert.Equal(t, []int{4}, tree.AvailableVersions())
+	root, err := tree.ndb.dbGet(tree.ndb.nodeKey(&NodeKey{version: 2, nonce: 2}))
+	require.NoError(t, err)
+	require.Nil(t, root)
+}
+
+func TestImporter_Commit_UnchangedVersion(t *testing.T) {
+	source, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	for i := byte(0); i < 10; i++ {
+		_, err = source.Set([]byte{i}, []byte{i})
+		require.NoError(t, err)
+	}
+	_, _, err = source.SaveVersion()
+	require.NoError(t, err)
+	// version 2 is saved without changes, so its root is the root of version 1.
+	hash, version, err := source.SaveVersion()
+	require.NoError(t, err)
+	itree, err := source.GetImmutable(version)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	importer, err := tree.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		node, err := exporter.Next()
+		if err == ErrorExportDone {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+
+	// the imported version loads from the database, and the version of its root does not exist.
+	reloaded, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	loaded, err := reloaded.LoadVersion(version)
+	require.NoError(t, err)
+	assert.EqualValues(t, version, loaded)
+	assert.Equal(t, []int{int(version)}, reloaded.AvailableVersions())
+	reloadedHash, err := reloaded.Hash()
+	require.NoError(t, err)
+	assert.Equal(t, hash, reloadedHash)
+}
+
 func BenchmarkImport(b *testing.B) {
 	b.StopTimer()
 	tree := setupExportTreeSized(b, 4096)
@@ -10,6 +10,10 @@ import (
 	"sync"
 )
 
+// ReadChunkSize is the most memory ReadSized allocates ahead of the bytes actually read, so that a
+// forged length cannot make a reader allocate more than the stream contains.
+const ReadChunkSize = 64 * 1024
+
 var bufPool = &sync.Pool{
 	New: func() interface{} {
 		return new(bytes.Buffer)
@@ -28,6 +32,31 @@ var uvarintPool = &sync.Pool{
 	},
 }
 
+// ReadSized reads exactly size bytes from r. They are read in chunks of ReadChunkSize, so memory
+// only grows with the bytes actually present in r, however large the size.
+func ReadSized(r io.Reader, size uint64) ([]byte, error) {
+	bz := make([]byte, 0, minUint64(size, ReadChunkSize))
+	for uint64(len(bz)) < size {
+		n := int(minUint64(size-uint64(len(bz)), ReadChunkSize))
+		bz = append(bz, make([]byte, n)...)
+		if _, err := io.ReadFull(r, bz[len(bz)-n:]); err != nil {
+			if err == io.EOF {
+				// the size promised more bytes, even if a chunk boundary was reached.
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return bz, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // decodeBytes decodes a varint length-prefixed byte slice, returning it along with the number
 // of input bytes read.
 func DecodeBytes(bz []byte) ([]byte, int, error) {
@@ -1,7 +1,9 @@
 package encoding
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
 	"math"
 	"testing"
 
@@ -86,3 +88,18 @@ func TestDecodeBytes_invalidVarint(t *testing.T) {
 	_, _, err := DecodeBytes([]byte{0xff})
 	require.Error(t, err)
 }
+
+func TestReadSized(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3}, ReadChunkSize)
+	bz, err := ReadSized(bytes.NewReader(data), uint64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, data, bz)
+
+	bz, err = ReadSized(bytes.NewReader(nil), 0)
+	require.NoError(t, err)
+	require.Empty(t, bz)
+
+	// a forged size fails once the reader runs out of bytes.
+	_, err = ReadSized(bytes.NewReader(data), math.MaxUint64)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
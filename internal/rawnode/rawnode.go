@@ -0,0 +1,19 @@
+// Package rawnode connects the raw node access of package iavl to the public unsafe package,
+// without exporting it from package iavl.
+package rawnode
+
+import "errors"
+
+var (
+	// ErrNotANode is returned for records which are not encoded nodes, e.g. references to the root
+	// of a previous version.
+	ErrNotANode = errors.New("record is not a node")
+	// ErrHashMismatch is returned when putting a node whose hash does not match the expected hash.
+	ErrHashMismatch = errors.New("node hash mismatch")
+)
+
+// Get and Put are set by package iavl. The tree is an *iavl.MutableTree.
+var (
+	Get func(tree interface{}, version int64, nonce int32) (raw []byte, hash []byte, err error)
+	Put func(tree interface{}, version int64, nonce int32, raw []byte, hash []byte) error
+)
@@ -228,10 +228,10 @@ func (iter *Iterator) Next() {
 	}
 
 	node, err := iter.t.next()
-	// TODO: double-check if this error is correctly handled.
 	if node == nil || err != nil {
 		iter.t = nil
 		iter.valid = false
+		iter.err = err
 		return
 	}
 
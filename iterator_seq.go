@@ -0,0 +1,113 @@
+//go:build go1.23
+
+package iavl
+
+import (
+	"iter"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+// All returns a range-over-func iterator over all key/value pairs of the tree in ascending key
+// order, and a function returning the error which ended the iteration early, see Range. Like
+// Iterate, it traverses the tree itself, so on a MutableTree it includes unsaved changes. The keys
+// and values must not be modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) All() (iter.Seq2[[]byte, []byte], func() error) {
+	return t.Range(nil, nil, true)
+}
+
+// Range returns a range-over-func iterator over the key/value pairs with keys between start
+// (inclusive) and end (exclusive), like an Iterator over the tree. A node failing to load ends the
+// iteration, so the returned function must be called once the loop is done to tell such an error
+// from the end of the range. The iterator can be used multiple times, and each use resets the
+// error.
+func (t *ImmutableTree) Range(start, end []byte, ascending bool) (iter.Seq2[[]byte, []byte], func() error) {
+	var err error
+	seq := func(yield func([]byte, []byte) bool) {
+		itr := NewIterator(start, end, ascending, t)
+		defer itr.Close()
+		for err = nil; itr.Valid(); itr.Next() {
+			if !yield(itr.Key(), itr.Value()) {
+				return
+			}
+		}
+		err = itr.Error()
+	}
+	return seq, func() error { return err }
+}
+
+// Seq adapts a dbm.Iterator, e.g. as returned by Iterator, to a range-over-func iterator, which
+// yields the remaining pairs of itr. The iterator is not closed, so that its Error can be checked
+// once the loop is done.
+func Seq(itr dbm.Iterator) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for ; itr.Valid(); itr.Next() {
+			if !yield(itr.Key(), itr.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// SeqIterator is a dbm.Iterator over a range-over-func iterator, see NewSeqIterator.
+type SeqIterator struct {
+	start, end []byte
+	next       func() ([]byte, []byte, bool)
+	stop       func()
+	err        func() error
+	key, value []byte
+	valid      bool
+}
+
+var _ dbm.Iterator = (*SeqIterator)(nil)
+
+// NewSeqIterator returns a dbm.Iterator over the pairs yielded by seq, e.g. to pass the result of
+// Range to code expecting a database iterator. The domain is only reported, not enforced. Error
+// reports the result of err, which may be nil for sequences that can't fail. The iterator must be
+// closed to release seq if it is not exhausted.
+func NewSeqIterator(start, end []byte, seq iter.Seq2[[]byte, []byte], err func() error) *SeqIterator {
+	next, stop := iter.Pull2(seq)
+	itr := &SeqIterator{start: start, end: end, next: next, stop: stop, err: err}
+	itr.Next()
+	return itr
+}
+
+// Domain implements dbm.Iterator.
+func (itr *SeqIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements dbm.Iterator.
+func (itr *SeqIterator) Valid() bool {
+	return itr.valid
+}
+
+// Next implements dbm.Iterator.
+func (itr *SeqIterator) Next() {
+	itr.key, itr.value, itr.valid = itr.next()
+}
+
+// Key implements dbm.Iterator.
+func (itr *SeqIterator) Key() []byte {
+	return itr.key
+}
+
+// Value implements dbm.Iterator.
+func (itr *SeqIterator) Value() []byte {
+	return itr.value
+}
+
+// Error implements dbm.Iterator.
+func (itr *SeqIterator) Error() error {
+	if itr.err == nil {
+		return nil
+	}
+	return itr.err()
+}
+
+// Close implements dbm.Iterator.
+func (itr *SeqIterator) Close() error {
+	itr.stop()
+	itr.valid = false
+	return nil
+}
@@ -0,0 +1,107 @@
+//go:build go1.23
+
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIteratorSeq(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	var keys [][]byte
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		keys = append(keys, key)
+		_, err = tree.Set(key, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// unsaved changes are included.
+	_, err = tree.Set([]byte("key-9"), []byte("unsaved"))
+	require.NoError(t, err)
+
+	collect := func(seq func(yield func([]byte, []byte) bool), limit int) (ks [][]byte, vs [][]byte) {
+		seq(func(key, value []byte) bool {
+			ks, vs = append(ks, key), append(vs, value)
+			return len(ks) < limit
+		})
+		return ks, vs
+	}
+
+	all, allErr := tree.All()
+	ks, vs := collect(all, 100)
+	require.NoError(t, allErr())
+	require.Equal(t, keys, ks)
+	require.Equal(t, []byte("unsaved"), vs[9])
+	seq, seqErr := tree.Range(keys[2], keys[5], false)
+	ks, _ = collect(seq, 100)
+	require.NoError(t, seqErr())
+	require.Equal(t, [][]byte{keys[4], keys[3], keys[2]}, ks)
+	ks, _ = collect(all, 3)
+	require.NoError(t, allErr())
+	require.Equal(t, keys[:3], ks)
+
+	itr, err := tree.Iterator(keys[7], nil, true)
+	require.NoError(t, err)
+	ks, vs = collect(Seq(itr), 100)
+	require.NoError(t, itr.Error())
+	require.NoError(t, itr.Close())
+	require.Equal(t, keys[7:], ks)
+	require.Equal(t, []byte("unsaved"), vs[2])
+
+	seq, seqErr = tree.Range(keys[1], keys[4], true)
+	sitr := NewSeqIterator(keys[1], keys[4], seq, seqErr)
+	start, end := sitr.Domain()
+	require.Equal(t, keys[1], start)
+	require.Equal(t, keys[4], end)
+	for i := 1; i < 4; i++ {
+		require.True(t, sitr.Valid())
+		require.Equal(t, keys[i], sitr.Key())
+		require.Equal(t, []byte{byte(i)}, sitr.Value())
+		sitr.Next()
+	}
+	require.False(t, sitr.Valid())
+	require.NoError(t, sitr.Error())
+	require.NoError(t, sitr.Close())
+
+	// closing an unexhausted iterator releases the sequence.
+	sitr = NewSeqIterator(nil, nil, all, allErr)
+	require.True(t, sitr.Valid())
+	require.NoError(t, sitr.Close())
+	require.False(t, sitr.Valid())
+}
+
+func TestIteratorSeq_Error(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, memDB.Delete(tree.ndb.nodeKey(&NodeKey{version: 1, nonce: 2})))
+
+	// a node failing to load is reported rather than ending the iteration silently.
+	tree, err = NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	all, allErr := tree.All()
+	for range all {
+	}
+	require.ErrorIs(t, allErr(), ErrNodeNotFound)
+
+	sitr := NewSeqIterator(nil, nil, all, allErr)
+	for ; sitr.Valid(); sitr.Next() {
+	}
+	require.ErrorIs(t, sitr.Error(), ErrNodeNotFound)
+	require.NoError(t, sitr.Close())
+}
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	dbm "github.com/cosmos/cosmos-db"
 
+	"github.com/cosmos/iavl/cache"
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
 	"github.com/cosmos/iavl/internal/logger"
@@ -23,9 +26,25 @@ var ErrVersionDoesNotExist = errors.New("version does not exist")
 // ErrKeyDoesNotExist is returned if a key does not exist.
 var ErrKeyDoesNotExist = errors.New("key does not exist")
 
-// MutableTree is a persistent tree which keeps track of versions. It is not safe for concurrent
-// use, and should be guarded by a Mutex or RWLock as appropriate. An immutable tree at a given
-// version can be returned via GetImmutable, which is safe for concurrent access.
+// ErrTreeHeightExceeded is returned if the tree height exceeds Options.MaxTreeHeight.
+var ErrTreeHeightExceeded = errors.New("tree height exceeds the configured maximum")
+
+// errSetConditionFailed aborts a conditional set, leaving the working tree unchanged.
+var errSetConditionFailed = errors.New("set condition failed")
+
+// setCondition decides whether a conditional set goes ahead, given the existing value of the key.
+type setCondition func(existing []byte, exists bool) bool
+
+// MutableTree is a persistent tree which keeps track of versions. The working tree (Set, Remove,
+// Get, Iterate, etc.) is not safe for concurrent use, and should be guarded by a Mutex or RWLock
+// as appropriate. An immutable tree at a given version can be returned via GetImmutable, which is
+// safe for concurrent access.
+//
+// Reads of committed state (Hash, VersionExists, AvailableVersions, GetImmutable and
+// GetVersioned) are lock-free and may be called concurrently with each other and with a
+// single writer. Operations that change the set of committed versions (SaveVersion,
+// LoadVersion, LoadVersionForOverwriting, DeleteVersionsTo and Rollback) are serialized by
+// the commit lock.
 //
 // Given and returned key/value byte slices must not be modified, since they may point to data
 // located inside IAVL which would also be modified.
@@ -33,13 +52,18 @@ var ErrKeyDoesNotExist = errors.New("key does not exist")
 // The inner ImmutableTree should not be used directly by callers.
 type MutableTree struct {
 	*ImmutableTree                                     // The current, working tree.
-	lastSaved                *ImmutableTree            // The most recently saved tree.
+	lastSaved                atomic.Value              // The most recently saved tree, holds an *ImmutableTree.
 	unsavedFastNodeAdditions map[string]*fastnode.Node // FastNodes that have not yet been saved to disk
 	unsavedFastNodeRemovals  map[string]interface{}    // FastNodes that have not yet been removed from disk
 	ndb                      *nodeDB
 	skipFastStorageUpgrade   bool // If true, the tree will work like no fast storage and always not upgrade fast storage
+	preCommitHooks           []PreCommitHook
+	lastCommitTimings        atomic.Value // The timings of the most recent commit, holds a CommitTimings.
+	auditLog                 atomic.Value // The attached audit log, holds an *AuditLog.
+	orphanedValueBytes       int64        // The value bytes of saved leaves replaced or removed by the working tree.
+	snapshots                *SnapshotManager
 
-	mtx sync.Mutex
+	mtx sync.Mutex // Commit lock, serializes changes to the set of committed versions.
 }
 
 // NewMutableTree returns a new tree with the specified cache size and datastore.
@@ -47,19 +71,44 @@ func NewMutableTree(db dbm.DB, cacheSize int, skipFastStorageUpgrade bool) (*Mut
 	return NewMutableTreeWithOpts(db, cacheSize, nil, skipFastStorageUpgrade)
 }
 
-// NewMutableTreeWithOpts returns a new tree with the specified options.
+// NewMutableTreeWithOpts returns a new tree with the specified options. It returns an
+// *IncompatibleFormatError if the database was written in a format newer than this library can
+// read, see CheckCompatibility.
 func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options, skipFastStorageUpgrade bool) (*MutableTree, error) {
+	if opts != nil {
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := CheckCompatibility(db); err != nil {
+		return nil, err
+	}
+	hashKeysRecorded, err := checkHashKeys(db, opts != nil && opts.HashKeys)
+	if err != nil {
+		return nil, err
+	}
 	ndb := newNodeDB(db, cacheSize, opts)
+	ndb.hashKeysRecorded = hashKeysRecorded
 	head := &ImmutableTree{ndb: ndb, skipFastStorageUpgrade: skipFastStorageUpgrade}
 
-	return &MutableTree{
+	tree := &MutableTree{
 		ImmutableTree:            head,
-		lastSaved:                head.clone(),
 		unsavedFastNodeAdditions: make(map[string]*fastnode.Node),
 		unsavedFastNodeRemovals:  make(map[string]interface{}),
 		ndb:                      ndb,
 		skipFastStorageUpgrade:   skipFastStorageUpgrade,
-	}, nil
+	}
+	tree.setLastSaved(head.clone())
+	return tree, nil
+}
+
+// getLastSaved returns the most recently saved tree. It is safe for concurrent use.
+func (tree *MutableTree) getLastSaved() *ImmutableTree {
+	return tree.lastSaved.Load().(*ImmutableTree)
+}
+
+func (tree *MutableTree) setLastSaved(lastSaved *ImmutableTree) {
+	tree.lastSaved.Store(lastSaved)
 }
 
 // IsEmpty returns whether or not the tree has any keys. Only trees that are
@@ -78,7 +127,11 @@ func (tree *MutableTree) VersionExists(version int64) bool {
 	if err != nil {
 		return false
 	}
-	return firstVersion <= version && version <= latestVersion
+	if firstVersion > version || version > latestVersion {
+		return false
+	}
+	_, _, gap, err := tree.ndb.findVersionGap(version)
+	return err == nil && !gap
 }
 
 // AvailableVersions returns all available versions in ascending order
@@ -93,16 +146,26 @@ func (tree *MutableTree) AvailableVersions() []int {
 	}
 
 	res := make([]int, 0)
-	for version := firstVersion; version <= latestVersion; version++ {
+	for version := firstVersion; version <= latestVersion; {
 		res = append(res, int(version))
+		if version, err = tree.ndb.nextVersion(version); err != nil {
+			return nil
+		}
 	}
 	return res
 }
 
+// NodeCacheStats returns the per-tier metrics of the node cache, or false if the cache is not
+// segmented by node size, see Options.NodeCacheLargeNodeThreshold. It is safe for concurrent use.
+func (tree *MutableTree) NodeCacheStats() (cache.TieredStats, bool) {
+	return tree.ndb.nodeCacheStats()
+}
+
 // Hash returns the hash of the latest saved version of the tree, as returned
 // by SaveVersion. If no versions have been saved, Hash returns nil.
+// It is safe to call concurrently with SaveVersion.
 func (tree *MutableTree) Hash() ([]byte, error) {
-	return tree.lastSaved.Hash()
+	return tree.getLastSaved().Hash()
 }
 
 // WorkingHash returns the hash of the current working tree.
@@ -120,20 +183,63 @@ func (tree *MutableTree) String() (string, error) {
 // to slices stored within IAVL. It returns true when an existing value was
 // updated, while false means it was a new key.
 func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
-	updated, err = tree.set(key, value)
+	updated, err = tree.set(tree.treeKey(key), value)
 	if err != nil {
 		return false, err
 	}
+	tree.recordAccess(AccessWrite, key, tree.version+1)
 	return updated, nil
 }
 
+// SetIfAbsent sets a key in the working tree unless it already exists, in which case the tree is
+// left unchanged. It returns the existing value, if any, and whether the value was set. The key
+// is only looked up once, along the path the value is set on.
+func (tree *MutableTree) SetIfAbsent(key, value []byte) (existing []byte, set bool, err error) {
+	set, err = tree.setIf(key, value, func(old []byte, exists bool) bool {
+		existing = old
+		return !exists
+	})
+	return existing, set, err
+}
+
+// CompareAndSet sets a key in the working tree to newValue if its current value equals expected,
+// where a nil expected value means that the key must not exist. Otherwise, the tree is left
+// unchanged. It returns the prior value, if any, and whether the value was set. The key is only
+// looked up once, along the path the value is set on.
+func (tree *MutableTree) CompareAndSet(key, expected, newValue []byte) (prior []byte, set bool, err error) {
+	set, err = tree.setIf(key, newValue, func(old []byte, exists bool) bool {
+		prior = old
+		if expected == nil {
+			return !exists
+		}
+		return exists && bytes.Equal(old, expected)
+	})
+	return prior, set, err
+}
+
+// setIf sets a key if cond holds for its existing value, and returns whether it was set.
+func (tree *MutableTree) setIf(key, value []byte, cond setCondition) (bool, error) {
+	tree.recordAccess(AccessRead, key, tree.version+1)
+	_, err := tree.setConditional(tree.treeKey(key), value, cond)
+	if errors.Is(err, errSetConditionFailed) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	tree.recordAccess(AccessWrite, key, tree.version+1)
+	return true, nil
+}
+
 // Get returns the value of the specified key if it exists, or nil otherwise.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 func (tree *MutableTree) Get(key []byte) ([]byte, error) {
+	tree.recordAccess(AccessRead, key, tree.version+1)
 	if tree.root == nil {
 		return nil, nil
 	}
 
+	key = tree.treeKey(key)
+
 	if !tree.skipFastStorageUpgrade {
 		if fastNode, ok := tree.unsavedFastNodeAdditions[ibytes.UnsafeBytesToStr(key)]; ok {
 			return fastNode.GetValue(), nil
@@ -142,9 +248,37 @@ func (tree *MutableTree) Get(key []byte) ([]byte, error) {
 		if _, ok := tree.unsavedFastNodeRemovals[string(key)]; ok {
 			return nil, nil
 		}
+		if spilled, err := tree.ndb.hasSpilledFastNodeRemoval(key); err != nil || spilled {
+			return nil, err
+		}
+	}
+
+	return tree.ImmutableTree.get(key)
+}
+
+// Has returns whether the key exists in the working tree. Like Get, it checks the unsaved changes
+// and the fast index first, see ImmutableTree.Has.
+func (tree *MutableTree) Has(key []byte) (bool, error) {
+	tree.recordAccess(AccessRead, key, tree.version+1)
+	if tree.root == nil {
+		return false, nil
+	}
+
+	key = tree.treeKey(key)
+
+	if !tree.skipFastStorageUpgrade {
+		if _, ok := tree.unsavedFastNodeAdditions[ibytes.UnsafeBytesToStr(key)]; ok {
+			return true, nil
+		}
+		if _, ok := tree.unsavedFastNodeRemovals[string(key)]; ok {
+			return false, nil
+		}
+		if spilled, err := tree.ndb.hasSpilledFastNodeRemoval(key); err != nil || spilled {
+			return false, err
+		}
 	}
 
-	return tree.ImmutableTree.Get(key)
+	return tree.ImmutableTree.has(key)
 }
 
 // Import returns an importer for tree nodes previously exported by ImmutableTree.Export(),
@@ -185,7 +319,7 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 			return true, nil
 		}
 	}
-	return false, nil
+	return false, itr.Error()
 }
 
 // Iterator returns an iterator over the mutable tree.
@@ -206,30 +340,58 @@ func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (dbm.Iterat
 }
 
 func (tree *MutableTree) set(key []byte, value []byte) (updated bool, err error) {
+	return tree.setConditional(key, value, nil)
+}
+
+// setConditional sets a key in tree-key space. If cond is given and rejects the existing value,
+// errSetConditionFailed is returned and the working tree is left unchanged.
+func (tree *MutableTree) setConditional(key []byte, value []byte, cond setCondition) (updated bool, err error) {
 	if value == nil {
 		return updated, fmt.Errorf("attempt to store nil value at key '%s'", key)
 	}
 
 	if tree.ImmutableTree.root == nil {
+		if cond != nil && !cond(nil, false) {
+			return false, errSetConditionFailed
+		}
 		if !tree.skipFastStorageUpgrade {
-			tree.addUnsavedAddition(key, fastnode.NewNode(key, value, tree.version+1))
+			if err := tree.addUnsavedAddition(key, fastnode.NewNode(key, value, tree.version+1)); err != nil {
+				return updated, err
+			}
 		}
 		tree.ImmutableTree.root = NewNode(key, value)
 		return updated, nil
 	}
 
-	tree.ImmutableTree.root, updated, err = tree.recursiveSet(tree.ImmutableTree.root, key, value)
+	newRoot, updated, err := tree.recursiveSet(tree.ImmutableTree.root, key, value, cond)
+	if errors.Is(err, errSetConditionFailed) {
+		// the original nodes along the path are untouched by cloning, so keep the old root.
+		return false, err
+	}
+	tree.ImmutableTree.root = newRoot
 	return updated, err
 }
 
-func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
+func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, cond setCondition) (
 	newSelf *Node, updated bool, err error,
 ) {
 	version := tree.version + 1
 
 	if node.isLeaf() {
+		if cond != nil {
+			exists := bytes.Equal(key, node.key)
+			var existing []byte
+			if exists {
+				existing = node.value
+			}
+			if !cond(existing, exists) {
+				return nil, false, errSetConditionFailed
+			}
+		}
 		if !tree.skipFastStorageUpgrade {
-			tree.addUnsavedAddition(key, fastnode.NewNode(key, value, version))
+			if err := tree.addUnsavedAddition(key, fastnode.NewNode(key, value, version)); err != nil {
+				return nil, false, err
+			}
 		}
 		switch bytes.Compare(key, node.key) {
 		case -1: // setKey < leafKey
@@ -251,6 +413,9 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 				rightNode:     NewNode(key, value),
 			}, false, nil
 		default:
+			if node.nodeKey != nil {
+				tree.orphanedValueBytes += int64(len(node.value))
+			}
 			return NewNode(key, value), true, nil
 		}
 	} else {
@@ -260,12 +425,12 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 		}
 
 		if bytes.Compare(key, node.key) < 0 {
-			node.leftNode, updated, err = tree.recursiveSet(node.leftNode, key, value)
+			node.leftNode, updated, err = tree.recursiveSet(node.leftNode, key, value, cond)
 			if err != nil {
 				return nil, updated, err
 			}
 		} else {
-			node.rightNode, updated, err = tree.recursiveSet(node.rightNode, key, value)
+			node.rightNode, updated, err = tree.recursiveSet(node.rightNode, key, value, cond)
 			if err != nil {
 				return nil, updated, err
 			}
@@ -289,6 +454,15 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 // Remove removes a key from the working tree. The given key byte slice should not be modified
 // after this call, since it may point to data stored inside IAVL.
 func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
+	value, removed, err := tree.remove(tree.treeKey(key))
+	if err == nil {
+		tree.recordAccess(AccessDelete, key, tree.version+1)
+	}
+	return value, removed, err
+}
+
+// remove implements Remove for a key that has already been passed through treeKey.
+func (tree *MutableTree) remove(key []byte) ([]byte, bool, error) {
 	if tree.root == nil {
 		return nil, false, nil
 	}
@@ -301,7 +475,9 @@ func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
 	}
 
 	if !tree.skipFastStorageUpgrade {
-		tree.addUnsavedRemoval(key)
+		if err := tree.addUnsavedRemoval(key); err != nil {
+			return nil, false, err
+		}
 	}
 
 	tree.root = newRoot
@@ -318,6 +494,9 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node,
 	logger.Debug("recursiveRemove node: %v, key: %x\n", node, key)
 	if node.isLeaf() {
 		if bytes.Equal(key, node.key) {
+			if node.nodeKey != nil {
+				tree.orphanedValueBytes += int64(len(node.value))
+			}
 			return nil, nil, node.value, true, nil
 		}
 		return node, nil, nil, false, nil
@@ -393,6 +572,31 @@ func (tree *MutableTree) Load() (int64, error) {
 
 // Returns the version number of the specific version found
 func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	return tree.loadVersion(targetVersion)
+}
+
+// loadVersion implements LoadVersion, the caller must hold the commit lock.
+func (tree *MutableTree) loadVersion(targetVersion int64) (int64, error) {
+	if err := tree.ndb.clearSpilledFastNodeRemovals(); err != nil {
+		return 0, err
+	}
+	if rolledBack, err := tree.ndb.rollbackInterruptedCommit(); err != nil {
+		return 0, err
+	} else if rolledBack > 0 {
+		if err := tree.ndb.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	if resumed, err := tree.ndb.resumePruning(); err != nil {
+		return 0, err
+	} else if resumed > 0 {
+		if err := tree.ndb.Commit(); err != nil {
+			return 0, err
+		}
+	}
+
 	firstVersion, err := tree.ndb.getFirstVersion()
 	if err != nil {
 		return 0, err
@@ -420,8 +624,6 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	if firstVersion == 0 {
 		if targetVersion <= 0 {
 			if !tree.skipFastStorageUpgrade {
-				tree.mtx.Lock()
-				defer tree.mtx.Unlock()
 				_, err := tree.enableFastStorageAndCommitIfNotEnabled()
 				return 0, err
 			}
@@ -453,9 +655,13 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 			return 0, err
 		}
 	}
+	if err := tree.checkHeight(targetVersion, iTree.root); err != nil {
+		return 0, err
+	}
 
 	tree.ImmutableTree = iTree
-	tree.lastSaved = iTree.clone()
+	tree.setLastSaved(iTree.clone())
+	tree.orphanedValueBytes = 0
 
 	if !tree.skipFastStorageUpgrade {
 		// Attempt to upgrade
@@ -470,7 +676,10 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 // loadVersionForOverwriting attempts to load a tree at a previously committed
 // version, or the latest version below it. Any versions greater than targetVersion will be deleted.
 func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) error {
-	if _, err := tree.LoadVersion(targetVersion); err != nil {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	if _, err := tree.loadVersion(targetVersion); err != nil {
 		return err
 	}
 
@@ -545,7 +754,7 @@ func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error)
 	}
 
 	if err := tree.enableFastStorageAndCommit(); err != nil {
-		tree.ndb.storageVersion = defaultStorageVersionValue
+		tree.ndb.setStorageVersion(defaultStorageVersionValue)
 		return false, err
 	}
 	return true, nil
@@ -583,6 +792,8 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 
 // GetImmutable loads an ImmutableTree at a given version for querying. The returned tree is
 // safe for concurrent access, provided the version is not deleted, e.g. via `DeleteVersion()`.
+// It is safe to call concurrently with SaveVersion, and does not open a version before its commit
+// is published, even if some of it was already written with Options.CommitSubBatchSize.
 func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 	rootNodeKey, err := tree.ndb.GetRoot(version)
 	if err != nil {
@@ -600,6 +811,15 @@ func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 			return nil, err
 		}
 	}
+	// the root is only checked after loading it, since a concurrent commit may publish it after
+	// flushing it, see Options.CommitSubBatchSize.
+	published, err := tree.ndb.isPublished(version)
+	if err != nil {
+		return nil, err
+	}
+	if !published {
+		return nil, ErrVersionDoesNotExist
+	}
 
 	return &ImmutableTree{
 		root:                   root,
@@ -609,11 +829,120 @@ func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 	}, nil
 }
 
+// ExportCheckpoint starts an export of a saved version, which pins the version against pruning
+// until the exporter is closed. Unlike exporting the tree returned by GetImmutable, the version
+// can not be pruned between loading and pinning it. New versions can be saved while the export is
+// in progress, and with Options.DeferPruning older versions pruned as well, so the node does not
+// have to be paused.
+//
+// While the version is pinned, the nodes orphaned by later versions are kept on disk, so disk
+// usage grows with the amount of state changed since the version until the exporter is closed and
+// the deferred pruning has run. The export itself only buffers a few nodes in memory, but it
+// reads through the node cache, which may evict nodes used by ongoing commits.
+func (tree *MutableTree) ExportCheckpoint(version int64) (*Exporter, error) {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	return t.Export()
+}
+
+// DeferredPruneVersion returns the version that pruning was deferred to by DeleteVersionsTo,
+// because of active version readers, or 0 if no pruning is pending. Pruning is only deferred with
+// Options.DeferPruning.
+func (tree *MutableTree) DeferredPruneVersion() int64 {
+	return tree.ndb.deferredPruneVersion()
+}
+
+// InterruptedPruneVersion returns the target version of a DeleteVersionsTo interrupted by a crash
+// after some of its sub-batches were written, see Options.CommitSubBatchSize, or 0 if there is
+// none. The pruning is resumed by the next load.
+func (tree *MutableTree) InterruptedPruneVersion() (int64, error) {
+	return tree.ndb.interruptedPruneVersion()
+}
+
+// LoadVersionIntoMemory eagerly loads the entire tree at the given version into memory, and returns
+// it as an ImmutableTree detached from the backend: reads of the returned tree never touch the
+// shared database or node cache, which makes it suitable for intense analytical workloads over
+// small historical versions. Memory usage is proportional to the size of the tree.
+//
+// The returned tree is safe for concurrent access, and remains valid after the version is deleted.
+func (tree *MutableTree) LoadVersionIntoMemory(version int64) (*ImmutableTree, error) {
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := DefaultOptions()
+	opts.HashKeys = tree.ndb.opts.HashKeys
+	detached := &ImmutableTree{
+		ndb:                    newNodeDB(dbm.NewMemDB(), 0, &opts),
+		version:                version,
+		skipFastStorageUpgrade: true,
+	}
+	if itree.root != nil {
+		detached.root, err = itree.materializeNode(itree.root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return detached, nil
+}
+
+// materializeNode returns a copy of the node with all of its descendants loaded and linked.
+// Descendants not in memory are read from disk without adding them to the node cache, so that
+// loading a version does not evict the working set of the live tree.
+func (t *ImmutableTree) materializeNode(node *Node) (*Node, error) {
+	materialized := &Node{
+		key:           node.key,
+		value:         node.value,
+		hash:          node.hash,
+		nodeKey:       node.nodeKey,
+		leftNodeKey:   node.leftNodeKey,
+		rightNodeKey:  node.rightNodeKey,
+		size:          node.size,
+		subtreeHeight: node.subtreeHeight,
+	}
+	if node.isLeaf() {
+		return materialized, nil
+	}
+
+	leftNode := node.leftNode
+	if leftNode == nil {
+		var err error
+		if leftNode, err = t.ndb.readNode(node.leftNodeKey); err != nil {
+			return nil, err
+		}
+	}
+	rightNode := node.rightNode
+	if rightNode == nil {
+		var err error
+		if rightNode, err = t.ndb.readNode(node.rightNodeKey); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if materialized.leftNode, err = t.materializeNode(leftNode); err != nil {
+		return nil, err
+	}
+	if materialized.rightNode, err = t.materializeNode(rightNode); err != nil {
+		return nil, err
+	}
+	return materialized, nil
+}
+
 // Rollback resets the working tree to the latest saved version, discarding
 // any unsaved modifications.
 func (tree *MutableTree) Rollback() {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	tree.orphanedValueBytes = 0
 	if tree.version > 0 {
-		tree.ImmutableTree = tree.lastSaved.clone()
+		tree.ImmutableTree = tree.getLastSaved().clone()
 	} else {
 		tree.ImmutableTree = &ImmutableTree{
 			ndb:                    tree.ndb,
@@ -624,35 +953,55 @@ func (tree *MutableTree) Rollback() {
 	if !tree.skipFastStorageUpgrade {
 		tree.unsavedFastNodeAdditions = map[string]*fastnode.Node{}
 		tree.unsavedFastNodeRemovals = map[string]interface{}{}
+		tree.ndb.discardSpilledFastNodeRemovals()
 	}
 }
 
 // GetVersioned gets the value at the specified key and version. The returned value must not be
-// modified, since it may point to data stored within IAVL.
+// modified, since it may point to data stored within IAVL. It is safe to call concurrently with
+// SaveVersion.
 func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error) {
+	tree.recordAccess(AccessRead, key, version)
+	key = tree.ndb.treeKey(key)
 	if tree.VersionExists(version) {
 		if !tree.skipFastStorageUpgrade {
-			isFastCacheEnabled, err := tree.IsFastCacheEnabled()
+			isFastCacheEnabled, err := tree.getLastSaved().IsFastCacheEnabled()
 			if err != nil {
 				return nil, err
 			}
 
 			if isFastCacheEnabled {
-				fastNode, _ := tree.ndb.GetFastNode(key)
-				if fastNode == nil && version == tree.ndb.latestVersion {
-					return nil, nil
+				commits := tree.ndb.getCommits()
+				fastNode, err := tree.ndb.GetFastNode(key)
+				if errors.Is(err, ErrBackendRead) {
+					return nil, err
 				}
-
-				if fastNode != nil && fastNode.GetVersionLastUpdatedAt() <= version {
-					return fastNode.GetValue(), nil
+				// other fast node errors fall back to the tree.
+				if err == nil {
+					latestVersion, err := tree.ndb.getLatestVersion()
+					if err != nil {
+						return nil, err
+					}
+					// a missing fast node only means a missing key if no commit changed the fast
+					// nodes meanwhile.
+					if fastNode == nil && version == latestVersion && !tree.ndb.commitsSince(commits) {
+						return nil, nil
+					}
+
+					if fastNode != nil && fastNode.GetVersionLastUpdatedAt() <= version {
+						return fastNode.GetValue(), nil
+					}
 				}
 			}
 		}
 		t, err := tree.GetImmutable(version)
-		if err != nil {
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			// the version was deleted meanwhile.
 			return nil, nil
+		} else if err != nil {
+			return nil, err
 		}
-		value, err := t.Get(key)
+		value, err := t.get(key)
 		if err != nil {
 			return nil, err
 		}
@@ -661,13 +1010,95 @@ func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error)
 	return nil, nil
 }
 
+// SizeAt returns the number of leaves at the specified version. Only the root record of the
+// version is read, which stores the size of the tree, so it is cheap for any version. It is safe
+// to call concurrently with SaveVersion.
+func (tree *MutableTree) SizeAt(version int64) (int64, error) {
+	if !tree.VersionExists(version) {
+		return 0, ErrVersionDoesNotExist
+	}
+	rootNodeKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return 0, err
+	}
+	// rootNodeKey.version = 0 means root is a nil
+	if rootNodeKey == nil || rootNodeKey.version == 0 {
+		return 0, nil
+	}
+	root, err := tree.ndb.GetNode(rootNodeKey)
+	if err != nil {
+		return 0, err
+	}
+	return root.size, nil
+}
+
+// IsEmptyAt returns true if the tree has no leaves at the specified version. Like SizeAt, it only
+// reads the root record of the version.
+func (tree *MutableTree) IsEmptyAt(version int64) (bool, error) {
+	size, err := tree.SizeAt(version)
+	if err != nil {
+		return false, err
+	}
+	return size == 0, nil
+}
+
+// checkHeight checks the height of the root of a version against Options.MaxTreeHeight.
+func (tree *MutableTree) checkHeight(version int64, root *Node) error {
+	maxHeight := tree.ndb.opts.MaxTreeHeight
+	if maxHeight <= 0 || root == nil || int(root.subtreeHeight) <= maxHeight {
+		return nil
+	}
+	if hook := tree.ndb.opts.OnMaxTreeHeightExceeded; hook != nil {
+		hook(version, root.subtreeHeight)
+		return nil
+	}
+	return fmt.Errorf("%w: version %d has height %d, the maximum is %d",
+		ErrTreeHeightExceeded, version, root.subtreeHeight, maxHeight)
+}
+
 // SaveVersion saves a new tree version to disk, based on the current state of
 // the tree. Returns the hash and new version number.
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
 	version := tree.version + 1
 	if version == 1 && tree.ndb.opts.InitialVersion > 0 {
 		version = int64(tree.ndb.opts.InitialVersion)
 	}
+	return tree.saveVersion(version)
+}
+
+// SaveVersionAt saves a new tree version at the given version, which may skip versions after the
+// latest version, e.g. to map versions to external heights with gaps. Skipped versions do not
+// exist: they can not be loaded or queried, and are passed over by pruning, state change
+// traversal and AvailableVersions. Saving the version after the latest one is equivalent to
+// SaveVersion.
+//
+// The working hash is computed for the version after the latest one, so it differs from the hash
+// returned here when versions are skipped, since node hashes include their version.
+func (tree *MutableTree) SaveVersionAt(version int64) ([]byte, int64, error) {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	if version <= tree.version {
+		return nil, version, fmt.Errorf("version %d is not after the working version %d", version, tree.version)
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, version, err
+	}
+	if version <= latestVersion && version != tree.version+1 {
+		return nil, version, fmt.Errorf("can not skip to version %d before the latest version %d", version, latestVersion)
+	}
+	return tree.saveVersion(version)
+}
+
+// saveVersion saves the working tree as the given version. It must be called with the commit
+// lock held.
+func (tree *MutableTree) saveVersion(version int64) ([]byte, int64, error) {
+	start := time.Now()
+	defer tree.ndb.resetCommitMark()
 
 	if tree.VersionExists(version) {
 		// If the version already exists, return an error as we're attempting to overwrite.
@@ -693,15 +1124,55 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 			tree.version = version
 			tree.root = existingRoot
 			tree.ImmutableTree = tree.ImmutableTree.clone()
-			tree.lastSaved = tree.ImmutableTree.clone()
+			tree.setLastSaved(tree.ImmutableTree.clone())
 			return newHash, version, nil
 		}
 
 		return nil, version, fmt.Errorf("version %d was already saved to different hash from %X (existing nodeKey %d)", version, newHash, existingNodeKey)
 	}
 
+	if err := tree.checkHeight(version, tree.root); err != nil {
+		return nil, version, err
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, version, err
+	}
+	if version <= latestVersion {
+		return nil, version, fmt.Errorf("version %d was skipped before the latest version %d", version, latestVersion)
+	}
+
+	// the working hashes are cached for the next version, so a skipped version must rehash.
+	if version != tree.version+1 {
+		tree.root.clearUnsavedHashes()
+	}
+
+	// the hooks run before anything is written to the batch, so that a veto leaves nothing behind.
+	timings := &CommitTimings{Version: version}
+	phase := time.Now()
+	if err := tree.runPreCommitHooks(version); err != nil {
+		if version != tree.version+1 {
+			tree.root.clearUnsavedHashes()
+		}
+		return nil, version, err
+	}
+	phase = since(&timings.Hooks, phase)
+
+	if latestVersion > 0 && version > latestVersion+1 {
+		if err := tree.ndb.setVersionGapToBatch(latestVersion, version); err != nil {
+			return nil, version, err
+		}
+	}
+	if err := tree.ndb.setHashKeysToBatch(tree.ndb.batch); err != nil {
+		return nil, version, err
+	}
+
+	tree.ndb.timings = timings
+	defer func() { tree.ndb.timings = nil }()
+
 	logger.Debug("SAVE TREE %v\n", version)
 	// save new nodes
+	var newNodes []*Node
 	if tree.root == nil {
 		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
 			return nil, 0, err
@@ -713,29 +1184,54 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 				return nil, 0, err
 			}
 		} else {
-			if err := tree.saveNewNodes(version); err != nil {
+			if newNodes, err = tree.saveNewNodes(version); err != nil {
 				return nil, 0, err
 			}
 		}
 	}
 
-	tree.ndb.resetLatestVersion(version)
+	// the time not attributed to new nodes was spent writing the root.
+	phase = time.Now()
+	timings.MetadataUpdate += phase.Sub(start) - timings.Hooks - timings.Hashing -
+		timings.Encoding - timings.BatchBuild - timings.BackendWrite
+
+	if tree.ndb.opts.RecordVersionTimestamps {
+		if err := tree.recordVersionTimestamp(version, phase); err != nil {
+			return nil, version, err
+		}
+	}
+	if tree.ndb.opts.RecordVersionStats {
+		if err := tree.recordVersionStats(version, newNodes); err != nil {
+			return nil, version, err
+		}
+	}
 
+	tree.ndb.beginCommit()
+	defer tree.ndb.endCommit()
 	if !tree.skipFastStorageUpgrade {
-		if err := tree.saveFastNodeVersion(); err != nil {
+		if err := tree.saveFastNodeVersion(version); err != nil {
 			return nil, version, err
 		}
 	}
+	if err := tree.ndb.unmarkCommitToBatch(); err != nil {
+		return nil, version, err
+	}
+	phase = since(&timings.MetadataUpdate, phase)
 
 	if err := tree.ndb.Commit(); err != nil {
 		return nil, version, err
 	}
+	since(&timings.BackendWrite, phase)
+
+	// the version is only published to lock-free readers once it is persisted.
+	tree.ndb.resetLatestVersion(version)
 
 	tree.version = version
+	tree.orphanedValueBytes = 0
 
 	// set new working tree
 	tree.ImmutableTree = tree.ImmutableTree.clone()
-	tree.lastSaved = tree.ImmutableTree.clone()
+	tree.setLastSaved(tree.ImmutableTree.clone())
 	if !tree.skipFastStorageUpgrade {
 		tree.unsavedFastNodeAdditions = make(map[string]*fastnode.Node)
 		tree.unsavedFastNodeRemovals = make(map[string]interface{})
@@ -746,17 +1242,20 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 		return nil, version, err
 	}
 
+	timings.AutoTune = tree.ndb.tuner.tune(tree.ndb, timings)
+	tree.finishCommitTimings(timings, start)
+	tree.snapshots.committed(version)
 	return hash, version, nil
 }
 
-func (tree *MutableTree) saveFastNodeVersion() error {
+func (tree *MutableTree) saveFastNodeVersion(latestVersion int64) error {
 	if err := tree.saveFastNodeAdditions(); err != nil {
 		return err
 	}
 	if err := tree.saveFastNodeRemovals(); err != nil {
 		return err
 	}
-	return tree.ndb.setFastStorageVersionToBatch()
+	return tree.ndb.setFastStorageVersionAtToBatch(latestVersion)
 }
 
 func (tree *MutableTree) getUnsavedFastNodeAdditions() map[string]*fastnode.Node {
@@ -769,10 +1268,11 @@ func (tree *MutableTree) getUnsavedFastNodeRemovals() map[string]interface{} {
 	return tree.unsavedFastNodeRemovals
 }
 
-func (tree *MutableTree) addUnsavedAddition(key []byte, node *fastnode.Node) {
+func (tree *MutableTree) addUnsavedAddition(key []byte, node *fastnode.Node) error {
 	skey := ibytes.UnsafeBytesToStr(key)
 	delete(tree.unsavedFastNodeRemovals, skey)
 	tree.unsavedFastNodeAdditions[skey] = node
+	return tree.ndb.unspillFastNodeRemoval(key)
 }
 
 func (tree *MutableTree) saveFastNodeAdditions() error {
@@ -790,10 +1290,19 @@ func (tree *MutableTree) saveFastNodeAdditions() error {
 	return nil
 }
 
-func (tree *MutableTree) addUnsavedRemoval(key []byte) {
+// addUnsavedRemoval records the removal of a fast node, spilling it to disk once the number of
+// removals held in memory reaches Options.FastNodeRemovalsSpillThreshold.
+func (tree *MutableTree) addUnsavedRemoval(key []byte) error {
 	skey := ibytes.UnsafeBytesToStr(key)
 	delete(tree.unsavedFastNodeAdditions, skey)
+	threshold := tree.ndb.opts.FastNodeRemovalsSpillThreshold
+	if threshold > 0 && len(tree.unsavedFastNodeRemovals) >= threshold {
+		if _, ok := tree.unsavedFastNodeRemovals[skey]; !ok {
+			return tree.ndb.spillFastNodeRemoval(key)
+		}
+	}
 	tree.unsavedFastNodeRemovals[skey] = true
+	return nil
 }
 
 func (tree *MutableTree) saveFastNodeRemovals() error {
@@ -808,7 +1317,14 @@ func (tree *MutableTree) saveFastNodeRemovals() error {
 			return err
 		}
 	}
-	return nil
+
+	err := tree.ndb.traverseSpilledFastNodeRemovals(func(key []byte) error {
+		return tree.ndb.DeleteFastNode(key)
+	})
+	if err != nil {
+		return err
+	}
+	return tree.ndb.deleteSpilledFastNodeRemovalsToBatch()
 }
 
 // SetInitialVersion sets the initial version of the tree, replacing Options.InitialVersion.
@@ -819,9 +1335,16 @@ func (tree *MutableTree) SetInitialVersion(version uint64) {
 }
 
 // DeleteVersionsTo removes versions upto the given version from the MutableTree.
-// An error is returned if any single version has active readers.
-// All writes happen in a single batch with a single commit.
+// An error is returned if any single version has active readers, unless Options.DeferPruning is
+// set, in which case the versions from the first version with active readers, e.g. an export
+// started with ExportCheckpoint, are not removed yet. Their removal is deferred to a later call
+// once the readers are done, see DeferredPruneVersion. All writes happen in a single batch with a
+// single commit, unless Options.CommitSubBatchSize is set, in which case the progress is recorded
+// on disk and an interrupted pruning is resumed by the next Load or LoadVersion.
 func (tree *MutableTree) DeleteVersionsTo(toVersion int64) error {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
 	if err := tree.ndb.DeleteVersionsTo(toVersion); err != nil {
 		return err
 	}
@@ -969,7 +1492,7 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, err error) {
 // saveNewNodes save new created nodes by the changes of the working tree.
 // NOTE: This function clears leftNode/rigthNode recursively and
 // calls _hash() on the given node.
-func (tree *MutableTree) saveNewNodes(version int64) error {
+func (tree *MutableTree) saveNewNodes(version int64) ([]*Node, error) {
 	nonce := int32(0)
 	newNodes := make([]*Node, 0)
 	var recursiveAssignKey func(*Node) (*NodeKey, error)
@@ -1004,22 +1527,28 @@ func (tree *MutableTree) saveNewNodes(version int64) error {
 		return node.nodeKey, nil
 	}
 
+	start := time.Now()
 	if _, err := recursiveAssignKey(tree.root); err != nil {
-		return err
+		return nil, err
+	}
+	if timings := tree.ndb.timings; timings != nil {
+		since(&timings.Hashing, start)
+		timings.NewNodes = len(newNodes)
 	}
 
 	for _, node := range newNodes {
 		if err := tree.ndb.SaveNode(node); err != nil {
-			return err
+			return nil, err
 		}
 		node.leftNode, node.rightNode = nil, nil
 	}
 
-	return nil
+	return newNodes, nil
 }
 
 // SaveChangeSet saves a ChangeSet to the tree.
-// It is used to replay a ChangeSet as a new version.
+// It is used to replay a ChangeSet as a new version. Keys are taken as stored in the tree, e.g.
+// as extracted by TraverseStateChanges, so they are not hashed again when Options.HashKeys is set.
 func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
 	// if the tree has uncommitted changes, return error
 	if tree.root != nil && tree.root.nodeKey == nil {
@@ -1027,7 +1556,7 @@ func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
 	}
 	for _, pair := range cs.Pairs {
 		if pair.Delete {
-			_, removed, err := tree.Remove(pair.Key)
+			_, removed, err := tree.remove(pair.Key)
 			if !removed {
 				return 0, fmt.Errorf("attempted to remove non-existent key %s", pair.Key)
 			}
@@ -1035,7 +1564,7 @@ func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
 				return 0, err
 			}
 		} else {
-			if _, err := tree.Set(pair.Key, pair.Value); err != nil {
+			if _, err := tree.set(pair.Key, pair.Value); err != nil {
 				return 0, err
 			}
 		}
@@ -2,13 +2,16 @@ package iavl
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"runtime"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cosmos/iavl/fastnode"
 
@@ -20,6 +23,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	db "github.com/cosmos/cosmos-db"
+	ics23 "github.com/cosmos/ics23/go"
 )
 
 var (
@@ -811,6 +815,9 @@ func TestUpgradeStorageToFast_DbErrorConstructor_Failure(t *testing.T) {
 
 	expectedError := errors.New("some db error")
 
+	// the format compatibility checks read the minimum reader version and key mode first.
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(minReaderVersionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hashKeysKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, expectedError).Times(1)
 	dbMock.EXPECT().NewBatch().Return(nil).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
@@ -838,6 +845,9 @@ func TestUpgradeStorageToFast_DbErrorEnableFastStorage_Failure(t *testing.T) {
 
 	batchMock := mock.NewMockBatch(ctrl)
 
+	// the format compatibility checks read the minimum reader version and key mode first.
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(minReaderVersionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hashKeysKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
@@ -887,6 +897,9 @@ func TestFastStorageReUpgradeProtection_NoForceUpgrade_Success(t *testing.T) {
 
 	batchMock := mock.NewMockBatch(ctrl)
 
+	// the format compatibility checks read the minimum reader version and key mode first.
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(minReaderVersionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hashKeysKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
@@ -935,6 +948,9 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 	// require.NoError(t, err)
 
 	// dbMock represents the underlying database under the hood of nodeDB
+	// the format compatibility checks read the minimum reader version and key mode first.
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(minReaderVersionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(hashKeysKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
 	dbMock.EXPECT().NewBatch().Return(batchMock).Times(3)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
@@ -1464,3 +1480,998 @@ func TestMutableTree_InitialVersion_FirstVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, initialVersion+1, node.nodeKey.version)
 }
+
+// TestMutableTree_ConcurrentCommittedReads runs readers of committed state concurrently
+// with a writer, it is meant to be run with the race detector enabled.
+func TestMutableTree_ConcurrentCommittedReads(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipFastStorageUpgrade=%v", skipFastStorageUpgrade), func(t *testing.T) {
+			tree := setupMutableTree(t, skipFastStorageUpgrade)
+			_, err := tree.Set([]byte("k0"), []byte("v0"))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			const versions = 50
+			var committing int64
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						_, err := tree.Hash()
+						assert.NoError(t, err)
+						assert.True(t, tree.VersionExists(1))
+						assert.NotEmpty(t, tree.AvailableVersions())
+
+						value, err := tree.GetVersioned([]byte("k0"), 1)
+						assert.NoError(t, err)
+						assert.Equal(t, []byte("v0"), value)
+
+						itree, err := tree.GetImmutable(1)
+						assert.NoError(t, err)
+						value, err = itree.Get([]byte("k0"))
+						assert.NoError(t, err)
+						assert.Equal(t, []byte("v0"), value)
+
+						// the version being committed is either not visible yet, or fully readable.
+						version := atomic.LoadInt64(&committing)
+						if tree.VersionExists(version) {
+							value, err = tree.GetVersioned([]byte(fmt.Sprintf("k%d", version-1)), version)
+							assert.NoError(t, err)
+							assert.Equal(t, []byte(fmt.Sprintf("v%d", version-1)), value)
+						}
+					}
+				}()
+			}
+
+			for i := 1; i <= versions; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+				require.NoError(t, err)
+				atomic.StoreInt64(&committing, int64(i+1))
+				_, _, err = tree.SaveVersion()
+				require.NoError(t, err)
+			}
+			close(done)
+			wg.Wait()
+
+			require.Equal(t, int64(versions+1), tree.Version())
+		})
+	}
+}
+
+func TestMutableTree_SpillFastNodeRemovals(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{FastNodeRemovalsSpillThreshold: 10}, false)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set(i2b(i), i2b(i))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for i := 0; i < 60; i++ {
+		_, removed, err := tree.Remove(i2b(i))
+		require.NoError(t, err)
+		require.True(t, removed)
+	}
+	// re-adding a spilled removal must take precedence over it
+	_, err = tree.Set(i2b(50), []byte("new"))
+	require.NoError(t, err)
+
+	require.Len(t, tree.unsavedFastNodeRemovals, 10)
+	require.Equal(t, 49, tree.ndb.spilledCount)
+
+	for i := 0; i < 100; i++ {
+		value, err := tree.Get(i2b(i))
+		require.NoError(t, err)
+		switch {
+		case i == 50:
+			require.Equal(t, []byte("new"), value)
+		case i < 60:
+			require.Nil(t, value)
+		default:
+			require.Equal(t, i2b(i), value)
+		}
+	}
+	count := 0
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, 41, count)
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 0, tree.ndb.spilledCount)
+
+	itr, err := db.IteratePrefix(memDB, spilledRemovalKeyFormat.Key())
+	require.NoError(t, err)
+	require.False(t, itr.Valid())
+	require.NoError(t, itr.Close())
+
+	// the fast index on disk must match the tree
+	reloaded, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	count = 0
+	_, err = reloaded.Iterate(func(key, value []byte) bool {
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, 41, count)
+
+	// rollback discards spilled removals
+	for i := 60; i < 90; i++ {
+		_, _, err := tree.Remove(i2b(i))
+		require.NoError(t, err)
+	}
+	tree.Rollback()
+	require.Equal(t, 0, tree.ndb.spilledCount)
+	value, err := tree.Get(i2b(80))
+	require.NoError(t, err)
+	require.Equal(t, i2b(80), value)
+}
+
+func TestMutableTree_Rollback_RetriesSpillClear(t *testing.T) {
+	crashDB := &crashingDB{DB: db.NewMemDB(), writes: 1 << 30}
+	tree, err := NewMutableTreeWithOpts(crashDB, 0, &Options{FastNodeRemovalsSpillThreshold: 1}, false)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set(i2b(i), i2b(i))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, _, err := tree.Remove(i2b(i))
+		require.NoError(t, err)
+	}
+	require.Positive(t, tree.ndb.spilledCount)
+
+	// the spilled removals can not be deleted, so reads retry and report the failure.
+	crashDB.writes = 0
+	tree.Rollback()
+	_, err = tree.Get(i2b(3))
+	require.Error(t, err)
+
+	// once the deletion succeeds, the removals are gone.
+	crashDB.writes = 1 << 30
+	value, err := tree.Get(i2b(3))
+	require.NoError(t, err)
+	require.Equal(t, i2b(3), value)
+	require.Zero(t, tree.ndb.spilledCount)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, tree.Size())
+}
+
+func TestMutableTree_Iterator_SpillReadError(t *testing.T) {
+	flaky := &flakyDB{DB: db.NewMemDB()}
+	tree, err := NewMutableTreeWithOpts(flaky, 0, &Options{FastNodeRemovalsSpillThreshold: 1}, false)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set(i2b(i), i2b(i))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, _, err := tree.Remove(i2b(i))
+		require.NoError(t, err)
+	}
+
+	// a failed lookup of a spilled removal invalidates the iterator rather than skipping it.
+	flaky.failures = 1
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	require.False(t, itr.Valid())
+	require.Error(t, itr.Error())
+	require.NoError(t, itr.Close())
+
+	// and Iterate reports it instead of a truncated iteration.
+	flaky.failures = 1
+	count := 0
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		count++
+		return false
+	})
+	require.Error(t, err)
+	require.Zero(t, count)
+
+	count = 0
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+}
+
+func TestMutableTree_LoadVersionIntoMemory(t *testing.T) {
+	tree := setupMutableTree(t, false)
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set(i2b(i), i2b(i))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		_, _, err := tree.Remove(i2b(i))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	expected, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	expectedHash, err := expected.Hash()
+	require.NoError(t, err)
+
+	mem, err := tree.LoadVersionIntoMemory(1)
+	require.NoError(t, err)
+
+	// the tree must stay usable once the version is gone from the backend
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	require.False(t, tree.VersionExists(1))
+
+	hash, err := mem.Hash()
+	require.NoError(t, err)
+	require.Equal(t, expectedHash, hash)
+	require.EqualValues(t, 100, mem.Size())
+	require.EqualValues(t, 1, mem.Version())
+
+	value, err := mem.Get(i2b(10))
+	require.NoError(t, err)
+	require.Equal(t, i2b(10), value)
+
+	count := 0
+	_, err = mem.Iterate(func(key, value []byte) bool {
+		require.Equal(t, i2b(count), key)
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, 100, count)
+
+	proof, err := mem.GetMembershipProof(i2b(10))
+	require.NoError(t, err)
+	ok, err := mem.VerifyMembership(proof, i2b(10))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = tree.LoadVersionIntoMemory(1)
+	require.Error(t, err)
+}
+
+func TestMutableTree_LoadVersionIntoMemory_BypassesCache(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set(i2b(i), i2b(i))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTree(memDB, 1000, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	cached := tree.ndb.nodeCache.Len()
+
+	mem, err := tree.LoadVersionIntoMemory(1)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, mem.Size())
+	require.Equal(t, cached, tree.ndb.nodeCache.Len())
+}
+
+func TestMutableTree_PreCommitHooks(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+
+	var summaries []CommitSummary
+	tree.AddPreCommitHook(func(summary *CommitSummary) error {
+		summaries = append(summaries, *summary)
+		return nil
+	})
+	veto := errors.New("veto")
+	vetoing := false
+	tree.AddPreCommitHook(func(summary *CommitSummary) error {
+		if vetoing {
+			return veto
+		}
+		return nil
+	})
+
+	_, err = tree.Set([]byte("a"), []byte{1})
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte{2})
+	require.NoError(t, err)
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	require.Equal(t, CommitSummary{
+		Version:       version,
+		Hash:          hash,
+		PrevHash:      sha256.New().Sum(nil),
+		Size:          2,
+		NewLeaves:     2,
+		NewInnerNodes: 1,
+	}, summaries[0])
+
+	// a vetoed commit persists nothing and leaves the working tree intact.
+	vetoing = true
+	_, err = tree.Set([]byte("c"), []byte{3})
+	require.NoError(t, err)
+	workingHash, err := tree.WorkingHash()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, veto)
+	require.Len(t, summaries, 2)
+	require.Equal(t, workingHash, summaries[1].Hash)
+	require.Equal(t, hash, summaries[1].PrevHash)
+	require.Equal(t, 1, summaries[1].NewLeaves)
+	require.Equal(t, 2, summaries[1].NewInnerNodes)
+	require.Equal(t, version, tree.Version())
+	require.False(t, tree.VersionExists(version+1))
+
+	vetoing = false
+	newHash, newVersion, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, version+1, newVersion)
+	require.Equal(t, workingHash, newHash)
+
+	value, err := tree.GetVersioned([]byte("c"), newVersion)
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, value)
+
+	// a vetoed skip does not leave its version gap behind for the next commit.
+	vetoing = true
+	_, err = tree.Set([]byte("d"), []byte{4})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersionAt(10)
+	require.ErrorIs(t, err, veto)
+	vetoing = false
+	_, newVersion, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, version+2, newVersion)
+	require.Equal(t, []int{1, 2, 3}, tree.AvailableVersions())
+
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	latest, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, newVersion, latest)
+	value, err = tree.Get([]byte("d"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, value)
+}
+
+func TestMutableTree_TieredNodeCache(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, true)
+	require.NoError(t, err)
+	_, ok := tree.NodeCacheStats()
+	require.False(t, ok)
+
+	opts := DefaultOptions()
+	opts.NodeCacheLargeNodeThreshold = 1024
+	opts.NodeCacheLargeNodeSize = 4
+	memDB := db.NewMemDB()
+	tree, err = NewMutableTreeWithOpts(memDB, 1000, &opts, true)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("small%03d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+		_, err = tree.Set([]byte(fmt.Sprintf("large%03d", i)), bytes.Repeat([]byte{byte(i)}, 2048))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	stats, ok := tree.NodeCacheStats()
+	require.True(t, ok)
+	require.Equal(t, 4, stats.Large.Len)
+	require.Equal(t, 100+199, stats.Small.Len)
+
+	// reading all large values through a fresh tree only evicts large nodes.
+	tree, err = NewMutableTreeWithOpts(memDB, 1000, &opts, true)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(version)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		value, err := tree.Get([]byte(fmt.Sprintf("large%03d", i)))
+		require.NoError(t, err)
+		require.Len(t, value, 2048)
+	}
+	stats, ok = tree.NodeCacheStats()
+	require.True(t, ok)
+	require.Equal(t, 4, stats.Large.Len)
+	require.EqualValues(t, 96, stats.Large.Evictions)
+	require.Zero(t, stats.Small.Evictions)
+}
+
+func TestMutableTree_AuditLog(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+
+	var records []AccessRecord
+	log := NewAuditLog(func(flushed []AccessRecord) {
+		records = append(records, flushed...)
+	}, 2)
+	tree.SetAuditLog(log)
+
+	log.SetLabels("tx1")
+	// reads of an empty tree are recorded too.
+	_, err = tree.Get([]byte("z"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte{1})
+	require.NoError(t, err)
+	_, err = tree.Get([]byte("a"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	log.SetLabels("tx2", "block2")
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	_, err = tree.GetVersioned([]byte("a"), 1)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), nil)
+	require.Error(t, err)
+
+	log.Close()
+	// accesses after closing are not recorded.
+	_, err = tree.Get([]byte("b"))
+	require.NoError(t, err)
+
+	// the log can be replaced while versions are read concurrently.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_, err := tree.GetVersioned([]byte("a"), 1)
+			require.NoError(t, err)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		tree.SetAuditLog(nil)
+		tree.SetAuditLog(log)
+	}
+	<-done
+
+	tx1, tx2 := []string{"tx1"}, []string{"tx2", "block2"}
+	require.Equal(t, []AccessRecord{
+		{Kind: AccessRead, Key: []byte("z"), Version: 1, Labels: tx1},
+		{Kind: AccessWrite, Key: []byte("a"), Version: 1, Labels: tx1},
+		{Kind: AccessRead, Key: []byte("a"), Version: 1, Labels: tx1},
+		{Kind: AccessDelete, Key: []byte("a"), Version: 2, Labels: tx2},
+		{Kind: AccessRead, Key: []byte("a"), Version: 1, Labels: tx2},
+	}, records)
+}
+
+func TestMutableTree_CommitTimings(t *testing.T) {
+	var reported []CommitTimings
+	opts := DefaultOptions()
+	opts.CommitDeadline = time.Nanosecond
+	opts.OnCommitTimings = func(timings CommitTimings) {
+		reported = append(reported, timings)
+	}
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &opts, false)
+	require.NoError(t, err)
+
+	_, ok := tree.LastCommitTimings()
+	require.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	timings, ok := tree.LastCommitTimings()
+	require.True(t, ok)
+	require.Equal(t, []CommitTimings{timings}, reported)
+	require.Equal(t, version, timings.Version)
+	require.Equal(t, 199, timings.NewNodes)
+	// the genesis version flushes the batch after every node.
+	require.Equal(t, 199, timings.PartialFlushes)
+	require.True(t, timings.DeadlineExceeded)
+	require.Positive(t, timings.Total)
+	require.LessOrEqual(t, timings.Hooks+timings.Hashing+timings.Encoding+timings.BatchBuild+
+		timings.MetadataUpdate+timings.BackendWrite, timings.Total)
+
+	_, err = tree.Set([]byte("key0"), []byte{255})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	timings, ok = tree.LastCommitTimings()
+	require.True(t, ok)
+	require.Len(t, reported, 2)
+	require.Equal(t, 0, timings.PartialFlushes)
+	require.Equal(t, int(tree.Height())+1, timings.NewNodes)
+}
+
+func TestMutableTree_MaxTreeHeight(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	height := tree.Height()
+
+	// the guard errors on load and save.
+	opts := DefaultOptions()
+	opts.MaxTreeHeight = int(height) - 1
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &opts, false)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(version)
+	require.ErrorIs(t, err, ErrTreeHeightExceeded)
+
+	opts.MaxTreeHeight = int(height)
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &opts, false)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(version)
+	require.NoError(t, err)
+	for i := 100; tree.Height() <= height; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, ErrTreeHeightExceeded)
+	require.False(t, tree.VersionExists(version+1))
+
+	// the hook warns instead.
+	var warned []int8
+	opts.OnMaxTreeHeightExceeded = func(v int64, h int8) {
+		require.Equal(t, version, v)
+		warned = append(warned, h)
+	}
+	opts.MaxTreeHeight = int(height) - 1
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &opts, false)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(version)
+	require.NoError(t, err)
+	require.Equal(t, []int8{height}, warned)
+}
+
+func TestMutableTree_ConditionalSet(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+
+	existing, set, err := tree.SetIfAbsent([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	require.True(t, set)
+	require.Nil(t, existing)
+	for i := 0; i < 50; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// failed conditions leave the working tree unchanged.
+	existing, set, err = tree.SetIfAbsent([]byte("a"), []byte("2"))
+	require.NoError(t, err)
+	require.False(t, set)
+	require.Equal(t, []byte("1"), existing)
+	prior, set, err := tree.CompareAndSet([]byte("key10"), []byte{9}, []byte("x"))
+	require.NoError(t, err)
+	require.False(t, set)
+	require.Equal(t, []byte{10}, prior)
+	prior, set, err = tree.CompareAndSet([]byte("key10"), nil, []byte("x"))
+	require.NoError(t, err)
+	require.False(t, set)
+	require.Equal(t, []byte{10}, prior)
+	prior, set, err = tree.CompareAndSet([]byte("b"), []byte("1"), []byte("x"))
+	require.NoError(t, err)
+	require.False(t, set)
+	require.Nil(t, prior)
+	workingHash, err := tree.WorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, workingHash)
+
+	prior, set, err = tree.CompareAndSet([]byte("key10"), []byte{10}, []byte("x"))
+	require.NoError(t, err)
+	require.True(t, set)
+	require.Equal(t, []byte{10}, prior)
+	prior, set, err = tree.CompareAndSet([]byte("b"), nil, []byte("y"))
+	require.NoError(t, err)
+	require.True(t, set)
+	require.Nil(t, prior)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	value, err := tree.Get([]byte("key10"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("x"), value)
+	value, err = tree.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("y"), value)
+	require.EqualValues(t, 52, tree.Size())
+}
+
+func TestMutableTree_SaveVersionAt(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+
+	hashes := map[int64][]byte{}
+	for _, version := range []int64{1, 2, 10, 11, 20} {
+		_, err = tree.Set([]byte(fmt.Sprintf("key%02d", version)), []byte{byte(version)})
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("shared"), []byte{byte(version)})
+		require.NoError(t, err)
+		hash, v, err := tree.SaveVersionAt(version)
+		require.NoError(t, err)
+		require.Equal(t, version, v)
+		hashes[version] = hash
+	}
+	_, _, err = tree.SaveVersionAt(20)
+	require.Error(t, err)
+	_, _, err = tree.SaveVersionAt(15)
+	require.Error(t, err)
+
+	requireVersions := func(tree *MutableTree, versions ...int) {
+		require.Equal(t, versions, tree.AvailableVersions())
+		for _, version := range versions {
+			require.True(t, tree.VersionExists(int64(version)))
+			value, err := tree.GetVersioned([]byte("shared"), int64(version))
+			require.NoError(t, err)
+			require.Equal(t, []byte{byte(version)}, value)
+
+			itree, err := tree.GetImmutable(int64(version))
+			require.NoError(t, err)
+			hash, err := itree.Hash()
+			require.NoError(t, err)
+			require.Equal(t, hashes[int64(version)], hash)
+			proof, err := itree.GetMembershipProof([]byte("shared"))
+			require.NoError(t, err)
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, hash, proof, []byte("shared"), []byte{byte(version)}))
+		}
+	}
+	requireVersions(tree, 1, 2, 10, 11, 20)
+	require.False(t, tree.VersionExists(5))
+	require.False(t, tree.VersionExists(19))
+	_, err = tree.GetImmutable(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// state changes are relative to the previous saved version.
+	var changed []int64
+	err = tree.TraverseStateChanges(1, 20, func(version int64, cs *ChangeSet) error {
+		changed = append(changed, version)
+		require.Len(t, cs.Pairs, 2)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 10, 11, 20}, changed)
+
+	// gaps survive reloading.
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(10)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	latest, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 20, latest)
+	requireVersions(tree, 1, 2, 10, 11, 20)
+
+	// pruning skips gaps, and leaves no orphans behind.
+	require.NoError(t, tree.DeleteVersionsTo(10))
+	requireVersions(tree, 11, 20)
+	require.NoError(t, tree.DeleteVersionsTo(15))
+	requireVersions(tree, 20)
+	tree, err = NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	requireVersions(tree, 20)
+	nodes := 0
+	_, err = tree.root.traversePost(tree.ImmutableTree, true, func(*Node) bool {
+		nodes++
+		return false
+	})
+	require.NoError(t, err)
+	stored := 0
+	require.NoError(t, tree.ndb.traversePrefix(nodeKeyFormat.Key(), func(_, _ []byte) error {
+		stored++
+		return nil
+	}))
+	require.Equal(t, nodes, stored)
+
+	_, err = tree.Set([]byte("shared"), []byte{30})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersionAt(30)
+	require.NoError(t, err)
+	require.NoError(t, tree.LoadVersionForOverwriting(20))
+	requireVersions(tree, 20)
+	_, version, err := tree.SaveVersionAt(25)
+	require.NoError(t, err)
+	require.EqualValues(t, 25, version)
+	require.Equal(t, []int{20, 25}, tree.AvailableVersions())
+
+	// hashes cached by WorkingHash for the next version are not reused for a skipped version.
+	var skipHashes [2][]byte
+	for i, workingHash := range []bool{false, true} {
+		memDB := db.NewMemDB()
+		tree, err := NewMutableTree(memDB, 0, false)
+		require.NoError(t, err)
+		for _, key := range []string{"a", "b", "c"} {
+			_, err = tree.Set([]byte(key), []byte(key))
+			require.NoError(t, err)
+		}
+		if workingHash {
+			_, err = tree.WorkingHash()
+			require.NoError(t, err)
+		}
+		skipHashes[i], _, err = tree.SaveVersionAt(10)
+		require.NoError(t, err)
+
+		tree, err = NewMutableTree(memDB, 0, false)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		proof, err := tree.GetMembershipProof([]byte("b"))
+		require.NoError(t, err)
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, skipHashes[i], proof, []byte("b"), []byte("b")))
+	}
+	require.Equal(t, skipHashes[0], skipHashes[1])
+}
+
+func TestMutableTree_SizeAt(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = tree.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// version 3 refers to the root of version 2.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		_, _, err = tree.Remove([]byte(key))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for version, expected := range map[int64]int64{1: 0, 2: 3, 3: 3, 4: 0} {
+		size, err := tree.SizeAt(version)
+		require.NoError(t, err)
+		require.Equal(t, expected, size, "version %d", version)
+		empty, err := tree.IsEmptyAt(version)
+		require.NoError(t, err)
+		require.Equal(t, expected == 0, empty, "version %d", version)
+	}
+
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	_, err = tree.SizeAt(2)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.IsEmptyAt(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	size, err := tree.SizeAt(3)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, size)
+}
+
+func TestMutableTree_Has(t *testing.T) {
+	for _, opts := range []*Options{nil, {HashKeys: true}} {
+		tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, opts, false)
+		require.NoError(t, err)
+		for i := 0; i < 50; i++ {
+			_, err = tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", i)))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		_, _, err = tree.Remove([]byte("k10"))
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("new"), []byte("v"))
+		require.NoError(t, err)
+
+		// the working tree reflects the unsaved changes.
+		for key, expected := range map[string]bool{"k00": true, "k10": false, "k49": true, "new": true, "k50": false, "": false} {
+			has, err := tree.Has([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, expected, has, key)
+		}
+
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		// the latest version uses the fast index, the previous one walks the tree.
+		for version, present := range map[int64][]string{1: {"k10"}, 2: {"new"}} {
+			itree, err := tree.GetImmutable(version)
+			require.NoError(t, err)
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("k%02d", i)
+				has, err := itree.Has([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, key != "k10" || version == 1, has, key)
+			}
+			for _, key := range present {
+				has, err := itree.Has([]byte(key))
+				require.NoError(t, err)
+				require.True(t, has, key)
+			}
+			has, err := itree.Has([]byte("k50"))
+			require.NoError(t, err)
+			require.False(t, has)
+		}
+	}
+}
+
+// TestImmutableTree_ConcurrentCommits checks Has and Get on the latest version while the next one
+// is committed, it is meant to be run with the race detector enabled.
+func TestImmutableTree_ConcurrentCommits(t *testing.T) {
+	tree := setupMutableTree(t, false)
+	_, err := tree.Set([]byte("k1"), []byte("v1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// version v holds k<v> only, the next version removes it and adds k<v+1>.
+				latestVersion, err := tree.ndb.getLatestVersion()
+				assert.NoError(t, err)
+				itree, err := tree.GetImmutable(latestVersion)
+				assert.NoError(t, err)
+				has, err := itree.Has([]byte(fmt.Sprintf("k%d", latestVersion)))
+				assert.NoError(t, err)
+				assert.True(t, has, latestVersion)
+				has, err = itree.Has([]byte(fmt.Sprintf("k%d", latestVersion+1)))
+				assert.NoError(t, err)
+				assert.False(t, has, latestVersion)
+				value, err := itree.Get([]byte(fmt.Sprintf("k%d", latestVersion)))
+				assert.NoError(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("v%d", latestVersion)), value)
+			}
+		}()
+	}
+
+	for i := 2; i <= 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+		_, removed, err := tree.Remove([]byte(fmt.Sprintf("k%d", i-1)))
+		require.NoError(t, err)
+		require.True(t, removed)
+		// widen the window between the fast node writes and the commit.
+		for j := 0; j < 200; j++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("f%d-%d", i, j)), []byte("v"))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+}
+
+// writeHookDB calls onWrite after every batch written to the database.
+type writeHookDB struct {
+	db.DB
+	onWrite func()
+}
+
+func (d *writeHookDB) NewBatch() db.Batch {
+	return &writeHookBatch{Batch: d.DB.NewBatch(), db: d}
+}
+
+type writeHookBatch struct {
+	db.Batch
+	db *writeHookDB
+}
+
+func (b *writeHookBatch) Write() error {
+	if err := b.Batch.Write(); err != nil {
+		return err
+	}
+	if b.db.onWrite != nil {
+		b.db.onWrite()
+	}
+	return nil
+}
+
+func (b *writeHookBatch) WriteSync() error {
+	return b.Write()
+}
+
+// TestImmutableTree_ReadsAfterCommitWrite reads the latest version after the next version was
+// written, but before it is published.
+func TestImmutableTree_ReadsAfterCommitWrite(t *testing.T) {
+	hookDB := &writeHookDB{DB: db.NewMemDB()}
+	tree, err := NewMutableTree(hookDB, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("k1"), []byte("v1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("k2"), []byte("v2"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("k1"))
+	require.NoError(t, err)
+	writes := 0
+	hookDB.onWrite = func() {
+		writes++
+		itree, err := tree.GetImmutable(1)
+		require.NoError(t, err)
+		value, err := itree.Get([]byte("k1"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("v1"), value)
+		has, err := itree.Has([]byte("k1"))
+		require.NoError(t, err)
+		require.True(t, has)
+		has, err = itree.Has([]byte("k2"))
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Positive(t, writes)
+}
+
+func TestImmutableTree_Has_SkipsLeafValues(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte{byte(i)}, 1024))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// reload with a large cache, and check that lookups don't cache the leaves.
+	tree, err = NewMutableTree(memDB, 1000, true)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for i := 0; i < 101; i++ {
+		has, err := tree.Has([]byte(fmt.Sprintf("k%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, i < 100, has)
+	}
+	require.Less(t, tree.ndb.nodeCache.Len(), 100)
+}
@@ -148,6 +148,23 @@ func MakeNode(nodeKey *NodeKey, buf []byte) (*Node, error) {
 	return node, nil
 }
 
+// decodeNodeKey decodes only the key of an encoded node, skipping the value of leaves and the
+// hashing MakeNode does for them.
+func decodeNodeKey(buf []byte) ([]byte, error) {
+	for _, field := range []string{"height", "size"} {
+		_, n, err := encoding.DecodeVarint(buf)
+		if err != nil {
+			return nil, fmt.Errorf("decoding node.%s, %w", field, err)
+		}
+		buf = buf[n:]
+	}
+	key, _, err := encoding.DecodeBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding node.key, %w", err)
+	}
+	return key, nil
+}
+
 func (node *Node) GetKey() []byte {
 	return node.nodeKey.GetKey()
 }
@@ -192,8 +209,12 @@ func (node *Node) clone(tree *MutableTree) (*Node, error) {
 		if err != nil {
 			return nil, err
 		}
-		node.leftNode = nil
-		node.rightNode = nil
+		// Persisted nodes may be shared with concurrent readers through the node
+		// cache, so only write to them when there is something to detach.
+		if node.leftNode != nil || node.rightNode != nil {
+			node.leftNode = nil
+			node.rightNode = nil
+		}
 	}
 
 	return &Node{
@@ -213,7 +234,8 @@ func (node *Node) isLeaf() bool {
 	return node.subtreeHeight == 0
 }
 
-// Check if the node has a descendant with the given key.
+// has returns whether the key exists under the node. It stops at the first node holding the key,
+// and only decodes the key of leaves, not their value.
 func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 	if bytes.Equal(node.key, key) {
 		return true, nil
@@ -221,6 +243,17 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 	if node.isLeaf() {
 		return false, nil
 	}
+	if node.subtreeHeight == 1 {
+		// the right leaf holds node.key, so only the left leaf can hold the key.
+		if bytes.Compare(key, node.key) > 0 {
+			return false, nil
+		}
+		leafKey, err := node.getLeftLeafKey(t)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(leafKey, key), nil
+	}
 	if bytes.Compare(key, node.key) < 0 {
 		leftNode, err := node.getLeftNode(t)
 		if err != nil {
@@ -309,15 +342,30 @@ func (node *Node) _hash(version int64) ([]byte, error) {
 		return node.hash, nil
 	}
 
-	h := sha256.New()
-	if err := node.writeHashBytes(h, version); err != nil {
+	hash, err := DefaultEncoderPool.Sum256(func(w io.Writer) error {
+		return node.writeHashBytes(w, version)
+	})
+	if err != nil {
 		return nil, err
 	}
-	node.hash = h.Sum(nil)
+	node.hash = hash
 
 	return node.hash, nil
 }
 
+// clearUnsavedHashes drops the cached hashes of the nodes which have not been persisted yet, since
+// they depend on the version the nodes are saved at.
+func (node *Node) clearUnsavedHashes() {
+	if node == nil || node.nodeKey != nil {
+		return
+	}
+	node.hash = nil
+	if !node.isLeaf() {
+		node.leftNode.clearUnsavedHashes()
+		node.rightNode.clearUnsavedHashes()
+	}
+}
+
 // Hash the node and its descendants recursively. This usually mutates all
 // descendant nodes. Returns the node hash and number of nodes hashed.
 // If the tree is empty (i.e. the node is nil), returns the hash of an empty input,
@@ -330,17 +378,13 @@ func (node *Node) hashWithCount(version int64) ([]byte, error) {
 		return node.hash, nil
 	}
 
-	h := sha256.New()
-	buf := new(bytes.Buffer)
-	err := node.writeHashBytesRecursively(buf, version)
-	if err != nil {
-		return nil, err
-	}
-	_, err = h.Write(buf.Bytes())
+	hash, err := DefaultEncoderPool.Sum256(func(w io.Writer) error {
+		return node.writeHashBytesRecursively(w, version)
+	})
 	if err != nil {
 		return nil, err
 	}
-	node.hash = h.Sum(nil)
+	node.hash = hash
 
 	return node.hash, nil
 }
@@ -534,6 +578,15 @@ func (node *Node) getLeftNode(t *ImmutableTree) (*Node, error) {
 	return leftNode, nil
 }
 
+// getLeftLeafKey returns the key of the left child of a node of height 1, without loading the
+// whole leaf if it is not in memory.
+func (node *Node) getLeftLeafKey(t *ImmutableTree) ([]byte, error) {
+	if node.leftNode != nil {
+		return node.leftNode.key, nil
+	}
+	return t.ndb.getLeafKey(node.leftNodeKey)
+}
+
 func (node *Node) getRightNode(t *ImmutableTree) (*Node, error) {
 	if node.rightNode != nil {
 		return node.rightNode, nil
@@ -577,30 +630,35 @@ func (node *Node) calcBalance(t *ImmutableTree) (int, error) {
 }
 
 // traverse is a wrapper over traverseInRange when we want the whole tree
-func (node *Node) traverse(t *ImmutableTree, ascending bool, cb func(*Node) bool) bool {
+func (node *Node) traverse(t *ImmutableTree, ascending bool, cb func(*Node) bool) (bool, error) {
 	return node.traverseInRange(t, nil, nil, ascending, false, false, func(node *Node) bool {
 		return cb(node)
 	})
 }
 
 // traversePost is a wrapper over traverseInRange when we want the whole tree post-order
-func (node *Node) traversePost(t *ImmutableTree, ascending bool, cb func(*Node) bool) bool {
+func (node *Node) traversePost(t *ImmutableTree, ascending bool, cb func(*Node) bool) (bool, error) {
 	return node.traverseInRange(t, nil, nil, ascending, false, true, func(node *Node) bool {
 		return cb(node)
 	})
 }
 
-func (node *Node) traverseInRange(tree *ImmutableTree, start, end []byte, ascending bool, inclusive bool, post bool, cb func(*Node) bool) bool {
-	stop := false
+// traverseInRange calls cb for the nodes of the subtree in the range, until cb returns true or a
+// node fails to load, in which case the error is returned.
+func (node *Node) traverseInRange(tree *ImmutableTree, start, end []byte, ascending bool, inclusive bool, post bool, cb func(*Node) bool) (bool, error) {
 	t := node.newTraversal(tree, start, end, ascending, inclusive, post)
-	// TODO: figure out how to handle these errors
-	for node2, err := t.next(); node2 != nil && err == nil; node2, err = t.next() {
-		stop = cb(node2)
-		if stop {
-			return stop
+	for {
+		node2, err := t.next()
+		if err != nil {
+			return false, err
+		}
+		if node2 == nil {
+			return false, nil
+		}
+		if cb(node2) {
+			return true, nil
 		}
 	}
-	return stop
 }
 
 var (
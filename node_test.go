@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"math/rand"
 	"testing"
 
@@ -244,6 +245,15 @@ func BenchmarkNode_HashNode(b *testing.B) {
 			_ = h.Sum(nil)
 		}
 	})
+	b.Run("Pooled", func(sub *testing.B) {
+		sub.ReportAllocs()
+		for i := 0; i < sub.N; i++ {
+			_, err := DefaultEncoderPool.Sum256(func(w io.Writer) error {
+				return node.writeHashBytes(w, node.nodeKey.version)
+			})
+			require.NoError(b, err)
+		}
+	})
 	b.Run("NoPreAllocate", func(sub *testing.B) {
 		sub.ReportAllocs()
 		for i := 0; i < sub.N; i++ {
@@ -3,6 +3,7 @@ package iavl
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
@@ -10,13 +11,17 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	dbm "github.com/cosmos/cosmos-db"
 
 	"github.com/cosmos/iavl/cache"
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
+	"github.com/cosmos/iavl/internal/encoding"
 	"github.com/cosmos/iavl/internal/logger"
+	"github.com/cosmos/iavl/internal/rawnode"
 	"github.com/cosmos/iavl/keyformat"
 )
 
@@ -26,6 +31,17 @@ const (
 	hashSize          = sha256.Size
 	genesisVersion    = 1
 	storageVersionKey = "storage_version"
+	// pruneProgressKey is the metadata key of the progress of an unfinished DeleteVersionsTo, see
+	// nodeDB.resumePruning. The value is the next version to delete followed by the target version.
+	pruneProgressKey = "prune_progress"
+	// commitProgressKey is the metadata key of a version whose commit was partially flushed, see
+	// nodeDB.rollbackInterruptedCommit. It is deleted by the last batch of the commit.
+	commitProgressKey = "commit_progress"
+	// restoreProgressKey is the metadata key of the progress of an unfinished restore from object
+	// storage, see MutableTree.RestoreFromObjectStoreWithOpts. The parts downloaded so far are
+	// stored under the metadata keys restorePartKeyPrefix followed by the part index.
+	restoreProgressKey   = "restore_progress"
+	restorePartKeyPrefix = "restore_part/"
 	// We store latest saved version together with storage version delimited by the constant below.
 	// This delimiter is valid only if fast storage is enabled (i.e. storageVersion >= fastStorageVersionValue).
 	// The latest saved version is needed for protection against downgrade and re-upgrade. In such a case, it would
@@ -55,21 +71,74 @@ var (
 	// The value at an entry will be in a variable format and up to the caller to
 	// decide how to parse.
 	metadataKeyFormat = keyformat.NewKeyFormat('m', 0) // m<keystring>
+
+	// Key Format for fast node removals of the working tree which were spilled to disk once they
+	// exceeded Options.FastNodeRemovalsSpillThreshold. Entries only exist while there are unsaved
+	// changes, and are removed in the same batch that saves the next version.
+	spilledRemovalKeyFormat = keyformat.NewKeyFormat('r', 0) // r<keystring>
+
+	// Key Format for the commit timestamps of versions, used to look up versions by time. The
+	// value is the timestamp in Unix nanoseconds.
+	timestampKeyFormat = keyformat.NewKeyFormat('t', int64Size) // t<version>
+
+	// Key Format for the version gaps left by MutableTree.SaveVersionAt, indexed by the version
+	// after the gap. The value is the version before the gap.
+	gapKeyFormat = keyformat.NewKeyFormat('g', int64Size) // g<version>
+
+	// Key Format for the statistics of versions, see VersionStats. The value is a sequence of
+	// varints.
+	statsKeyFormat = keyformat.NewKeyFormat('s', int64Size) // s<version>
+)
+
+// Values of nodeDB.gaps.
+const (
+	gapsUnknown int32 = iota
+	gapsNone
+	gapsPresent
 )
 
 var errInvalidFastStorageVersion = fmt.Sprintf("Fast storage version must be in the format <storage version>%s<latest fast cache version>", fastStorageVersionDelimiter)
 
+// nodeDB synchronization:
+//
+//   - mtx is the commit lock. It guards batch, versionReaders and pruneTo, and is held while
+//     the batch is written to disk.
+//   - cacheMtx is the cache lock. It guards nodeCache and fastNodeCache, and is only
+//     held for the duration of a single cache operation, never across disk reads.
+//   - storageMtx guards storageVersion, which is read on every fast node lookup.
+//   - firstVersion, latestVersion and commits are accessed atomically, so that readers of
+//     committed state never block on a commit in progress. latestVersion is only advanced once
+//     the version is written to disk.
+//
+// When both are needed, mtx must be acquired before cacheMtx.
 type nodeDB struct {
-	mtx            sync.Mutex       // Read/write lock.
-	db             dbm.DB           // Persistent node storage.
-	batch          dbm.Batch        // Batched writing buffer.
-	opts           Options          // Options to customize for pruning/writing
-	versionReaders map[int64]uint32 // Number of active version readers
-	storageVersion string           // Storage version
-	firstVersion   int64            // First version of nodeDB.
-	latestVersion  int64            // Latest version of nodeDB.
-	nodeCache      cache.Cache      // Cache for nodes in the regular tree that consists of key-value pairs at any version.
-	fastNodeCache  cache.Cache      // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
+	// firstVersion, latestVersion and commits are accessed atomically and must stay at the
+	// start of the struct to guarantee 64-bit alignment on 32-bit platforms.
+	firstVersion  int64 // First version of nodeDB.
+	latestVersion int64 // Latest version of nodeDB.
+	commits       int64 // Counts the starts and ends of commits, so it is odd during a commit.
+
+	mtx              sync.Mutex       // Commit lock.
+	cacheMtx         sync.Mutex       // Cache lock.
+	storageMtx       sync.RWMutex     // Storage version lock.
+	db               dbm.DB           // Persistent node storage.
+	batch            dbm.Batch        // Batched writing buffer.
+	opts             Options          // Options to customize for pruning/writing
+	versionReaders   map[int64]uint32 // Number of active version readers
+	pruneTo          int64            // Target of pruning deferred by active version readers, or 0.
+	gaps             int32            // Whether there are version gaps, see hasGaps. Accessed atomically.
+	hashKeysRecorded bool             // Whether the database records Options.HashKeys. Guarded by the tree commit lock.
+	commitMarked     bool             // Whether the commit in progress was recorded, see markCommitToBatch.
+	storageVersion   string           // Storage version
+	spilledCount     int              // Number of fast node removals spilled to disk
+	spillStale       bool             // Whether the spilled removals belong to a discarded working tree.
+	spillBatch       dbm.Batch        // Spilled fast node removals not yet written, see spillFastNodeRemoval.
+	spillPending     map[string]bool  // Keys of the removals in spillBatch.
+	timings          *CommitTimings   // Timings of the commit in progress, if any. Guarded by the tree commit lock.
+	nodeCache        cache.Cache      // Cache for nodes in the regular tree that consists of key-value pairs at any version.
+	fastNodeCache    cache.Cache      // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
+	tuner            *autoTuner       // Adaptive controller, see Options.AutoTune. Guarded by the tree commit lock.
+	prefixes         *prefixMetrics   // Metrics by key prefix, see Options.KeyPrefixes.
 }
 
 func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
@@ -84,69 +153,176 @@ func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
 		storeVersion = []byte(defaultStorageVersionValue)
 	}
 
+	var tuner *autoTuner
+	if opts.AutoTune != nil {
+		tuner = newAutoTuner(*opts.AutoTune, cacheSize)
+		if opts.Stat == nil {
+			// the tuner observes the hit rate through the statistics.
+			o := *opts
+			o.Stat = &Statistics{}
+			opts = &o
+		}
+	}
+
 	return &nodeDB{
 		db:             db,
 		batch:          db.NewBatch(),
 		opts:           *opts,
 		firstVersion:   0,
 		latestVersion:  0, // initially invalid
-		nodeCache:      cache.New(cacheSize),
+		nodeCache:      newNodeCache(cacheSize, opts),
 		fastNodeCache:  cache.New(fastNodeCacheSize),
 		versionReaders: make(map[int64]uint32, 8),
 		storageVersion: string(storeVersion),
+		tuner:          tuner,
+		prefixes:       newPrefixMetrics(opts.KeyPrefixes),
+	}
+}
+
+// newNodeCache creates the node cache, segmented by node size if configured.
+func newNodeCache(cacheSize int, opts *Options) cache.Cache {
+	if opts.NodeCacheLargeNodeThreshold <= 0 {
+		return cache.New(cacheSize)
+	}
+	largeSize := opts.NodeCacheLargeNodeSize
+	if largeSize <= 0 {
+		largeSize = cacheSize / 10
 	}
+	return cache.NewTiered(cacheSize, largeSize, opts.NodeCacheLargeNodeThreshold, func(node cache.Node) int {
+		return node.(*Node).encodedSize()
+	})
+}
+
+// nodeCacheStats returns the metrics of the node cache, if it is segmented by node size.
+func (ndb *nodeDB) nodeCacheStats() (cache.TieredStats, bool) {
+	ndb.cacheMtx.Lock()
+	defer ndb.cacheMtx.Unlock()
+	tiered, ok := ndb.nodeCache.(*cache.TieredCache)
+	if !ok {
+		return cache.TieredStats{}, false
+	}
+	return tiered.Stats(), true
 }
 
 // GetNode gets a node from memory or disk. If it is an inner node, it does not
-// load its children.
+// load its children. It is safe for concurrent use and does not block on commits.
 func (ndb *nodeDB) GetNode(nk *NodeKey) (*Node, error) {
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
-
 	if nk == nil {
 		return nil, ErrNodeMissingNodeKey
 	}
 
 	// Check the cache.
-	if cachedNode := ndb.nodeCache.Get(nk.GetKey()); cachedNode != nil {
+	ndb.cacheMtx.Lock()
+	cachedNode := ndb.nodeCache.Get(nk.GetKey())
+	ndb.cacheMtx.Unlock()
+	if cachedNode != nil {
 		ndb.opts.Stat.IncCacheHitCnt()
+		ndb.prefixes.recordCacheLookup(cachedNode.(*Node).key, true)
 		return cachedNode.(*Node), nil
 	}
 
 	ndb.opts.Stat.IncCacheMissCnt()
 
 	// Doesn't exist, load.
-	buf, err := ndb.db.Get(ndb.nodeKey(nk))
+	node, err := ndb.readNode(nk)
+	if err != nil {
+		return nil, err
+	}
+	ndb.prefixes.recordCacheLookup(node.key, false)
+
+	ndb.cacheMtx.Lock()
+	ndb.prefixes.cacheAdded(node, ndb.nodeCache.Add(node))
+	ndb.cacheMtx.Unlock()
+
+	return node, nil
+}
+
+// getNodeRecord reads the stored encoding of a node from disk, returning ErrNodeNotFound if it is
+// missing.
+func (ndb *nodeDB) getNodeRecord(nk *NodeKey) ([]byte, error) {
+	key := ndb.nodeKey(nk)
+	buf, err := ndb.dbGet(key)
 	if err != nil {
-		return nil, fmt.Errorf("can't get node %v: %v", nk, err)
+		return nil, fmt.Errorf("can't get node %v: %w", nk, err)
 	}
 	if buf == nil {
-		return nil, fmt.Errorf("Value missing for key %v corresponding to nodeKey %x", nk, ndb.nodeKey(nk))
+		return nil, fmt.Errorf("%w: node %v with key %x", ErrNodeNotFound, nk, key)
+	}
+	return buf, nil
+}
+
+// readNode reads and decodes a node from disk, bypassing the node cache.
+func (ndb *nodeDB) readNode(nk *NodeKey) (*Node, error) {
+	buf, err := ndb.getNodeRecord(nk)
+	if err != nil {
+		return nil, err
 	}
 
 	node, err := MakeNode(nk, buf)
 	if err != nil {
 		return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
 	}
+	if ndb.opts.StrictDeterminism {
+		if err := checkCanonicalNode(node, buf); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// getLeafKey returns the key of a node from memory or disk, without decoding and hashing the value
+// of a leaf loaded from disk. Such leaves are not cached. It is safe for concurrent use.
+func (ndb *nodeDB) getLeafKey(nk *NodeKey) ([]byte, error) {
+	if nk == nil {
+		return nil, ErrNodeMissingNodeKey
+	}
 
-	ndb.nodeCache.Add(node)
+	ndb.cacheMtx.Lock()
+	cachedNode := ndb.nodeCache.Get(nk.GetKey())
+	ndb.cacheMtx.Unlock()
+	if cachedNode != nil {
+		ndb.opts.Stat.IncCacheHitCnt()
+		ndb.prefixes.recordCacheLookup(cachedNode.(*Node).key, true)
+		return cachedNode.(*Node).key, nil
+	}
 
-	return node, nil
+	if ndb.opts.StrictDeterminism { // the whole node is needed to check its encoding.
+		node, err := ndb.GetNode(nk)
+		if err != nil {
+			return nil, err
+		}
+		return node.key, nil
+	}
+
+	ndb.opts.Stat.IncCacheMissCnt()
+
+	buf, err := ndb.getNodeRecord(nk)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeNodeKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+	}
+	ndb.prefixes.recordCacheLookup(key, false)
+	return key, nil
 }
 
+// GetFastNode gets a FastNode from memory or disk. It is safe for concurrent use and
+// does not block on commits.
 func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	if !ndb.hasUpgradedToFastStorage() {
 		return nil, errors.New("storage version is not fast")
 	}
 
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
-
 	if len(key) == 0 {
 		return nil, fmt.Errorf("nodeDB.GetFastNode() requires key, len(key) equals 0")
 	}
 
-	if cachedFastNode := ndb.fastNodeCache.Get(key); cachedFastNode != nil {
+	ndb.cacheMtx.Lock()
+	cachedFastNode := ndb.fastNodeCache.Get(key)
+	ndb.cacheMtx.Unlock()
+	if cachedFastNode != nil {
 		ndb.opts.Stat.IncFastCacheHitCnt()
 		return cachedFastNode.(*fastnode.Node), nil
 	}
@@ -154,7 +330,7 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	ndb.opts.Stat.IncFastCacheMissCnt()
 
 	// Doesn't exist, load.
-	buf, err := ndb.db.Get(ndb.fastNodeKey(key))
+	buf, err := ndb.dbGet(ndb.fastNodeKey(key))
 	if err != nil {
 		return nil, fmt.Errorf("can't get FastNode %X: %w", key, err)
 	}
@@ -166,10 +342,76 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading FastNode. bytes: %x, error: %w", buf, err)
 	}
+
+	ndb.cacheMtx.Lock()
 	ndb.fastNodeCache.Add(fastNode)
+	ndb.cacheMtx.Unlock()
+
 	return fastNode, nil
 }
 
+// getRawNode returns the stored encoding of a node, bypassing the cache, along with its hash.
+func (ndb *nodeDB) getRawNode(nk *NodeKey) ([]byte, []byte, error) {
+	buf, err := ndb.getNodeRecord(nk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(buf) == 0 || buf[0] == nodeKeyFormat.Prefix()[0] { // empty root or point to the prev root
+		return nil, nil, fmt.Errorf("%w: %v", rawnode.ErrNotANode, nk)
+	}
+	node, err := MakeNode(nk, buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+	}
+	return buf, node.hash, nil
+}
+
+// putRawNode replaces the stored encoding of a node, e.g. to repair a corrupted node from a copy
+// of a healthy database. The node must decode and hash to the given hash, with the hashes of
+// inner nodes recomputed from their stored children, so those must be intact. The write bypasses
+// the commit batch and is synced immediately.
+func (ndb *nodeDB) putRawNode(nk *NodeKey, buf []byte, hash []byte) error {
+	if len(buf) == 0 || buf[0] == nodeKeyFormat.Prefix()[0] {
+		return fmt.Errorf("%w: %v", rawnode.ErrNotANode, nk)
+	}
+	node, err := MakeNode(nk, buf)
+	if err != nil {
+		return fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+	}
+	if !node.isLeaf() {
+		stored := node.hash
+		if node.leftNode, err = ndb.GetNode(node.leftNodeKey); err != nil {
+			return err
+		}
+		if node.rightNode, err = ndb.GetNode(node.rightNodeKey); err != nil {
+			return err
+		}
+		node.hash = nil
+		if _, err := node._hash(nk.version); err != nil {
+			return err
+		}
+		if !bytes.Equal(node.hash, stored) {
+			return fmt.Errorf("%w: node %v stores hash %X, but its children hash to %X",
+				rawnode.ErrHashMismatch, nk, stored, node.hash)
+		}
+		node.leftNode, node.rightNode = nil, nil
+	}
+	if !bytes.Equal(node.hash, hash) {
+		return fmt.Errorf("%w: node %v hashes to %X, expected %X", rawnode.ErrHashMismatch, nk, node.hash, hash)
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if err := ndb.db.SetSync(ndb.nodeKey(nk), buf); err != nil {
+		return err
+	}
+	ndb.cacheMtx.Lock()
+	ndb.nodeCache.Remove(nk.GetKey())
+	ndb.prefixes.cacheRemoved(nk.GetKey())
+	ndb.cacheMtx.Unlock()
+	return nil
+}
+
 // SaveNode saves a node to disk.
 func (ndb *nodeDB) SaveNode(node *Node) error {
 	ndb.mtx.Lock()
@@ -179,6 +421,8 @@ func (ndb *nodeDB) SaveNode(node *Node) error {
 		return ErrNodeMissingNodeKey
 	}
 
+	start := time.Now()
+
 	// Save node bytes to db.
 	var buf bytes.Buffer
 	buf.Grow(node.encodedSize())
@@ -186,20 +430,49 @@ func (ndb *nodeDB) SaveNode(node *Node) error {
 	if err := node.writeBytes(&buf); err != nil {
 		return err
 	}
+	if ndb.timings != nil {
+		start = since(&ndb.timings.Encoding, start)
+		ndb.timings.NewNodeBytes += buf.Len()
+	}
+	ndb.prefixes.recordCommit(node, buf.Len())
 
 	if err := ndb.batch.Set(ndb.nodeKey(node.nodeKey), buf.Bytes()); err != nil {
 		return err
 	}
+	if ndb.timings != nil {
+		since(&ndb.timings.BatchBuild, start)
+	}
 
-	// resetBatch only working on generate a genesis block
+	// resetBatch only working on generate a genesis block, or once the batch reaches the
+	// sub-batch size.
 	if node.nodeKey.version <= genesisVersion {
+		if ndb.opts.CommitSubBatchSize > 0 {
+			if err := ndb.markCommitToBatch(node.nodeKey.version); err != nil {
+				return err
+			}
+		}
 		if err := ndb.resetBatch(); err != nil {
 			return err
 		}
+	} else if ndb.opts.CommitSubBatchSize > 0 {
+		size, err := ndb.batch.GetByteSize()
+		if err != nil {
+			return err
+		}
+		if size >= ndb.opts.CommitSubBatchSize {
+			if err := ndb.markCommitToBatch(node.nodeKey.version); err != nil {
+				return err
+			}
+			if err := ndb.resetBatch(); err != nil {
+				return err
+			}
+		}
 	}
 
 	logger.Debug("BATCH SAVE %+v\n", node)
-	ndb.nodeCache.Add(node)
+	ndb.cacheMtx.Lock()
+	ndb.prefixes.cacheAdded(node, ndb.nodeCache.Add(node))
+	ndb.cacheMtx.Unlock()
 	return nil
 }
 
@@ -221,10 +494,18 @@ func (ndb *nodeDB) SaveFastNodeNoCache(node *fastnode.Node) error {
 // 1.1.0-<version of the current live state>. Returns error if storage version is incorrect or on
 // db error, nil otherwise. Requires changes to be committed after to be persisted.
 func (ndb *nodeDB) setFastStorageVersionToBatch() error {
+	return ndb.setFastStorageVersionAtToBatch(0)
+}
+
+// setFastStorageVersionAtToBatch is like setFastStorageVersionToBatch, but records the given
+// version as the version of the live state, e.g. for a version which is not committed yet. A
+// version of 0 records the latest version.
+func (ndb *nodeDB) setFastStorageVersionAtToBatch(latestVersion int64) error {
 	var newVersion string
-	if ndb.storageVersion >= fastStorageVersionValue {
+	storageVersion := ndb.getStorageVersion()
+	if storageVersion >= fastStorageVersionValue {
 		// Storage version should be at index 0 and latest fast cache version at index 1
-		versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
+		versions := strings.Split(storageVersion, fastStorageVersionDelimiter)
 
 		if len(versions) > 2 {
 			return errors.New(errInvalidFastStorageVersion)
@@ -235,24 +516,43 @@ func (ndb *nodeDB) setFastStorageVersionToBatch() error {
 		newVersion = fastStorageVersionValue
 	}
 
-	latestVersion, err := ndb.getLatestVersion()
-	if err != nil {
-		return err
+	if latestVersion == 0 {
+		var err error
+		if latestVersion, err = ndb.getLatestVersion(); err != nil {
+			return err
+		}
 	}
-
 	newVersion += fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion))
 
 	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
 		return err
 	}
-	ndb.storageVersion = newVersion
+	ndb.setStorageVersion(newVersion)
 	return nil
 }
 
+// treeKey returns the key the given key is stored under in the tree, see ImmutableTree.treeKey.
+// Unlike the tree's, it is safe to call concurrently with SaveVersion.
+func (ndb *nodeDB) treeKey(key []byte) []byte {
+	if !ndb.opts.HashKeys {
+		return key
+	}
+	hash := sha256.Sum256(key)
+	return hash[:]
+}
+
 func (ndb *nodeDB) getStorageVersion() string {
+	ndb.storageMtx.RLock()
+	defer ndb.storageMtx.RUnlock()
 	return ndb.storageVersion
 }
 
+func (ndb *nodeDB) setStorageVersion(storageVersion string) {
+	ndb.storageMtx.Lock()
+	defer ndb.storageMtx.Unlock()
+	ndb.storageVersion = storageVersion
+}
+
 // Returns true if the upgrade to latest storage version has been performed, false otherwise.
 func (ndb *nodeDB) hasUpgradedToFastStorage() bool {
 	return ndb.getStorageVersion() >= fastStorageVersionValue
@@ -263,7 +563,7 @@ func (ndb *nodeDB) hasUpgradedToFastStorage() bool {
 // We determine this by checking the version of the live state and the version of the live state when
 // latest storage was updated on disk the last time.
 func (ndb *nodeDB) shouldForceFastStorageUpgrade() (bool, error) {
-	versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
+	versions := strings.Split(ndb.getStorageVersion(), fastStorageVersionDelimiter)
 
 	if len(versions) == 2 {
 		latestVersion, err := ndb.getLatestVersion()
@@ -278,7 +578,7 @@ func (ndb *nodeDB) shouldForceFastStorageUpgrade() (bool, error) {
 	return false, nil
 }
 
-// saveFastNodeUnlocked saves a FastNode to disk.
+// saveFastNodeUnlocked saves a FastNode to disk. The caller must hold the commit lock.
 func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bool) error {
 	if node.GetKey() == nil {
 		return fmt.Errorf("cannot have FastNode with a nil value for key")
@@ -296,7 +596,9 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bo
 		return fmt.Errorf("error while writing key/val to nodedb batch. Err: %w", err)
 	}
 	if shouldAddToCache {
+		ndb.cacheMtx.Lock()
 		ndb.fastNodeCache.Add(node)
+		ndb.cacheMtx.Unlock()
 	}
 	return nil
 }
@@ -306,13 +608,14 @@ func (ndb *nodeDB) Has(nk *NodeKey) (bool, error) {
 	key := ndb.nodeKey(nk)
 
 	if ldb, ok := ndb.db.(*dbm.GoLevelDB); ok {
-		exists, err := ldb.DB().Has(key, nil)
-		if err != nil {
-			return false, err
-		}
-		return exists, nil
+		var exists bool
+		err := ndb.retryRead(key, func() (err error) {
+			exists, err = ldb.DB().Has(key, nil)
+			return err
+		})
+		return exists, err
 	}
-	value, err := ndb.db.Get(key)
+	value, err := ndb.dbGet(key)
 	if err != nil {
 		return false, err
 	}
@@ -320,8 +623,53 @@ func (ndb *nodeDB) Has(nk *NodeKey) (bool, error) {
 	return value != nil, nil
 }
 
+// dbGet reads a record from the database, retrying failed reads as configured by
+// Options.ReadRetries. It returns a *BackendReadError if the read keeps failing, and nil if the
+// record does not exist.
+func (ndb *nodeDB) dbGet(key []byte) ([]byte, error) {
+	var value []byte
+	err := ndb.retryRead(key, func() (err error) {
+		value, err = ndb.db.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// dbHas checks whether a record exists in the database, retrying like dbGet.
+func (ndb *nodeDB) dbHas(key []byte) (bool, error) {
+	var has bool
+	err := ndb.retryRead(key, func() (err error) {
+		has, err = ndb.db.Has(key)
+		return err
+	})
+	return has, err
+}
+
+// retryRead calls read until it succeeds or it has been retried Options.ReadRetries times, with
+// exponential backoff, and wraps the last error in a *BackendReadError.
+func (ndb *nodeDB) retryRead(key []byte, read func() error) error {
+	backoff := ndb.opts.ReadRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := read()
+		if err == nil {
+			return nil
+		}
+		if attempt >= ndb.opts.ReadRetries {
+			return &BackendReadError{Key: key, Attempts: attempt + 1, Err: err}
+		}
+		logger.Debug("retrying read of key %X after attempt %d failed: %v\n", key, attempt+1, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 // resetBatch reset the db batch, keep low memory used
 func (ndb *nodeDB) resetBatch() error {
+	if ndb.timings != nil {
+		defer since(&ndb.timings.BackendWrite, time.Now())
+		ndb.timings.PartialFlushes++
+	}
+
 	var err error
 	if ndb.opts.Sync {
 		err = ndb.batch.WriteSync()
@@ -354,6 +702,16 @@ func (ndb *nodeDB) deleteVersion(version int64) error {
 		}
 	}
 
+	if err := ndb.batch.Delete(timestampKeyFormat.Key(version)); err != nil {
+		return err
+	}
+	if err := ndb.batch.Delete(gapKeyFormat.Key(version)); err != nil {
+		return err
+	}
+	if err := ndb.batch.Delete(statsKeyFormat.Key(version)); err != nil {
+		return err
+	}
+
 	return ndb.traverseOrphans(version, func(orphan *Node) error {
 		return ndb.batch.Delete(ndb.nodeKey(orphan.nodeKey))
 	})
@@ -369,13 +727,9 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 		return nil
 	}
 
-	ndb.mtx.Lock()
-	for v, r := range ndb.versionReaders {
-		if v >= fromVersion && r != 0 {
-			return fmt.Errorf("unable to delete version %v with %v active readers", v, r)
-		}
+	if err := ndb.checkVersionReaders(fromVersion, latest); err != nil {
+		return err
 	}
-	ndb.mtx.Unlock()
 
 	// Delete the nodes
 	err = ndb.traverseRange(nodeKeyFormat.Key(fromVersion), nodeKeyFormat.Key(latest+1), func(k, v []byte) error {
@@ -389,9 +743,33 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 		return err
 	}
 
+	err = ndb.traverseRange(timestampKeyFormat.Key(fromVersion), timestampKeyFormat.Key(latest+1), func(k, v []byte) error {
+		return ndb.batch.Delete(k)
+	})
+	if err != nil {
+		return err
+	}
+
+	prevVersion, err := ndb.previousVersion(fromVersion)
+	if err != nil {
+		return err
+	}
+	err = ndb.traverseRange(gapKeyFormat.Key(fromVersion), gapKeyFormat.Key(latest+1), func(k, v []byte) error {
+		return ndb.batch.Delete(k)
+	})
+	if err != nil {
+		return err
+	}
+	err = ndb.traverseRange(statsKeyFormat.Key(fromVersion), statsKeyFormat.Key(latest+1), func(k, v []byte) error {
+		return ndb.batch.Delete(k)
+	})
+	if err != nil {
+		return err
+	}
+
 	// NOTICE: we don't touch fast node indexes here, because it'll be rebuilt later because of version mismatch.
 
-	ndb.resetLatestVersion(fromVersion - 1)
+	ndb.resetLatestVersion(prevVersion)
 
 	return nil
 }
@@ -412,32 +790,337 @@ func (ndb *nodeDB) DeleteVersionsTo(toVersion int64) error {
 		return fmt.Errorf("the version should be in the range of [%d, %d)", first, latest)
 	}
 
-	for v, r := range ndb.versionReaders {
-		if v >= first && v <= toVersion && r != 0 {
-			return fmt.Errorf("unable to delete version %v with %v active readers", v, r)
+	if !ndb.opts.DeferPruning {
+		if err := ndb.checkVersionReaders(first, toVersion); err != nil {
+			return err
 		}
+		return ndb.deleteVersionsRange(first, toVersion)
 	}
+	return ndb.deleteVersionsRange(first, ndb.pruneTarget(first, toVersion))
+}
 
-	for version := first; version <= toVersion; version++ {
+// deleteVersionsRange deletes the versions from fromVersion to toVersion. With
+// Options.CommitSubBatchSize set, the batch is flushed between versions once it grows large, so
+// the progress is recorded with each version and resumed by resumePruning after a crash. A
+// version is never split across flushes, so no version is left partially deleted.
+func (ndb *nodeDB) deleteVersionsRange(fromVersion, toVersion int64) error {
+	for version := fromVersion; version <= toVersion; {
+		next, err := ndb.nextVersion(version)
+		if err != nil {
+			return err
+		}
 		if err := ndb.deleteVersion(version); err != nil {
 			return err
 		}
-		ndb.resetFirstVersion(version + 1)
+		ndb.resetFirstVersion(next)
+		version = next
+
+		if version > toVersion {
+			break
+		}
+		if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(pruneProgressKey)), encodePruneProgress(version, toVersion)); err != nil {
+			return err
+		}
+		if ndb.opts.CommitSubBatchSize > 0 {
+			size, err := ndb.batch.GetByteSize()
+			if err != nil {
+				return err
+			}
+			if size >= ndb.opts.CommitSubBatchSize {
+				if err := ndb.resetBatch(); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
+	return ndb.batch.Delete(metadataKeyFormat.Key([]byte(pruneProgressKey)))
+}
+
+// resumePruning finishes a DeleteVersionsTo interrupted by a crash after some of its sub-batches
+// were flushed, as recorded by deleteVersionsRange. It returns the target version of the resumed
+// pruning, or 0 if there was none. The caller must commit the batch.
+func (ndb *nodeDB) resumePruning() (int64, error) {
+	value, err := ndb.dbGet(metadataKeyFormat.Key([]byte(pruneProgressKey)))
+	if err != nil || value == nil {
+		return 0, err
+	}
+	fromVersion, toVersion, err := decodePruneProgress(value)
+	if err != nil {
+		return 0, err
+	}
+	logger.Debug("resuming the pruning of versions %d to %d\n", fromVersion, toVersion)
+	if err := ndb.deleteVersionsRange(fromVersion, toVersion); err != nil {
+		return 0, fmt.Errorf("failed to resume pruning of versions %d to %d: %w", fromVersion, toVersion, err)
+	}
+	return toVersion, nil
+}
+
+// interruptedPruneVersion returns the target version of the pruning recorded by
+// deleteVersionsRange, or 0 if there is none.
+func (ndb *nodeDB) interruptedPruneVersion() (int64, error) {
+	value, err := ndb.dbGet(metadataKeyFormat.Key([]byte(pruneProgressKey)))
+	if err != nil || value == nil {
+		return 0, err
+	}
+	_, toVersion, err := decodePruneProgress(value)
+	return toVersion, err
+}
+
+// markCommitToBatch records the version being saved before the first partial flush of its commit
+// with Options.CommitSubBatchSize, so that a crash before the commit finishes is detected by the
+// next load.
+func (ndb *nodeDB) markCommitToBatch(version int64) error {
+	if ndb.commitMarked {
+		return nil
+	}
+	var value [int64Size]byte
+	binary.BigEndian.PutUint64(value[:], uint64(version))
+	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(commitProgressKey)), value[:]); err != nil {
+		return err
+	}
+	ndb.commitMarked = true
 	return nil
 }
 
+// unmarkCommitToBatch deletes the record of markCommitToBatch with the last batch of the commit.
+func (ndb *nodeDB) unmarkCommitToBatch() error {
+	if !ndb.commitMarked {
+		return nil
+	}
+	if err := ndb.batch.Delete(metadataKeyFormat.Key([]byte(commitProgressKey))); err != nil {
+		return err
+	}
+	ndb.commitMarked = false
+	return nil
+}
+
+// resetCommitMark forgets that the commit in progress was recorded by markCommitToBatch once it
+// ends, so that a commit retried after a failure records itself again.
+func (ndb *nodeDB) resetCommitMark() {
+	ndb.commitMarked = false
+}
+
+// rollbackInterruptedCommit deletes a version whose commit was interrupted by a crash after some of
+// its sub-batches were flushed, as recorded by markCommitToBatch. It returns the deleted version,
+// or 0 if there was none. The caller must commit the batch.
+func (ndb *nodeDB) rollbackInterruptedCommit() (int64, error) {
+	version, err := ndb.interruptedCommitVersion()
+	if err != nil || version == 0 {
+		return 0, err
+	}
+	logger.Debug("rolling back the interrupted commit of version %d\n", version)
+	if err := ndb.DeleteVersionsFrom(version); err != nil {
+		return 0, fmt.Errorf("failed to roll back the interrupted commit of version %d: %w", version, err)
+	}
+	// the interrupted version may have been the first one.
+	ndb.resetFirstVersion(0)
+	return version, ndb.batch.Delete(metadataKeyFormat.Key([]byte(commitProgressKey)))
+}
+
+// interruptedCommitVersion returns the version recorded by markCommitToBatch, or 0 if there is
+// none.
+func (ndb *nodeDB) interruptedCommitVersion() (int64, error) {
+	value, err := ndb.dbGet(metadataKeyFormat.Key([]byte(commitProgressKey)))
+	if err != nil || value == nil {
+		return 0, err
+	}
+	if len(value) != int64Size {
+		return 0, fmt.Errorf("invalid commit progress %X", value)
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+func encodePruneProgress(fromVersion, toVersion int64) []byte {
+	value := make([]byte, 2*int64Size)
+	binary.BigEndian.PutUint64(value, uint64(fromVersion))
+	binary.BigEndian.PutUint64(value[int64Size:], uint64(toVersion))
+	return value
+}
+
+func decodePruneProgress(value []byte) (int64, int64, error) {
+	if len(value) != 2*int64Size {
+		return 0, 0, fmt.Errorf("invalid prune progress %X", value)
+	}
+	return int64(binary.BigEndian.Uint64(value)), int64(binary.BigEndian.Uint64(value[int64Size:])), nil
+}
+
 func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 	if err := ndb.batch.Delete(ndb.fastNodeKey(key)); err != nil {
 		return err
 	}
+	ndb.cacheMtx.Lock()
 	ndb.fastNodeCache.Remove(key)
+	ndb.cacheMtx.Unlock()
+	return nil
+}
+
+// spillFastNodeRemoval records a fast node removal of the working tree on disk, so that it does
+// not have to be kept in memory. The removals are written through a dedicated batch rather than
+// the commit batch, since they must be readable before the commit, and are not part of it. The
+// batch is written once it holds Options.FastNodeRemovalsSpillThreshold removals, or before the
+// spilled removals are read.
+func (ndb *nodeDB) spillFastNodeRemoval(key []byte) error {
+	if err := ndb.retryClearSpilledFastNodeRemovals(); err != nil {
+		return err
+	}
+	if ndb.spillPending[string(key)] {
+		return nil
+	}
+	spilledKey := spilledRemovalKeyFormat.KeyBytes(key)
+	has, err := ndb.dbHas(spilledKey)
+	if err != nil {
+		return err
+	}
+	if has {
+		return nil
+	}
+	if ndb.spillBatch == nil {
+		ndb.spillBatch = ndb.db.NewBatch()
+		ndb.spillPending = map[string]bool{}
+	}
+	if err := ndb.spillBatch.Set(spilledKey, []byte{}); err != nil {
+		return err
+	}
+	ndb.spillPending[string(key)] = true
+	ndb.spilledCount++
+	if len(ndb.spillPending) >= ndb.opts.FastNodeRemovalsSpillThreshold {
+		return ndb.flushSpilledFastNodeRemovals()
+	}
+	return nil
+}
+
+// flushSpilledFastNodeRemovals writes the spill batch, if any.
+func (ndb *nodeDB) flushSpilledFastNodeRemovals() error {
+	if ndb.spillBatch == nil {
+		return nil
+	}
+	err := ndb.spillBatch.Write()
+	ndb.discardSpillBatch()
+	return err
+}
+
+// discardSpillBatch drops the spill batch without writing it.
+func (ndb *nodeDB) discardSpillBatch() {
+	if ndb.spillBatch == nil {
+		return
+	}
+	ndb.spillBatch.Close()
+	ndb.spillBatch = nil
+	ndb.spillPending = nil
+}
+
+// unspillFastNodeRemoval drops a spilled fast node removal, if any.
+func (ndb *nodeDB) unspillFastNodeRemoval(key []byte) error {
+	if err := ndb.retryClearSpilledFastNodeRemovals(); err != nil {
+		return err
+	}
+	if ndb.spilledCount == 0 {
+		return nil
+	}
+	if err := ndb.flushSpilledFastNodeRemovals(); err != nil {
+		return err
+	}
+	spilledKey := spilledRemovalKeyFormat.KeyBytes(key)
+	has, err := ndb.dbHas(spilledKey)
+	if err != nil || !has {
+		return err
+	}
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	if err := batch.Delete(spilledKey); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	ndb.spilledCount--
+	return nil
+}
+
+// hasSpilledFastNodeRemoval returns true if the removal of the given key was spilled to disk.
+func (ndb *nodeDB) hasSpilledFastNodeRemoval(key []byte) (bool, error) {
+	if err := ndb.retryClearSpilledFastNodeRemovals(); err != nil {
+		return false, err
+	}
+	if ndb.spilledCount == 0 {
+		return false, nil
+	}
+	if ndb.spillPending[string(key)] {
+		return true, nil
+	}
+	return ndb.dbHas(spilledRemovalKeyFormat.KeyBytes(key))
+}
+
+// traverseSpilledFastNodeRemovals traverses the keys of the spilled fast node removals in order.
+func (ndb *nodeDB) traverseSpilledFastNodeRemovals(fn func(key []byte) error) error {
+	if err := ndb.retryClearSpilledFastNodeRemovals(); err != nil {
+		return err
+	}
+	if ndb.spilledCount == 0 {
+		return nil
+	}
+	if err := ndb.flushSpilledFastNodeRemovals(); err != nil {
+		return err
+	}
+	return ndb.traversePrefix(spilledRemovalKeyFormat.Key(), func(k, _ []byte) error {
+		return fn(k[1:])
+	})
+}
+
+// deleteSpilledFastNodeRemovalsToBatch deletes all spilled fast node removals as part of the batch.
+func (ndb *nodeDB) deleteSpilledFastNodeRemovalsToBatch() error {
+	err := ndb.traverseSpilledFastNodeRemovals(func(key []byte) error {
+		return ndb.batch.Delete(spilledRemovalKeyFormat.KeyBytes(key))
+	})
+	if err != nil {
+		return err
+	}
+	ndb.spilledCount = 0
+	return nil
+}
+
+// clearSpilledFastNodeRemovals discards the spill batch and immediately deletes all spilled fast
+// node removals, including ones left behind by a previous process.
+func (ndb *nodeDB) clearSpilledFastNodeRemovals() error {
+	ndb.discardSpillBatch()
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	err := ndb.traversePrefix(spilledRemovalKeyFormat.Key(), func(k, _ []byte) error {
+		return batch.Delete(k)
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	ndb.spilledCount = 0
+	ndb.spillStale = false
 	return nil
 }
 
+// discardSpilledFastNodeRemovals clears the spilled fast node removals of a discarded working
+// tree. If they can not be deleted, the deletion is retried before they are used again, and its
+// error returned then.
+func (ndb *nodeDB) discardSpilledFastNodeRemovals() {
+	if err := ndb.clearSpilledFastNodeRemovals(); err != nil {
+		logger.Debug("failed to clear spilled fast node removals: %v\n", err)
+		ndb.spillStale = true
+	}
+}
+
+// retryClearSpilledFastNodeRemovals retries the deletion of the spilled fast node removals which
+// discardSpilledFastNodeRemovals failed to delete, if any.
+func (ndb *nodeDB) retryClearSpilledFastNodeRemovals() error {
+	if !ndb.spillStale {
+		return nil
+	}
+	return ndb.clearSpilledFastNodeRemovals()
+}
+
 func (ndb *nodeDB) nodeKey(nk *NodeKey) []byte {
 	return nodeKeyFormat.Key(nk.version, nk.nonce)
 }
@@ -447,15 +1130,20 @@ func (ndb *nodeDB) fastNodeKey(key []byte) []byte {
 }
 
 func (ndb *nodeDB) getFirstVersion() (int64, error) {
-	if ndb.firstVersion == 0 {
+	firstVersion := atomic.LoadInt64(&ndb.firstVersion)
+	if firstVersion == 0 {
 		latestVersion, err := ndb.getLatestVersion()
 		if err != nil {
 			return 0, err
 		}
-		firstVersion := int64(0)
 		for firstVersion < latestVersion {
 			version := (latestVersion + firstVersion) >> 1
-			has, err := ndb.HasVersion(version)
+			// versions in a gap exist if the version after the gap does.
+			probe, err := ndb.nextVersion(version - 1)
+			if err != nil {
+				return 0, err
+			}
+			has, err := ndb.HasVersion(probe)
 			if err != nil {
 				return 0, err
 			}
@@ -465,17 +1153,23 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 				firstVersion = version + 1
 			}
 		}
-		ndb.firstVersion = latestVersion
+		firstVersion, err := ndb.nextVersion(latestVersion - 1)
+		if err != nil {
+			return 0, err
+		}
+		ndb.resetFirstVersion(firstVersion)
+		return firstVersion, nil
 	}
-	return ndb.firstVersion, nil
+	return firstVersion, nil
 }
 
 func (ndb *nodeDB) resetFirstVersion(version int64) {
-	ndb.firstVersion = version
+	atomic.StoreInt64(&ndb.firstVersion, version)
 }
 
 func (ndb *nodeDB) getLatestVersion() (int64, error) {
-	if ndb.latestVersion == 0 {
+	latestVersion := atomic.LoadInt64(&ndb.latestVersion)
+	if latestVersion == 0 {
 		itr, err := ndb.db.ReverseIterator(
 			nodeKeyFormat.Key(int64(1)),
 			nodeKeyFormat.Key(int64(math.MaxInt64)),
@@ -489,7 +1183,7 @@ func (ndb *nodeDB) getLatestVersion() (int64, error) {
 		if itr.Valid() {
 			k := itr.Key()
 			nodeKeyFormat.Scan(k, &version)
-			ndb.latestVersion = version
+			ndb.resetLatestVersion(version)
 			return version, nil
 		}
 
@@ -499,21 +1193,57 @@ func (ndb *nodeDB) getLatestVersion() (int64, error) {
 
 		return 0, nil
 	}
-	return ndb.latestVersion, nil
+	return latestVersion, nil
 }
 
 func (ndb *nodeDB) resetLatestVersion(version int64) {
-	ndb.latestVersion = version
+	atomic.StoreInt64(&ndb.latestVersion, version)
+}
+
+// beginCommit and endCommit bracket the writes of a commit to the fast nodes and the latest
+// version, so that lock-free readers can detect that they raced with them, see commitsSince.
+func (ndb *nodeDB) beginCommit() {
+	atomic.AddInt64(&ndb.commits, 1)
+}
+
+func (ndb *nodeDB) endCommit() {
+	atomic.AddInt64(&ndb.commits, 1)
+}
+
+// commitsSince returns whether a commit was in progress or completed since the given result of
+// getCommits.
+func (ndb *nodeDB) commitsSince(commits int64) bool {
+	return commits%2 != 0 || atomic.LoadInt64(&ndb.commits) != commits
+}
+
+func (ndb *nodeDB) getCommits() int64 {
+	return atomic.LoadInt64(&ndb.commits)
+}
+
+// isPublished returns whether the given version was published to lock-free readers by its
+// commit. It must be called after reading the root of the version, since a commit with
+// Options.CommitSubBatchSize flushes nodes, including the root, before it is published.
+func (ndb *nodeDB) isPublished(version int64) (bool, error) {
+	if latestVersion := atomic.LoadInt64(&ndb.latestVersion); latestVersion > 0 {
+		return version <= latestVersion, nil
+	}
+	// no version was loaded or saved yet, so only a version whose commit is still recorded as
+	// in progress is unpublished, see markCommitToBatch.
+	committing, err := ndb.interruptedCommitVersion()
+	if err != nil {
+		return false, err
+	}
+	return committing == 0 || version < committing, nil
 }
 
 // HasVersion checks if the given version exists.
 func (ndb *nodeDB) HasVersion(version int64) (bool, error) {
-	return ndb.db.Has(nodeKeyFormat.Key(version, []byte{1}))
+	return ndb.dbHas(nodeKeyFormat.Key(version, []byte{1}))
 }
 
 // GetRoot gets the nodeKey of the root for the specific version.
 func (ndb *nodeDB) GetRoot(version int64) (*NodeKey, error) {
-	val, err := ndb.db.Get(nodeKeyFormat.Key(version, []byte{1}))
+	val, err := ndb.dbGet(nodeKeyFormat.Key(version, []byte{1}))
 	if err != nil {
 		return nil, err
 	}
@@ -542,6 +1272,183 @@ func (ndb *nodeDB) SaveRoot(version int64, prevRootKey *NodeKey) error {
 	return ndb.batch.Set(nodeKeyFormat.Key(version, []byte{1}), ndb.nodeKey(prevRootKey))
 }
 
+// setVersionTimestampToBatch records the commit timestamp of a version.
+func (ndb *nodeDB) setVersionTimestampToBatch(version int64, ts time.Time) error {
+	return ndb.batch.Set(timestampKeyFormat.Key(version), encodeVersionTimestamp(ts))
+}
+
+// setVersionTimestamp immediately records the commit timestamp of a saved version, through its own
+// batch so that it does not write whatever is pending in ndb.batch.
+func (ndb *nodeDB) setVersionTimestamp(version int64, ts time.Time) error {
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(timestampKeyFormat.Key(version), encodeVersionTimestamp(ts)); err != nil {
+		return err
+	}
+	if ndb.opts.Sync {
+		return batch.WriteSync()
+	}
+	return batch.Write()
+}
+
+func encodeVersionTimestamp(ts time.Time) []byte {
+	value := make([]byte, int64Size)
+	binary.BigEndian.PutUint64(value, uint64(ts.UnixNano()))
+	return value
+}
+
+// getVersionTimestamp returns the commit timestamp of a version, or false if none is recorded.
+func (ndb *nodeDB) getVersionTimestamp(version int64) (time.Time, bool, error) {
+	value, err := ndb.dbGet(timestampKeyFormat.Key(version))
+	if err != nil || value == nil {
+		return time.Time{}, false, err
+	}
+	if len(value) != int64Size {
+		return time.Time{}, false, fmt.Errorf("invalid timestamp %X for version %d", value, version)
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value))), true, nil
+}
+
+// findVersionTimestamp returns the first (or last, if reverse is set) version within
+// [from, to] with a recorded commit timestamp, or false if there is none.
+func (ndb *nodeDB) findVersionTimestamp(from, to int64, reverse bool) (int64, time.Time, bool, error) {
+	if from > to {
+		return 0, time.Time{}, false, nil
+	}
+	start, end := timestampKeyFormat.Key(from), timestampKeyFormat.Key(to+1)
+	var (
+		itr dbm.Iterator
+		err error
+	)
+	if reverse {
+		itr, err = ndb.db.ReverseIterator(start, end)
+	} else {
+		itr, err = ndb.db.Iterator(start, end)
+	}
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	defer itr.Close()
+	if !itr.Valid() {
+		return 0, time.Time{}, false, itr.Error()
+	}
+
+	var version int64
+	timestampKeyFormat.Scan(itr.Key(), &version)
+	if len(itr.Value()) != int64Size {
+		return 0, time.Time{}, false, fmt.Errorf("invalid timestamp %X for version %d", itr.Value(), version)
+	}
+	return version, time.Unix(0, int64(binary.BigEndian.Uint64(itr.Value()))), true, nil
+}
+
+// setVersionStatsToBatch records the statistics of a version.
+func (ndb *nodeDB) setVersionStatsToBatch(stats VersionStats) error {
+	var buf bytes.Buffer
+	for _, v := range []int64{stats.Leaves, stats.ValueBytes, stats.NewNodes, stats.Orphans} {
+		if err := encoding.EncodeVarint(&buf, v); err != nil {
+			return err
+		}
+	}
+	return ndb.batch.Set(statsKeyFormat.Key(stats.Version), buf.Bytes())
+}
+
+// getVersionStats returns the statistics of a version, or false if none were recorded.
+func (ndb *nodeDB) getVersionStats(version int64) (VersionStats, bool, error) {
+	bz, err := ndb.dbGet(statsKeyFormat.Key(version))
+	if err != nil || bz == nil {
+		return VersionStats{}, false, err
+	}
+	stats := VersionStats{Version: version}
+	for _, v := range []*int64{&stats.Leaves, &stats.ValueBytes, &stats.NewNodes, &stats.Orphans} {
+		var n int
+		*v, n, err = encoding.DecodeVarint(bz)
+		if err != nil {
+			return VersionStats{}, false, fmt.Errorf("invalid stats of version %d: %w", version, err)
+		}
+		bz = bz[n:]
+	}
+	return stats, true, nil
+}
+
+// setVersionGapToBatch records that the versions between prevVersion and version were skipped.
+func (ndb *nodeDB) setVersionGapToBatch(prevVersion, version int64) error {
+	var value [int64Size]byte
+	binary.BigEndian.PutUint64(value[:], uint64(prevVersion))
+	if err := ndb.batch.Set(gapKeyFormat.Key(version), value[:]); err != nil {
+		return err
+	}
+	if err := ndb.raiseMinReaderVersionToBatch(ndb.batch, formatRevisionGaps); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&ndb.gaps, gapsPresent)
+	return nil
+}
+
+// hasGaps returns whether any version gaps were recorded, so that trees without gaps do not pay
+// for gap lookups.
+func (ndb *nodeDB) hasGaps() (bool, error) {
+	switch atomic.LoadInt32(&ndb.gaps) {
+	case gapsNone:
+		return false, nil
+	case gapsPresent:
+		return true, nil
+	}
+	itr, err := dbm.IteratePrefix(ndb.db, gapKeyFormat.Key())
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+	gaps := gapsNone
+	if itr.Valid() {
+		gaps = gapsPresent
+	}
+	atomic.CompareAndSwapInt32(&ndb.gaps, gapsUnknown, gaps)
+	return gaps == gapsPresent, itr.Error()
+}
+
+// findVersionGap returns the gap containing the version, as the versions before and after it, or
+// false if the version is not in a gap.
+func (ndb *nodeDB) findVersionGap(version int64) (int64, int64, bool, error) {
+	if ok, err := ndb.hasGaps(); !ok || err != nil {
+		return 0, 0, false, err
+	}
+	itr, err := ndb.db.Iterator(gapKeyFormat.Key(version+1), gapKeyFormat.Key(maxVersion))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer itr.Close()
+	if !itr.Valid() {
+		return 0, 0, false, itr.Error()
+	}
+	var next int64
+	gapKeyFormat.Scan(itr.Key(), &next)
+	if len(itr.Value()) != int64Size {
+		return 0, 0, false, fmt.Errorf("invalid gap %X before version %d", itr.Value(), next)
+	}
+	prev := int64(binary.BigEndian.Uint64(itr.Value()))
+	return prev, next, prev < version, nil
+}
+
+// nextVersion returns the version saved after the given one, skipping any gap. It does not check
+// whether the version exists.
+func (ndb *nodeDB) nextVersion(version int64) (int64, error) {
+	_, next, ok, err := ndb.findVersionGap(version + 1)
+	if err != nil || !ok {
+		return version + 1, err
+	}
+	return next, nil
+}
+
+// previousVersion returns the version saved before the given one, skipping any gap. It does not
+// check whether the version exists.
+func (ndb *nodeDB) previousVersion(version int64) (int64, error) {
+	prev, _, ok, err := ndb.findVersionGap(version - 1)
+	if err != nil || !ok {
+		return version - 1, err
+	}
+	return prev, nil
+}
+
 // Traverse fast nodes and return error if any, nil otherwise
 func (ndb *nodeDB) traverseFastNodes(fn func(k, v []byte) error) error {
 	return ndb.traversePrefix(fastKeyFormat.Key(), fn)
@@ -650,9 +1557,56 @@ func (ndb *nodeDB) decrVersionReaders(version int64) {
 	}
 }
 
-// traverseOrphans traverses orphans which removed by the updates of the version (n+1).
+// checkVersionReaders returns an error if any version in [fromVersion, toVersion]
+// has active readers.
+func (ndb *nodeDB) checkVersionReaders(fromVersion, toVersion int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	for v, r := range ndb.versionReaders {
+		if v >= fromVersion && v <= toVersion && r != 0 {
+			return fmt.Errorf("unable to delete version %v with %v active readers", v, r)
+		}
+	}
+	return nil
+}
+
+// pruneTarget returns the version that pruning from fromVersion to toVersion can proceed to,
+// which is before the first version in the range with active readers. Pruning of the remaining
+// versions is deferred, and resumed by the next call once the readers are done.
+func (ndb *nodeDB) pruneTarget(fromVersion, toVersion int64) int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if ndb.pruneTo > toVersion {
+		toVersion = ndb.pruneTo
+	}
+	ndb.pruneTo = 0
+	target := toVersion
+	for v, r := range ndb.versionReaders {
+		if v >= fromVersion && v <= target && r != 0 {
+			target = v - 1
+		}
+	}
+	if target < toVersion {
+		logger.Debug("deferring pruning of versions %d to %d with active readers\n", target+1, toVersion)
+		ndb.pruneTo = toVersion
+	}
+	return target
+}
+
+// deferredPruneVersion returns the target of pruning deferred by active version readers, or 0.
+func (ndb *nodeDB) deferredPruneVersion() int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.pruneTo
+}
+
+// traverseOrphans traverses orphans which removed by the updates of the next version.
 func (ndb *nodeDB) traverseOrphans(version int64, fn func(*Node) error) error {
-	curKey, err := ndb.GetRoot(version + 1)
+	nextVersion, err := ndb.nextVersion(version)
+	if err != nil {
+		return err
+	}
+	curKey, err := ndb.GetRoot(nextVersion)
 	if err != nil {
 		return err
 	}
@@ -734,7 +1688,16 @@ func (ndb *nodeDB) nodes() ([]*Node, error) {
 func (ndb *nodeDB) orphans() ([][]byte, error) {
 	orphans := [][]byte{}
 
-	for version := ndb.firstVersion; version < ndb.latestVersion; version++ {
+	firstVersion, err := ndb.getFirstVersion()
+	if err != nil {
+		return nil, err
+	}
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	for version := firstVersion; version < latestVersion; {
 		err := ndb.traverseOrphans(version, func(orphan *Node) error {
 			orphans = append(orphans, orphan.hash)
 			return nil
@@ -742,6 +1705,9 @@ func (ndb *nodeDB) orphans() ([][]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+		if version, err = ndb.nextVersion(version); err != nil {
+			return nil, err
+		}
 	}
 
 	return orphans, nil
@@ -823,13 +1789,20 @@ func (ndb *nodeDB) traverseStateChanges(startVersion, endVersion int64, fn func(
 		endVersion = latestVersion
 	}
 
-	prevVersion := startVersion - 1
+	startVersion, err = ndb.nextVersion(startVersion - 1)
+	if err != nil {
+		return err
+	}
+	prevVersion, err := ndb.previousVersion(startVersion)
+	if err != nil {
+		return err
+	}
 	prevRoot, err := ndb.GetRoot(prevVersion)
 	if err != nil {
 		return err
 	}
 
-	for version := startVersion; version <= endVersion; version++ {
+	for version := startVersion; version <= endVersion; {
 		root, err := ndb.GetRoot(version)
 		if err != nil {
 			return err
@@ -850,15 +1823,17 @@ func (ndb *nodeDB) traverseStateChanges(startVersion, endVersion int64, fn func(
 		}
 		prevVersion = version
 		prevRoot = root
+		if version, err = ndb.nextVersion(version); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (ndb *nodeDB) String() (string, error) {
-	buf := bufPool.Get().(*bytes.Buffer)
-	defer bufPool.Put(buf)
-	buf.Reset()
+	buf := DefaultEncoderPool.GetBuffer()
+	defer DefaultEncoderPool.PutBuffer(buf)
 
 	index := 0
 
@@ -894,8 +1869,56 @@ func (ndb *nodeDB) String() (string, error) {
 	return "-" + "\n" + buf.String() + "-", nil
 }
 
+// checkCanonicalNode checks that the node read from the bytes encodes back to the same bytes, as
+// required by Options.StrictDeterminism.
+func checkCanonicalNode(node *Node, buf []byte) error {
+	encoded := DefaultEncoderPool.GetBuffer()
+	defer DefaultEncoderPool.PutBuffer(encoded)
+	if err := node.writeBytes(encoded); err != nil {
+		return err
+	}
+	if !bytes.Equal(encoded.Bytes(), buf) {
+		return fmt.Errorf("%w: node %v is stored as %X, expected %X", ErrNonCanonicalNode, node.nodeKey, buf, encoded.Bytes())
+	}
+	return nil
+}
+
 var (
+	// ErrNodeNotFound is returned when a node referenced by the tree, e.g. by a version root or a
+	// parent node, is missing from the database. Unlike a *BackendReadError, it indicates that
+	// the database is inconsistent, e.g. because the version was pruned or the data is corrupted.
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrBackendRead matches every *BackendReadError with errors.Is.
+	ErrBackendRead = errors.New("backend read error")
+
+	// ErrNonCanonicalNode is returned with Options.StrictDeterminism when a node read from the
+	// database is not canonically encoded.
+	ErrNonCanonicalNode = errors.New("node is not canonically encoded")
+
 	ErrNodeMissingNodeKey   = fmt.Errorf("node does not have a nodeKey")
 	ErrNodeAlreadyPersisted = fmt.Errorf("shouldn't be calling save on an already persisted node")
 	ErrRootMissingNodeKey   = fmt.Errorf("root node key must not be zero")
 )
+
+// BackendReadError is returned when the database fails to read a record, after the retries
+// configured by Options.ReadRetries. Such errors may be transient, e.g. IO errors of the disk,
+// and unlike ErrNodeNotFound do not indicate that the stored state is corrupted.
+type BackendReadError struct {
+	Key      []byte // The key of the record.
+	Attempts int    // The number of attempts made to read the record.
+	Err      error  // The error of the last attempt.
+}
+
+func (e *BackendReadError) Error() string {
+	return fmt.Sprintf("%v: reading key %X failed after %d attempt(s): %v", ErrBackendRead, e.Key, e.Attempts, e.Err)
+}
+
+func (e *BackendReadError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrBackendRead) match BackendReadErrors.
+func (e *BackendReadError) Is(target error) bool {
+	return target == ErrBackendRead
+}
@@ -359,3 +359,364 @@ func makeAndPopulateMutableTree(tb testing.TB) *MutableTree {
 	require.Nil(tb, err, "Expected .SaveVersion to succeed")
 	return tree
 }
+
+// crashingDB fails all batch writes after the given number of writes, simulating a crash.
+type crashingDB struct {
+	db.DB
+	writes int
+}
+
+func (d *crashingDB) NewBatch() db.Batch {
+	return &crashingBatch{Batch: d.DB.NewBatch(), db: d}
+}
+
+type crashingBatch struct {
+	db.Batch
+	db *crashingDB
+}
+
+func (b *crashingBatch) Write() error {
+	if b.db.writes <= 0 {
+		return errors.New("crashed")
+	}
+	b.db.writes--
+	return b.Batch.Write()
+}
+
+func (b *crashingBatch) WriteSync() error {
+	return b.Write()
+}
+
+func TestDeleteVersionsTo_ResumeAfterCrash(t *testing.T) {
+	setup := func(d db.DB) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(d, 0, &Options{CommitSubBatchSize: 1}, true)
+		require.NoError(t, err)
+		for version := 1; version <= 10; version++ {
+			for i := 0; i < 20; i++ {
+				_, err = tree.Set([]byte(strconv.Itoa(i*version)), []byte(strconv.Itoa(version)))
+				require.NoError(t, err)
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		return tree
+	}
+
+	// the reference prunes without interruption.
+	refDB := db.NewMemDB()
+	require.NoError(t, setup(refDB).DeleteVersionsTo(7))
+
+	memDB := db.NewMemDB()
+	crashDB := &crashingDB{DB: memDB, writes: 1 << 30}
+	tree := setup(crashDB)
+	// each version is flushed separately, crash after the first three.
+	crashDB.writes = 3
+	require.Error(t, tree.DeleteVersionsTo(7))
+	progress, err := memDB.Get(metadataKeyFormat.Key([]byte(pruneProgressKey)))
+	require.NoError(t, err)
+	fromVersion, toVersion, err := decodePruneProgress(progress)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, fromVersion)
+	require.EqualValues(t, 7, toVersion)
+
+	// a new tree resumes the pruning on load.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{CommitSubBatchSize: 1}, true)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{8, 9, 10}, tree.AvailableVersions())
+
+	// the database ends up identical to the uninterrupted one.
+	refIter, err := refDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer refIter.Close()
+	iter, err := memDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer iter.Close()
+	for ; refIter.Valid(); refIter.Next() {
+		require.True(t, iter.Valid())
+		require.Equal(t, refIter.Key(), iter.Key())
+		require.Equal(t, refIter.Value(), iter.Value())
+		iter.Next()
+	}
+	require.False(t, iter.Valid())
+}
+
+func TestSaveVersion_RollbackAfterCrash(t *testing.T) {
+	setup := func(d db.DB, versions int) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(d, 0, &Options{CommitSubBatchSize: 1}, true)
+		require.NoError(t, err)
+		for version := 1; version <= versions; version++ {
+			for i := 0; i < 20; i++ {
+				_, err = tree.Set([]byte(strconv.Itoa(i*version)), []byte(strconv.Itoa(version)))
+				require.NoError(t, err)
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		return tree
+	}
+
+	memDB := db.NewMemDB()
+	crashDB := &crashingDB{DB: memDB, writes: 1 << 30}
+	tree := setup(crashDB, 3)
+	// crash after the first sub-batches of the next version were flushed.
+	crashDB.writes = 2
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(strconv.Itoa(i*4)), []byte("4"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.Error(t, err)
+	has, err := memDB.Has(nodeKeyFormat.Key(int64(4), int32(1)))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// a new tree rolls it back on load.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{CommitSubBatchSize: 1}, true)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, []int{1, 2, 3}, tree.AvailableVersions())
+	progress, err := memDB.Get(metadataKeyFormat.Key([]byte(commitProgressKey)))
+	require.NoError(t, err)
+	require.Nil(t, progress)
+
+	// and the version can be saved again.
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(strconv.Itoa(i*4)), []byte("4"))
+		require.NoError(t, err)
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	refTree := setup(db.NewMemDB(), 4)
+	refHash, err := refTree.Hash()
+	require.NoError(t, err)
+	require.Equal(t, refHash, hash)
+}
+
+func TestSaveVersion_CommitProgress(t *testing.T) {
+	progress := func(memDB db.DB) []byte {
+		value, err := memDB.Get(metadataKeyFormat.Key([]byte(commitProgressKey)))
+		require.NoError(t, err)
+		return value
+	}
+
+	// the genesis version is flushed node by node, but only sub-batches record their progress.
+	memDB := db.NewMemDB()
+	crashDB := &crashingDB{DB: memDB, writes: 1}
+	tree, err := NewMutableTree(crashDB, 0, true)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(strconv.Itoa(i)), []byte("1"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.Nil(t, progress(memDB))
+
+	// a commit retried after a failed one records its progress again.
+	memDB = db.NewMemDB()
+	crashDB = &crashingDB{DB: memDB, writes: 1 << 30}
+	tree, err = NewMutableTreeWithOpts(crashDB, 0, &Options{CommitSubBatchSize: 1}, true)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for attempt := 0; attempt < 2; attempt++ {
+		crashDB.writes = 1
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(strconv.Itoa(i)), []byte("2"))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.Error(t, err)
+		require.NotNil(t, progress(memDB), "attempt %d", attempt)
+
+		crashDB.writes = 1 << 30
+		version, err := tree.Load()
+		require.NoError(t, err)
+		require.EqualValues(t, 1, version)
+		require.Nil(t, progress(memDB))
+	}
+}
+
+func TestGetImmutable_UnpublishedCommit(t *testing.T) {
+	memDB := db.NewMemDB()
+	crashDB := &crashingDB{DB: memDB, writes: 1 << 30}
+	tree, err := NewMutableTreeWithOpts(crashDB, 0, &Options{CommitSubBatchSize: 1}, true)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// every node is flushed by its own sub-batch, so crashing at a growing number of writes
+	// eventually leaves the root of version 2 on disk without publishing it.
+	rootFlushed := false
+	for writes := 1; ; writes++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(strconv.Itoa(i)), []byte("2"))
+			require.NoError(t, err)
+		}
+		crashDB.writes = writes
+		_, _, err = tree.SaveVersion()
+		crashDB.writes = 1 << 30
+		if err == nil {
+			break
+		}
+		hasRoot, err := memDB.Has(nodeKeyFormat.Key(int64(2), []byte{1}))
+		require.NoError(t, err)
+		rootFlushed = rootFlushed || hasRoot
+
+		_, err = tree.GetImmutable(2)
+		require.ErrorIs(t, err, ErrVersionDoesNotExist, "writes %d", writes)
+
+		// a tree which did not load any version yet does not open it either.
+		other, err := NewMutableTreeWithOpts(memDB, 0, &Options{CommitSubBatchSize: 1}, true)
+		require.NoError(t, err)
+		_, err = other.GetImmutable(2)
+		require.ErrorIs(t, err, ErrVersionDoesNotExist, "writes %d", writes)
+		_, err = other.GetImmutable(1)
+		require.NoError(t, err)
+
+		_, err = tree.Load()
+		require.NoError(t, err)
+	}
+	require.True(t, rootFlushed)
+
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	value, err := itree.Get([]byte("0"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+}
+
+// flakyDB fails the given number of reads before succeeding, simulating transient IO errors.
+type flakyDB struct {
+	db.DB
+	failures int
+}
+
+func (d *flakyDB) fail() error {
+	if d.failures > 0 {
+		d.failures--
+		return errors.New("input/output error")
+	}
+	return nil
+}
+
+func (d *flakyDB) Get(key []byte) ([]byte, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return d.DB.Get(key)
+}
+
+func (d *flakyDB) Has(key []byte) (bool, error) {
+	if err := d.fail(); err != nil {
+		return false, err
+	}
+	return d.DB.Has(key)
+}
+
+func TestNodeDB_ReadErrors(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err = tree.Set([]byte(strconv.Itoa(i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	flaky := &flakyDB{DB: memDB}
+	load := func(opts Options) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(flaky, 0, &opts, true)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+	iterate := func(tree *MutableTree) error {
+		itree, err := tree.GetImmutable(1)
+		if err != nil {
+			return err
+		}
+		_, err = itree.Iterate(func(key, value []byte) bool { return false })
+		return err
+	}
+
+	// transient errors are retried.
+	tree = load(Options{ReadRetries: 3})
+	flaky.failures = 3
+	require.NoError(t, iterate(tree))
+	require.Zero(t, flaky.failures)
+
+	// persistent errors are returned as backend read errors once the retries are exhausted.
+	tree = load(Options{ReadRetries: 1})
+	flaky.failures = 10
+	err = iterate(tree)
+	require.ErrorIs(t, err, ErrBackendRead)
+	require.NotErrorIs(t, err, ErrNodeNotFound)
+	var readErr *BackendReadError
+	require.ErrorAs(t, err, &readErr)
+	require.Equal(t, 2, readErr.Attempts)
+	require.EqualError(t, readErr.Err, "input/output error")
+	flaky.failures = 0
+
+	// missing nodes are not retried, and reported as such.
+	require.NoError(t, memDB.Delete(tree.ndb.nodeKey(&NodeKey{version: 1, nonce: 2})))
+	tree = load(Options{ReadRetries: 3})
+	err = iterate(tree)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+	require.NotErrorIs(t, err, ErrBackendRead)
+
+	// exports fail rather than ending early.
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	for err == nil {
+		_, err = exporter.Next()
+	}
+	require.ErrorIs(t, err, ErrNodeNotFound)
+
+	// so do range iterations.
+	_, err = itree.IterateRangeWithError(nil, nil, true, func(key, value []byte) bool { return false })
+	require.ErrorIs(t, err, ErrNodeNotFound)
+	_, err = itree.IterateRangeInclusiveWithError(nil, nil, false, func(key, value []byte, version int64) bool { return false })
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
+
+func TestMutableTree_GetVersioned_ReadErrors(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		memDB := db.NewMemDB()
+		tree, err := NewMutableTree(memDB, 0, skipFastStorageUpgrade)
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("k"), []byte("v"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		flaky := &flakyDB{DB: memDB}
+		tree, err = NewMutableTree(flaky, 0, skipFastStorageUpgrade)
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		require.True(t, tree.VersionExists(1))
+
+		// a failing read is not reported as a missing key.
+		flaky.failures = 10
+		_, err = tree.GetVersioned([]byte("k"), 1)
+		require.ErrorIs(t, err, ErrBackendRead)
+		flaky.failures = 0
+		value, err := tree.GetVersioned([]byte("k"), 1)
+		require.NoError(t, err)
+		require.Equal(t, []byte("v"), value)
+	}
+}
@@ -1,6 +1,15 @@
 package iavl
 
-import "sync/atomic"
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNonDeterministicOptions is returned when creating a tree with Options.StrictDeterminism and
+// an option whose effects are not determined by the operations on the tree alone.
+var ErrNonDeterministicOptions = errors.New("options are not deterministic")
 
 // Statisc about db runtime state
 type Statistics struct {
@@ -81,6 +90,119 @@ type Options struct {
 
 	// When Stat is not nil, statistical logic needs to be executed
 	Stat *Statistics
+
+	// HashKeys positions leaves by the SHA256 hash of their key rather than by the key itself,
+	// which gives a uniform key distribution for workloads with adversarially chosen or highly
+	// skewed keys. Keys returned by iteration, export and state change traversal are the hashed
+	// keys, and proofs must be verified against ImmutableTree.ProofSpec(). The setting is recorded
+	// in the database when the first version is written, and opening it with the other setting
+	// returns ErrHashKeysMismatch.
+	HashKeys bool
+
+	// FastNodeRemovalsSpillThreshold is the number of unsaved fast node removals kept in memory
+	// before further removals are spilled to a temporary region of the database, which bounds
+	// memory usage when deleting a very large number of keys in a single version. Zero disables
+	// spilling.
+	FastNodeRemovalsSpillThreshold int
+
+	// NodeCacheLargeNodeThreshold segments the node cache into a tier of small nodes and a tier of
+	// large nodes when non-zero, with nodes of at least this many encoded bytes cached in the large
+	// tier. The small tier holds up to the configured cache size of nodes, so scans over leaves
+	// with large values can't evict the inner nodes of the working set.
+	NodeCacheLargeNodeThreshold int
+
+	// NodeCacheLargeNodeSize is the maximum number of nodes in the large node tier, see
+	// NodeCacheLargeNodeThreshold. It defaults to a tenth of the cache size.
+	NodeCacheLargeNodeSize int
+
+	// RecordVersionTimestamps records the wall clock time of every SaveVersion as the commit
+	// timestamp of the version, for use with MutableTree.GetAsOf. Timestamps are clamped to be
+	// non-decreasing across versions.
+	RecordVersionTimestamps bool
+
+	// RecordVersionStats records the statistics of every saved version, see MutableTree.StatsAt.
+	// If the statistics of the previous version are missing, e.g. when enabling this on an
+	// existing tree, the total size of the values is recorded as unknown rather than walking the
+	// previous version during the commit, and is computed by StatsAt instead.
+	RecordVersionStats bool
+
+	// CommitDeadline is a soft deadline for SaveVersion. Commits taking longer are not aborted,
+	// but flagged with CommitTimings.DeadlineExceeded, which callers can observe through
+	// OnCommitTimings or LastCommitTimings. Zero disables the deadline.
+	CommitDeadline time.Duration
+
+	// OnCommitTimings is called with the phase timings of every successful SaveVersion, e.g. to
+	// export them as metrics. It is called with the commit lock held, so it should return quickly.
+	OnCommitTimings func(CommitTimings)
+
+	// MaxTreeHeight is the maximum expected height of the tree. A balanced tree of n leaves has a
+	// height of at most 1.44*log2(n), so exceeding a sensible bound indicates corruption of the
+	// balance invariant. SaveVersion and LoadVersion then return ErrTreeHeightExceeded, unless
+	// OnMaxTreeHeightExceeded is set. Zero disables the check.
+	MaxTreeHeight int
+
+	// OnMaxTreeHeightExceeded is called instead of returning an error when the tree height
+	// exceeds MaxTreeHeight, e.g. to log a warning.
+	OnMaxTreeHeightExceeded func(version int64, height int8)
+
+	// DeferPruning makes DeleteVersionsTo prune only up to the first version with active readers,
+	// e.g. an export started with MutableTree.ExportCheckpoint or a pending snapshot, and defer the
+	// remaining versions to a later call once the readers are done, rather than returning an
+	// error. The deferred target is only kept in memory, so after a restart the pruning must be
+	// requested again. See MutableTree.DeferredPruneVersion.
+	DeferPruning bool
+
+	// CommitSubBatchSize flushes the write batch of a commit to the database every time it grows
+	// to this many bytes, bounding the memory used by large commits. A commit is then no longer
+	// written atomically: if the process crashes during SaveVersion, the partially written version
+	// is rolled back by the next load. DeleteVersionsTo flushes between the deleted versions, and
+	// an interrupted pruning is resumed on the next load. Zero writes each commit in a single batch.
+	CommitSubBatchSize int
+
+	// AutoTune enables an adaptive controller, which adjusts the node cache size and
+	// CommitSubBatchSize after every commit within the configured bounds. Its decisions are
+	// reported in CommitTimings.
+	AutoTune *AutoTuneOptions
+
+	// KeyPrefixes registers logical key prefixes, e.g. the store prefixes of modules sharing the
+	// tree, which key accesses, node cache lookups and occupancy, and commit bytes are attributed
+	// to, see MutableTree.PrefixStats. Keys are attributed to the longest matching prefix. With
+	// HashKeys, nodes are positioned by hashed keys, so only key accesses can be attributed.
+	KeyPrefixes []KeyPrefix
+
+	// StrictDeterminism guarantees that the node records in the database are determined by the
+	// operations on the tree alone, so that they can be compared byte for byte across nodes and
+	// implementations, see testdata/golden. Options depending on the wall clock, on timings or on
+	// the active readers, RecordVersionTimestamps, AutoTune and DeferPruning, are rejected with
+	// ErrNonDeterministicOptions, and nodes read from the database must be canonically encoded,
+	// otherwise ErrNonCanonicalNode is returned.
+	StrictDeterminism bool
+
+	// ReadRetries is the number of times a failed read from the database is retried before the
+	// error is returned as a *BackendReadError, e.g. to ride out transient IO errors of a flaky
+	// disk or network volume. Missing records are not errors and are never retried, they are
+	// reported as ErrNodeNotFound where a record was expected. Zero disables retries.
+	ReadRetries int
+
+	// ReadRetryBackoff is the delay before the first read retry, doubled on each further retry.
+	ReadRetryBackoff time.Duration
+}
+
+// validate checks the options for consistency.
+func (opts *Options) validate() error {
+	if !opts.StrictDeterminism {
+		return nil
+	}
+	if opts.RecordVersionTimestamps {
+		return fmt.Errorf("%w: RecordVersionTimestamps records the wall clock", ErrNonDeterministicOptions)
+	}
+	if opts.AutoTune != nil {
+		return fmt.Errorf("%w: AutoTune adjusts the commits to their timings", ErrNonDeterministicOptions)
+	}
+	if opts.DeferPruning {
+		return fmt.Errorf("%w: DeferPruning prunes depending on the active readers", ErrNonDeterministicOptions)
+	}
+	return nil
 }
 
 // DefaultOptions returns the default options for IAVL.
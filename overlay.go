@@ -0,0 +1,276 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// overlayEntry is a change of a key in an OverlayTree.
+type overlayEntry struct {
+	treeKey []byte
+	value   []byte
+	deleted bool
+}
+
+// OverlayTree is a writable in-memory layer over a read-only base version of a tree, e.g. for
+// speculative execution or dry runs of upgrades. Reads resolve the changes of the overlay before
+// the base version, and the changes can be committed with Flatten. The base version is never
+// modified, and discarding the overlay discards the changes.
+//
+// Like the working tree of a MutableTree, an OverlayTree is not safe for concurrent use. Keys
+// returned by iteration are keys as stored in the tree, see Options.HashKeys.
+type OverlayTree struct {
+	base    *ImmutableTree
+	changes map[string]*overlayEntry // By tree key.
+}
+
+// NewOverlayTree returns an empty overlay over the base tree.
+func NewOverlayTree(base *ImmutableTree) *OverlayTree {
+	return &OverlayTree{base: base, changes: make(map[string]*overlayEntry)}
+}
+
+// Overlay returns an empty overlay over a saved version of the tree. Like GetImmutable, the
+// overlay remains valid as long as the version is not deleted.
+func (tree *MutableTree) Overlay(version int64) (*OverlayTree, error) {
+	base, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	return NewOverlayTree(base), nil
+}
+
+// Version returns the version of the base tree.
+func (o *OverlayTree) Version() int64 {
+	return o.base.Version()
+}
+
+// Get returns the value of the key in the overlay, or nil if it does not exist.
+func (o *OverlayTree) Get(key []byte) ([]byte, error) {
+	if entry, ok := o.changes[ibytes.UnsafeBytesToStr(o.base.treeKey(key))]; ok {
+		if entry.deleted {
+			return nil, nil
+		}
+		return entry.value, nil
+	}
+	return o.base.Get(key)
+}
+
+// Has returns whether the key exists in the overlay.
+func (o *OverlayTree) Has(key []byte) (bool, error) {
+	if entry, ok := o.changes[ibytes.UnsafeBytesToStr(o.base.treeKey(key))]; ok {
+		return !entry.deleted, nil
+	}
+	return o.base.Has(key)
+}
+
+// Set sets a key in the overlay. It returns true when an existing value was updated. Nil values
+// are invalid.
+func (o *OverlayTree) Set(key, value []byte) (updated bool, err error) {
+	if value == nil {
+		return false, fmt.Errorf("attempt to store nil value at key '%s'", key)
+	}
+	if updated, err = o.Has(key); err != nil {
+		return false, err
+	}
+	treeKey := o.base.treeKey(key)
+	o.changes[string(treeKey)] = &overlayEntry{treeKey: treeKey, value: value}
+	return updated, nil
+}
+
+// Remove removes a key from the overlay. It returns the removed value, and whether the key
+// existed.
+func (o *OverlayTree) Remove(key []byte) ([]byte, bool, error) {
+	value, err := o.Get(key)
+	if err != nil || value == nil {
+		return nil, false, err
+	}
+	treeKey := o.base.treeKey(key)
+	inBase, err := o.base.Has(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if inBase {
+		o.changes[string(treeKey)] = &overlayEntry{treeKey: treeKey, deleted: true}
+	} else {
+		delete(o.changes, string(treeKey))
+	}
+	return value, true, nil
+}
+
+// ChangeSet returns the changes of the overlay relative to the base version, sorted by key. Keys
+// are keys as stored in the tree, as expected by MutableTree.SaveChangeSet.
+func (o *OverlayTree) ChangeSet() *ChangeSet {
+	entries := o.sortedChanges(nil, nil, true)
+	cs := &ChangeSet{Pairs: make([]KVPair, 0, len(entries))}
+	for _, entry := range entries {
+		cs.Pairs = append(cs.Pairs, KVPair{Delete: entry.deleted, Key: entry.treeKey, Value: entry.value})
+	}
+	return cs
+}
+
+// Flatten commits the changes of the overlay as a new version of tree, which must be the tree of
+// the base version, with the base version as its latest version and no uncommitted changes. The
+// changes are applied in key order, so the resulting root hash matches applying them in that order
+// rather than the order they were made in. The overlay can not be used afterwards.
+func (o *OverlayTree) Flatten(tree *MutableTree) ([]byte, int64, error) {
+	if tree.ndb != o.base.ndb {
+		return nil, 0, fmt.Errorf("overlay is not based on the tree")
+	}
+	if tree.Version() != o.base.Version() {
+		return nil, 0, fmt.Errorf("overlay is based on version %d, but the tree is at version %d",
+			o.base.Version(), tree.Version())
+	}
+	version, err := tree.SaveChangeSet(o.ChangeSet())
+	if err != nil {
+		return nil, version, err
+	}
+	o.changes = nil
+	hash, err := tree.Hash()
+	return hash, version, err
+}
+
+// Iterator returns an iterator over the overlay between start (inclusive) and end (exclusive).
+// CONTRACT: no updates are made to the overlay while an iterator is active.
+func (o *OverlayTree) Iterator(start, end []byte, ascending bool) (dbm.Iterator, error) {
+	base, err := o.base.Iterator(start, end, ascending)
+	if err != nil {
+		return nil, err
+	}
+	itr := &OverlayIterator{
+		start:     start,
+		end:       end,
+		ascending: ascending,
+		base:      base,
+		changes:   o.sortedChanges(start, end, ascending),
+	}
+	itr.seek()
+	return itr, nil
+}
+
+// Iterate iterates over all keys of the overlay in ascending order, until fn returns true.
+func (o *OverlayTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	itr, err := o.Iterator(nil, nil, true)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if fn(itr.Key(), itr.Value()) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
+// sortedChanges returns the changes with tree keys in the range, in iteration order.
+func (o *OverlayTree) sortedChanges(start, end []byte, ascending bool) []*overlayEntry {
+	entries := make([]*overlayEntry, 0, len(o.changes))
+	for _, entry := range o.changes {
+		if (start == nil || bytes.Compare(entry.treeKey, start) >= 0) &&
+			(end == nil || bytes.Compare(entry.treeKey, end) < 0) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return (bytes.Compare(entries[i].treeKey, entries[j].treeKey) < 0) == ascending
+	})
+	return entries
+}
+
+// OverlayIterator is a dbm.Iterator over an OverlayTree, merging the changes of the overlay into
+// an iterator over the base tree.
+type OverlayIterator struct {
+	start, end []byte
+	ascending  bool
+	base       dbm.Iterator
+	changes    []*overlayEntry
+
+	key, value []byte
+	valid      bool
+}
+
+var _ dbm.Iterator = (*OverlayIterator)(nil)
+
+// seek positions the iterator at the next pair which is not deleted, starting from the current
+// positions of the base iterator and the changes.
+func (itr *OverlayIterator) seek() {
+	for {
+		baseValid := itr.base.Valid()
+		if !baseValid && len(itr.changes) == 0 {
+			itr.key, itr.value, itr.valid = nil, nil, false
+			return
+		}
+		cmp := 1 // > 0 takes the change, < 0 the base pair, 0 the change in place of the base pair.
+		if baseValid && len(itr.changes) > 0 {
+			cmp = bytes.Compare(itr.base.Key(), itr.changes[0].treeKey)
+			if !itr.ascending {
+				cmp = -cmp
+			}
+		} else if baseValid {
+			cmp = -1
+		}
+
+		if cmp < 0 {
+			itr.key, itr.value, itr.valid = itr.base.Key(), itr.base.Value(), true
+			return
+		}
+		if cmp == 0 {
+			itr.base.Next()
+		}
+		entry := itr.changes[0]
+		if !entry.deleted {
+			itr.key, itr.value, itr.valid = entry.treeKey, entry.value, true
+			return
+		}
+		itr.changes = itr.changes[1:]
+	}
+}
+
+// Domain implements dbm.Iterator.
+func (itr *OverlayIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements dbm.Iterator.
+func (itr *OverlayIterator) Valid() bool {
+	return itr.valid
+}
+
+// Next implements dbm.Iterator.
+func (itr *OverlayIterator) Next() {
+	if !itr.valid {
+		return
+	}
+	if len(itr.changes) > 0 && bytes.Equal(itr.key, itr.changes[0].treeKey) {
+		itr.changes = itr.changes[1:]
+	} else {
+		itr.base.Next()
+	}
+	itr.seek()
+}
+
+// Key implements dbm.Iterator.
+func (itr *OverlayIterator) Key() []byte {
+	return itr.key
+}
+
+// Value implements dbm.Iterator.
+func (itr *OverlayIterator) Value() []byte {
+	return itr.value
+}
+
+// Error implements dbm.Iterator.
+func (itr *OverlayIterator) Error() error {
+	return itr.base.Error()
+}
+
+// Close implements dbm.Iterator.
+func (itr *OverlayIterator) Close() error {
+	itr.valid = false
+	return itr.base.Close()
+}
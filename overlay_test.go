@@ -0,0 +1,155 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayTree(t *testing.T) {
+	for _, hashKeys := range []bool{false, true} {
+		t.Run(fmt.Sprintf("HashKeys=%v", hashKeys), func(t *testing.T) {
+			newTree := func() *MutableTree {
+				tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{HashKeys: hashKeys}, false)
+				require.NoError(t, err)
+				for i := 0; i < 10; i++ {
+					_, err = tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte{byte(i)})
+					require.NoError(t, err)
+				}
+				_, _, err = tree.SaveVersion()
+				require.NoError(t, err)
+				return tree
+			}
+			tree, direct := newTree(), newTree()
+
+			overlay, err := tree.Overlay(1)
+			require.NoError(t, err)
+			require.EqualValues(t, 1, overlay.Version())
+			apply := func(set bool, key string, value string) {
+				if set {
+					updated, err := overlay.Set([]byte(key), []byte(value))
+					require.NoError(t, err)
+					existed, err := direct.Has([]byte(key))
+					require.NoError(t, err)
+					require.Equal(t, existed, updated)
+					_, err = direct.Set([]byte(key), []byte(value))
+					require.NoError(t, err)
+					return
+				}
+				_, removed, err := overlay.Remove([]byte(key))
+				require.NoError(t, err)
+				_, existed, err := direct.Remove([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, existed, removed)
+			}
+			apply(true, "key-3", "updated")
+			apply(true, "key-35", "new")
+			apply(false, "key-5", "")
+			apply(false, "missing", "")
+			apply(true, "key-7", "removed later")
+			apply(false, "key-7", "")
+			apply(true, "temp", "x")
+			apply(false, "temp", "")
+
+			value, err := overlay.Get([]byte("key-3"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("updated"), value)
+			value, err = overlay.Get([]byte("key-4"))
+			require.NoError(t, err)
+			require.Equal(t, []byte{4}, value)
+			has, err := overlay.Has([]byte("key-5"))
+			require.NoError(t, err)
+			require.False(t, has)
+			has, err = overlay.Has([]byte("key-35"))
+			require.NoError(t, err)
+			require.True(t, has)
+			_, err = overlay.Set([]byte("nil"), nil)
+			require.Error(t, err)
+
+			// the base version is unchanged.
+			value, err = tree.Get([]byte("key-3"))
+			require.NoError(t, err)
+			require.Equal(t, []byte{3}, value)
+
+			// iteration matches the directly modified tree, in both directions and within ranges.
+			collect := func(itr interface {
+				Valid() bool
+				Next()
+				Key() []byte
+				Value() []byte
+				Close() error
+			},
+			) (pairs [][2]string) {
+				for ; itr.Valid(); itr.Next() {
+					pairs = append(pairs, [2]string{string(itr.Key()), string(itr.Value())})
+				}
+				require.NoError(t, itr.Close())
+				return pairs
+			}
+			keys := make([][]byte, 0, 10)
+			_, err = direct.Iterate(func(key, _ []byte) bool {
+				keys = append(keys, key)
+				return false
+			})
+			require.NoError(t, err)
+			ranges := [][2][]byte{{nil, nil}, {keys[1], keys[len(keys)-2]}, {keys[3], nil}}
+			for _, r := range ranges {
+				for _, ascending := range []bool{true, false} {
+					itr, err := overlay.Iterator(r[0], r[1], ascending)
+					require.NoError(t, err)
+					expect, err := direct.Iterator(r[0], r[1], ascending)
+					require.NoError(t, err)
+					require.Equal(t, collect(expect), collect(itr))
+				}
+			}
+			count := 0
+			stopped, err := overlay.Iterate(func(_, _ []byte) bool {
+				count++
+				return count == 3
+			})
+			require.NoError(t, err)
+			require.True(t, stopped)
+
+			// flattening commits the same contents as applying the changes directly, and the same
+			// tree as applying them in key order.
+			cs := overlay.ChangeSet()
+			require.Len(t, cs.Pairs, 4)
+			ordered := newTree()
+			keysByTreeKey := map[string][]byte{}
+			for _, key := range []string{"key-3", "key-35", "key-5", "key-7"} {
+				keysByTreeKey[string(ordered.treeKey([]byte(key)))] = []byte(key)
+			}
+			for _, pair := range cs.Pairs {
+				if pair.Delete {
+					_, _, err = ordered.Remove(keysByTreeKey[string(pair.Key)])
+				} else {
+					_, err = ordered.Set(keysByTreeKey[string(pair.Key)], pair.Value)
+				}
+				require.NoError(t, err)
+			}
+			expected, _, err := ordered.SaveVersion()
+			require.NoError(t, err)
+			hash, version, err := overlay.Flatten(tree)
+			require.NoError(t, err)
+			require.EqualValues(t, 2, version)
+			require.Equal(t, expected, hash)
+			_, _, err = direct.SaveVersion()
+			require.NoError(t, err)
+			for _, ascending := range []bool{true, false} {
+				itr, err := tree.Iterator(nil, nil, ascending)
+				require.NoError(t, err)
+				expect, err := direct.Iterator(nil, nil, ascending)
+				require.NoError(t, err)
+				require.Equal(t, collect(expect), collect(itr))
+			}
+
+			// overlays of older versions can not be flattened.
+			overlay, err = tree.Overlay(1)
+			require.NoError(t, err)
+			_, _, err = overlay.Flatten(tree)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+
+	"github.com/cosmos/iavl/cache"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// KeyPrefix is a logical key prefix registered with Options.KeyPrefixes, e.g. the store prefix of
+// a module, which metrics are attributed to.
+type KeyPrefix struct {
+	Name   string
+	Prefix []byte
+}
+
+// PrefixStats are the metrics attributed to a KeyPrefix, see MutableTree.PrefixStats.
+type PrefixStats struct {
+	// Reads, Writes and Deletes count the key accesses through the MutableTree, as recorded by
+	// an AuditLog.
+	Reads   uint64
+	Writes  uint64
+	Deletes uint64
+
+	// CacheHits and CacheMisses count the node cache lookups of nodes with keys in the prefix.
+	CacheHits   uint64
+	CacheMisses uint64
+
+	// CachedNodes and CachedBytes are the number and encoded size of the nodes with keys in the
+	// prefix currently held by the node cache.
+	CachedNodes int64
+	CachedBytes int64
+
+	// CommitNodes and CommitBytes are the number and encoded size of the nodes with keys in the
+	// prefix written by all commits so far.
+	CommitNodes uint64
+	CommitBytes uint64
+}
+
+// prefixCounters are the metrics of a prefix. The cache occupancy is guarded by nodeDB.cacheMtx,
+// the other counters are atomic.
+type prefixCounters struct {
+	reads, writes, deletes   uint64
+	cacheHits, cacheMisses   uint64
+	commitNodes, commitBytes uint64
+	cachedNodes, cachedBytes int64
+}
+
+// cachedNodeEntry is the attribution of a node held by the node cache.
+type cachedNodeEntry struct {
+	index int
+	bytes int64
+}
+
+// prefixMetrics attributes metrics to the registered key prefixes. Its methods are no-ops on a
+// nil receiver, which is used when no prefixes are registered.
+type prefixMetrics struct {
+	prefixes []KeyPrefix      // By descending prefix length, so the longest match is found first.
+	counters []prefixCounters // By prefix index, followed by keys matching no prefix.
+	cached   map[string]cachedNodeEntry
+}
+
+func newPrefixMetrics(prefixes []KeyPrefix) *prefixMetrics {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	sorted := append([]KeyPrefix(nil), prefixes...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+	return &prefixMetrics{
+		prefixes: sorted,
+		counters: make([]prefixCounters, len(sorted)+1),
+		cached:   make(map[string]cachedNodeEntry),
+	}
+}
+
+// counterOf returns the counters of the longest prefix matching the key.
+func (m *prefixMetrics) counterOf(key []byte) (int, *prefixCounters) {
+	for i, prefix := range m.prefixes {
+		if bytes.HasPrefix(key, prefix.Prefix) {
+			return i, &m.counters[i]
+		}
+	}
+	return len(m.prefixes), &m.counters[len(m.prefixes)]
+}
+
+// recordAccess counts a key access through the MutableTree.
+func (m *prefixMetrics) recordAccess(kind AccessKind, key []byte) {
+	if m == nil {
+		return
+	}
+	_, c := m.counterOf(key)
+	switch kind {
+	case AccessRead:
+		atomic.AddUint64(&c.reads, 1)
+	case AccessWrite:
+		atomic.AddUint64(&c.writes, 1)
+	case AccessDelete:
+		atomic.AddUint64(&c.deletes, 1)
+	}
+}
+
+// recordCacheLookup counts a node cache hit or miss of a node with the given key.
+func (m *prefixMetrics) recordCacheLookup(key []byte, hit bool) {
+	if m == nil {
+		return
+	}
+	_, c := m.counterOf(key)
+	if hit {
+		atomic.AddUint64(&c.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&c.cacheMisses, 1)
+	}
+}
+
+// recordCommit counts a node written by a commit.
+func (m *prefixMetrics) recordCommit(node *Node, size int) {
+	if m == nil {
+		return
+	}
+	_, c := m.counterOf(node.key)
+	atomic.AddUint64(&c.commitNodes, 1)
+	atomic.AddUint64(&c.commitBytes, uint64(size))
+}
+
+// cacheAdded accounts for a node added to the node cache, and for the node evicted or replaced
+// by it, if any. The caller must hold nodeDB.cacheMtx.
+func (m *prefixMetrics) cacheAdded(node *Node, removed cache.Node) {
+	if m == nil {
+		return
+	}
+	key := node.GetKey()
+	m.cacheRemoved(key) // a replaced copy may have been dropped without being returned.
+	if removed != nil {
+		if removed == cache.Node(node) { // evicted right away by a cache of size zero.
+			return
+		}
+		m.cacheRemoved(removed.GetKey())
+	}
+	index, c := m.counterOf(node.key)
+	size := int64(node.encodedSize())
+	c.cachedNodes++
+	c.cachedBytes += size
+	m.cached[string(key)] = cachedNodeEntry{index: index, bytes: size}
+}
+
+// cacheRemoved accounts for a node removed from the node cache by its cache key. The caller must
+// hold nodeDB.cacheMtx.
+func (m *prefixMetrics) cacheRemoved(key []byte) {
+	if m == nil {
+		return
+	}
+	entry, ok := m.cached[ibytes.UnsafeBytesToStr(key)]
+	if !ok {
+		return
+	}
+	delete(m.cached, ibytes.UnsafeBytesToStr(key))
+	m.counters[entry.index].cachedNodes--
+	m.counters[entry.index].cachedBytes -= entry.bytes
+}
+
+// reconcile drops the nodes no longer held by the cache, e.g. after it was resized. The caller
+// must hold nodeDB.cacheMtx.
+func (m *prefixMetrics) reconcile(c cache.Cache) {
+	if m == nil {
+		return
+	}
+	for key := range m.cached {
+		if !c.Has([]byte(key)) {
+			m.cacheRemoved([]byte(key))
+		}
+	}
+}
+
+// stats returns the metrics by prefix name, with keys matching no prefix under the empty name.
+// The caller must hold nodeDB.cacheMtx.
+func (m *prefixMetrics) stats() map[string]PrefixStats {
+	if m == nil {
+		return nil
+	}
+	stats := make(map[string]PrefixStats, len(m.counters))
+	for i := range m.counters {
+		c := &m.counters[i]
+		name := ""
+		if i < len(m.prefixes) {
+			name = m.prefixes[i].Name
+		}
+		stats[name] = PrefixStats{
+			Reads:       atomic.LoadUint64(&c.reads),
+			Writes:      atomic.LoadUint64(&c.writes),
+			Deletes:     atomic.LoadUint64(&c.deletes),
+			CacheHits:   atomic.LoadUint64(&c.cacheHits),
+			CacheMisses: atomic.LoadUint64(&c.cacheMisses),
+			CachedNodes: c.cachedNodes,
+			CachedBytes: c.cachedBytes,
+			CommitNodes: atomic.LoadUint64(&c.commitNodes),
+			CommitBytes: atomic.LoadUint64(&c.commitBytes),
+		}
+	}
+	return stats
+}
+
+// PrefixStats returns the metrics attributed to each prefix registered with Options.KeyPrefixes,
+// by prefix name, with the metrics of keys matching no prefix under the empty name. It returns
+// nil if no prefixes are registered. It is safe for concurrent use.
+func (tree *MutableTree) PrefixStats() map[string]PrefixStats {
+	tree.ndb.cacheMtx.Lock()
+	defer tree.ndb.cacheMtx.Unlock()
+	return tree.ndb.prefixes.stats()
+}
+
+// recordAccess records a key access with the audit log and the prefix metrics.
+func (tree *MutableTree) recordAccess(kind AccessKind, key []byte, version int64) {
+	tree.getAuditLog().record(kind, key, version)
+	tree.ndb.prefixes.recordAccess(kind, key)
+}
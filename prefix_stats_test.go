@@ -0,0 +1,109 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutableTree_PrefixStats(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	require.Nil(t, tree.PrefixStats())
+
+	memDB := db.NewMemDB()
+	opts := &Options{KeyPrefixes: []KeyPrefix{
+		{Name: "bank", Prefix: []byte("bank/")},
+		{Name: "bank-supply", Prefix: []byte("bank/supply/")},
+		{Name: "staking", Prefix: []byte("staking/")},
+	}}
+	tree, err = NewMutableTreeWithOpts(memDB, 1000, opts, false)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("bank/%03d", i)), []byte("balance"))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("bank/supply/%03d", i)), []byte("supply"))
+		require.NoError(t, err)
+		_, err = tree.Set([]byte(fmt.Sprintf("staking/%03d", i)), make([]byte, 1000))
+		require.NoError(t, err)
+	}
+	_, err = tree.Set([]byte("other"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("staking/000"))
+	require.NoError(t, err)
+	_, err = tree.Get([]byte("bank/supply/001"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	stats := tree.PrefixStats()
+	require.Len(t, stats, 4)
+	require.EqualValues(t, 100, stats["bank"].Writes)
+	require.EqualValues(t, 10, stats["bank-supply"].Writes)
+	require.EqualValues(t, 1, stats["bank-supply"].Reads)
+	require.EqualValues(t, 10, stats["staking"].Writes)
+	require.EqualValues(t, 1, stats["staking"].Deletes)
+	require.EqualValues(t, 1, stats[""].Writes)
+
+	// every saved node is attributed by its key, and held by the cache.
+	var commitNodes uint64
+	var cachedNodes int64
+	for _, s := range stats {
+		commitNodes += s.CommitNodes
+		cachedNodes += s.CachedNodes
+		require.Equal(t, s.CommitNodes, uint64(s.CachedNodes))
+	}
+	require.EqualValues(t, 2*tree.Size()-1, commitNodes)
+	require.EqualValues(t, commitNodes, cachedNodes)
+	require.Greater(t, stats["staking"].CommitBytes, stats["bank"].CommitBytes)
+	require.Greater(t, stats["staking"].CachedBytes, int64(9000))
+
+	// cache lookups of another tree on the same database are attributed on load and on hit.
+	tree, err = NewMutableTreeWithOpts(memDB, 1000, opts, true)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	_, err = tree.Get([]byte("staking/005"))
+	require.NoError(t, err)
+	first := tree.PrefixStats()["staking"]
+	require.Positive(t, first.CacheMisses)
+	require.EqualValues(t, first.CacheMisses, first.CachedNodes)
+	_, err = tree.Get([]byte("staking/005"))
+	require.NoError(t, err)
+	stats = tree.PrefixStats()
+	require.Equal(t, first.CacheMisses, stats["staking"].CacheMisses)
+	require.Equal(t, first.CacheHits+first.CacheMisses, stats["staking"].CacheHits)
+	require.Zero(t, stats["staking"].CommitNodes)
+}
+
+func TestPrefixMetrics_CacheEvictions(t *testing.T) {
+	opts := &Options{KeyPrefixes: []KeyPrefix{{Name: "a", Prefix: []byte("a")}}}
+	for _, cacheSize := range []int{0, 10} {
+		tree, err := NewMutableTreeWithOpts(db.NewMemDB(), cacheSize, opts, false)
+		require.NoError(t, err)
+		for i := 0; i < 50; i++ {
+			_, err = tree.Set([]byte(fmt.Sprintf("a%02d", i)), []byte{1})
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		stats := tree.PrefixStats()
+		require.EqualValues(t, 99, stats["a"].CommitNodes)
+		require.EqualValues(t, tree.ndb.nodeCache.Len(), stats["a"].CachedNodes)
+		require.EqualValues(t, tree.ndb.nodeCache.Len(), len(tree.ndb.prefixes.cached))
+
+		// resizing the cache drops the evicted nodes.
+		if cacheSize > 0 {
+			tree.ndb.cacheMtx.Lock()
+			tree.ndb.nodeCache.(interface{ Resize(int) }).Resize(3)
+			tree.ndb.prefixes.reconcile(tree.ndb.nodeCache)
+			tree.ndb.cacheMtx.Unlock()
+			require.EqualValues(t, 3, tree.PrefixStats()["a"].CachedNodes)
+		}
+	}
+}
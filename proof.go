@@ -2,21 +2,13 @@ package iavl
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"errors"
 	"fmt"
-	"sync"
 
 	hexbytes "github.com/cosmos/iavl/internal/bytes"
 	"github.com/cosmos/iavl/internal/encoding"
 )
 
-var bufPool = &sync.Pool{
-	New: func() interface{} {
-		return new(bytes.Buffer)
-	},
-}
-
 var (
 	// ErrInvalidProof is returned by Verify when a proof cannot be validated.
 	ErrInvalidProof = fmt.Errorf("invalid proof")
@@ -61,11 +53,11 @@ func (pin ProofInnerNode) stringIndented(indent string) string {
 }
 
 func (pin ProofInnerNode) Hash(childHash []byte) ([]byte, error) {
-	hasher := sha256.New()
+	hasher := DefaultEncoderPool.GetHasher()
+	defer DefaultEncoderPool.PutHasher(hasher)
 
-	buf := bufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bufPool.Put(buf)
+	buf := DefaultEncoderPool.GetBuffer()
+	defer DefaultEncoderPool.PutBuffer(buf)
 
 	err := encoding.EncodeVarint(buf, int64(pin.Height))
 	if err == nil {
@@ -131,11 +123,11 @@ func (pln ProofLeafNode) stringIndented(indent string) string {
 }
 
 func (pln ProofLeafNode) Hash() ([]byte, error) {
-	hasher := sha256.New()
+	hasher := DefaultEncoderPool.GetHasher()
+	defer DefaultEncoderPool.PutHasher(hasher)
 
-	buf := bufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bufPool.Put(buf)
+	buf := DefaultEncoderPool.GetBuffer()
+	defer DefaultEncoderPool.PutBuffer(buf)
 
 	err := encoding.EncodeVarint(buf, 0)
 	if err == nil {
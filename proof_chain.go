@@ -0,0 +1,203 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// ProofOpSimpleMerkleCommitment is the type of proof operations holding an ics23 commitment proof
+// of a simple merkle map, as used for the store roots of the Cosmos SDK multistore.
+const ProofOpSimpleMerkleCommitment = "ics23:simple"
+
+// ErrInvalidProofChain is returned when a proof chain does not verify.
+var ErrInvalidProofChain = errors.New("invalid proof chain")
+
+// CommitmentOp is a single step of a proof chain: an ics23 proof of a key against a spec.
+type CommitmentOp struct {
+	Type  string
+	Key   []byte
+	Spec  *ics23.ProofSpec
+	Proof *ics23.CommitmentProof
+}
+
+// CommitmentOp returns the proof chain step proving the membership, or non-membership, of the key
+// in the tree.
+func (t *ImmutableTree) CommitmentOp(key []byte) (CommitmentOp, error) {
+	proof, err := t.GetProof(key)
+	if err != nil {
+		return CommitmentOp{}, err
+	}
+	op := CommitmentOp{Type: ProofOpIAVLCommitment, Key: key, Spec: t.ProofSpec(), Proof: proof}
+	if proof.GetNonexist() != nil {
+		// non-membership proofs are about the tree key, see ProofSpec.
+		op.Key, op.Spec = t.treeKey(key), ics23.IavlSpec
+	}
+	return op, nil
+}
+
+// NewSimpleMerkleOp returns the proof chain step proving that the named root is committed to by a
+// simple merkle map of roots, e.g. the store roots of a multistore, along with the root of the
+// map. Keys are sorted, leaves are SHA256(0x00 || len(key) || key || len(SHA256(root)) ||
+// SHA256(root)) with lengths as uvarints, and inner nodes are SHA256(0x01 || left || right),
+// split at the largest power of two below the number of leaves, matching ics23.TendermintSpec.
+func NewSimpleMerkleOp(name string, roots map[string][]byte) (CommitmentOp, []byte, error) {
+	if _, ok := roots[name]; !ok {
+		return CommitmentOp{}, nil, fmt.Errorf("%w: %q", ErrKeyDoesNotExist, name)
+	}
+	names := make([]string, 0, len(roots))
+	for n := range roots {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	leaves := make([][]byte, len(names))
+	index := 0
+	for i, n := range names {
+		leaves[i] = simpleLeafHash([]byte(n), roots[n])
+		if n == name {
+			index = i
+		}
+	}
+
+	root, path := simpleMerklePath(leaves, index)
+	exist := &ics23.ExistenceProof{
+		Key:   []byte(name),
+		Value: roots[name],
+		Leaf:  ics23.TendermintSpec.LeafSpec,
+		Path:  path,
+	}
+	op := CommitmentOp{
+		Type:  ProofOpSimpleMerkleCommitment,
+		Key:   []byte(name),
+		Spec:  ics23.TendermintSpec,
+		Proof: &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Exist{Exist: exist}},
+	}
+	return op, root, nil
+}
+
+// simpleLeafHash returns the leaf hash of a simple merkle map entry.
+func simpleLeafHash(key, value []byte) []byte {
+	valueHash := sha256.Sum256(value)
+	var length [binary.MaxVarintLen64]byte
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(length[:binary.PutUvarint(length[:], uint64(len(key)))])
+	h.Write(key)
+	h.Write(length[:binary.PutUvarint(length[:], uint64(len(valueHash)))])
+	h.Write(valueHash[:])
+	return h.Sum(nil)
+}
+
+// simpleMerklePath returns the root of a simple merkle tree of the leaf hashes, and the path of
+// inner ops from the leaf at index to the root.
+func simpleMerklePath(leaves [][]byte, index int) ([]byte, []*ics23.InnerOp) {
+	if len(leaves) == 1 {
+		return leaves[0], nil
+	}
+	split := 1
+	for split*2 < len(leaves) {
+		split *= 2
+	}
+	if index < split {
+		left, path := simpleMerklePath(leaves[:split], index)
+		right, _ := simpleMerklePath(leaves[split:], -1)
+		return simpleInnerHash(left, right), append(path, &ics23.InnerOp{
+			Hash:   ics23.HashOp_SHA256,
+			Prefix: []byte{0x01},
+			Suffix: right,
+		})
+	}
+	left, _ := simpleMerklePath(leaves[:split], -1)
+	right, path := simpleMerklePath(leaves[split:], index-split)
+	return simpleInnerHash(left, right), append(path, &ics23.InnerOp{
+		Hash:   ics23.HashOp_SHA256,
+		Prefix: append([]byte{0x01}, left...),
+	})
+}
+
+func simpleInnerHash(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{0x01}, left...), right...))
+	return hash[:]
+}
+
+// ProofChain is a chain of commitment proofs, ordered from the innermost tree to the outermost,
+// where each step proves the root computed by the previous step under its key, e.g. a proof of a
+// key in an IAVL tree followed by a proof of the tree root in a multistore.
+type ProofChain []CommitmentOp
+
+// Verify checks that the chain proves the value of the key of the first step against root, or the
+// absence of the key if value is nil.
+func (c ProofChain) Verify(root []byte, value []byte) error {
+	if len(c) == 0 {
+		return fmt.Errorf("%w: empty chain", ErrInvalidProofChain)
+	}
+	for i, op := range c {
+		if op.Proof == nil || op.Spec == nil {
+			return fmt.Errorf("%w: step %d has no proof or spec", ErrInvalidProofChain, i)
+		}
+		if i > 0 && op.Proof.GetExist() == nil {
+			return fmt.Errorf("%w: step %d does not prove membership", ErrInvalidProofChain, i)
+		}
+		stepRoot, err := op.Proof.Calculate()
+		if err != nil {
+			return fmt.Errorf("%w: step %d: %v", ErrInvalidProofChain, i, err)
+		}
+		var ok bool
+		if value == nil {
+			ok = ics23.VerifyNonMembership(op.Spec, stepRoot, op.Proof, op.Key)
+		} else {
+			ok = ics23.VerifyMembership(op.Spec, stepRoot, op.Proof, op.Key, value)
+		}
+		if !ok {
+			return fmt.Errorf("%w: step %d does not prove key %X", ErrInvalidProofChain, i, op.Key)
+		}
+		value = stepRoot
+	}
+	if !bytes.Equal(value, root) {
+		return fmt.Errorf("%w: computed root %X, expected %X", ErrInvalidProofChain, value, root)
+	}
+	return nil
+}
+
+// ProofOps serializes the chain as proof operations, e.g. for a QueryResponse.
+func (c ProofChain) ProofOps() ([]ProofOp, error) {
+	ops := make([]ProofOp, 0, len(c))
+	for _, op := range c {
+		bz, err := op.Proof.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, ProofOp{Type: op.Type, Key: op.Key, Data: bz})
+	}
+	return ops, nil
+}
+
+// ProofChainFromOps deserializes a chain from proof operations, with the spec of each step looked
+// up by its type. ProofOpIAVLCommitment and ProofOpSimpleMerkleCommitment are known by default.
+func ProofChainFromOps(ops []ProofOp, specs map[string]*ics23.ProofSpec) (ProofChain, error) {
+	chain := make(ProofChain, 0, len(ops))
+	for i, op := range ops {
+		spec, ok := specs[op.Type]
+		if !ok {
+			switch op.Type {
+			case ProofOpIAVLCommitment:
+				spec = ics23.IavlSpec
+			case ProofOpSimpleMerkleCommitment:
+				spec = ics23.TendermintSpec
+			default:
+				return nil, fmt.Errorf("%w: unknown type %q of step %d", ErrInvalidProofChain, op.Type, i)
+			}
+		}
+		proof := &ics23.CommitmentProof{}
+		if err := proof.Unmarshal(op.Data); err != nil {
+			return nil, fmt.Errorf("%w: step %d: %v", ErrInvalidProofChain, i, err)
+		}
+		chain = append(chain, CommitmentOp{Type: op.Type, Key: op.Key, Spec: spec, Proof: proof})
+	}
+	return chain, nil
+}
@@ -0,0 +1,56 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProofChain(t *testing.T) {
+	tree := setupSplitTree(t, 50)
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	hash, err := itree.Hash()
+	require.NoError(t, err)
+
+	roots := map[string][]byte{"iavl": hash}
+	for i := 0; i < 4; i++ {
+		roots[fmt.Sprintf("store%d", i)] = []byte(fmt.Sprintf("root%d", i))
+	}
+	storeOp, appHash, err := NewSimpleMerkleOp("iavl", roots)
+	require.NoError(t, err)
+	require.Equal(t, ProofOpSimpleMerkleCommitment, storeOp.Type)
+
+	keyOp, err := itree.CommitmentOp([]byte("key0010"))
+	require.NoError(t, err)
+	chain := ProofChain{keyOp, storeOp}
+	require.NoError(t, chain.Verify(appHash, []byte("value10")))
+	require.ErrorIs(t, chain.Verify(appHash, []byte("value11")), ErrInvalidProofChain)
+	require.ErrorIs(t, chain.Verify(hash, []byte("value10")), ErrInvalidProofChain)
+	require.NoError(t, ProofChain{keyOp}.Verify(hash, []byte("value10")))
+
+	absentOp, err := itree.CommitmentOp([]byte("key0010a"))
+	require.NoError(t, err)
+	require.NoError(t, ProofChain{absentOp, storeOp}.Verify(appHash, nil))
+
+	// the chain survives serialization.
+	ops, err := chain.ProofOps()
+	require.NoError(t, err)
+	decoded, err := ProofChainFromOps(ops, nil)
+	require.NoError(t, err)
+	require.NoError(t, decoded.Verify(appHash, []byte("value10")))
+	_, err = ProofChainFromOps([]ProofOp{{Type: "unknown"}}, nil)
+	require.ErrorIs(t, err, ErrInvalidProofChain)
+
+	// every store is provable against the same root.
+	for name, root := range roots {
+		op, opRoot, err := NewSimpleMerkleOp(name, roots)
+		require.NoError(t, err)
+		require.Equal(t, appHash, opRoot)
+		require.True(t, ics23.VerifyMembership(ics23.TendermintSpec, appHash, op.Proof, []byte(name), root))
+	}
+	_, _, err = NewSimpleMerkleOp("missing", roots)
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+}
@@ -1,21 +1,88 @@
 package iavl
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 
 	ics23 "github.com/cosmos/ics23/go"
 )
 
+// HashedKeyIavlSpec is the ics23 proof spec for membership proofs of trees created with
+// Options.HashKeys, where the key is hashed before being committed to in the leaf.
+var HashedKeyIavlSpec = &ics23.ProofSpec{
+	LeafSpec: &ics23.LeafOp{
+		Prefix:       ics23.IavlSpec.LeafSpec.Prefix,
+		PrehashKey:   ics23.HashOp_SHA256,
+		Hash:         ics23.IavlSpec.LeafSpec.Hash,
+		PrehashValue: ics23.IavlSpec.LeafSpec.PrehashValue,
+		Length:       ics23.IavlSpec.LeafSpec.Length,
+	},
+	InnerSpec: ics23.IavlSpec.InnerSpec,
+}
+
+// ProofSpec returns the ics23 proof spec that membership proofs of the tree must be verified
+// against. It is ics23.IavlSpec, unless the tree was created with Options.HashKeys.
+//
+// Non-membership proofs of trees created with Options.HashKeys are proofs about the SHA256 hash
+// of the key, and must be verified against ics23.IavlSpec with the hashed key.
+func (t *ImmutableTree) ProofSpec() *ics23.ProofSpec {
+	if t.hashKeys() {
+		return HashedKeyIavlSpec
+	}
+	return ics23.IavlSpec
+}
+
+// ValueHashProofSpec returns the ics23 proof spec that proofs created by GetValueHashMembershipProof
+// must be verified against. It is ProofSpec(), except that the value is expected to be hashed already.
+func (t *ImmutableTree) ValueHashProofSpec() *ics23.ProofSpec {
+	spec := t.ProofSpec()
+	leafSpec := *spec.LeafSpec
+	leafSpec.PrehashValue = ics23.HashOp_NO_HASH
+	return &ics23.ProofSpec{
+		LeafSpec:  &leafSpec,
+		InnerSpec: spec.InnerSpec,
+	}
+}
+
 /*
 GetMembershipProof will produce a CommitmentProof that the given key (and queries value) exists in the iavl tree.
 If the key doesn't exist in the tree, this will return an error.
 */
 func (t *ImmutableTree) GetMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
-	exist, err := t.createExistenceProof(key)
+	return t.getMembershipProof(key, false)
+}
+
+/*
+GetValueHashMembershipProof will produce a CommitmentProof that the given key exists in the iavl tree,
+which carries the SHA256 hash of the value instead of the value itself, e.g. for verifiers who store
+values elsewhere and only know their hashes. It does not avoid reading the value: values are stored
+inline in the leaf nodes, so the full value is read from the tree and hashed like for
+GetMembershipProof, and only the proof is smaller. The proof verifies against ValueHashProofSpec()
+with the value hash in place of the value, and the root hash of the tree is unchanged.
+If the key doesn't exist in the tree, this will return an error.
+*/
+func (t *ImmutableTree) GetValueHashMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	return t.getMembershipProof(key, true)
+}
+
+func (t *ImmutableTree) getMembershipProof(key []byte, valueHash bool) (*ics23.CommitmentProof, error) {
+	exist, err := t.createExistenceProof(t.treeKey(key))
 	if err != nil {
 		return nil, err
 	}
+	if t.hashKeys() {
+		// commit to the original key, the verifier hashes it as the leaf spec requires.
+		exist.Key = key
+		exist.Leaf.PrehashKey = ics23.HashOp_SHA256
+	}
+	if valueHash {
+		// the leaf commits to the length-prefixed value hash either way, so the leaf hash
+		// is identical when the verifier doesn't hash the value itself.
+		hash := sha256.Sum256(exist.Value)
+		exist.Value = hash[:]
+		exist.Leaf.PrehashValue = ics23.HashOp_NO_HASH
+	}
 	proof := &ics23.CommitmentProof{
 		Proof: &ics23.CommitmentProof_Exist{
 			Exist: exist,
@@ -35,17 +102,20 @@ func (t *ImmutableTree) VerifyMembership(proof *ics23.CommitmentProof, key []byt
 		return false, err
 	}
 
-	return ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, val), nil
+	return ics23.VerifyMembership(t.ProofSpec(), root, proof, key, val), nil
 }
 
 /*
 GetNonMembershipProof will produce a CommitmentProof that the given key doesn't exist in the iavl tree.
-If the key exists in the tree, this will return an error.
+If the key exists in the tree, this will return an error. For trees created with Options.HashKeys,
+the proof is about the hashed key.
 */
 func (t *ImmutableTree) GetNonMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	key = t.treeKey(key)
+
 	// idx is one node right of what we want....
 	var err error
-	idx, val, err := t.GetWithIndex(key)
+	idx, val, err := t.getWithIndex(key)
 	if err != nil {
 		return nil, err
 	}
@@ -98,11 +168,11 @@ func (t *ImmutableTree) VerifyNonMembership(proof *ics23.CommitmentProof, key []
 		return false, err
 	}
 
-	return ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key), nil
+	return ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, t.treeKey(key)), nil
 }
 
 // createExistenceProof will get the proof from the tree and convert the proof into a valid
-// existence proof, if that's what it is.
+// existence proof, if that's what it is. The key must already be passed through treeKey.
 func (t *ImmutableTree) createExistenceProof(key []byte) (*ics23.ExistenceProof, error) {
 	_, err := t.Hash()
 	if err != nil {
@@ -219,3 +289,89 @@ func (tree *MutableTree) GetVersionedProof(key []byte, version int64) (*ics23.Co
 	}
 	return nil, ErrVersionDoesNotExist
 }
+
+// VersionedProof is a proof of a key at a historical version, as returned by
+// GetVersionedWithProof.
+type VersionedProof struct {
+	Proof *ics23.CommitmentProof
+
+	// RequestedVersion is the version the proof was requested for.
+	RequestedVersion int64
+
+	// ProvenVersion is the version whose root hash the proof verifies against.
+	ProvenVersion int64
+
+	// Substituted is true when RequestedVersion was pruned and the proof is against the retained
+	// ProvenVersion instead. The proven leaf was written at LeafVersion, no later than
+	// RequestedVersion, and was not changed up to ProvenVersion, so it also held at
+	// RequestedVersion.
+	Substituted bool
+
+	// LeafVersion is the version the proven leaf was written at, or 0 for non-membership proofs.
+	LeafVersion int64
+}
+
+// GetVersionedWithProof returns the value of the key at the given version along with a proof.
+// If the version was pruned, but the leaf holding the key in the nearest retained version was
+// written no later than the requested version, the value and a membership proof against the
+// retained version are returned instead, with VersionedProof.Substituted set. Otherwise,
+// ErrVersionDoesNotExist is returned for pruned versions, since neither a changed value nor the
+// absence of a key can be proven.
+func (tree *MutableTree) GetVersionedWithProof(key []byte, version int64) ([]byte, *VersionedProof, error) {
+	if tree.VersionExists(version) {
+		t, err := tree.GetImmutable(version)
+		if err != nil {
+			return nil, nil, err
+		}
+		leaf, err := t.getLeaf(t.treeKey(key))
+		if err != nil {
+			return nil, nil, err
+		}
+		proof, err := t.GetProof(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		vp := &VersionedProof{
+			Proof:            proof,
+			RequestedVersion: version,
+			ProvenVersion:    version,
+		}
+		if leaf == nil {
+			return nil, vp, nil
+		}
+		vp.LeafVersion = leaf.nodeKey.version
+		return leaf.value, vp, nil
+	}
+
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, nil, err
+	}
+	if version <= 0 || version >= firstVersion {
+		return nil, nil, ErrVersionDoesNotExist
+	}
+
+	t, err := tree.GetImmutable(firstVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := t.getLeaf(t.treeKey(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	if leaf == nil || leaf.nodeKey.version > version {
+		return nil, nil, fmt.Errorf("%w: version %d was pruned and key %X changed before retained version %d",
+			ErrVersionDoesNotExist, version, key, firstVersion)
+	}
+	proof, err := t.GetMembershipProof(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaf.value, &VersionedProof{
+		Proof:            proof,
+		RequestedVersion: version,
+		ProvenVersion:    firstVersion,
+		Substituted:      true,
+		LeafVersion:      leaf.nodeKey.version,
+	}, nil
+}
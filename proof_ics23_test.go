@@ -2,6 +2,7 @@ package iavl
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"math/rand"
 	"sort"
 	"testing"
@@ -263,3 +264,163 @@ func BenchmarkConvertLeafOp(b *testing.B) {
 	}
 	sink = nil
 }
+
+func TestHashedKeyProofs(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{HashKeys: true}, false)
+	require.NoError(t, err)
+
+	// sequential keys would normally end up next to each other
+	for i := 0; i < 200; i++ {
+		_, err := tree.Set(i2b(i), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, HashedKeyIavlSpec, tree.ProofSpec())
+
+	root, err := tree.Hash()
+	require.NoError(t, err)
+
+	value, err := tree.Get(i2b(42))
+	require.NoError(t, err)
+	require.Equal(t, []byte{42}, value)
+	value, err = tree.GetVersioned(i2b(42), 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{42}, value)
+
+	// leaves are ordered by the hashed key
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		require.Len(t, key, hashSize)
+		return false
+	})
+	require.NoError(t, err)
+
+	proof, err := tree.GetProof(i2b(42))
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(HashedKeyIavlSpec, root, proof, i2b(42), []byte{42}))
+	require.False(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, i2b(42), []byte{42}))
+	ok, err := tree.VerifyProof(proof, i2b(42))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	proof, err = tree.GetProof(i2b(1000))
+	require.NoError(t, err)
+	hashedKey := sha256.Sum256(i2b(1000))
+	require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, hashedKey[:]))
+	ok, err = tree.VerifyProof(proof, i2b(1000))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	value, removed, err := tree.Remove(i2b(42))
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Equal(t, []byte{42}, value)
+	has, err := tree.Has(i2b(42))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestValueHashProofs(t *testing.T) {
+	tree, allkeys, err := BuildTree(200, 0)
+	require.NoError(t, err)
+	root, err := tree.WorkingHash()
+	require.NoError(t, err)
+
+	key := GetKey(allkeys, Middle)
+	value, err := tree.Get(key)
+	require.NoError(t, err)
+	valueHash := sha256.Sum256(value)
+
+	proof, err := tree.GetValueHashMembershipProof(key)
+	require.NoError(t, err)
+	require.Equal(t, valueHash[:], proof.GetExist().Value)
+	require.True(t, ics23.VerifyMembership(tree.ValueHashProofSpec(), root, proof, key, valueHash[:]))
+	require.False(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value))
+
+	// the leaf hash is what both kinds of proofs commit to, once the leaf is saved
+	_, err = tree.GetLeafHash(key)
+	require.ErrorIs(t, err, ErrLeafNotSaved)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	leafHash, err := tree.GetLeafHash(key)
+	require.NoError(t, err)
+	calculated, err := proof.GetExist().Leaf.Apply(key, valueHash[:])
+	require.NoError(t, err)
+	require.Equal(t, leafHash, calculated)
+
+	leafHash, err = tree.GetLeafHash([]byte("non-existent"))
+	require.NoError(t, err)
+	require.Nil(t, leafHash)
+
+	_, err = tree.GetValueHashMembershipProof([]byte("non-existent"))
+	require.Error(t, err)
+}
+
+func TestGetVersionedWithProof(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+
+	for _, kvs := range [][]string{{"a", "1", "b", "1"}, {"b", "2"}, {"c", "3"}} {
+		for i := 0; i < len(kvs); i += 2 {
+			_, err := tree.Set([]byte(kvs[i]), []byte(kvs[i+1]))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	root, err := tree.Hash()
+	require.NoError(t, err)
+
+	// retained versions are proven directly.
+	value, vp, err := tree.GetVersionedWithProof([]byte("a"), 3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	require.Equal(t, &VersionedProof{Proof: vp.Proof, RequestedVersion: 3, ProvenVersion: 3, LeafVersion: 1}, vp)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, vp.Proof, []byte("a"), value))
+
+	value, vp, err = tree.GetVersionedWithProof([]byte("x"), 3)
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.False(t, vp.Substituted)
+	require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, vp.Proof, []byte("x")))
+
+	// unchanged leaves of pruned versions are proven against the first retained version.
+	for _, tc := range []struct {
+		key         string
+		version     int64
+		value       string
+		leafVersion int64
+	}{
+		{"a", 1, "1", 1},
+		{"a", 2, "1", 1},
+		{"b", 2, "2", 2},
+	} {
+		value, vp, err = tree.GetVersionedWithProof([]byte(tc.key), tc.version)
+		require.NoError(t, err)
+		require.Equal(t, []byte(tc.value), value)
+		require.Equal(t, &VersionedProof{
+			Proof:            vp.Proof,
+			RequestedVersion: tc.version,
+			ProvenVersion:    3,
+			Substituted:      true,
+			LeafVersion:      tc.leafVersion,
+		}, vp)
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, vp.Proof, []byte(tc.key), value))
+	}
+
+	// changed, added or missing keys can't be proven for pruned versions.
+	for _, tc := range []struct {
+		key     string
+		version int64
+	}{
+		{"b", 1},
+		{"c", 2},
+		{"x", 1},
+		{"a", 0},
+		{"a", 4},
+	} {
+		_, _, err = tree.GetVersionedWithProof([]byte(tc.key), tc.version)
+		require.ErrorIs(t, err, ErrVersionDoesNotExist, "key %s version %d", tc.key, tc.version)
+	}
+}
@@ -0,0 +1,203 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// ErrInvalidUpdateProof is returned when an update proof does not verify.
+var ErrInvalidUpdateProof = errors.New("invalid update proof")
+
+// siblingLength is the length prefix of sibling hashes in the inner ops of IAVL proofs.
+const siblingLength = 0x20
+
+// UpdateProof proves that a key had one value at a version and another value at a later version,
+// e.g. for bridges that prove state transitions rather than single snapshots. A nil value proves
+// the absence of the key.
+//
+// When the key exists at both versions, the proof at the later version is stored compactly as
+// ToLeafVersion and ToPath: the path is usually identical in shape, and most sibling subtrees are
+// unchanged between the versions, so their hashes are taken from the proof at the earlier version
+// instead of being repeated.
+type UpdateProof struct {
+	Key         []byte
+	FromVersion int64
+	ToVersion   int64
+	FromValue   []byte
+	ToValue     []byte
+
+	// From proves FromValue at FromVersion.
+	From CommitmentOp
+	// To proves ToValue at ToVersion, unless the proof is compacted into ToLeafVersion and ToPath,
+	// in which case To.Proof is nil.
+	To CommitmentOp
+
+	// ToLeafVersion is the version the leaf holding ToValue was written at.
+	ToLeafVersion int64
+	// ToPath is the path from the root to the leaf holding ToValue at ToVersion.
+	ToPath []UpdateProofStep
+}
+
+// UpdateProofStep is an inner node on the path to a leaf in an UpdateProof.
+type UpdateProofStep struct {
+	Height  int8
+	Size    int64
+	Version int64
+	// SiblingLeft is set when the sibling of the path is the left child.
+	SiblingLeft bool
+	// Sibling is the hash of the sibling, or nil if it equals the sibling hash at the same depth
+	// and side of the proof at FromVersion.
+	Sibling []byte
+}
+
+// GetUpdateProof returns a proof of the values of the key at two saved versions, see UpdateProof.
+// ErrVersionDoesNotExist is returned if either version does not exist.
+func (tree *MutableTree) GetUpdateProof(key []byte, fromVersion, toVersion int64) (*UpdateProof, error) {
+	if fromVersion >= toVersion {
+		return nil, fmt.Errorf("version %d is not before version %d", fromVersion, toVersion)
+	}
+	if !tree.VersionExists(fromVersion) || !tree.VersionExists(toVersion) {
+		return nil, ErrVersionDoesNotExist
+	}
+	from, err := tree.GetImmutable(fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	to, err := tree.GetImmutable(toVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &UpdateProof{Key: key, FromVersion: fromVersion, ToVersion: toVersion}
+	if proof.FromValue, err = from.Get(key); err != nil {
+		return nil, err
+	}
+	if proof.ToValue, err = to.Get(key); err != nil {
+		return nil, err
+	}
+	if proof.From, err = from.CommitmentOp(key); err != nil {
+		return nil, err
+	}
+	if proof.FromValue == nil || proof.ToValue == nil {
+		if proof.To, err = to.CommitmentOp(key); err != nil {
+			return nil, err
+		}
+		return proof, nil
+	}
+
+	treeKey := from.treeKey(key)
+	fromPath, _, err := from.root.PathToLeaf(from, treeKey, fromVersion+1)
+	if err != nil {
+		return nil, err
+	}
+	toPath, leaf, err := to.root.PathToLeaf(to, treeKey, toVersion+1)
+	if err != nil {
+		return nil, err
+	}
+	proof.To = CommitmentOp{Type: proof.From.Type, Key: proof.From.Key, Spec: to.ProofSpec()}
+	proof.ToLeafVersion = leaf.nodeKey.version
+	proof.ToPath = make([]UpdateProofStep, 0, len(toPath))
+	for i, pin := range toPath {
+		step := UpdateProofStep{
+			Height:      pin.Height,
+			Size:        pin.Size,
+			Version:     pin.Version,
+			SiblingLeft: len(pin.Left) > 0,
+			Sibling:     pin.Right,
+		}
+		if step.SiblingLeft {
+			step.Sibling = pin.Left
+		}
+		if i < len(fromPath) {
+			shared := fromPath[i].Right
+			if step.SiblingLeft {
+				shared = fromPath[i].Left
+			}
+			if bytes.Equal(step.Sibling, shared) {
+				step.Sibling = nil
+			}
+		}
+		proof.ToPath = append(proof.ToPath, step)
+	}
+	return proof, nil
+}
+
+// Verify checks the proof against the root hashes of both versions.
+func (p *UpdateProof) Verify(fromRoot, toRoot []byte) error {
+	if err := (ProofChain{p.From}).Verify(fromRoot, p.FromValue); err != nil {
+		return fmt.Errorf("%w: version %d: %v", ErrInvalidUpdateProof, p.FromVersion, err)
+	}
+	to, err := p.toOp()
+	if err != nil {
+		return err
+	}
+	if err := (ProofChain{to}).Verify(toRoot, p.ToValue); err != nil {
+		return fmt.Errorf("%w: version %d: %v", ErrInvalidUpdateProof, p.ToVersion, err)
+	}
+	return nil
+}
+
+// toOp returns the proof at ToVersion, expanding a compacted proof.
+func (p *UpdateProof) toOp() (CommitmentOp, error) {
+	if p.To.Proof != nil {
+		return p.To, nil
+	}
+	fromExist := p.From.Proof.GetExist()
+	if fromExist == nil || p.ToValue == nil {
+		return CommitmentOp{}, fmt.Errorf("%w: compacted proof of a missing key", ErrInvalidUpdateProof)
+	}
+
+	path := make(PathToLeaf, 0, len(p.ToPath))
+	fromOps := fromExist.Path
+	for i, step := range p.ToPath {
+		sibling := step.Sibling
+		if sibling == nil {
+			if i >= len(fromOps) {
+				return CommitmentOp{}, fmt.Errorf("%w: no shared sibling at depth %d", ErrInvalidUpdateProof, i)
+			}
+			// the ops of the existence proof are ordered from the leaf to the root.
+			var ok bool
+			if sibling, ok = innerOpSibling(fromOps[len(fromOps)-1-i], step.SiblingLeft); !ok {
+				return CommitmentOp{}, fmt.Errorf("%w: no shared sibling at depth %d", ErrInvalidUpdateProof, i)
+			}
+		}
+		pin := ProofInnerNode{Height: step.Height, Size: step.Size, Version: step.Version}
+		if step.SiblingLeft {
+			pin.Left = sibling
+		} else {
+			pin.Right = sibling
+		}
+		path = append(path, pin)
+	}
+
+	leaf := *fromExist.Leaf
+	leaf.Prefix = convertLeafOp(p.ToLeafVersion).Prefix
+	exist := &ics23.ExistenceProof{
+		Key:   fromExist.Key,
+		Value: p.ToValue,
+		Leaf:  &leaf,
+		Path:  convertInnerOps(path),
+	}
+	to := p.To
+	to.Proof = &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Exist{Exist: exist}}
+	return to, nil
+}
+
+// innerOpSibling returns the sibling hash of an inner op of an IAVL proof, as written by
+// convertInnerOps, if the sibling is on the given side.
+func innerOpSibling(op *ics23.InnerOp, left bool) ([]byte, bool) {
+	if left {
+		n := len(op.Prefix)
+		if len(op.Suffix) > 0 || n < hashSize+2 || op.Prefix[n-hashSize-2] != siblingLength {
+			return nil, false
+		}
+		return op.Prefix[n-hashSize-1 : n-1], true
+	}
+	if len(op.Suffix) != hashSize+1 || op.Suffix[0] != siblingLength {
+		return nil, false
+	}
+	return op.Suffix[1:], true
+}
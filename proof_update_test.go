@@ -0,0 +1,86 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutableTree_GetUpdateProof(t *testing.T) {
+	for _, hashKeys := range []bool{false, true} {
+		t.Run(fmt.Sprintf("HashKeys=%v", hashKeys), func(t *testing.T) {
+			tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{HashKeys: hashKeys}, false)
+			require.NoError(t, err)
+			roots := map[int64][]byte{}
+			save := func() {
+				hash, version, err := tree.SaveVersion()
+				require.NoError(t, err)
+				roots[version] = hash
+			}
+
+			for i := 0; i < 100; i++ {
+				_, err = tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte{byte(i)})
+				require.NoError(t, err)
+			}
+			save()
+			_, err = tree.Set([]byte("key-50"), []byte("updated"))
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("key-90"), []byte("updated"))
+			require.NoError(t, err)
+			save()
+			_, _, err = tree.Remove([]byte("key-50"))
+			require.NoError(t, err)
+			save()
+
+			key := []byte("key-50")
+			proof, err := tree.GetUpdateProof(key, 1, 2)
+			require.NoError(t, err)
+			require.Equal(t, []byte{50}, proof.FromValue)
+			require.Equal(t, []byte("updated"), proof.ToValue)
+			require.Nil(t, proof.To.Proof)
+			require.EqualValues(t, 2, proof.ToLeafVersion)
+			shared := 0
+			for _, step := range proof.ToPath {
+				if step.Sibling == nil {
+					shared++
+				}
+			}
+			// only the sibling of the path to key-90 changed.
+			require.GreaterOrEqual(t, shared, len(proof.ToPath)-1)
+			require.NoError(t, proof.Verify(roots[1], roots[2]))
+			require.ErrorIs(t, proof.Verify(roots[2], roots[1]), ErrInvalidUpdateProof)
+
+			tampered := *proof
+			tampered.ToValue = []byte("forged")
+			require.ErrorIs(t, tampered.Verify(roots[1], roots[2]), ErrInvalidUpdateProof)
+			tampered = *proof
+			tampered.FromValue = []byte("forged")
+			require.ErrorIs(t, tampered.Verify(roots[1], roots[2]), ErrInvalidUpdateProof)
+
+			// removal and unchanged keys.
+			proof, err = tree.GetUpdateProof(key, 2, 3)
+			require.NoError(t, err)
+			require.Nil(t, proof.ToValue)
+			require.NotNil(t, proof.To.Proof)
+			require.NoError(t, proof.Verify(roots[2], roots[3]))
+			proof, err = tree.GetUpdateProof(key, 1, 3)
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(roots[1], roots[3]))
+			proof, err = tree.GetUpdateProof([]byte("key-10"), 1, 3)
+			require.NoError(t, err)
+			require.Equal(t, proof.FromValue, proof.ToValue)
+			require.NoError(t, proof.Verify(roots[1], roots[3]))
+			proof, err = tree.GetUpdateProof([]byte("missing"), 1, 2)
+			require.NoError(t, err)
+			require.Nil(t, proof.FromValue)
+			require.NoError(t, proof.Verify(roots[1], roots[2]))
+
+			_, err = tree.GetUpdateProof(key, 1, 4)
+			require.ErrorIs(t, err, ErrVersionDoesNotExist)
+			_, err = tree.GetUpdateProof(key, 2, 1)
+			require.Error(t, err)
+		})
+	}
+}
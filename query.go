@@ -0,0 +1,138 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// QueryPathKey is the query path returning the value of the key in QueryRequest.Data.
+	QueryPathKey = "/key"
+	// QueryPathSubspace is the query path returning all pairs with the prefix in QueryRequest.Data.
+	QueryPathSubspace = "/subspace"
+
+	// ProofOpIAVLCommitment is the type of proof operations holding an ics23 commitment proof of an
+	// IAVL tree, as used by the Cosmos SDK.
+	ProofOpIAVLCommitment = "ics23:iavl"
+)
+
+// ErrUnknownQueryPath is returned by Query for paths other than QueryPathKey and
+// QueryPathSubspace.
+var ErrUnknownQueryPath = errors.New("unknown query path")
+
+// QueryRequest is a store query, following the fields of an ABCI query request.
+type QueryRequest struct {
+	Path string
+	Data []byte
+	// Height is the version to query, or 0 for the latest version.
+	Height int64
+	// Prove requests a proof of the result. Only supported for QueryPathKey.
+	Prove bool
+}
+
+// QueryResponse is the result of a store query, following the fields of an ABCI query response.
+type QueryResponse struct {
+	Key   []byte
+	Value []byte
+	// Pairs are the pairs found by a QueryPathSubspace query, in key order.
+	Pairs []KVPair
+	// ProofOps proves Value, or the absence of Key, against the root hash at Height.
+	ProofOps []ProofOp
+	// Height is the version the query was answered at.
+	Height int64
+}
+
+// ProofOp is a serialized proof operation, following the fields of a Tendermint/CometBFT
+// crypto.ProofOp.
+type ProofOp struct {
+	Type string
+	Key  []byte
+	Data []byte
+}
+
+// Query answers a store query with the semantics of the Cosmos SDK IAVL store: QueryPathKey
+// returns the value of a key, with an ics23 proof of (non-)membership if requested, and
+// QueryPathSubspace returns all pairs with a prefix. Queries at a height of 0 are answered at the
+// latest saved version. Trees with Options.HashKeys do not keep keys in order, so they do not
+// support QueryPathSubspace.
+func (tree *MutableTree) Query(req QueryRequest) (*QueryResponse, error) {
+	version := req.Height
+	if version == 0 {
+		version = tree.Version()
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load version %d: %w", version, err)
+	}
+	return t.Query(req)
+}
+
+// Query answers a store query against the tree. The height of the request must be 0 or the
+// version of the tree. See MutableTree.Query.
+func (t *ImmutableTree) Query(req QueryRequest) (*QueryResponse, error) {
+	if req.Height != 0 && req.Height != t.version {
+		return nil, fmt.Errorf("query height %d does not match tree version %d", req.Height, t.version)
+	}
+	res := &QueryResponse{Height: t.version}
+
+	switch req.Path {
+	case QueryPathKey:
+		value, err := t.Get(req.Data)
+		if err != nil {
+			return nil, err
+		}
+		res.Key = req.Data
+		res.Value = value
+		if !req.Prove {
+			break
+		}
+		proof, err := t.GetProof(req.Data)
+		if err != nil {
+			return nil, err
+		}
+		bz, err := proof.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		res.ProofOps = []ProofOp{{Type: ProofOpIAVLCommitment, Key: req.Data, Data: bz}}
+
+	case QueryPathSubspace:
+		if req.Prove {
+			return nil, fmt.Errorf("proofs are not supported for %s queries", QueryPathSubspace)
+		}
+		if t.hashKeys() {
+			return nil, fmt.Errorf("%s queries are not supported by trees with hashed keys", QueryPathSubspace)
+		}
+		itr, err := t.Iterator(req.Data, prefixEnd(req.Data), true)
+		if err != nil {
+			return nil, err
+		}
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			res.Pairs = append(res.Pairs, KVPair{Key: itr.Key(), Value: itr.Value()})
+		}
+		if err := itr.Error(); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownQueryPath, req.Path)
+	}
+	return res, nil
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix, or nil if there is
+// none.
+func prefixEnd(prefix []byte) []byte {
+	if len(prefix) == 0 {
+		return nil
+	}
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
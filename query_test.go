@@ -0,0 +1,80 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutableTree_Query(t *testing.T) {
+	tree := setupSplitTree(t, 30)
+	_, err := tree.Set([]byte("key0005"), []byte("changed"))
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	res, err := tree.Query(QueryRequest{Path: QueryPathKey, Data: []byte("key0005"), Prove: true})
+	require.NoError(t, err)
+	require.Equal(t, version, res.Height)
+	require.Equal(t, []byte("changed"), res.Value)
+	require.Len(t, res.ProofOps, 1)
+	require.Equal(t, ProofOpIAVLCommitment, res.ProofOps[0].Type)
+	var proof ics23.CommitmentProof
+	require.NoError(t, proof.Unmarshal(res.ProofOps[0].Data))
+	hash, err := tree.Hash()
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, hash, &proof, []byte("key0005"), []byte("changed")))
+
+	// queries at an earlier height.
+	res, err = tree.Query(QueryRequest{Path: QueryPathKey, Data: []byte("key0005"), Height: 1, Prove: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Height)
+	require.Equal(t, []byte("value5"), res.Value)
+
+	// missing keys are proven absent.
+	res, err = tree.Query(QueryRequest{Path: QueryPathKey, Data: []byte("key0005a"), Prove: true})
+	require.NoError(t, err)
+	require.Nil(t, res.Value)
+	require.NoError(t, proof.Unmarshal(res.ProofOps[0].Data))
+	require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, hash, &proof, []byte("key0005a")))
+
+	res, err = tree.Query(QueryRequest{Path: QueryPathSubspace, Data: []byte("key001")})
+	require.NoError(t, err)
+	require.Len(t, res.Pairs, 10)
+	require.Equal(t, []byte("key0010"), res.Pairs[0].Key)
+	require.Equal(t, []byte("value19"), res.Pairs[9].Value)
+
+	_, err = tree.Query(QueryRequest{Path: "/store"})
+	require.ErrorIs(t, err, ErrUnknownQueryPath)
+	_, err = tree.Query(QueryRequest{Path: QueryPathKey, Height: version + 1})
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_Query_HashKeys(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{HashKeys: true}, false)
+	require.NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	res, err := tree.Query(QueryRequest{Path: QueryPathKey, Data: []byte("key0005")})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value5"), res.Value)
+
+	// the prefix would be matched against the hashed keys.
+	_, err = tree.Query(QueryRequest{Path: QueryPathSubspace, Data: []byte("key001")})
+	require.Error(t, err)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Nil(t, prefixEnd(nil))
+	require.Equal(t, []byte("ab"), prefixEnd([]byte("aa")))
+	require.Equal(t, []byte{0x02}, prefixEnd([]byte{0x01, 0xff}))
+	require.Nil(t, prefixEnd([]byte{0xff, 0xff}))
+}
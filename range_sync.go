@@ -0,0 +1,497 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// ErrInvalidRangeNode is returned by RangeVerifier when a node does not verify against the trusted
+// root hash, or when the nodes do not cover the requested key range.
+var ErrInvalidRangeNode = errors.New("invalid range node")
+
+// RangeNode is a node of a range export, see ImmutableTree.ExportRange. Nodes are sent in
+// depth-first pre-order (NLR), with the children of inner nodes given by their hashes, so that
+// each node can be verified against its parent as it arrives. Subtrees not covering the range are
+// sent as a single node with only Pruned set.
+type RangeNode struct {
+	Pruned  bool
+	Height  int8
+	Size    int64
+	Version int64
+	// Nonce is the nonce of the node key, which is the version and nonce the node is stored at.
+	Nonce int32
+	// Key is the key of a leaf node, or the smallest key of the right subtree of an inner node.
+	Key []byte
+	// Value is only set for leaf nodes.
+	Value []byte
+	// Left and Right are the child hashes, and LeftNodeKey and RightNodeKey the child node keys,
+	// only set for inner nodes.
+	Left         []byte
+	Right        []byte
+	LeftNodeKey  *NodeKey
+	RightNodeKey *NodeKey
+}
+
+// hash computes the hash of the node.
+func (n *RangeNode) hash() ([]byte, error) {
+	node := &Node{subtreeHeight: n.Height, size: n.Size, key: n.Key, value: n.Value}
+	if n.Height > 0 {
+		node.leftNode = &Node{hash: n.Left}
+		node.rightNode = &Node{hash: n.Right}
+	}
+	return node._hash(n.Version)
+}
+
+// Marshal encodes the node, e.g. to send it to a peer.
+func (n *RangeNode) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	if n.Pruned {
+		buf.WriteByte(1)
+		return buf.Bytes(), nil
+	}
+	buf.WriteByte(0)
+	for _, v := range []int64{int64(n.Height), n.Size, n.Version, int64(n.Nonce)} {
+		if err := encoding.EncodeVarint(&buf, v); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoding.EncodeBytes(&buf, n.Key); err != nil {
+		return nil, err
+	}
+	if n.Height == 0 {
+		if err := encoding.EncodeBytes(&buf, n.Value); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	if n.LeftNodeKey == nil || n.RightNodeKey == nil {
+		return nil, errors.New("inner node without child node keys")
+	}
+	for _, hash := range [][]byte{n.Left, n.Right} {
+		if err := encoding.EncodeBytes(&buf, hash); err != nil {
+			return nil, err
+		}
+	}
+	for _, nk := range []*NodeKey{n.LeftNodeKey, n.RightNodeKey} {
+		if err := encoding.EncodeVarint(&buf, nk.version); err != nil {
+			return nil, err
+		}
+		if err := encoding.EncodeVarint(&buf, int64(nk.nonce)); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a node encoded by Marshal.
+func (n *RangeNode) Unmarshal(bz []byte) error {
+	if len(bz) == 0 {
+		return errors.New("empty range node")
+	}
+	if bz[0] == 1 {
+		if len(bz) != 1 {
+			return errors.New("invalid pruned range node")
+		}
+		*n = RangeNode{Pruned: true}
+		return nil
+	}
+	if bz[0] != 0 {
+		return fmt.Errorf("invalid range node flags %d", bz[0])
+	}
+	bz = bz[1:]
+
+	readVarint := func(min, max int64, field string) (int64, error) {
+		v, read, err := encoding.DecodeVarint(bz)
+		if err != nil {
+			return 0, fmt.Errorf("decoding %s, %w", field, err)
+		}
+		if v < min || v > max {
+			return 0, fmt.Errorf("invalid %s %d", field, v)
+		}
+		bz = bz[read:]
+		return v, nil
+	}
+	readBytes := func(field string) ([]byte, error) {
+		v, read, err := encoding.DecodeBytes(bz)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s, %w", field, err)
+		}
+		bz = bz[read:]
+		return v, nil
+	}
+
+	height, err := readVarint(0, math.MaxInt8, "height")
+	if err != nil {
+		return err
+	}
+	node := RangeNode{Height: int8(height)}
+	if node.Size, err = readVarint(1, math.MaxInt64, "size"); err != nil {
+		return err
+	}
+	if node.Version, err = readVarint(0, math.MaxInt64, "version"); err != nil {
+		return err
+	}
+	nonce, err := readVarint(0, math.MaxInt32, "nonce")
+	if err != nil {
+		return err
+	}
+	node.Nonce = int32(nonce)
+	if node.Key, err = readBytes("key"); err != nil {
+		return err
+	}
+	if node.Height == 0 {
+		if node.Value, err = readBytes("value"); err != nil {
+			return err
+		}
+	} else {
+		if node.Left, err = readBytes("left hash"); err != nil {
+			return err
+		}
+		if node.Right, err = readBytes("right hash"); err != nil {
+			return err
+		}
+		for _, nk := range []**NodeKey{&node.LeftNodeKey, &node.RightNodeKey} {
+			version, err := readVarint(0, math.MaxInt64, "child version")
+			if err != nil {
+				return err
+			}
+			nonce, err := readVarint(0, math.MaxInt32, "child nonce")
+			if err != nil {
+				return err
+			}
+			*nk = &NodeKey{version: version, nonce: int32(nonce)}
+		}
+	}
+	if len(bz) > 0 {
+		return fmt.Errorf("%d trailing bytes after range node", len(bz))
+	}
+	*n = node
+	return nil
+}
+
+// ExportRange exports the nodes covering the keys from start, inclusive, to end, exclusive, for
+// verification with a RangeVerifier, e.g. by a light node syncing a key range from a peer instead
+// of a full snapshot. A nil start or end is unbounded. The keys are the keys as stored in the
+// tree, i.e. hashes for trees with Options.HashKeys. Besides the leaves in the range, the leaves
+// just before and after it are exported, which prove that no key of the range was left out.
+func (t *ImmutableTree) ExportRange(start, end []byte, fn func(*RangeNode) error) error {
+	if t.root == nil {
+		return nil
+	}
+	first, last := int64(0), t.root.size-1
+	if start != nil {
+		index, _, err := t.root.get(t, start)
+		if err != nil {
+			return err
+		}
+		if index > 0 {
+			first = index - 1
+		}
+	}
+	if end != nil {
+		index, _, err := t.root.get(t, end)
+		if err != nil {
+			return err
+		}
+		if index < last {
+			last = index
+		}
+	}
+	return t.exportRange(t.root, 0, first, last, fn)
+}
+
+// exportRange exports the subtree of the node, whose first leaf has the given index, expanding the
+// subtrees containing leaves with indexes from first to last.
+func (t *ImmutableTree) exportRange(node *Node, offset, first, last int64, fn func(*RangeNode) error) error {
+	if offset > last || offset+node.size <= first {
+		return fn(&RangeNode{Pruned: true})
+	}
+	if node.isLeaf() {
+		return fn(&RangeNode{
+			Size:    1,
+			Version: node.nodeKey.version,
+			Nonce:   node.nodeKey.nonce,
+			Key:     node.key,
+			Value:   node.value,
+		})
+	}
+
+	left, err := node.getLeftNode(t)
+	if err != nil {
+		return err
+	}
+	right, err := node.getRightNode(t)
+	if err != nil {
+		return err
+	}
+	err = fn(&RangeNode{
+		Height:       node.subtreeHeight,
+		Size:         node.size,
+		Version:      node.nodeKey.version,
+		Nonce:        node.nodeKey.nonce,
+		Key:          node.key,
+		Left:         left.hash,
+		Right:        right.hash,
+		LeftNodeKey:  node.leftNodeKey,
+		RightNodeKey: node.rightNodeKey,
+	})
+	if err != nil {
+		return err
+	}
+	if err := t.exportRange(left, offset, first, last, fn); err != nil {
+		return err
+	}
+	return t.exportRange(right, offset+left.size, first, last, fn)
+}
+
+// rangeSlot is a child expected by a RangeVerifier. The index of the first leaf of a left child
+// is known from its parent, that of a right child from its size and the end of its parent.
+type rangeSlot struct {
+	hash     []byte
+	nodeKey  *NodeKey // nil for the root.
+	firstKey []byte   // the key of the first leaf, if known from an ancestor.
+	right    bool
+	offset   int64 // for left children.
+	end      int64 // for right children.
+}
+
+// RangeVerifier verifies the nodes of a key range exported by ImmutableTree.ExportRange against a
+// trusted root hash, and persists the verified nodes to a database as they arrive, under their
+// node keys and in the same format as the nodes of a tree. The nodes form the part of the tree
+// covering the range, whose root is stored at RootNodeKey. The contents of each persisted node
+// match the trusted root hash, but the range is only known to be complete once Finish succeeds.
+//
+// Node keys are supplied by the exporting peer and are not part of the node hashes, so they are
+// only checked to match the child node keys of the parent, to be unique within the range and not
+// to exist in the database yet. The database must therefore be empty or dedicated to the range,
+// e.g. not the database of a live tree.
+//
+// RangeVerifier is not concurrency-safe.
+type RangeVerifier struct {
+	start, end []byte
+	db         dbm.DB
+	batch      dbm.Batch
+	batchSize  uint32
+
+	pending   []rangeSlot
+	root      *NodeKey
+	size      int64 // number of leaves of the tree.
+	lastIndex int64 // index of the last leaf, or -1.
+	lastKey   []byte
+	count     int64
+	persisted map[NodeKey]struct{} // node keys persisted so far, to reject duplicates.
+	err       error
+}
+
+// NewRangeVerifier creates a RangeVerifier of the keys from start, inclusive, to end, exclusive,
+// against the trusted root hash. Verified nodes are written to db, which must be empty or dedicated
+// to the range. Users must call Finish, or Close to abort.
+func NewRangeVerifier(rootHash, start, end []byte, db dbm.DB) *RangeVerifier {
+	v := &RangeVerifier{
+		start:     start,
+		end:       end,
+		db:        db,
+		batch:     db.NewBatch(),
+		lastIndex: -1,
+		persisted: make(map[NodeKey]struct{}),
+	}
+	if !bytes.Equal(rootHash, sha256.New().Sum(nil)) { // the hash of an empty tree.
+		v.pending = []rangeSlot{{hash: rootHash}}
+	}
+	return v
+}
+
+// Add verifies the next node of the range export, and persists it unless it is pruned.
+// After an error, the verifier must be closed.
+func (v *RangeVerifier) Add(node *RangeNode) error {
+	if v.err != nil {
+		return v.err
+	}
+	if v.batch == nil {
+		return errors.New("range verifier is closed")
+	}
+	if err := v.add(node); err != nil {
+		v.err = fmt.Errorf("%w: %v", ErrInvalidRangeNode, err)
+		return v.err
+	}
+	return nil
+}
+
+func (v *RangeVerifier) add(node *RangeNode) error {
+	if node == nil {
+		return errors.New("node cannot be nil")
+	}
+	if len(v.pending) == 0 {
+		return errors.New("unexpected node after the tree was complete")
+	}
+	slot := v.pending[len(v.pending)-1]
+	v.pending = v.pending[:len(v.pending)-1]
+	if node.Pruned {
+		if len(v.pending) == 0 && v.size == 0 {
+			return errors.New("the root cannot be pruned")
+		}
+		// the key of the parent of a pruned right subtree is its first key, so it must follow
+		// the leaves verified before, i.e. those of the left subtree.
+		if slot.right && v.lastIndex >= 0 && bytes.Compare(slot.firstKey, v.lastKey) <= 0 {
+			return fmt.Errorf("inner node key %X does not follow the leaf %X of its left subtree", slot.firstKey, v.lastKey)
+		}
+		return nil
+	}
+
+	hash, err := node.hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, slot.hash) {
+		return fmt.Errorf("node hash %X does not match expected hash %X", hash, slot.hash)
+	}
+	nodeKey := &NodeKey{version: node.Version, nonce: node.Nonce}
+	if slot.nodeKey != nil && *slot.nodeKey != *nodeKey {
+		return fmt.Errorf("node key %v does not match expected node key %v", nodeKey, slot.nodeKey)
+	}
+	offset := slot.offset
+	if slot.right {
+		offset = slot.end - node.Size
+	}
+	if v.size == 0 {
+		v.size = node.Size
+		v.root = nodeKey
+	}
+
+	if node.Height > 0 {
+		// the node keys and the key of an inner node are not part of its hash. The key is checked
+		// against the first leaf of the right subtree if it is exported, and against the last leaf
+		// of the left subtree otherwise.
+		if node.LeftNodeKey == nil || node.RightNodeKey == nil {
+			return errors.New("inner node without child node keys")
+		}
+		v.pending = append(v.pending,
+			rangeSlot{hash: node.Right, nodeKey: node.RightNodeKey, firstKey: node.Key, right: true, end: offset + node.Size},
+			rangeSlot{hash: node.Left, nodeKey: node.LeftNodeKey, firstKey: slot.firstKey, offset: offset})
+		return v.persist(&Node{
+			subtreeHeight: node.Height,
+			size:          node.Size,
+			key:           node.Key,
+			hash:          hash,
+			nodeKey:       nodeKey,
+			leftNodeKey:   node.LeftNodeKey,
+			rightNodeKey:  node.RightNodeKey,
+		})
+	}
+	if slot.firstKey != nil && !bytes.Equal(node.Key, slot.firstKey) {
+		return fmt.Errorf("leaf key %X does not match the key %X of its ancestor", node.Key, slot.firstKey)
+	}
+	if err := v.addLeaf(offset, node); err != nil {
+		return err
+	}
+	return v.persist(&Node{subtreeHeight: 0, size: 1, key: node.Key, value: node.Value, nodeKey: nodeKey})
+}
+
+// persist writes a verified node to the database, unless its node key was already used.
+func (v *RangeVerifier) persist(node *Node) error {
+	if _, ok := v.persisted[*node.nodeKey]; ok {
+		return fmt.Errorf("node key %v is not unique", node.nodeKey)
+	}
+	key := nodeKeyFormat.Key(node.nodeKey.version, node.nodeKey.nonce)
+	exists, err := v.db.Has(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("node key %v already exists in the database", node.nodeKey)
+	}
+	v.persisted[*node.nodeKey] = struct{}{}
+
+	buf := DefaultEncoderPool.GetBuffer()
+	defer DefaultEncoderPool.PutBuffer(buf)
+	if err := node.writeBytes(buf); err != nil {
+		return err
+	}
+	bytesCopy := make([]byte, buf.Len())
+	copy(bytesCopy, buf.Bytes())
+	if err := v.batch.Set(key, bytesCopy); err != nil {
+		return err
+	}
+	v.batchSize++
+	if v.batchSize >= maxBatchSize {
+		if err := v.batch.Write(); err != nil {
+			return err
+		}
+		v.batch.Close()
+		v.batch = v.db.NewBatch()
+		v.batchSize = 0
+	}
+	return nil
+}
+
+// addLeaf checks that the verified leaf at the index follows the previous one, and counts it if
+// it is in the range.
+func (v *RangeVerifier) addLeaf(index int64, node *RangeNode) error {
+	if v.lastIndex >= 0 && index != v.lastIndex+1 {
+		return fmt.Errorf("leaf %d does not follow leaf %d", index, v.lastIndex)
+	}
+	if v.lastIndex < 0 && index > 0 && (v.start == nil || bytes.Compare(node.Key, v.start) >= 0) {
+		return fmt.Errorf("first leaf %d with key %X does not precede the range", index, node.Key)
+	}
+	if v.lastIndex >= 0 && v.end != nil && bytes.Compare(v.lastKey, v.end) >= 0 {
+		return fmt.Errorf("leaf %d follows the end of the range", index)
+	}
+	v.lastIndex, v.lastKey = index, node.Key
+
+	if bytes.Compare(node.Key, v.start) >= 0 && (v.end == nil || bytes.Compare(node.Key, v.end) < 0) {
+		v.count++
+	}
+	return nil
+}
+
+// Count returns the number of pairs in the range verified so far.
+func (v *RangeVerifier) Count() int64 {
+	return v.count
+}
+
+// RootNodeKey returns the node key of the root of the tree, or nil if no node was verified yet or
+// the tree is empty.
+func (v *RangeVerifier) RootNodeKey() *NodeKey {
+	return v.root
+}
+
+// Finish checks that all nodes were received and that they covered the whole range, writes the
+// remaining nodes and closes the verifier.
+func (v *RangeVerifier) Finish() error {
+	defer v.Close()
+	if v.err != nil {
+		return v.err
+	}
+	if v.batch == nil {
+		return errors.New("range verifier is closed")
+	}
+	if len(v.pending) > 0 {
+		return fmt.Errorf("%w: the export ended before the tree was complete", ErrInvalidRangeNode)
+	}
+	if v.size > 0 {
+		if v.lastIndex < 0 {
+			return fmt.Errorf("%w: no leaves were exported", ErrInvalidRangeNode)
+		}
+		if v.lastIndex < v.size-1 && (v.end == nil || bytes.Compare(v.lastKey, v.end) < 0) {
+			return fmt.Errorf("%w: last leaf %d does not follow the range", ErrInvalidRangeNode, v.lastIndex)
+		}
+	}
+	return v.batch.WriteSync()
+}
+
+// Close frees the resources of the verifier. Nodes may already have been written to the database.
+// It is safe to call multiple times.
+func (v *RangeVerifier) Close() {
+	if v.batch != nil {
+		v.batch.Close()
+	}
+	v.batch = nil
+}
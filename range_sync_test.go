@@ -0,0 +1,260 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/cosmos/cosmos-db"
+)
+
+func setupRangeSyncTree(t *testing.T) *ImmutableTree {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i += 2 {
+		_, err = tree.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	return itree
+}
+
+// exportRangeNodes collects the nodes of a range export.
+func exportRangeNodes(t *testing.T, tree *ImmutableTree, start, end []byte) []*RangeNode {
+	var nodes []*RangeNode
+	require.NoError(t, tree.ExportRange(start, end, func(node *RangeNode) error {
+		nodes = append(nodes, node)
+		return nil
+	}))
+	return nodes
+}
+
+// verifyRange verifies the nodes against the root hash, and returns the synced pairs, read from the
+// persisted nodes.
+func verifyRange(tree *ImmutableTree, nodes []*RangeNode, start, end []byte) (map[string]string, error) {
+	hash, err := tree.Hash()
+	if err != nil {
+		return nil, err
+	}
+	memDB := db.NewMemDB()
+	verifier := NewRangeVerifier(hash, start, end, memDB)
+	for _, node := range nodes {
+		if err := verifier.Add(node); err != nil {
+			verifier.Close()
+			return nil, err
+		}
+	}
+	rootNodeKey, count := verifier.RootNodeKey(), verifier.Count()
+	if err := verifier.Finish(); err != nil {
+		return nil, err
+	}
+
+	synced := &ImmutableTree{ndb: newNodeDB(memDB, 0, nil), version: tree.version, skipFastStorageUpgrade: true}
+	if rootNodeKey != nil {
+		if synced.root, err = synced.ndb.GetNode(rootNodeKey); err != nil {
+			return nil, err
+		}
+	}
+	syncedHash, err := synced.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hash, syncedHash) {
+		return nil, fmt.Errorf("synced hash %X does not match %X", syncedHash, hash)
+	}
+	pairs := make(map[string]string)
+	if synced.root == nil {
+		return pairs, nil
+	}
+	iter, err := synced.Iterator(start, end, true)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		pairs[string(iter.Key())] = string(iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if int64(len(pairs)) != count {
+		return nil, fmt.Errorf("synced %d pairs, verified %d", len(pairs), count)
+	}
+	return pairs, nil
+}
+
+func TestRangeSync(t *testing.T) {
+	tree := setupRangeSyncTree(t)
+
+	testcases := []struct {
+		start, end string
+	}{
+		{"", ""},
+		{"k0100", "k0200"},
+		{"k0101", "k0199"},
+		{"", "k0010"},
+		{"k0990", ""},
+		{"a", "b"},
+		{"z", ""},
+		{"k0101", "k0102"},
+	}
+	for _, tc := range testcases {
+		var start, end []byte
+		if tc.start != "" {
+			start = []byte(tc.start)
+		}
+		if tc.end != "" {
+			end = []byte(tc.end)
+		}
+		nodes := exportRangeNodes(t, tree, start, end)
+		pairs, err := verifyRange(tree, nodes, start, end)
+		require.NoError(t, err, "%q to %q", tc.start, tc.end)
+
+		expected := make(map[string]string)
+		_, err = tree.Iterate(func(key, value []byte) bool {
+			if bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0) {
+				expected[string(key)] = string(value)
+			}
+			return false
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected, pairs, "%q to %q", tc.start, tc.end)
+		if tc.start != "" || tc.end != "" {
+			require.Less(t, len(nodes), 2*int(tree.Size())-1)
+		}
+	}
+
+	// an empty tree has no nodes.
+	empty, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	pairs, err := verifyRange(empty.ImmutableTree, exportRangeNodes(t, empty.ImmutableTree, nil, nil), nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, pairs)
+}
+
+func TestRangeSync_Invalid(t *testing.T) {
+	tree := setupRangeSyncTree(t)
+	start, end := []byte("k0100"), []byte("k0200")
+	nodes := exportRangeNodes(t, tree, start, end)
+
+	tamper := func(fn func(nodes []*RangeNode) []*RangeNode) []*RangeNode {
+		copied := make([]*RangeNode, len(nodes))
+		for i, node := range nodes {
+			n := *node
+			copied[i] = &n
+		}
+		return fn(copied)
+	}
+	leafIndex := func(nodes []*RangeNode, key string) int {
+		for i, node := range nodes {
+			if node.Height == 0 && string(node.Key) == key {
+				return i
+			}
+		}
+		t.Fatalf("leaf %s not exported", key)
+		return -1
+	}
+
+	testcases := map[string][]*RangeNode{
+		"tampered value": tamper(func(nodes []*RangeNode) []*RangeNode {
+			nodes[leafIndex(nodes, "k0150")].Value = []byte("forged")
+			return nodes
+		}),
+		"omitted leaf": tamper(func(nodes []*RangeNode) []*RangeNode {
+			nodes[leafIndex(nodes, "k0150")] = &RangeNode{Pruned: true}
+			return nodes
+		}),
+		"omitted predecessor": tamper(func(nodes []*RangeNode) []*RangeNode {
+			nodes[leafIndex(nodes, "k0098")] = &RangeNode{Pruned: true}
+			return nodes
+		}),
+		"omitted successor": tamper(func(nodes []*RangeNode) []*RangeNode {
+			nodes[leafIndex(nodes, "k0200")] = &RangeNode{Pruned: true}
+			return nodes
+		}),
+		"forged inner key": tamper(func(nodes []*RangeNode) []*RangeNode {
+			for _, node := range nodes {
+				if node.Height > 0 && string(node.Key) == "k0150" {
+					node.Key = []byte("k0151")
+				}
+			}
+			return nodes
+		}),
+		"forged inner key over a pruned subtree": tamper(func(nodes []*RangeNode) []*RangeNode {
+			// the right subtree of the root is outside of the range, so only the leaves of its
+			// left subtree bound its key.
+			require.Greater(t, string(nodes[0].Key), "k0200")
+			nodes[0].Key = []byte("k0150")
+			return nodes
+		}),
+		"forged node key": tamper(func(nodes []*RangeNode) []*RangeNode {
+			nodes[leafIndex(nodes, "k0150")].Nonce++
+			return nodes
+		}),
+		"duplicate node key": tamper(func(nodes []*RangeNode) []*RangeNode {
+			// node keys are not part of the hashes, so reuse the key of the root for a leaf and
+			// its parent consistently.
+			leaf := nodes[leafIndex(nodes, "k0150")]
+			leafKey, rootKey := NodeKey{version: leaf.Version, nonce: leaf.Nonce}, &NodeKey{version: nodes[0].Version, nonce: nodes[0].Nonce}
+			for _, node := range nodes {
+				if node.LeftNodeKey != nil && *node.LeftNodeKey == leafKey {
+					node.LeftNodeKey = rootKey
+				}
+				if node.RightNodeKey != nil && *node.RightNodeKey == leafKey {
+					node.RightNodeKey = rootKey
+				}
+			}
+			leaf.Version, leaf.Nonce = rootKey.version, rootKey.nonce
+			return nodes
+		}),
+		"truncated":   nodes[:len(nodes)/2],
+		"extra node":  append(append([]*RangeNode{}, nodes...), nodes[len(nodes)-1]),
+		"pruned root": {{Pruned: true}},
+	}
+	for desc, nodes := range testcases {
+		_, err := verifyRange(tree, nodes, start, end)
+		require.ErrorIs(t, err, ErrInvalidRangeNode, desc)
+	}
+
+	// existing records in the database are not overwritten.
+	hash, err := tree.Hash()
+	require.NoError(t, err)
+	memDB := db.NewMemDB()
+	require.NoError(t, memDB.Set(nodeKeyFormat.Key(nodes[0].Version, nodes[0].Nonce), []byte("existing")))
+	verifier := NewRangeVerifier(hash, start, end, memDB)
+	require.ErrorIs(t, verifier.Add(nodes[0]), ErrInvalidRangeNode)
+	verifier.Close()
+
+	// a different trusted root fails at the first node.
+	verifier = NewRangeVerifier(bytes.Repeat([]byte{1}, 32), start, end, db.NewMemDB())
+	defer verifier.Close()
+	require.ErrorIs(t, verifier.Add(nodes[0]), ErrInvalidRangeNode)
+}
+
+func TestRangeNode_Marshal(t *testing.T) {
+	tree := setupRangeSyncTree(t)
+	start, end := []byte("k0100"), []byte("k0200")
+	nodes := exportRangeNodes(t, tree, start, end)
+
+	decoded := make([]*RangeNode, 0, len(nodes))
+	for _, node := range nodes {
+		bz, err := node.Marshal()
+		require.NoError(t, err)
+		var n RangeNode
+		require.NoError(t, n.Unmarshal(bz))
+		require.Equal(t, node, &n)
+		decoded = append(decoded, &n)
+
+		for i := 0; i < len(bz); i++ {
+			require.Error(t, new(RangeNode).Unmarshal(bz[:i]))
+		}
+		require.Error(t, new(RangeNode).Unmarshal(append(bz, 0)))
+	}
+	_, err := verifyRange(tree, decoded, start, end)
+	require.NoError(t, err)
+}
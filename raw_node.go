@@ -0,0 +1,13 @@
+package iavl
+
+import "github.com/cosmos/iavl/internal/rawnode"
+
+// The raw node access is exported by the unsafe package only.
+func init() {
+	rawnode.Get = func(tree interface{}, version int64, nonce int32) ([]byte, []byte, error) {
+		return tree.(*MutableTree).ndb.getRawNode(&NodeKey{version: version, nonce: nonce})
+	}
+	rawnode.Put = func(tree interface{}, version int64, nonce int32, raw []byte, hash []byte) error {
+		return tree.(*MutableTree).ndb.putRawNode(&NodeKey{version: version, nonce: nonce}, raw, hash)
+	}
+}
@@ -0,0 +1,236 @@
+// Package simulate replays key access traces recorded with an iavl.AuditLog against different
+// cache sizes, backends and layouts, to project the disk reads and latency of each without
+// experimenting in production.
+package simulate
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl"
+)
+
+// writeValue is the value written for replayed writes, since traces do not record values.
+var writeValue = []byte{0}
+
+// Trace is a recorded sequence of key accesses. Its Record method can be used as the sink of an
+// iavl.AuditLog to record a trace.
+type Trace struct {
+	mtx     sync.Mutex
+	Records []iavl.AccessRecord
+}
+
+// Record appends records to the trace. It implements iavl.AuditSink.
+func (t *Trace) Record(records []iavl.AccessRecord) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.Records = append(t.Records, records...)
+}
+
+// WriteTo writes the trace as JSON lines, one record per line.
+func (t *Trace) WriteTo(w io.Writer) (int64, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	cw := &countingWriter{w: w}
+	enc := json.NewEncoder(cw)
+	for _, record := range t.Records {
+		if err := enc.Encode(record); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// ReadTrace reads a trace written by Trace.WriteTo.
+func ReadTrace(r io.Reader) (*Trace, error) {
+	trace := &Trace{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var record iavl.AccessRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			return trace, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read trace record %d: %w", len(trace.Records), err)
+		}
+		trace.Records = append(trace.Records, record)
+	}
+}
+
+// Backend models the read cost of a database backend.
+type Backend struct {
+	Name string
+	// ReadLatency is the fixed cost of a read, e.g. a disk seek.
+	ReadLatency time.Duration
+	// BytesPerSecond is the read throughput, or 0 to ignore the size of reads.
+	BytesPerSecond int64
+}
+
+// Config is a configuration to replay a trace with.
+type Config struct {
+	Name      string
+	CacheSize int
+	Options   iavl.Options
+	Backend   Backend
+	// SkipFastStorageUpgrade selects the layout without the fast node index, where reads of the
+	// latest version traverse the tree.
+	SkipFastStorageUpgrade bool
+}
+
+// Report is the result of replaying a trace with a Config.
+type Report struct {
+	Config Config
+
+	Reads   int // The number of replayed reads.
+	Writes  int // The number of replayed writes.
+	Deletes int // The number of replayed deletes.
+	Skipped int // The number of reads skipped, since their version does not exist.
+
+	BackendReads     int   // The number of reads from the backend, i.e. cache misses.
+	BackendReadBytes int64 // The number of bytes read from the backend.
+
+	// Elapsed is the time spent replaying the trace, with backend reads served from memory.
+	Elapsed time.Duration
+	// ProjectedLatency is Elapsed plus the modelled cost of the backend reads.
+	ProjectedLatency time.Duration
+}
+
+// ReadsPerAccess returns the average number of backend reads per replayed access.
+func (r Report) ReadsPerAccess() float64 {
+	accesses := r.Reads + r.Writes + r.Deletes
+	if accesses == 0 {
+		return 0
+	}
+	return float64(r.BackendReads) / float64(accesses)
+}
+
+// Run replays the trace against the tree stored in db with each config, starting from a cold
+// cache, and returns a report per config. Writes and deletes are applied to the working tree
+// only, and are discarded after each run. Writes use a placeholder value, since traces do not
+// record values. Reads at versions after the latest saved version are replayed against the
+// working tree, while reads at versions which do not exist in db are skipped.
+//
+// db is only read from, except when a config enables the fast node index and db does not have an
+// up to date one, in which case it is built as when loading the tree, or when a config spills fast
+// node removals to db with Options.FastNodeRemovalsSpillThreshold. Use a copy of the database to
+// keep it unchanged.
+func Run(db dbm.DB, trace *Trace, configs ...Config) ([]Report, error) {
+	reports := make([]Report, 0, len(configs))
+	for _, config := range configs {
+		report, err := run(db, trace, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay trace with config %q: %w", config.Name, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func run(db dbm.DB, trace *Trace, config Config) (Report, error) {
+	cdb := &countingDB{DB: db}
+	opts := config.Options
+	tree, err := iavl.NewMutableTreeWithOpts(cdb, config.CacheSize, &opts, config.SkipFastStorageUpgrade)
+	if err != nil {
+		return Report{}, err
+	}
+	latest, err := tree.Load()
+	if err != nil {
+		return Report{}, err
+	}
+	// only count the reads of the replay, not those of loading the tree.
+	cdb.reset()
+
+	report := Report{Config: config}
+	start := time.Now()
+	for _, record := range trace.Records {
+		switch record.Kind {
+		case iavl.AccessRead:
+			if record.Version > latest {
+				report.Reads++
+				_, err = tree.Get(record.Key)
+			} else if tree.VersionExists(record.Version) {
+				report.Reads++
+				_, err = tree.GetVersioned(record.Key, record.Version)
+			} else {
+				report.Skipped++
+			}
+		case iavl.AccessWrite:
+			report.Writes++
+			_, err = tree.Set(record.Key, writeValue)
+		case iavl.AccessDelete:
+			report.Deletes++
+			_, _, err = tree.Remove(record.Key)
+		default:
+			err = fmt.Errorf("unknown access kind %d", record.Kind)
+		}
+		if err != nil {
+			return Report{}, err
+		}
+	}
+	report.Elapsed = time.Since(start)
+	tree.Rollback()
+
+	report.BackendReads, report.BackendReadBytes = cdb.counts()
+	report.ProjectedLatency = report.Elapsed + time.Duration(report.BackendReads)*config.Backend.ReadLatency
+	if config.Backend.BytesPerSecond > 0 {
+		report.ProjectedLatency += time.Duration(report.BackendReadBytes * int64(time.Second) / config.Backend.BytesPerSecond)
+	}
+	return report, nil
+}
+
+// countingDB counts the reads made from a database.
+type countingDB struct {
+	dbm.DB
+	mtx   sync.Mutex
+	reads int
+	bytes int64
+}
+
+// Get implements dbm.DB.
+func (db *countingDB) Get(key []byte) ([]byte, error) {
+	value, err := db.DB.Get(key)
+	db.mtx.Lock()
+	db.reads++
+	db.bytes += int64(len(value))
+	db.mtx.Unlock()
+	return value, err
+}
+
+// Has implements dbm.DB.
+func (db *countingDB) Has(key []byte) (bool, error) {
+	db.mtx.Lock()
+	db.reads++
+	db.mtx.Unlock()
+	return db.DB.Has(key)
+}
+
+func (db *countingDB) reset() {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.reads, db.bytes = 0, 0
+}
+
+func (db *countingDB) counts() (int, int64) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.reads, db.bytes
+}
+
+// countingWriter counts the bytes written to a writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,94 @@
+package simulate
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	dbm "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+)
+
+func setupTrace(t *testing.T) (dbm.DB, *Trace) {
+	db := dbm.NewMemDB()
+	tree, err := iavl.NewMutableTree(db, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	trace := &Trace{}
+	log := iavl.NewAuditLog(trace.Record, 16)
+	tree.SetAuditLog(log)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 100; i++ {
+			_, err = tree.Get([]byte(fmt.Sprintf("key%04d", i*7)))
+			require.NoError(t, err)
+		}
+	}
+	_, err = tree.GetVersioned([]byte("key0001"), 1)
+	require.NoError(t, err)
+	_, err = tree.GetVersioned([]byte("key0001"), 0)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key0003"), []byte("new"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("key0004"))
+	require.NoError(t, err)
+	log.Close()
+	return db, trace
+}
+
+func TestRun(t *testing.T) {
+	db, trace := setupTrace(t)
+	require.Len(t, trace.Records, 504)
+
+	hdd := Backend{Name: "hdd", ReadLatency: 5 * time.Millisecond}
+	reports, err := Run(db, trace,
+		Config{Name: "cold", CacheSize: 0, Backend: hdd, SkipFastStorageUpgrade: true},
+		Config{Name: "cached", CacheSize: 10000, Backend: hdd, SkipFastStorageUpgrade: true},
+		Config{Name: "fast", CacheSize: 0, Backend: hdd},
+	)
+	require.NoError(t, err)
+	require.Len(t, reports, 3)
+	cold, cached, fast := reports[0], reports[1], reports[2]
+
+	require.Equal(t, 501, cold.Reads)
+	require.Equal(t, 1, cold.Skipped)
+	require.Equal(t, 1, cold.Writes)
+	require.Equal(t, 1, cold.Deletes)
+	require.Greater(t, cold.BackendReads, cached.BackendReads)
+	require.Greater(t, cold.BackendReads, fast.BackendReads)
+	require.Greater(t, cold.ReadsPerAccess(), 1.0)
+	require.GreaterOrEqual(t, cold.ProjectedLatency, time.Duration(cold.BackendReads)*hdd.ReadLatency)
+	require.Less(t, cached.ProjectedLatency, cold.ProjectedLatency)
+
+	// the replay leaves the database unchanged.
+	tree, err := iavl.NewMutableTree(db, 0, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	value, err := tree.Get([]byte("key0003"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value3"), value)
+}
+
+func TestTrace_WriteTo(t *testing.T) {
+	_, trace := setupTrace(t)
+	var buf bytes.Buffer
+	n, err := trace.WriteTo(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, buf.Len(), n)
+
+	read, err := ReadTrace(&buf)
+	require.NoError(t, err)
+	require.Equal(t, trace.Records, read.Records)
+
+	_, err = ReadTrace(bytes.NewBufferString("{"))
+	require.Error(t, err)
+}
@@ -0,0 +1,225 @@
+package iavl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// snapshotIndexName is the name of the object listing the completed snapshots.
+	snapshotIndexName = "snapshots.json"
+	// defaultSnapshotMaxPending is the default number of snapshots waiting to be taken.
+	defaultSnapshotMaxPending = 1
+)
+
+// ErrSnapshotBusy is reported for versions which are not snapshotted, because too many earlier
+// snapshots are still pending.
+var ErrSnapshotBusy = errors.New("too many pending snapshots")
+
+// SnapshotOptions configures a SnapshotManager.
+type SnapshotOptions struct {
+	// URL is the bucket URL of the object store snapshots are backed up to, see OpenObjectStore.
+	URL string
+	// Interval snapshots every version divisible by it.
+	Interval int64
+	// KeepRecent is the number of most recent snapshots retained, or 0 to retain all.
+	KeepRecent int
+	// MaxPending is the number of versions waiting to be snapshotted, beyond which versions are
+	// skipped with ErrSnapshotBusy. It defaults to 1.
+	MaxPending int
+	// Backup configures the backups the snapshots are stored as.
+	Backup BackupOptions
+	// OnSnapshot, if set, is called with the result of every scheduled snapshot. It is called
+	// with the commit lock held for skipped versions, so it must not save or prune versions.
+	OnSnapshot func(version int64, err error)
+}
+
+// snapshotIndex is the stored list of completed snapshots.
+type snapshotIndex struct {
+	Versions []int64 `json:"versions"`
+}
+
+// SnapshotManager backs up every Nth saved version of a tree to object storage in the background,
+// retaining the most recent snapshots. It is started with MutableTree.StartSnapshots. Scheduled
+// versions are pinned against pruning until they have been snapshotted, so pruning them fails
+// unless Options.DeferPruning is set, see MutableTree.DeleteVersionsTo.
+type SnapshotManager struct {
+	tree  *MutableTree
+	opts  SnapshotOptions
+	store ObjectStore
+	ctx   context.Context
+	queue chan int64
+	done  chan struct{}
+
+	mtx      sync.Mutex
+	closed   bool
+	versions []int64 // The completed snapshots, in ascending order.
+}
+
+// StartSnapshots starts a SnapshotManager for the tree, replacing any previous one. Snapshots
+// are taken until the manager is closed, and are aborted when ctx is cancelled. The snapshots
+// already in the object store are retained according to the options.
+func (tree *MutableTree) StartSnapshots(ctx context.Context, opts SnapshotOptions) (*SnapshotManager, error) {
+	if opts.Interval <= 0 {
+		return nil, fmt.Errorf("invalid snapshot interval %d", opts.Interval)
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultSnapshotMaxPending
+	}
+	opts.Backup = opts.Backup.withDefaults()
+	store, err := OpenObjectStore(ctx, opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := readSnapshotIndex(ctx, store, opts.Backup)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SnapshotManager{
+		tree:     tree,
+		opts:     opts,
+		store:    store,
+		ctx:      ctx,
+		queue:    make(chan int64, opts.MaxPending),
+		done:     make(chan struct{}),
+		versions: versions,
+	}
+	go m.run()
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	if tree.snapshots != nil {
+		go tree.snapshots.Close()
+	}
+	tree.snapshots = m
+	return m, nil
+}
+
+// ListSnapshots returns the versions of the snapshots taken by a SnapshotManager to the object
+// store at bucketURL, in ascending order. They can be restored with RestoreFromObjectStore.
+func ListSnapshots(ctx context.Context, bucketURL string) ([]int64, error) {
+	store, err := OpenObjectStore(ctx, bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	return readSnapshotIndex(ctx, store, DefaultBackupOptions())
+}
+
+// Snapshots returns the versions of the completed snapshots, in ascending order.
+func (m *SnapshotManager) Snapshots() []int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]int64(nil), m.versions...)
+}
+
+// Close stops scheduling snapshots and waits for the pending ones to complete. It is safe to call
+// multiple times.
+func (m *SnapshotManager) Close() {
+	m.mtx.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mtx.Unlock()
+	<-m.done
+}
+
+// committed schedules a snapshot of a saved version, if due. It is a no-op on a nil manager, and
+// must be called with the commit lock held.
+func (m *SnapshotManager) committed(version int64) {
+	if m == nil || version%m.opts.Interval != 0 {
+		return
+	}
+	m.mtx.Lock()
+	if m.closed {
+		m.mtx.Unlock()
+		return
+	}
+	m.tree.ndb.incrVersionReaders(version)
+	busy := false
+	select {
+	case m.queue <- version:
+	default:
+		m.tree.ndb.decrVersionReaders(version)
+		busy = true
+	}
+	m.mtx.Unlock()
+
+	// the callback may call back into the manager, so it is called without holding its lock.
+	if busy {
+		m.report(version, ErrSnapshotBusy)
+	}
+}
+
+// run takes the scheduled snapshots until the manager is closed.
+func (m *SnapshotManager) run() {
+	defer close(m.done)
+	for version := range m.queue {
+		err := m.snapshot(version)
+		m.tree.ndb.decrVersionReaders(version)
+		m.report(version, err)
+	}
+}
+
+// snapshot backs up a version and applies the retention policy.
+func (m *SnapshotManager) snapshot(version int64) error {
+	if err := m.tree.BackupToObjectStoreWithOpts(m.ctx, m.opts.URL, version, m.opts.Backup); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	m.versions = append(m.versions, version)
+	var expired []int64
+	if keep := m.opts.KeepRecent; keep > 0 && len(m.versions) > keep {
+		expired = append(expired, m.versions[:len(m.versions)-keep]...)
+		m.versions = append([]int64(nil), m.versions[len(m.versions)-keep:]...)
+	}
+	index := snapshotIndex{Versions: append([]int64(nil), m.versions...)}
+	m.mtx.Unlock()
+
+	// update the index first, so that it never lists deleted snapshots.
+	bz, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = m.opts.Backup.retry(m.ctx, func() error {
+		return m.store.Put(m.ctx, snapshotIndexName, bz)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update snapshot index: %w", err)
+	}
+	for _, v := range expired {
+		if err := deleteBackup(m.ctx, m.store, v, m.opts.Backup); err != nil {
+			return fmt.Errorf("failed to delete expired snapshot %d: %w", v, err)
+		}
+	}
+	return nil
+}
+
+func (m *SnapshotManager) report(version int64, err error) {
+	if m.opts.OnSnapshot != nil {
+		m.opts.OnSnapshot(version, err)
+	}
+}
+
+// readSnapshotIndex reads the versions listed in the snapshot index, if any.
+func readSnapshotIndex(ctx context.Context, store ObjectStore, opts BackupOptions) ([]int64, error) {
+	var index snapshotIndex
+	err := opts.retry(ctx, func() error {
+		bz, err := store.Get(ctx, snapshotIndexName)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(bz, &index)
+	})
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot index: %w", err)
+	}
+	return index.Versions, nil
+}
@@ -0,0 +1,133 @@
+package iavl
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingObjectStore blocks puts until its gate is closed.
+type blockingObjectStore struct {
+	ObjectStore
+	gate chan struct{}
+}
+
+func (s *blockingObjectStore) Put(ctx context.Context, name string, data []byte) error {
+	<-s.gate
+	return s.ObjectStore.Put(ctx, name, data)
+}
+
+func TestMutableTree_StartSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{DeferPruning: true}, false)
+	require.NoError(t, err)
+
+	var results []error
+	ctx := context.Background()
+	opts := SnapshotOptions{
+		URL:        "file://" + dir,
+		Interval:   2,
+		KeepRecent: 2,
+		MaxPending: 10,
+		OnSnapshot: func(version int64, err error) { results = append(results, err) },
+	}
+	snapshots, err := tree.StartSnapshots(ctx, opts)
+	require.NoError(t, err)
+
+	var hash []byte
+	for i := 1; i <= 10; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+		hash, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		if i > 1 {
+			require.NoError(t, tree.DeleteVersionsTo(int64(i-1)))
+		}
+	}
+	snapshots.Close()
+	require.Len(t, results, 5)
+	for _, err := range results {
+		require.NoError(t, err)
+	}
+	require.Equal(t, []int64{8, 10}, snapshots.Snapshots())
+
+	listed, err := ListSnapshots(ctx, opts.URL)
+	require.NoError(t, err)
+	require.Equal(t, []int64{8, 10}, listed)
+	for _, version := range []int64{2, 4, 6} {
+		matches, err := filepath.Glob(filepath.Join(dir, fmt.Sprint(version), "*"))
+		require.NoError(t, err)
+		require.Empty(t, matches)
+	}
+
+	restored, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	require.NoError(t, restored.RestoreFromObjectStore(ctx, opts.URL, 10))
+	restoredHash, err := restored.Hash()
+	require.NoError(t, err)
+	require.Equal(t, hash, restoredHash)
+
+	// snapshots are no longer scheduled once closed.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Len(t, results, 5)
+}
+
+func TestMutableTree_StartSnapshotsRetainsPending(t *testing.T) {
+	dir := t.TempDir()
+	gate := make(chan struct{})
+	RegisterObjectStore("blocking", func(ctx context.Context, u *url.URL) (ObjectStore, error) {
+		store, err := OpenObjectStore(ctx, "file://"+u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &blockingObjectStore{ObjectStore: store, gate: gate}, nil
+	})
+
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{DeferPruning: true}, false)
+	require.NoError(t, err)
+	busy := 0
+	var snapshots *SnapshotManager
+	snapshots, err = tree.StartSnapshots(context.Background(), SnapshotOptions{
+		URL:      "blocking://" + dir,
+		Interval: 2,
+		OnSnapshot: func(version int64, err error) {
+			if err == ErrSnapshotBusy {
+				busy++
+				// the callback may call back into the manager.
+				require.NotContains(t, snapshots.Snapshots(), version)
+			}
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 1; i <= 6; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// at most one snapshot is in progress and one pending, so at least one version is skipped,
+	// and pruning stops before version 2 until it is snapshotted.
+	require.GreaterOrEqual(t, busy, 1)
+	require.NoError(t, tree.DeleteVersionsTo(5))
+	require.True(t, tree.VersionExists(2))
+
+	close(gate)
+	snapshots.Close()
+	require.Equal(t, int64(2), snapshots.Snapshots()[0])
+	require.Len(t, snapshots.Snapshots(), 3-busy)
+
+	require.NoError(t, tree.DeleteVersionsTo(5))
+	require.False(t, tree.VersionExists(2))
+	require.False(t, tree.VersionExists(4))
+	require.True(t, tree.VersionExists(6))
+}
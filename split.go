@@ -0,0 +1,249 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+// ErrOverlappingTrees is returned by MergeTrees when both trees contain the same key.
+var ErrOverlappingTrees = errors.New("trees to merge have overlapping keys")
+
+// kvSource returns the next key/value pair of a sorted stream.
+type kvSource func() (key, value []byte, err error)
+
+// SplitTree splits the tree at the given version into two new trees, written to leftDB and
+// rightDB. The left tree holds all keys strictly less than pivotKey, the right tree holds the
+// remaining keys. Both trees are saved at the given version. When Options.HashKeys is set,
+// pivotKey is compared against the hashed keys.
+//
+// The resulting trees are built in a single streaming pass and are perfectly balanced, so their
+// hashes only depend on their key/value pairs and version, and not on the history of the source
+// tree. In particular, merging the two halves back with MergeTrees yields the same hash as
+// splitting with a nil pivotKey, which rebuilds the whole tree into rightDB.
+func (tree *MutableTree) SplitTree(version int64, pivotKey []byte, leftDB, rightDB dbm.DB) (*MutableTree, *MutableTree, error) {
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the index of the pivot key, or the index it would be inserted at, is the left size.
+	leftSize, _, err := itree.getWithIndex(pivotKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	left, err := rebuildTree(itree, nil, pivotKey, leftSize, leftDB, version)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build left tree: %w", err)
+	}
+	right, err := rebuildTree(itree, pivotKey, nil, itree.Size()-leftSize, rightDB, version)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build right tree: %w", err)
+	}
+
+	return left, right, nil
+}
+
+// MergeTrees merges the two trees into a new tree written to db, saved at the greater of the two
+// tree versions. Both trees must have the same Options.HashKeys setting, and must not have any
+// keys in common, otherwise ErrOverlappingTrees is returned and db may contain partially imported
+// nodes which are not visible.
+//
+// Like SplitTree, the resulting tree is built in a single streaming pass and is perfectly
+// balanced, so its hash only depends on its key/value pairs and version.
+func MergeTrees(a, b *ImmutableTree, db dbm.DB) (*MutableTree, error) {
+	if a.hashKeys() != b.hashKeys() {
+		return nil, errors.New("cannot merge a tree with hashed keys with a tree without")
+	}
+	version := a.Version()
+	if b.Version() > version {
+		version = b.Version()
+	}
+
+	itrA, err := a.Iterator(nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer itrA.Close()
+	itrB, err := b.Iterator(nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer itrB.Close()
+
+	next := func() ([]byte, []byte, error) {
+		var itr dbm.Iterator
+		switch {
+		case !itrA.Valid() && !itrB.Valid():
+			return nil, nil, errors.New("unexpected end of trees")
+		case !itrA.Valid():
+			itr = itrB
+		case !itrB.Valid():
+			itr = itrA
+		default:
+			switch bytes.Compare(itrA.Key(), itrB.Key()) {
+			case -1:
+				itr = itrA
+			case 1:
+				itr = itrB
+			default:
+				return nil, nil, fmt.Errorf("%w: %X", ErrOverlappingTrees, itrA.Key())
+			}
+		}
+		key, value := itr.Key(), itr.Value()
+		itr.Next()
+		return key, value, nil
+	}
+
+	tree, err := newRebuiltTree(a, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := importBalanced(tree, a.Size()+b.Size(), version, next); err != nil {
+		return nil, err
+	}
+	if err := itrA.Error(); err != nil {
+		return nil, err
+	}
+	if err := itrB.Error(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// rebuildTree builds a new balanced tree in db from the size keys of itree within [start, end).
+func rebuildTree(itree *ImmutableTree, start, end []byte, size int64, db dbm.DB, version int64) (*MutableTree, error) {
+	itr, err := itree.Iterator(start, end, true)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	next := func() ([]byte, []byte, error) {
+		if !itr.Valid() {
+			return nil, nil, errors.New("unexpected end of tree")
+		}
+		key, value := itr.Key(), itr.Value()
+		itr.Next()
+		return key, value, nil
+	}
+
+	tree, err := newRebuiltTree(itree, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := importBalanced(tree, size, version, next); err != nil {
+		return nil, err
+	}
+	return tree, itr.Error()
+}
+
+// newRebuiltTree creates an empty tree in db with the same key handling as the source tree.
+func newRebuiltTree(source *ImmutableTree, db dbm.DB) (*MutableTree, error) {
+	opts := DefaultOptions()
+	opts.Sync = source.ndb.opts.Sync
+	opts.HashKeys = source.ndb.opts.HashKeys
+	return NewMutableTreeWithOpts(db, 0, &opts, source.skipFastStorageUpgrade)
+}
+
+// importBalanced imports size sorted key/value pairs from next into the empty tree as a perfectly
+// balanced tree, with all nodes assigned to the given version. Only O(log(size)) nodes are held
+// in memory at any time.
+func importBalanced(tree *MutableTree, size int64, version int64, next kvSource) error {
+	importer, err := tree.Import(version)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+
+	if size > 0 {
+		if _, _, err := importBalancedSubtree(importer, size, version, next); err != nil {
+			return err
+		}
+	}
+	return importer.Commit()
+}
+
+// importBalancedSubtree adds the nodes of a balanced subtree with size leaves to the importer in
+// post-order, and returns the height and the smallest key of the subtree.
+func importBalancedSubtree(importer *Importer, size int64, version int64, next kvSource) (int8, []byte, error) {
+	if size == 1 {
+		key, value, err := next()
+		if err != nil {
+			return 0, nil, err
+		}
+		return 0, key, importer.Add(&ExportNode{
+			Key:     key,
+			Value:   value,
+			Version: version,
+			Height:  0,
+		})
+	}
+
+	leftSize := (size + 1) / 2
+	leftHeight, minKey, err := importBalancedSubtree(importer, leftSize, version, next)
+	if err != nil {
+		return 0, nil, err
+	}
+	rightHeight, rightMinKey, err := importBalancedSubtree(importer, size-leftSize, version, next)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// inner nodes are keyed by the smallest key of their right subtree.
+	height := maxInt8(leftHeight, rightHeight) + 1
+	return height, minKey, importer.Add(&ExportNode{
+		Key:     rightMinKey,
+		Version: version,
+		Height:  height,
+	})
+}
+
+// KeyRange is a range of keys from Start inclusive to End exclusive, where nil means unbounded.
+// It matches the arguments of Iterator.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+// SplitRanges computes up to n contiguous key ranges covering the whole key space of the tree at
+// the given version, each holding approximately the same number of leaves, e.g. to partition work
+// among parallel iterators. See ImmutableTree.SplitRanges.
+func (tree *MutableTree) SplitRanges(version int64, n int) ([]KeyRange, error) {
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	return itree.SplitRanges(n)
+}
+
+// SplitRanges computes up to n contiguous key ranges covering the whole key space of the tree,
+// each holding approximately the same number of leaves. The boundaries are located with the
+// subtree sizes stored in inner nodes, in O(n*log(size)) node reads and without scanning leaves,
+// and are deterministic for a given tree. Fewer than n ranges are returned if the tree has fewer
+// than n leaves, but at least one range is always returned. When Options.HashKeys is set, the
+// boundaries are hashed keys.
+func (t *ImmutableTree) SplitRanges(n int) ([]KeyRange, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of ranges %d", n)
+	}
+	size := t.Size()
+	if int64(n) > size {
+		n = int(size)
+	}
+
+	ranges := make([]KeyRange, 0, n)
+	var start []byte
+	for i := 1; i < n; i++ {
+		key, _, err := t.GetByIndex(int64(i) * size / int64(n))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, KeyRange{Start: start, End: key})
+		start = key
+	}
+	return append(ranges, KeyRange{Start: start}), nil
+}
@@ -0,0 +1,181 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func setupSplitTree(t *testing.T, n int) *MutableTree {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+		if i%10 == 9 {
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	return tree
+}
+
+func TestSplitTree(t *testing.T) {
+	testCases := []struct {
+		pivot     string
+		leftSize  int64
+		rightSize int64
+	}{
+		{"key0050", 50, 51},
+		{"key0050a", 51, 50},
+		{"", 0, 101},
+		{"key9999", 101, 0},
+	}
+	tree := setupSplitTree(t, 101)
+	version := tree.Version()
+
+	for _, tc := range testCases {
+		t.Run(tc.pivot, func(t *testing.T) {
+			left, right, err := tree.SplitTree(version, []byte(tc.pivot), db.NewMemDB(), db.NewMemDB())
+			require.NoError(t, err)
+			require.Equal(t, tc.leftSize, left.Size())
+			require.Equal(t, tc.rightSize, right.Size())
+			require.Equal(t, version, left.Version())
+			require.Equal(t, version, right.Version())
+
+			source, err := tree.GetImmutable(version)
+			require.NoError(t, err)
+			_, err = source.Iterate(func(key, value []byte) bool {
+				target := right
+				if string(key) < tc.pivot {
+					target = left
+				}
+				got, err := target.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, value, got)
+				return false
+			})
+			require.NoError(t, err)
+
+			// the trees must be valid AVL trees which can be modified further.
+			_, err = left.Set([]byte("new"), []byte("value"))
+			require.NoError(t, err)
+			_, _, err = left.SaveVersion()
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSplitTree_Deterministic(t *testing.T) {
+	tree := setupSplitTree(t, 64)
+	version := tree.Version()
+
+	// a differently built tree with the same contents
+	other, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	for i := 63; i >= 0; i-- {
+		_, err := other.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	for other.Version() < version {
+		_, _, err = other.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	left, right, err := tree.SplitTree(version, []byte("key0020"), db.NewMemDB(), db.NewMemDB())
+	require.NoError(t, err)
+	otherLeft, otherRight, err := other.SplitTree(version, []byte("key0020"), db.NewMemDB(), db.NewMemDB())
+	require.NoError(t, err)
+
+	requireSameHash(t, left, otherLeft)
+	requireSameHash(t, right, otherRight)
+}
+
+func TestMergeTrees(t *testing.T) {
+	tree := setupSplitTree(t, 77)
+	version := tree.Version()
+
+	left, right, err := tree.SplitTree(version, []byte("key0033"), db.NewMemDB(), db.NewMemDB())
+	require.NoError(t, err)
+	_, whole, err := tree.SplitTree(version, nil, db.NewMemDB(), db.NewMemDB())
+	require.NoError(t, err)
+
+	merged, err := MergeTrees(left.ImmutableTree, right.ImmutableTree, db.NewMemDB())
+	require.NoError(t, err)
+	require.Equal(t, int64(77), merged.Size())
+	require.Equal(t, version, merged.Version())
+	requireSameHash(t, whole, merged)
+
+	// the argument order doesn't matter
+	merged, err = MergeTrees(right.ImmutableTree, left.ImmutableTree, db.NewMemDB())
+	require.NoError(t, err)
+	requireSameHash(t, whole, merged)
+
+	_, err = MergeTrees(left.ImmutableTree, whole.ImmutableTree, db.NewMemDB())
+	require.ErrorIs(t, err, ErrOverlappingTrees)
+
+	// the keys of trees with hashed keys are not comparable with those of other trees.
+	hashed, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{HashKeys: true}, false)
+	require.NoError(t, err)
+	_, err = hashed.Set([]byte("other"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = hashed.SaveVersion()
+	require.NoError(t, err)
+	_, err = MergeTrees(left.ImmutableTree, hashed.ImmutableTree, db.NewMemDB())
+	require.Error(t, err)
+}
+
+func requireSameHash(t *testing.T, expected, actual *MutableTree) {
+	expectedHash, err := expected.Hash()
+	require.NoError(t, err)
+	actualHash, err := actual.Hash()
+	require.NoError(t, err)
+	require.Equal(t, expectedHash, actualHash)
+}
+
+func TestSplitRanges(t *testing.T) {
+	tree := setupSplitTree(t, 1000)
+	version := tree.Version()
+
+	for _, n := range []int{1, 3, 7, 1000} {
+		ranges, err := tree.SplitRanges(version, n)
+		require.NoError(t, err)
+		require.Len(t, ranges, n)
+		require.Nil(t, ranges[0].Start)
+		require.Nil(t, ranges[len(ranges)-1].End)
+
+		total := 0
+		for i, r := range ranges {
+			if i > 0 {
+				require.Equal(t, ranges[i-1].End, r.Start)
+			}
+			itr, err := tree.Iterator(r.Start, r.End, true)
+			require.NoError(t, err)
+			count := 0
+			for ; itr.Valid(); itr.Next() {
+				count++
+			}
+			require.NoError(t, itr.Close())
+			require.InDelta(t, 1000/n, count, 1)
+			total += count
+		}
+		require.Equal(t, 1000, total)
+	}
+
+	// small trees get fewer ranges, empty trees a single unbounded range.
+	small := setupSplitTree(t, 10)
+	ranges, err := small.SplitRanges(small.Version(), 20)
+	require.NoError(t, err)
+	require.Len(t, ranges, 10)
+
+	ranges, err = NewImmutableTree(db.NewMemDB(), 0, false).SplitRanges(4)
+	require.NoError(t, err)
+	require.Equal(t, []KeyRange{{}}, ranges)
+
+	_, err = tree.SplitRanges(tree.Version(), 0)
+	require.Error(t, err)
+}
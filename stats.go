@@ -0,0 +1,93 @@
+package iavl
+
+// VersionStats are the statistics of a saved version, recorded by SaveVersion when
+// Options.RecordVersionStats is set.
+type VersionStats struct {
+	Version    int64
+	Leaves     int64 // The number of key/value pairs.
+	ValueBytes int64 // The total size of all values, see StatsAt.
+	NewNodes   int64 // The number of nodes written by the version.
+	Orphans    int64 // The number of nodes of the previous version no longer in this version.
+}
+
+// unknownValueBytes is recorded as the value bytes of a version if those of its base version are
+// not known, e.g. after enabling Options.RecordVersionStats on an existing tree.
+const unknownValueBytes = -1
+
+// StatsAt returns the statistics of a version, or false if none were recorded, without walking
+// the tree. The exception is the total size of the values, which is not known for versions
+// recorded since Options.RecordVersionStats was enabled on an existing tree, and is then computed
+// by walking the version.
+func (tree *MutableTree) StatsAt(version int64) (VersionStats, bool, error) {
+	if !tree.VersionExists(version) {
+		return VersionStats{}, false, ErrVersionDoesNotExist
+	}
+	stats, ok, err := tree.ndb.getVersionStats(version)
+	if err != nil || !ok || stats.ValueBytes != unknownValueBytes {
+		return stats, ok, err
+	}
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return VersionStats{}, false, err
+	}
+	stats.ValueBytes = 0
+	_, err = itree.Iterate(func(_, value []byte) bool {
+		stats.ValueBytes += int64(len(value))
+		return false
+	})
+	if err != nil {
+		return VersionStats{}, false, err
+	}
+	return stats, true, nil
+}
+
+// recordVersionStats records the statistics of a version being saved, given the nodes it wrote,
+// from those of the working tree's base version. It must be called with the commit lock held.
+func (tree *MutableTree) recordVersionStats(version int64, newNodes []*Node) error {
+	prev, err := tree.baseVersionStats()
+	if err != nil {
+		return err
+	}
+	stats := VersionStats{
+		Version:    version,
+		ValueBytes: prev.ValueBytes - tree.orphanedValueBytes,
+		NewNodes:   int64(len(newNodes)),
+	}
+	if tree.root != nil {
+		stats.Leaves = tree.root.size
+	}
+	for _, node := range newNodes {
+		if node.isLeaf() {
+			stats.ValueBytes += int64(len(node.value))
+		}
+	}
+	if prev.ValueBytes == unknownValueBytes {
+		stats.ValueBytes = unknownValueBytes
+	}
+	// a tree with n leaves has 2n-1 nodes, and those not retained from the previous version are
+	// new.
+	stats.Orphans = nodeCount(prev.Leaves) + stats.NewNodes - nodeCount(stats.Leaves)
+	return tree.ndb.setVersionStatsToBatch(stats)
+}
+
+// baseVersionStats returns the statistics of the version the working tree is based on. If they
+// were not recorded, the total size of the values is unknown, since computing it would walk the
+// version while holding the commit lock.
+func (tree *MutableTree) baseVersionStats() (VersionStats, error) {
+	base := tree.getLastSaved()
+	if base == nil || base.root == nil {
+		return VersionStats{}, nil
+	}
+	stats, ok, err := tree.ndb.getVersionStats(base.version)
+	if err != nil || ok {
+		return stats, err
+	}
+	return VersionStats{Version: base.version, Leaves: base.root.size, ValueBytes: unknownValueBytes}, nil
+}
+
+func nodeCount(leaves int64) int64 {
+	if leaves == 0 {
+		return 0
+	}
+	return 2*leaves - 1
+}
@@ -0,0 +1,97 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutableTree_StatsAt(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key%03d", i)), make([]byte, i))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, ok, err := tree.StatsAt(version)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// enabling stats on an existing tree leaves the value bytes unknown, which StatsAt computes.
+	opts := DefaultOptions()
+	opts.RecordVersionStats = true
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &opts, false)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j++ {
+			key := []byte(fmt.Sprintf("key%03d", r.Intn(40)))
+			if r.Intn(3) == 0 {
+				_, _, err = tree.Remove(key)
+			} else {
+				_, err = tree.Set(key, make([]byte, r.Intn(100)))
+			}
+			require.NoError(t, err)
+		}
+		_, version, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		stats, ok, err := tree.StatsAt(version)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, version, stats.Version)
+		require.Equal(t, tree.Size(), stats.Leaves)
+		valueBytes := int64(0)
+		_, err = tree.Iterate(func(_, value []byte) bool {
+			valueBytes += int64(len(value))
+			return false
+		})
+		require.NoError(t, err)
+		require.Equal(t, valueBytes, stats.ValueBytes)
+		recorded, _, err := tree.ndb.getVersionStats(version)
+		require.NoError(t, err)
+		require.EqualValues(t, unknownValueBytes, recorded.ValueBytes)
+		orphans := int64(0)
+		require.NoError(t, tree.ndb.traverseOrphans(version-1, func(*Node) error {
+			orphans++
+			return nil
+		}))
+		require.Equal(t, orphans, stats.Orphans)
+		timings, _ := tree.LastCommitTimings()
+		require.EqualValues(t, timings.NewNodes, stats.NewNodes)
+	}
+
+	_, _, err = tree.StatsAt(version + 1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.NoError(t, tree.DeleteVersionsTo(version-1))
+	_, ok, err = tree.ndb.getVersionStats(version - 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// the value bytes are recorded if stats are enabled from the first version.
+	tree, err = NewMutableTreeWithOpts(db.NewMemDB(), 0, &opts, false)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 10))
+		require.NoError(t, err)
+		_, version, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	_, _, err = tree.Remove([]byte("key000"))
+	require.NoError(t, err)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	recorded, ok, err := tree.ndb.getVersionStats(version)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.EqualValues(t, 10, recorded.ValueBytes)
+}
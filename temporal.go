@@ -0,0 +1,115 @@
+package iavl
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetVersionTimestamp records the commit timestamp of an existing version, e.g. the block time,
+// for use with GetAsOf. Timestamps must be non-decreasing across versions, so the timestamp must
+// not be before that of an earlier version nor after that of a later version. Timestamps are
+// also recorded automatically by SaveVersion when Options.RecordVersionTimestamps is set.
+func (tree *MutableTree) SetVersionTimestamp(version int64, ts time.Time) error {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	if !tree.VersionExists(version) {
+		return ErrVersionDoesNotExist
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+
+	prevVersion, prevTs, ok, err := tree.ndb.findVersionTimestamp(firstVersion, version-1, true)
+	if err != nil {
+		return err
+	}
+	if ok && ts.Before(prevTs) {
+		return fmt.Errorf("timestamp %v of version %d is before timestamp %v of version %d", ts, version, prevTs, prevVersion)
+	}
+	nextVersion, nextTs, ok, err := tree.ndb.findVersionTimestamp(version+1, latestVersion, false)
+	if err != nil {
+		return err
+	}
+	if ok && ts.After(nextTs) {
+		return fmt.Errorf("timestamp %v of version %d is after timestamp %v of version %d", ts, version, nextTs, nextVersion)
+	}
+
+	return tree.ndb.setVersionTimestamp(version, ts)
+}
+
+// GetVersionTimestamp returns the commit timestamp of a version, or false if none was recorded.
+func (tree *MutableTree) GetVersionTimestamp(version int64) (time.Time, bool, error) {
+	return tree.ndb.getVersionTimestamp(version)
+}
+
+// VersionAsOf returns the latest version with a commit timestamp at or before ts. Versions
+// without a recorded timestamp are ignored. ErrVersionDoesNotExist is returned if there is no
+// such version.
+func (tree *MutableTree) VersionAsOf(ts time.Time) (int64, error) {
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return 0, err
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	// binary search over the versions, where each probe seeks to the next timestamped version.
+	found := int64(-1)
+	low, high := firstVersion, latestVersion
+	for low <= high {
+		mid := low + (high-low)/2
+		version, versionTs, ok, err := tree.ndb.findVersionTimestamp(mid, high, false)
+		if err != nil {
+			return 0, err
+		}
+		if ok && !versionTs.After(ts) {
+			found = version
+			low = version + 1
+		} else {
+			high = mid - 1
+		}
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("%w: no version committed at or before %v", ErrVersionDoesNotExist, ts)
+	}
+	return found, nil
+}
+
+// GetAsOf returns the value of the key as of the given time, i.e. at the latest version committed
+// at or before ts, along with that version. See VersionAsOf.
+func (tree *MutableTree) GetAsOf(key []byte, ts time.Time) ([]byte, int64, error) {
+	version, err := tree.VersionAsOf(ts)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := tree.GetVersioned(key, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, version, nil
+}
+
+// recordVersionTimestamp records the timestamp of a version being saved, clamped to the
+// timestamp of the latest earlier version with one. It must be called with the commit lock held.
+func (tree *MutableTree) recordVersionTimestamp(version int64, ts time.Time) error {
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	_, prevTs, ok, err := tree.ndb.findVersionTimestamp(firstVersion, version-1, true)
+	if err != nil {
+		return err
+	}
+	if ok && ts.Before(prevTs) {
+		ts = prevTs
+	}
+	return tree.ndb.setVersionTimestampToBatch(version, ts)
+}
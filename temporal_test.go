@@ -0,0 +1,102 @@
+package iavl
+
+import (
+	"testing"
+	"time"
+
+	db "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAsOf(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, false)
+	require.NoError(t, err)
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 10; i++ {
+		_, err = tree.Set([]byte("balance"), []byte{byte(i)})
+		require.NoError(t, err)
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		// leave gaps without timestamps, which are skipped.
+		if version%3 != 0 {
+			require.NoError(t, tree.SetVersionTimestamp(version, start.Add(time.Duration(version)*time.Hour)))
+		}
+	}
+
+	ts, ok, err := tree.GetVersionTimestamp(2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, start.Add(2*time.Hour).Equal(ts))
+	_, ok, err = tree.GetVersionTimestamp(3)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	for _, tc := range []struct {
+		at      time.Duration
+		version int64
+	}{
+		{time.Hour, 1},
+		{time.Hour + time.Minute, 1},
+		{2 * time.Hour, 2},
+		{3*time.Hour + time.Minute, 2},
+		{4 * time.Hour, 4},
+		{9*time.Hour + time.Minute, 8},
+		{100 * time.Hour, 10},
+	} {
+		value, version, err := tree.GetAsOf([]byte("balance"), start.Add(tc.at))
+		require.NoError(t, err)
+		require.Equal(t, tc.version, version, "at %v", tc.at)
+		require.Equal(t, []byte{byte(tc.version)}, value)
+	}
+
+	_, _, err = tree.GetAsOf([]byte("balance"), start)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// timestamps must be non-decreasing.
+	require.Error(t, tree.SetVersionTimestamp(3, start.Add(time.Hour)))
+	require.Error(t, tree.SetVersionTimestamp(3, start.Add(5*time.Hour)))
+	require.NoError(t, tree.SetVersionTimestamp(3, start.Add(3*time.Hour)))
+	require.ErrorIs(t, tree.SetVersionTimestamp(11, start), ErrVersionDoesNotExist)
+
+	// setting a timestamp does not write what is pending in the batch of the working version.
+	require.NoError(t, tree.ndb.batch.Set([]byte("pending"), []byte{1}))
+	require.NoError(t, tree.SetVersionTimestamp(10, start.Add(10*time.Hour)))
+	has, err := tree.ndb.db.Has([]byte("pending"))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.NoError(t, tree.ndb.Commit())
+
+	// pruned versions lose their timestamps.
+	require.NoError(t, tree.DeleteVersionsTo(4))
+	_, ok, err = tree.GetVersionTimestamp(2)
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, _, err = tree.GetAsOf([]byte("balance"), start.Add(4*time.Hour))
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestRecordVersionTimestamps(t *testing.T) {
+	opts := DefaultOptions()
+	opts.RecordVersionTimestamps = true
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &opts, false)
+	require.NoError(t, err)
+
+	before := time.Now()
+	_, err = tree.Set([]byte("a"), []byte{1})
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	after := time.Now()
+
+	ts, ok, err := tree.GetVersionTimestamp(version)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.False(t, ts.Before(before))
+	require.False(t, ts.After(after))
+
+	value, asOf, err := tree.GetAsOf([]byte("a"), after)
+	require.NoError(t, err)
+	require.Equal(t, version, asOf)
+	require.Equal(t, []byte{1}, value)
+}
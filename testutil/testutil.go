@@ -0,0 +1,478 @@
+// Package testutil provides deterministic generators of tree operations, version schedules and
+// prune schedules, along with checkers of tree invariants, so that forks and alternative backends
+// can run the same correctness battery as iavl itself.
+//
+// A typical property test generates a program from a seed, runs it against a tree while
+// maintaining a reference model, and checks the invariants after every saved version:
+//
+//	gen := testutil.NewGenerator(seed, testutil.Config{KeepRecent: 5})
+//	_, err := testutil.Run(tree, gen.Program(50), testutil.CheckInvariants)
+//
+// Failures report the failing operation and its index, and a program can be replayed exactly from
+// its seed and config.
+package testutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	dbm "github.com/cosmos/cosmos-db"
+
+	"github.com/cosmos/iavl"
+)
+
+// OpKind is the kind of an Op.
+type OpKind int
+
+const (
+	// OpSet sets Key to Value in the working tree.
+	OpSet OpKind = iota
+	// OpRemove removes Key from the working tree.
+	OpRemove
+	// OpSave saves the working tree as a new version.
+	OpSave
+	// OpDeleteVersionsTo deletes the versions up to and including Version.
+	OpDeleteVersionsTo
+)
+
+// Op is an operation on a MutableTree.
+type Op struct {
+	Kind    OpKind
+	Key     []byte
+	Value   []byte
+	Version int64
+}
+
+// String returns a readable representation of the operation, e.g. for failure reports.
+func (op Op) String() string {
+	switch op.Kind {
+	case OpSet:
+		return fmt.Sprintf("SET %x=%x", op.Key, op.Value)
+	case OpRemove:
+		return fmt.Sprintf("REMOVE %x", op.Key)
+	case OpSave:
+		return "SAVE"
+	case OpDeleteVersionsTo:
+		return fmt.Sprintf("DELETE TO %d", op.Version)
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", op.Kind)
+	}
+}
+
+// Apply applies the operation to the tree.
+func (op Op) Apply(tree *iavl.MutableTree) error {
+	var err error
+	switch op.Kind {
+	case OpSet:
+		_, err = tree.Set(op.Key, op.Value)
+	case OpRemove:
+		_, _, err = tree.Remove(op.Key)
+	case OpSave:
+		_, _, err = tree.SaveVersion()
+	case OpDeleteVersionsTo:
+		err = tree.DeleteVersionsTo(op.Version)
+	default:
+		err = fmt.Errorf("unknown op kind %d", op.Kind)
+	}
+	return err
+}
+
+// Config configures a Generator. Zero fields take the defaults given below.
+type Config struct {
+	// KeySpace is the number of distinct keys, default 1000. Small key spaces exercise updates
+	// and removals, large ones insertions.
+	KeySpace int
+	// KeySize is the size of keys in bytes, default 8.
+	KeySize int
+	// ValueSize is the maximum size of values in bytes, default 16. Value sizes are uniformly
+	// distributed between 1 and ValueSize.
+	ValueSize int
+	// RemoveRatio is the fraction of removals among the generated operations, default 0.25.
+	RemoveRatio float64
+	// OpsPerVersion is the mean number of sets and removals per version, default 50. The number
+	// of each version is uniformly distributed between 0 and twice the mean.
+	OpsPerVersion int
+	// KeepRecent is the number of recent versions retained by the prune schedule. If zero, no
+	// versions are pruned.
+	KeepRecent int64
+	// PruneInterval is the number of versions between prunes, default 1.
+	PruneInterval int64
+}
+
+// Generator generates random but deterministic operations, version schedules and prune
+// schedules. The same seed and config always generate the same sequence.
+type Generator struct {
+	cfg  Config
+	rand *rand.Rand
+	keys [][]byte
+}
+
+// NewGenerator returns a generator seeded with seed.
+func NewGenerator(seed int64, cfg Config) *Generator {
+	if cfg.KeySpace <= 0 {
+		cfg.KeySpace = 1000
+	}
+	if cfg.KeySize <= 0 {
+		cfg.KeySize = 8
+	}
+	if cfg.ValueSize <= 0 {
+		cfg.ValueSize = 16
+	}
+	if cfg.RemoveRatio <= 0 {
+		cfg.RemoveRatio = 0.25
+	}
+	if cfg.OpsPerVersion <= 0 {
+		cfg.OpsPerVersion = 50
+	}
+	if cfg.PruneInterval <= 0 {
+		cfg.PruneInterval = 1
+	}
+	g := &Generator{cfg: cfg, rand: rand.New(rand.NewSource(seed))}
+	g.keys = make([][]byte, cfg.KeySpace)
+	for i := range g.keys {
+		g.keys[i] = g.bytes(cfg.KeySize)
+	}
+	return g
+}
+
+func (g *Generator) bytes(n int) []byte {
+	bz := make([]byte, n)
+	g.rand.Read(bz)
+	return bz
+}
+
+// Ops returns n random sets and removals over the key space.
+func (g *Generator) Ops(n int) []Op {
+	ops := make([]Op, n)
+	for i := range ops {
+		key := g.keys[g.rand.Intn(len(g.keys))]
+		if g.rand.Float64() < g.cfg.RemoveRatio {
+			ops[i] = Op{Kind: OpRemove, Key: key}
+		} else {
+			ops[i] = Op{Kind: OpSet, Key: key, Value: g.bytes(1 + g.rand.Intn(g.cfg.ValueSize))}
+		}
+	}
+	return ops
+}
+
+// VersionSchedule returns the number of sets and removals of each of the given number of versions.
+func (g *Generator) VersionSchedule(versions int) []int {
+	schedule := make([]int, versions)
+	for i := range schedule {
+		schedule[i] = g.rand.Intn(2*g.cfg.OpsPerVersion + 1)
+	}
+	return schedule
+}
+
+// PruneSchedule returns the version to delete up to after saving each of the given number of
+// versions, starting at version 1, or 0 to not prune after that version.
+func (g *Generator) PruneSchedule(versions int) []int64 {
+	schedule := make([]int64, versions)
+	if g.cfg.KeepRecent <= 0 {
+		return schedule
+	}
+	pruned := int64(0)
+	for i := range schedule {
+		version := int64(i + 1)
+		if version%g.cfg.PruneInterval == 0 && version-g.cfg.KeepRecent > pruned {
+			pruned = version - g.cfg.KeepRecent
+			schedule[i] = pruned
+		}
+	}
+	return schedule
+}
+
+// Program returns the operations of the given number of versions, following a version schedule,
+// each version ending with an OpSave and followed by the deletion of its prune schedule.
+func (g *Generator) Program(versions int) []Op {
+	var ops []Op
+	prunes := g.PruneSchedule(versions)
+	for i, n := range g.VersionSchedule(versions) {
+		ops = append(ops, g.Ops(n)...)
+		ops = append(ops, Op{Kind: OpSave})
+		if prunes[i] > 0 {
+			ops = append(ops, Op{Kind: OpDeleteVersionsTo, Version: prunes[i]})
+		}
+	}
+	return ops
+}
+
+// Model is a reference model of a tree, tracking the contents of the working tree and of each
+// retained version.
+type Model struct {
+	working  map[string][]byte
+	versions map[int64]map[string][]byte
+	version  int64
+}
+
+// NewModel returns the model of an empty tree.
+func NewModel() *Model {
+	return &Model{working: map[string][]byte{}, versions: map[int64]map[string][]byte{}}
+}
+
+// Apply applies an operation to the model.
+func (m *Model) Apply(op Op) {
+	switch op.Kind {
+	case OpSet:
+		m.working[string(op.Key)] = op.Value
+	case OpRemove:
+		delete(m.working, string(op.Key))
+	case OpSave:
+		m.version++
+		saved := make(map[string][]byte, len(m.working))
+		for key, value := range m.working {
+			saved[key] = value
+		}
+		m.versions[m.version] = saved
+	case OpDeleteVersionsTo:
+		for version := range m.versions {
+			if version <= op.Version {
+				delete(m.versions, version)
+			}
+		}
+	}
+}
+
+// Version returns the latest saved version.
+func (m *Model) Version() int64 {
+	return m.version
+}
+
+// Versions returns the retained versions in ascending order.
+func (m *Model) Versions() []int64 {
+	versions := make([]int64, 0, len(m.versions))
+	for version := range m.versions {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// Contents returns the contents of a retained version, or nil if it does not exist.
+func (m *Model) Contents(version int64) map[string][]byte {
+	return m.versions[version]
+}
+
+// Working returns the contents of the working tree.
+func (m *Model) Working() map[string][]byte {
+	return m.working
+}
+
+// CheckFunc checks a tree against the model after a version was saved.
+type CheckFunc func(tree *iavl.MutableTree, model *Model) error
+
+// Run applies the operations to the tree and a model of it, calling check after every saved
+// version, e.g. with CheckInvariants. Errors report the failing operation and its index. The
+// tree must be empty.
+func Run(tree *iavl.MutableTree, ops []Op, check CheckFunc) (*Model, error) {
+	model := NewModel()
+	for i, op := range ops {
+		if err := op.Apply(tree); err != nil {
+			return model, fmt.Errorf("op %d (%v): %w", i, op, err)
+		}
+		model.Apply(op)
+		if op.Kind == OpSave && check != nil {
+			if err := check(tree, model); err != nil {
+				return model, fmt.Errorf("version %d, after op %d: %w", model.Version(), i, err)
+			}
+		}
+	}
+	return model, nil
+}
+
+// CheckInvariants checks every retained version of the tree against the model, with CheckBalance,
+// CheckContents and CheckHashStable. It is a CheckFunc.
+func CheckInvariants(tree *iavl.MutableTree, model *Model) error {
+	versions := model.Versions()
+	available := tree.AvailableVersions()
+	if len(available) != len(versions) {
+		return fmt.Errorf("expected versions %v, got %v", versions, available)
+	}
+	for i, version := range versions {
+		if int64(available[i]) != version {
+			return fmt.Errorf("expected versions %v, got %v", versions, available)
+		}
+		itree, err := tree.GetImmutable(version)
+		if errors.Is(err, iavl.ErrVersionDoesNotExist) && len(model.Contents(version)) == 0 {
+			// the root of an empty version is indistinguishable from a missing one.
+			continue
+		} else if err != nil {
+			return fmt.Errorf("version %d: %w", version, err)
+		}
+		if _, err := CheckBalance(itree); err != nil {
+			return fmt.Errorf("version %d: %w", version, err)
+		}
+		if err := CheckContents(itree, model.Contents(version)); err != nil {
+			return fmt.Errorf("version %d: %w", version, err)
+		}
+		if err := CheckHashStable(itree); err != nil {
+			return fmt.Errorf("version %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// subtree summarizes a checked subtree.
+type subtree struct {
+	height   int8
+	size     int64
+	min, max []byte
+}
+
+// CheckBalance checks the shape of the tree: leaves are in strictly ascending key order, the
+// height of each inner node is one more than that of its highest child, the heights of its
+// children differ by at most one, and its key is the smallest key of its right subtree. It
+// returns the number of leaves.
+func CheckBalance(tree *iavl.ImmutableTree) (int64, error) {
+	exporter, err := tree.Export()
+	if err != nil {
+		return 0, err
+	}
+	defer exporter.Close()
+
+	var (
+		stack    []subtree
+		lastLeaf []byte
+	)
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, iavl.ErrorExportDone) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if node.Height == 0 {
+			if lastLeaf != nil && bytes.Compare(node.Key, lastLeaf) <= 0 {
+				return 0, fmt.Errorf("leaf %x is not after leaf %x", node.Key, lastLeaf)
+			}
+			lastLeaf = node.Key
+			stack = append(stack, subtree{size: 1, min: node.Key, max: node.Key})
+			continue
+		}
+		if len(stack) < 2 {
+			return 0, fmt.Errorf("inner node %x is missing children", node.Key)
+		}
+		left, right := stack[len(stack)-2], stack[len(stack)-1]
+		stack = stack[:len(stack)-2]
+		height := left.height
+		if right.height > height {
+			height = right.height
+		}
+		if node.Height != height+1 {
+			return 0, fmt.Errorf("inner node %x has height %d, expected %d", node.Key, node.Height, height+1)
+		}
+		if diff := int(left.height) - int(right.height); diff < -1 || diff > 1 {
+			return 0, fmt.Errorf("inner node %x is unbalanced, with child heights %d and %d",
+				node.Key, left.height, right.height)
+		}
+		if !bytes.Equal(node.Key, right.min) {
+			return 0, fmt.Errorf("inner node %x does not have the smallest key %x of its right subtree",
+				node.Key, right.min)
+		}
+		stack = append(stack, subtree{
+			height: node.Height,
+			size:   left.size + right.size,
+			min:    left.min,
+			max:    right.max,
+		})
+	}
+	switch len(stack) {
+	case 0:
+		return 0, nil
+	case 1:
+		return stack[0].size, nil
+	default:
+		return 0, fmt.Errorf("tree has %d roots", len(stack))
+	}
+}
+
+// CheckSize checks that the size of the tree and its number of leaves are both expected.
+func CheckSize(tree *iavl.ImmutableTree, expected int64) error {
+	if size := tree.Size(); size != expected {
+		return fmt.Errorf("expected size %d, got %d", expected, size)
+	}
+	leaves, err := CheckBalance(tree)
+	if err != nil {
+		return err
+	}
+	if leaves != expected {
+		return fmt.Errorf("expected %d leaves, got %d", expected, leaves)
+	}
+	return nil
+}
+
+// CheckContents checks that the tree holds exactly the given keys and values.
+func CheckContents(tree *iavl.ImmutableTree, contents map[string][]byte) error {
+	if err := CheckSize(tree, int64(len(contents))); err != nil {
+		return err
+	}
+	for key, expected := range contents {
+		value, err := tree.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(value, expected) {
+			return fmt.Errorf("key %x: expected value %x, got %x", key, expected, value)
+		}
+	}
+	return nil
+}
+
+// CheckHashStable checks that the hash of the tree is stable: computing it again returns the
+// same hash, and so does exporting the tree and importing it into a new database.
+func CheckHashStable(tree *iavl.ImmutableTree) error {
+	hash, err := tree.Hash()
+	if err != nil {
+		return err
+	}
+	again, err := tree.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, again) {
+		return fmt.Errorf("hash changed from %x to %x", hash, again)
+	}
+	if tree.Size() == 0 {
+		return nil
+	}
+
+	imported, err := iavl.NewMutableTree(dbm.NewMemDB(), 0, true)
+	if err != nil {
+		return err
+	}
+	importer, err := imported.Import(tree.Version())
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+	exporter, err := tree.Export()
+	if err != nil {
+		return err
+	}
+	defer exporter.Close()
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, iavl.ErrorExportDone) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := importer.Add(node); err != nil {
+			return err
+		}
+	}
+	if err := importer.Commit(); err != nil {
+		return err
+	}
+	importedHash, err := imported.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, importedHash) {
+		return fmt.Errorf("hash %x changed to %x by export and import", hash, importedHash)
+	}
+	return nil
+}
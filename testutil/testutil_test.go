@@ -0,0 +1,76 @@
+package testutil
+
+import (
+	"testing"
+
+	dbm "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+)
+
+func TestGenerator(t *testing.T) {
+	cfg := Config{KeySpace: 100, OpsPerVersion: 20, KeepRecent: 3, PruneInterval: 2}
+	program := NewGenerator(42, cfg).Program(20)
+	require.Equal(t, program, NewGenerator(42, cfg).Program(20))
+	require.NotEqual(t, program, NewGenerator(43, cfg).Program(20))
+
+	saves, prunes := 0, []int64{}
+	for _, op := range program {
+		switch op.Kind {
+		case OpSave:
+			saves++
+		case OpDeleteVersionsTo:
+			require.LessOrEqual(t, op.Version, int64(saves)-cfg.KeepRecent)
+			prunes = append(prunes, op.Version)
+		}
+	}
+	require.Equal(t, 20, saves)
+	require.Equal(t, []int64{1, 3, 5, 7, 9, 11, 13, 15, 17}, prunes)
+	require.Equal(t, make([]int64, 5), NewGenerator(1, Config{}).PruneSchedule(5))
+}
+
+func TestRun(t *testing.T) {
+	for _, opts := range []*iavl.Options{nil, {HashKeys: true}} {
+		for seed := int64(0); seed < 3; seed++ {
+			tree, err := iavl.NewMutableTreeWithOpts(dbm.NewMemDB(), 0, opts, false)
+			require.NoError(t, err)
+			gen := NewGenerator(seed, Config{KeySpace: 200, OpsPerVersion: 30, KeepRecent: 4})
+			model, err := Run(tree, gen.Program(15), CheckInvariants)
+			require.NoError(t, err)
+			require.EqualValues(t, 15, model.Version())
+			require.Equal(t, []int64{12, 13, 14, 15}, model.Versions())
+		}
+	}
+}
+
+func TestCheckers(t *testing.T) {
+	tree, err := iavl.NewMutableTree(dbm.NewMemDB(), 0, false)
+	require.NoError(t, err)
+	_, err = Run(tree, []Op{
+		{Kind: OpSet, Key: []byte("a"), Value: []byte("1")},
+		{Kind: OpSet, Key: []byte("b"), Value: []byte("2")},
+		{Kind: OpSave},
+	}, nil)
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	leaves, err := CheckBalance(itree)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, leaves)
+	require.NoError(t, CheckHashStable(itree))
+	require.NoError(t, CheckContents(itree, map[string][]byte{"a": []byte("1"), "b": []byte("2")}))
+	require.Error(t, CheckContents(itree, map[string][]byte{"a": []byte("1"), "b": []byte("3")}))
+	require.Error(t, CheckSize(itree, 3))
+
+	// a model diverging from the tree fails the invariants.
+	model := NewModel()
+	model.Apply(Op{Kind: OpSet, Key: []byte("a"), Value: []byte("1")})
+	model.Apply(Op{Kind: OpSave})
+	require.Error(t, CheckInvariants(tree, model))
+
+	// failing operations are reported.
+	_, err = Run(tree, []Op{{Kind: OpDeleteVersionsTo, Version: 5}}, nil)
+	require.ErrorContains(t, err, "DELETE TO 5")
+}
@@ -0,0 +1,36 @@
+// Package unsafe gives recovery tooling raw access to the stored nodes of an iavl tree, e.g. to
+// surgically replace corrupted nodes with copies from a healthy peer without rebuilding the whole
+// store. Nodes are addressed by the version and nonce of their node key; the root of a version
+// has nonce 1.
+//
+// Nothing here is needed in normal operation. Replacing nodes while the tree is in use may expose
+// inconsistent state to readers, so tools should only use it on a tree which is otherwise idle.
+package unsafe
+
+import (
+	"github.com/cosmos/iavl"
+	"github.com/cosmos/iavl/internal/rawnode"
+)
+
+var (
+	// ErrNotANode is returned for records which are not encoded nodes, e.g. references to the root
+	// of a previous version.
+	ErrNotANode = rawnode.ErrNotANode
+	// ErrHashMismatch is returned by PutRawNode for nodes which do not hash to the expected hash.
+	ErrHashMismatch = rawnode.ErrHashMismatch
+)
+
+// GetRawNode returns the stored encoding of a node, read directly from the database, along with
+// the hash of the node. The encoding can be put into another copy of the tree with PutRawNode.
+func GetRawNode(tree *iavl.MutableTree, version int64, nonce int32) (raw []byte, hash []byte, err error) {
+	return rawnode.Get(tree, version, nonce)
+}
+
+// PutRawNode replaces the stored encoding of a node, and evicts it from the node cache. The
+// encoding must decode to a node which hashes to hash, as returned by GetRawNode from a healthy
+// copy of the tree, otherwise ErrHashMismatch is returned and nothing is written. The hash of an
+// inner node is recomputed from its children, which must be intact, so corrupted subtrees must be
+// repaired bottom-up. The node is written immediately, outside of any version commit.
+func PutRawNode(tree *iavl.MutableTree, version int64, nonce int32, raw []byte, hash []byte) error {
+	return rawnode.Put(tree, version, nonce, raw, hash)
+}
@@ -0,0 +1,84 @@
+package unsafe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	dbm "github.com/cosmos/cosmos-db"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+)
+
+func nodeKey(version int64, nonce int32) []byte {
+	key := make([]byte, 13)
+	key[0] = 'n'
+	binary.BigEndian.PutUint64(key[1:], uint64(version))
+	binary.BigEndian.PutUint32(key[9:], uint32(nonce))
+	return key
+}
+
+func newTree(t *testing.T, db dbm.DB) *iavl.MutableTree {
+	tree, err := iavl.NewMutableTree(db, 0, false)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err = tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// version 2 refers to the root of version 1.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	return tree
+}
+
+func TestRawNode(t *testing.T) {
+	healthy := newTree(t, dbm.NewMemDB())
+	hash, err := healthy.Hash()
+	require.NoError(t, err)
+
+	db := dbm.NewMemDB()
+	corrupted := newTree(t, db)
+	// 8 leaves make 15 nodes, with nonces in pre-order.
+	const nodes = 15
+	for nonce := int32(1); nonce <= nodes; nonce++ {
+		require.NoError(t, db.Set(nodeKey(1, nonce), []byte{0xff}))
+	}
+	_, _, err = GetRawNode(corrupted, 1, 1)
+	require.Error(t, err)
+	_, _, err = GetRawNode(healthy, 2, 1)
+	require.ErrorIs(t, err, ErrNotANode)
+
+	raw, rootHash, err := GetRawNode(healthy, 1, 1)
+	require.NoError(t, err)
+	require.Equal(t, hash, rootHash)
+	// the children of the root are still corrupted.
+	require.Error(t, PutRawNode(corrupted, 1, 1, raw, rootHash))
+
+	raw, leafHash, err := GetRawNode(healthy, 1, nodes)
+	require.NoError(t, err)
+	require.ErrorIs(t, PutRawNode(corrupted, 1, nodes, raw, rootHash), ErrHashMismatch)
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)-1]++
+	require.ErrorIs(t, PutRawNode(corrupted, 1, nodes, tampered, leafHash), ErrHashMismatch)
+
+	// repair bottom-up.
+	for nonce := int32(nodes); nonce >= 1; nonce-- {
+		raw, hash, err := GetRawNode(healthy, 1, nonce)
+		require.NoError(t, err)
+		require.NoError(t, PutRawNode(corrupted, 1, nonce, raw, hash))
+	}
+
+	repaired, err := iavl.NewMutableTree(db, 0, false)
+	require.NoError(t, err)
+	_, err = repaired.Load()
+	require.NoError(t, err)
+	repairedHash, err := repaired.Hash()
+	require.NoError(t, err)
+	require.Equal(t, hash, repairedHash)
+	value, err := repaired.GetVersioned([]byte("key-3"), 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, value)
+}
@@ -105,6 +105,9 @@ func (iter *UnsavedFastIterator) Domain() ([]byte, []byte) {
 
 // Valid implements dbm.Iterator.
 func (iter *UnsavedFastIterator) Valid() bool {
+	if iter.err != nil {
+		return false
+	}
 	if iter.start != nil && iter.end != nil {
 		if bytes.Compare(iter.end, iter.start) != 1 {
 			return false
@@ -133,11 +136,18 @@ func (iter *UnsavedFastIterator) Next() {
 		iter.valid = false
 		return
 	}
+	if iter.err != nil {
+		return
+	}
 
 	diskKeyStr := ibytes.UnsafeBytesToStr(iter.fastIterator.Key())
 	if iter.fastIterator.Valid() && iter.nextUnsavedNodeIdx < len(iter.unsavedFastNodesToSort) {
-
-		if iter.unsavedFastNodeRemovals[diskKeyStr] != nil {
+		removed, err := iter.isRemoved(diskKeyStr)
+		if err != nil {
+			iter.fail(err)
+			return
+		}
+		if removed {
 			// If next fast node from disk is to be removed, skip it.
 			iter.fastIterator.Next()
 			iter.Next()
@@ -178,7 +188,12 @@ func (iter *UnsavedFastIterator) Next() {
 
 	// if only nodes on disk are left, we return them
 	if iter.fastIterator.Valid() {
-		if iter.unsavedFastNodeRemovals[diskKeyStr] != nil {
+		removed, err := iter.isRemoved(diskKeyStr)
+		if err != nil {
+			iter.fail(err)
+			return
+		}
+		if removed {
 			// If next fast node from disk is to be removed, skip it.
 			iter.fastIterator.Next()
 			iter.Next()
@@ -208,6 +223,24 @@ func (iter *UnsavedFastIterator) Next() {
 	iter.nextVal = nil
 }
 
+// isRemoved returns true if the fast node on disk with the given key is to be removed, either
+// in memory or spilled to disk.
+func (iter *UnsavedFastIterator) isRemoved(key string) (bool, error) {
+	if iter.unsavedFastNodeRemovals[key] != nil {
+		return true, nil
+	}
+	return iter.ndb.hasSpilledFastNodeRemoval(ibytes.UnsafeStrToBytes(key))
+}
+
+// fail invalidates the iterator with the given error, since it can't tell whether the fast node
+// on disk is to be removed.
+func (iter *UnsavedFastIterator) fail(err error) {
+	iter.err = err
+	iter.valid = false
+	iter.nextKey = nil
+	iter.nextVal = nil
+}
+
 // Close implements dbm.Iterator
 func (iter *UnsavedFastIterator) Close() error {
 	iter.valid = false
@@ -0,0 +1,275 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	hexbytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// ErrInvalidVersionChain is returned by VersionChainReport.Err when a version failed verification.
+var ErrInvalidVersionChain = errors.New("invalid version chain")
+
+// VerifyChainOptions configures VerifyVersionChain.
+type VerifyChainOptions struct {
+	// Samples is the number of random leaf paths verified per version. All nodes of each version
+	// are verified if zero.
+	Samples int
+
+	// Seed seeds the choice of the sampled leaves.
+	Seed int64
+
+	// ExpectedHashes are the root hashes the versions are expected to have, e.g. as recorded by
+	// the application or agreed on by the network. Versions without an expected hash are only
+	// checked against their nodes.
+	ExpectedHashes map[int64][]byte
+}
+
+// VersionChainReport is the result of VerifyVersionChain. It encodes to JSON for tooling.
+type VersionChainReport struct {
+	From     int64          `json:"from"`
+	To       int64          `json:"to"`
+	Samples  int            `json:"samples"`
+	Versions []VersionCheck `json:"versions"`
+}
+
+// VersionCheck is the verification result of a single version.
+type VersionCheck struct {
+	Version      int64             `json:"version"`
+	RootHash     hexbytes.HexBytes `json:"root_hash,omitempty"`
+	ExpectedHash hexbytes.HexBytes `json:"expected_hash,omitempty"`
+	// NodesVerified is the number of nodes verified for the version, excluding nodes shared with
+	// previously verified versions.
+	NodesVerified int64 `json:"nodes_verified"`
+	// Error describes the first problem found, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Valid returns whether all versions passed verification.
+func (r *VersionChainReport) Valid() bool {
+	return r.Err() == nil
+}
+
+// Err returns an error wrapping ErrInvalidVersionChain listing the versions which failed
+// verification, or nil if all passed.
+func (r *VersionChainReport) Err() error {
+	var failures []string
+	for _, check := range r.Versions {
+		if check.Error != "" {
+			failures = append(failures, fmt.Sprintf("version %d: %s", check.Version, check.Error))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidVersionChain, strings.Join(failures, "; "))
+}
+
+// VerifyVersionChain verifies each version from from to to, inclusive, skipping the versions
+// skipped by SaveVersionAt: it checks that the version exists, and that the stored root hash is
+// the hash of a valid tree over the nodes it refers to, i.e. that the stored hash of every inner
+// node matches the hash recomputed from its children, that heights, sizes and key ordering are
+// consistent, and that nodes only refer to nodes of the same or older versions. With
+// VerifyChainOptions.Samples set, only the nodes on random leaf paths are verified, otherwise all
+// nodes are. Nodes shared between versions are only verified once. The root hashes are also
+// compared against VerifyChainOptions.ExpectedHashes.
+//
+// Problems are recorded in the report, which is returned along with an error only if the range
+// is invalid. Full verification keeps the key range of every verified node in memory.
+func (tree *MutableTree) VerifyVersionChain(from, to int64, opts VerifyChainOptions) (*VersionChainReport, error) {
+	if from <= 0 || from > to {
+		return nil, fmt.Errorf("invalid version range %d to %d", from, to)
+	}
+	v := &chainVerifier{
+		ndb:      tree.ndb,
+		rand:     rand.New(rand.NewSource(opts.Seed)),
+		verified: make(map[string]keyRange),
+	}
+	report := &VersionChainReport{From: from, To: to, Samples: opts.Samples}
+	for version := from; version <= to; version++ {
+		// versions skipped by SaveVersionAt have nothing to verify.
+		_, _, gap, err := tree.ndb.findVersionGap(version)
+		if gap {
+			continue
+		}
+		check := VersionCheck{Version: version}
+		switch {
+		case err != nil:
+			check.Error = err.Error()
+		case !tree.VersionExists(version):
+			check.Error = ErrVersionDoesNotExist.Error()
+		default:
+			check = v.verifyVersion(version, opts.Samples)
+		}
+		if expected, ok := opts.ExpectedHashes[version]; ok {
+			check.ExpectedHash = expected
+			if check.Error == "" && !bytes.Equal(check.RootHash, expected) {
+				check.Error = fmt.Sprintf("root hash %X does not match expected hash %X", check.RootHash, expected)
+			}
+		}
+		report.Versions = append(report.Versions, check)
+	}
+	return report, nil
+}
+
+// keyRange is the smallest and largest key of a verified subtree.
+type keyRange struct {
+	min, max []byte
+}
+
+// chainVerifier holds the state of VerifyVersionChain. verified holds the nodes verified so far by
+// node key, with the key range of their subtree in full verification.
+type chainVerifier struct {
+	ndb      *nodeDB
+	rand     *rand.Rand
+	verified map[string]keyRange
+	count    int64
+}
+
+// verifyVersion verifies an existing version, with the given number of sampled paths or fully if
+// zero.
+func (v *chainVerifier) verifyVersion(version int64, samples int) VersionCheck {
+	check := VersionCheck{Version: version}
+	rootNodeKey, err := v.ndb.GetRoot(version)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	if rootNodeKey == nil { // the version is empty.
+		empty := sha256.Sum256(nil)
+		check.RootHash = empty[:]
+		return check
+	}
+	if rootNodeKey.version > version {
+		check.Error = fmt.Sprintf("root %v is newer than the version", rootNodeKey)
+		return check
+	}
+
+	root, err := v.ndb.GetNode(rootNodeKey)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.RootHash = root.hash
+
+	v.count = 0
+	if samples > 0 {
+		for i := 0; i < samples && err == nil; i++ {
+			err = v.verifyPath(root, v.rand.Int63n(root.size))
+		}
+	} else {
+		_, err = v.verifySubtree(root)
+	}
+	check.NodesVerified = v.count
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// verifySubtree verifies all nodes of the subtree not verified yet, and returns its key range.
+func (v *chainVerifier) verifySubtree(node *Node) (keyRange, error) {
+	if r, ok := v.verified[string(node.GetKey())]; ok && r.min != nil {
+		return r, nil
+	}
+	r := keyRange{min: node.key, max: node.key}
+	if !node.isLeaf() {
+		left, right, err := v.verifyNode(node)
+		if err != nil {
+			return r, err
+		}
+		leftRange, err := v.verifySubtree(left)
+		if err != nil {
+			return r, err
+		}
+		rightRange, err := v.verifySubtree(right)
+		if err != nil {
+			return r, err
+		}
+		if bytes.Compare(leftRange.max, node.key) >= 0 || !bytes.Equal(rightRange.min, node.key) {
+			return r, fmt.Errorf("node %v: key %X does not separate its subtrees", node.nodeKey, node.key)
+		}
+		r = keyRange{min: leftRange.min, max: rightRange.max}
+	} else {
+		v.count++
+	}
+	v.verified[string(node.GetKey())] = r
+	return r, nil
+}
+
+// verifyPath verifies the nodes on the path from the node to the leaf at the index.
+func (v *chainVerifier) verifyPath(node *Node, index int64) error {
+	var lower, upper []byte // the bounds of the keys in the subtree, upper exclusive.
+	for !node.isLeaf() {
+		left, right, err := v.verifyNode(node)
+		if err != nil {
+			return err
+		}
+		if index < left.size {
+			upper, node = node.key, left
+		} else {
+			index -= left.size
+			lower, node = node.key, right
+		}
+	}
+	if _, ok := v.verified[string(node.GetKey())]; !ok {
+		v.verified[string(node.GetKey())] = keyRange{}
+		v.count++
+	}
+	if (lower != nil && bytes.Compare(node.key, lower) < 0) || (upper != nil && bytes.Compare(node.key, upper) >= 0) {
+		return fmt.Errorf("leaf %v: key %X is out of order", node.nodeKey, node.key)
+	}
+	return nil
+}
+
+// verifyNode loads the children of an inner node and checks the node against them, unless the
+// node was already checked.
+func (v *chainVerifier) verifyNode(node *Node) (*Node, *Node, error) {
+	left, err := v.ndb.GetNode(node.leftNodeKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("node %v: %w", node.nodeKey, err)
+	}
+	right, err := v.ndb.GetNode(node.rightNodeKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("node %v: %w", node.nodeKey, err)
+	}
+	if _, ok := v.verified[string(node.GetKey())]; ok {
+		return left, right, nil
+	}
+
+	if left.nodeKey.version > node.nodeKey.version || right.nodeKey.version > node.nodeKey.version {
+		return nil, nil, fmt.Errorf("node %v: refers to a newer node", node.nodeKey)
+	}
+	if height := maxInt8(left.subtreeHeight, right.subtreeHeight) + 1; node.subtreeHeight != height {
+		return nil, nil, fmt.Errorf("node %v: height %d, expected %d", node.nodeKey, node.subtreeHeight, height)
+	}
+	if balance := int(left.subtreeHeight) - int(right.subtreeHeight); balance < -1 || balance > 1 {
+		return nil, nil, fmt.Errorf("node %v: unbalanced by %d", node.nodeKey, balance)
+	}
+	if size := left.size + right.size; node.size != size {
+		return nil, nil, fmt.Errorf("node %v: size %d, expected %d", node.nodeKey, node.size, size)
+	}
+
+	// hash a copy, since nodes may be shared with the node cache.
+	hashed := &Node{
+		subtreeHeight: node.subtreeHeight,
+		size:          node.size,
+		leftNode:      &Node{hash: left.hash},
+		rightNode:     &Node{hash: right.hash},
+	}
+	hash, err := hashed._hash(node.nodeKey.version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hash, node.hash) {
+		return nil, nil, fmt.Errorf("node %v: stored hash %X, computed %X", node.nodeKey, node.hash, hash)
+	}
+
+	v.verified[string(node.GetKey())] = keyRange{}
+	v.count++
+	return left, right, nil
+}
@@ -0,0 +1,120 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/cosmos/cosmos-db"
+)
+
+func setupVersionChain(t *testing.T) (*MutableTree, db.DB, map[int64][]byte) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0, true)
+	require.NoError(t, err)
+	hashes := make(map[int64][]byte)
+	for version := int64(1); version <= 6; version++ {
+		for i := 0; i < 100; i++ {
+			// version 4 has no changes, and refers to the root of version 3.
+			if version == 1 || (version != 4 && i%7 == int(version)) {
+				_, err = tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", version)))
+				require.NoError(t, err)
+			}
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	return tree, memDB, hashes
+}
+
+func TestMutableTree_VerifyVersionChain(t *testing.T) {
+	tree, _, hashes := setupVersionChain(t)
+
+	for _, samples := range []int{0, 5} {
+		report, err := tree.VerifyVersionChain(1, 6, VerifyChainOptions{Samples: samples, ExpectedHashes: hashes})
+		require.NoError(t, err)
+		require.NoError(t, report.Err())
+		require.True(t, report.Valid())
+		require.Len(t, report.Versions, 6)
+		for _, check := range report.Versions {
+			require.Equal(t, hashes[check.Version], []byte(check.RootHash))
+			// version 4 shares all nodes with version 3.
+			if check.Version == 4 && samples == 0 {
+				require.Zero(t, check.NodesVerified)
+			} else if check.Version != 4 {
+				require.Positive(t, check.NodesVerified)
+			}
+		}
+	}
+
+	// a full verification visits all nodes of the first version once.
+	report, err := tree.VerifyVersionChain(1, 1, VerifyChainOptions{})
+	require.NoError(t, err)
+	require.EqualValues(t, 2*100-1, report.Versions[0].NodesVerified)
+
+	// the report is machine-readable.
+	bz, err := json.Marshal(report)
+	require.NoError(t, err)
+	var decoded VersionChainReport
+	require.NoError(t, json.Unmarshal(bz, &decoded))
+	require.Equal(t, *report, decoded)
+
+	// mismatching expected hashes and missing versions are reported.
+	report, err = tree.VerifyVersionChain(5, 7, VerifyChainOptions{ExpectedHashes: map[int64][]byte{6: hashes[5]}})
+	require.NoError(t, err)
+	require.ErrorIs(t, report.Err(), ErrInvalidVersionChain)
+	require.Empty(t, report.Versions[0].Error)
+	require.Contains(t, report.Versions[1].Error, "does not match expected hash")
+	require.Equal(t, ErrVersionDoesNotExist.Error(), report.Versions[2].Error)
+
+	_, err = tree.VerifyVersionChain(3, 2, VerifyChainOptions{})
+	require.Error(t, err)
+}
+
+func TestMutableTree_VerifyVersionChain_EmptyAndSkipped(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0, true)
+	require.NoError(t, err)
+	empty, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("k"), []byte("v"))
+	require.NoError(t, err)
+	hash, _, err := tree.SaveVersionAt(5)
+	require.NoError(t, err)
+
+	// the empty version has the empty hash, and the skipped versions are not reported.
+	report, err := tree.VerifyVersionChain(1, 5, VerifyChainOptions{ExpectedHashes: map[int64][]byte{1: empty, 5: hash}})
+	require.NoError(t, err)
+	require.NoError(t, report.Err())
+	require.Len(t, report.Versions, 2)
+	require.EqualValues(t, 1, report.Versions[0].Version)
+	require.Equal(t, empty, []byte(report.Versions[0].RootHash))
+	require.EqualValues(t, 5, report.Versions[1].Version)
+}
+
+func TestMutableTree_VerifyVersionChain_Corrupted(t *testing.T) {
+	tree, memDB, _ := setupVersionChain(t)
+
+	// corrupt the stored hash of the root of version 5.
+	rootNodeKey, err := tree.ndb.GetRoot(5)
+	require.NoError(t, err)
+	root, err := tree.ndb.GetNode(rootNodeKey)
+	require.NoError(t, err)
+	corrupted := *root
+	corrupted.hash = bytes.Repeat([]byte{1}, 32)
+	var buf bytes.Buffer
+	require.NoError(t, corrupted.writeBytes(&buf))
+	require.NoError(t, memDB.Set(tree.ndb.nodeKey(root.nodeKey), buf.Bytes()))
+
+	for _, samples := range []int{0, 1} {
+		report, err := tree.VerifyVersionChain(4, 6, VerifyChainOptions{Samples: samples})
+		require.NoError(t, err)
+		require.False(t, report.Valid())
+		require.Empty(t, report.Versions[0].Error)
+		require.Contains(t, report.Versions[1].Error, "stored hash")
+		require.Empty(t, report.Versions[2].Error)
+	}
+}
@@ -0,0 +1,135 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+)
+
+// VersionedKey is a key at a version, as requested from BatchGetVersioned.
+type VersionedKey struct {
+	Key     []byte
+	Version int64
+}
+
+// versionedBatch executes the lookups of a BatchGetVersioned call. Nodes read from the database
+// are kept for the duration of the call, so nodes shared by several versions are only read once.
+type versionedBatch struct {
+	ndb      *nodeDB
+	requests []VersionedKey
+	keys     [][]byte // tree keys, by request index.
+	values   [][]byte // by request index.
+	nodes    map[string]*Node
+}
+
+// BatchGetVersioned gets the values of many keys at many versions, e.g. for reindexing jobs. It
+// returns the values in the order of the requests, with nil values for keys or versions that do
+// not exist, like GetVersioned. The requests are executed in (version, key) order: the root of
+// each version is loaded once, the tree is walked once for all keys of a version, and nodes shared
+// between versions are only read once. The read nodes are held in memory until the call returns,
+// so very large batches should be split by version range. It is safe to call concurrently with
+// SaveVersion.
+func (tree *MutableTree) BatchGetVersioned(requests []VersionedKey) ([][]byte, error) {
+	batch := &versionedBatch{
+		ndb:      tree.ndb,
+		requests: requests,
+		keys:     make([][]byte, len(requests)),
+		values:   make([][]byte, len(requests)),
+		nodes:    make(map[string]*Node),
+	}
+	order := make([]int, len(requests))
+	for i, req := range requests {
+		tree.recordAccess(AccessRead, req.Key, req.Version)
+		batch.keys[i] = tree.ndb.treeKey(req.Key)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if requests[a].Version != requests[b].Version {
+			return requests[a].Version < requests[b].Version
+		}
+		return bytes.Compare(batch.keys[a], batch.keys[b]) < 0
+	})
+
+	for len(order) > 0 {
+		version := requests[order[0]].Version
+		end := sort.Search(len(order), func(i int) bool { return requests[order[i]].Version > version })
+		if err := batch.getVersion(version, order[:end]); err != nil {
+			return nil, err
+		}
+		order = order[end:]
+	}
+	return batch.values, nil
+}
+
+// getVersion looks up the requests, sorted by key, at a version.
+func (b *versionedBatch) getVersion(version int64, indexes []int) error {
+	rootNodeKey, err := b.ndb.GetRoot(version)
+	if err != nil {
+		return err
+	}
+	// the version does not exist, or is empty.
+	if rootNodeKey == nil || rootNodeKey.version == 0 {
+		return nil
+	}
+	root, err := b.getNode(rootNodeKey)
+	if err != nil {
+		return err
+	}
+	return b.get(root, indexes)
+}
+
+// get looks up the requests, sorted by key, in the subtree of the node.
+func (b *versionedBatch) get(node *Node, indexes []int) error {
+	if node.isLeaf() {
+		for _, i := range indexes {
+			if bytes.Equal(b.keys[i], node.key) {
+				b.values[i] = node.value
+			}
+		}
+		return nil
+	}
+
+	// keys smaller than the key of an inner node are in its left subtree.
+	split := sort.Search(len(indexes), func(i int) bool {
+		return bytes.Compare(b.keys[indexes[i]], node.key) >= 0
+	})
+	if split > 0 {
+		left := node.leftNode
+		if left == nil {
+			var err error
+			if left, err = b.getNode(node.leftNodeKey); err != nil {
+				return err
+			}
+		}
+		if err := b.get(left, indexes[:split]); err != nil {
+			return err
+		}
+	}
+	if split < len(indexes) {
+		right := node.rightNode
+		if right == nil {
+			var err error
+			if right, err = b.getNode(node.rightNodeKey); err != nil {
+				return err
+			}
+		}
+		if err := b.get(right, indexes[split:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNode returns the node from the nodes read by the batch, or from the nodeDB.
+func (b *versionedBatch) getNode(nk *NodeKey) (*Node, error) {
+	key := string(nk.GetKey())
+	if node, ok := b.nodes[key]; ok {
+		return node, nil
+	}
+	node, err := b.ndb.GetNode(nk)
+	if err != nil {
+		return nil, err
+	}
+	b.nodes[key] = node
+	return node, nil
+}
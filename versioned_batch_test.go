@@ -0,0 +1,90 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/cosmos/cosmos-db"
+)
+
+func TestMutableTree_BatchGetVersioned(t *testing.T) {
+	for _, opts := range []*Options{nil, {HashKeys: true}} {
+		r := rand.New(rand.NewSource(7))
+		tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, opts, false)
+		require.NoError(t, err)
+		for version := 1; version <= 10; version++ {
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("k%03d", r.Intn(200)))
+				if r.Intn(4) == 0 {
+					_, _, err = tree.Remove(key)
+				} else {
+					_, err = tree.Set(key, []byte(fmt.Sprintf("v%d-%d", version, i)))
+				}
+				require.NoError(t, err)
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		require.NoError(t, tree.DeleteVersionsTo(2))
+
+		// requests in random order, with duplicates, missing keys and missing versions.
+		requests := make([]VersionedKey, 500)
+		for i := range requests {
+			requests[i] = VersionedKey{
+				Key:     []byte(fmt.Sprintf("k%03d", r.Intn(210))),
+				Version: int64(r.Intn(12)),
+			}
+		}
+		values, err := tree.BatchGetVersioned(requests)
+		require.NoError(t, err)
+		require.Len(t, values, len(requests))
+		for i, req := range requests {
+			expected, err := tree.GetVersioned(req.Key, req.Version)
+			require.NoError(t, err)
+			require.Equal(t, expected, values[i], "%s at %d", req.Key, req.Version)
+		}
+
+		values, err = tree.BatchGetVersioned(nil)
+		require.NoError(t, err)
+		require.Empty(t, values)
+	}
+}
+
+func TestMutableTree_BatchGetVersioned_SharesReads(t *testing.T) {
+	stat := &Statistics{}
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Stat: stat}, true)
+	require.NoError(t, err)
+	for version := 1; version <= 5; version++ {
+		// the first version sets all keys, later versions only update a few.
+		for i := 0; i < 200; i++ {
+			if version == 1 || i%20 == 0 {
+				_, err = tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", version)))
+				require.NoError(t, err)
+			}
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	requests := []VersionedKey{}
+	for version := int64(1); version <= 5; version++ {
+		for i := 0; i < 200; i += 3 {
+			requests = append(requests, VersionedKey{Key: []byte(fmt.Sprintf("k%03d", i)), Version: version})
+		}
+	}
+
+	stat.Reset()
+	for _, req := range requests {
+		_, err = tree.GetVersioned(req.Key, req.Version)
+		require.NoError(t, err)
+	}
+	individual := stat.GetCacheMissCnt()
+
+	stat.Reset()
+	_, err = tree.BatchGetVersioned(requests)
+	require.NoError(t, err)
+	require.Less(t, stat.GetCacheMissCnt()*4, individual)
+}